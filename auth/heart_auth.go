@@ -49,6 +49,32 @@ func HEARTScopesHandler(resourceName string) gin.HandlerFunc {
 	}
 }
 
+// AdminScope is the scope that grants access to administrative operations, such as cascading deletes
+const AdminScope = "system/*.*"
+
+// AdminScopesHandler middleware requires the AdminScope for the requests that isAdminRequest identifies as
+// administrative.  Other requests pass through, to be checked by the HEARTScopesHandler.  Unlike the
+// HEARTScopesHandler, OIDC authenticated requests are not allowed to perform administrative operations, since they
+// carry no scopes.
+func AdminScopesHandler(isAdminRequest func(c *gin.Context) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isAdminRequest(c) {
+			return
+		}
+
+		grantedScopes, exists := c.Get("scopes")
+		if exists {
+			for _, scope := range grantedScopes.([]string) {
+				if scope == AdminScope {
+					return
+				}
+			}
+		}
+		c.String(http.StatusForbidden, "You do not have permission to perform this administrative operation")
+		c.Abort()
+	}
+}
+
 func includesAnyScope(c *gin.Context, scopes ...string) bool {
 	grantedScopes, exists := c.Get("scopes")
 	if exists {
@@ -61,6 +61,41 @@ func (s *HEARTScopesSuite) TestPostPatientWithScopes(c *C) {
 	c.Assert(rr.Body.String(), Equals, "Hello")
 }
 
+func (s *HEARTScopesSuite) TestAdminRequestWithoutAdminScope(c *C) {
+	rr := s.SetUpAdminRequest("/?admin=true", "user/*.*")
+	c.Assert(rr.Code, Equals, http.StatusForbidden)
+}
+
+func (s *HEARTScopesSuite) TestAdminRequestWithAdminScope(c *C) {
+	rr := s.SetUpAdminRequest("/?admin=true", "user/*.* "+AdminScope)
+	c.Assert(rr.Code, Equals, http.StatusOK)
+	c.Assert(rr.Body.String(), Equals, "Hello")
+}
+
+func (s *HEARTScopesSuite) TestNonAdminRequestWithoutAdminScope(c *C) {
+	rr := s.SetUpAdminRequest("/", "")
+	c.Assert(rr.Code, Equals, http.StatusOK)
+	c.Assert(rr.Body.String(), Equals, "Hello")
+}
+
+func (s *HEARTScopesSuite) SetUpAdminRequest(path, scopes string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("DELETE", path, nil)
+	util.CheckErr(err)
+	mockTokenIntrospection := func(c *gin.Context) {
+		if scopes != "" {
+			c.Set("scopes", strings.Split(scopes, " "))
+		}
+	}
+
+	e := gin.New()
+	rw := httptest.NewRecorder()
+	noop := func(c *gin.Context) { c.String(http.StatusOK, "Hello") }
+	authHandler := AdminScopesHandler(func(c *gin.Context) bool { return c.Query("admin") == "true" })
+	e.DELETE("/", mockTokenIntrospection, authHandler, noop)
+	e.ServeHTTP(rw, r)
+	return rw
+}
+
 func (s *HEARTScopesSuite) SetUpRequest(method, scopes string) *httptest.ResponseRecorder {
 	r, err := http.NewRequest(method, "/", nil)
 	util.CheckErr(err)
@@ -0,0 +1,290 @@
+// Package client provides a client for the FHIR REST API, as implemented by the server package.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+	"golang.org/x/oauth2"
+)
+
+const contentType = "application/json+fhir"
+
+// Client makes requests to a FHIR server.  Resources are passed to and from its methods as pointers to the structs
+// in the models package, and their resource types are taken from the structs' types.
+type Client struct {
+	// BaseURL is the URL of the root of the FHIR server
+	BaseURL string
+	// HTTPClient makes the requests.  If it is nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+	// TokenSource provides the OAuth 2.0 bearer tokens sent in the Authorization header of each request, as expected
+	// by servers using the auth package.  If it is nil, requests aren't authorized.
+	TokenSource oauth2.TokenSource
+}
+
+// New creates a client for the FHIR server at the base URL, which makes unauthorized requests
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// NewWithToken creates a client for the FHIR server at the base URL, which sends the bearer token with each request
+func NewWithToken(baseURL, token string) *Client {
+	c := New(baseURL)
+	c.TokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token, TokenType: "Bearer"})
+	return c
+}
+
+// Error is returned when the server responds with an error status.  If the response's body is an OperationOutcome,
+// it is included.
+type Error struct {
+	StatusCode int
+	Status     string
+	Outcome    *models.OperationOutcome
+}
+
+func (e *Error) Error() string {
+	msg := e.Status
+	if e.Outcome != nil {
+		for _, issue := range e.Outcome.Issue {
+			if issue.Details != nil && issue.Details.Text != "" {
+				msg += ": " + issue.Details.Text
+			}
+			if issue.Diagnostics != "" {
+				msg += ": " + issue.Diagnostics
+			}
+		}
+	}
+	return msg
+}
+
+// IsNotFound reports whether the error is an Error with a 404 or 410 status
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && (e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone)
+}
+
+// Read reads the resource with the ID into the passed in resource
+func (c *Client) Read(id string, resource interface{}) error {
+	_, err := c.do("GET", resourceType(resource)+"/"+id, nil, resource)
+	return err
+}
+
+// VRead reads the version of the resource with the ID into the passed in resource
+func (c *Client) VRead(id, versionID string, resource interface{}) error {
+	_, err := c.do("GET", resourceType(resource)+"/"+id+"/_history/"+versionID, nil, resource)
+	return err
+}
+
+// Search searches for resources of the type with the query, which is in URL query string format (e.g.,
+// "gender=male&_count=10"), returning the first page of results.  Use Next to get the following pages.
+func (c *Client) Search(resourceType, query string) (*models.Bundle, error) {
+	path := resourceType
+	if query != "" {
+		path += "?" + query
+	}
+	bundle := &models.Bundle{}
+	if _, err := c.do("GET", path, nil, bundle); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// Next returns the page of search results that follows the passed in page, or nil if it is the last page
+func (c *Client) Next(bundle *models.Bundle) (*models.Bundle, error) {
+	for _, link := range bundle.Link {
+		if link.Relation == "next" {
+			next := &models.Bundle{}
+			if _, err := c.do("GET", link.Url, nil, next); err != nil {
+				return nil, err
+			}
+			return next, nil
+		}
+	}
+	return nil, nil
+}
+
+// EachPage searches for resources of the type with the query, calling the function with each page of results until
+// there are no more pages or the function returns an error
+func (c *Client) EachPage(resourceType, query string, f func(*models.Bundle) error) error {
+	bundle, err := c.Search(resourceType, query)
+	for err == nil && bundle != nil {
+		if err = f(bundle); err == nil {
+			bundle, err = c.Next(bundle)
+		}
+	}
+	return err
+}
+
+// Create creates the resource, returning the ID that the server assigned to it.  The resource is updated with the
+// server's representation of it, if the server returns one.
+func (c *Client) Create(resource interface{}) (id string, err error) {
+	loc, err := c.CreateWithLocation(resource)
+	if err != nil {
+		return "", err
+	}
+	return IDFromLocation(loc), nil
+}
+
+// CreateWithLocation creates the resource like Create, but returns the Location that the server responded with
+// (e.g., "http://example.org/fhir/Patient/123/_history/1") rather than just the ID.
+func (c *Client) CreateWithLocation(resource interface{}) (location string, err error) {
+	response, err := c.do("POST", resourceType(resource), resource, resource)
+	if err != nil {
+		return "", err
+	}
+	return response.Header.Get("Location"), nil
+}
+
+// ConditionalCreate creates the resource unless a resource matches the query, which is in URL query string format
+// (e.g., "identifier=http://example.org|123"), returning the ID of the created or matching resource.  Since it
+// doesn't create a duplicate of a resource that was already created, it is safe to retry.  The resource is updated
+// with the server's representation of it, if the server returns one.
+func (c *Client) ConditionalCreate(query string, resource interface{}) (id string, err error) {
+	header := http.Header{"If-None-Exist": []string{query}}
+	response, err := c.doWithHeader("POST", resourceType(resource), header, resource, resource)
+	if err != nil {
+		return "", err
+	}
+	return IDFromLocation(response.Header.Get("Location")), nil
+}
+
+// Update updates the resource with the ID, creating it if it doesn't exist.  It reports whether the resource was
+// created.
+func (c *Client) Update(id string, resource interface{}) (createdNew bool, err error) {
+	response, err := c.do("PUT", resourceType(resource)+"/"+id, resource, resource)
+	if err != nil {
+		return false, err
+	}
+	return response.StatusCode == http.StatusCreated, nil
+}
+
+// ConditionalUpdate updates the resource matching the query, which is in URL query string format, creating it if
+// no resource matches.  It returns the resource's ID, and whether it was created.
+func (c *Client) ConditionalUpdate(query string, resource interface{}) (id string, createdNew bool, err error) {
+	response, err := c.do("PUT", resourceType(resource)+"?"+query, resource, resource)
+	if err != nil {
+		return "", false, err
+	}
+	return IDFromLocation(response.Header.Get("Location")), response.StatusCode == http.StatusCreated, nil
+}
+
+// Delete deletes the resource of the type with the ID
+func (c *Client) Delete(resourceType, id string) error {
+	_, err := c.do("DELETE", resourceType+"/"+id, nil, nil)
+	return err
+}
+
+// Batch posts the batch or transaction Bundle to the server, returning the server's response Bundle
+func (c *Client) Batch(bundle *models.Bundle) (*models.Bundle, error) {
+	response := &models.Bundle{}
+	if _, err := c.do("POST", "", bundle, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// do makes a request to the path, which is relative to the server's root unless it is an absolute URL, sending the
+// body as JSON (if it isn't nil) and decoding the response into the result (if it isn't nil and the response has a
+// JSON body).  Error statuses are returned as an *Error.
+func (c *Client) do(method, path string, body, result interface{}) (*http.Response, error) {
+	return c.doWithHeader(method, path, nil, body, result)
+}
+
+// doWithHeader makes a request like do, adding the header's fields to the request
+func (c *Client) doWithHeader(method, path string, header http.Header, body, result interface{}) (*http.Response, error) {
+	u, err := c.url(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	request.Header.Set("Accept", contentType)
+	if body != nil {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if c.TokenSource != nil {
+		token, err := c.TokenSource.Token()
+		if err != nil {
+			return nil, err
+		}
+		token.SetAuthHeader(request)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode >= 300 {
+		e := &Error{StatusCode: response.StatusCode, Status: response.Status}
+		outcome := &models.OperationOutcome{}
+		if json.Unmarshal(data, outcome) == nil && len(outcome.Issue) > 0 {
+			e.Outcome = outcome
+		}
+		return response, e
+	}
+	if result != nil && len(bytes.TrimSpace(data)) > 0 && strings.Contains(response.Header.Get("Content-Type"), "json") {
+		if err = json.Unmarshal(data, result); err != nil {
+			return response, fmt.Errorf("Couldn't decode the response to %s %s: %s", method, u, err)
+		}
+	}
+	return response, nil
+}
+
+// url resolves the path against the base URL
+func (c *Client) url(path string) (string, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	if u.IsAbs() {
+		return path, nil
+	}
+	return strings.TrimSuffix(c.BaseURL, "/") + "/" + path, nil
+}
+
+func resourceType(resource interface{}) string {
+	return reflect.TypeOf(resource).Elem().Name()
+}
+
+var locationRegexp = regexp.MustCompile("(?:^|/)([^/]+)/([^/]+)(/_history/[^/]*)?$")
+
+// IDFromLocation returns the ID of the resource at the location, which may include the resource's version
+func IDFromLocation(loc string) string {
+	if matches := locationRegexp.FindStringSubmatch(loc); matches != nil {
+		return matches[2]
+	}
+	return ""
+}
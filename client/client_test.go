@@ -0,0 +1,193 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+)
+
+type ClientSuite struct {
+	Server        *httptest.Server
+	Client        *Client
+	Authorization string
+}
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&ClientSuite{})
+
+func (s *ClientSuite) SetUpTest(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		s.Authorization = c.Request.Header.Get("Authorization")
+	})
+	server.RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), server.NewMemoryDataAccessLayer(), server.Config{})
+	s.Server = httptest.NewServer(engine)
+	s.Client = New(s.Server.URL)
+}
+
+func (s *ClientSuite) TearDownTest(c *C) {
+	s.Server.Close()
+}
+
+func (s *ClientSuite) TestCRUD(c *C) {
+	patient := &models.Patient{Gender: "male"}
+	id, err := s.Client.Create(patient)
+	util.CheckErr(err)
+	c.Assert(id, Not(Equals), "")
+	c.Assert(patient.Id, Equals, id)
+
+	read := &models.Patient{}
+	util.CheckErr(s.Client.Read(id, read))
+	c.Assert(read.Gender, Equals, "male")
+
+	read.Gender = "female"
+	createdNew, err := s.Client.Update(id, read)
+	util.CheckErr(err)
+	c.Assert(createdNew, Equals, false)
+	read = &models.Patient{}
+	util.CheckErr(s.Client.Read(id, read))
+	c.Assert(read.Gender, Equals, "female")
+
+	util.CheckErr(s.Client.Delete("Patient", id))
+	err = s.Client.Read(id, &models.Patient{})
+	c.Assert(IsNotFound(err), Equals, true)
+	c.Assert(err.(*Error).StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *ClientSuite) TestCreateWithLocation(c *C) {
+	patient := &models.Patient{Gender: "male"}
+	loc, err := s.Client.CreateWithLocation(patient)
+	util.CheckErr(err)
+	c.Assert(loc, Equals, s.Server.URL+"/Patient/"+patient.Id)
+}
+
+func (s *ClientSuite) TestConditionalUpdate(c *C) {
+	id, createdNew, err := s.Client.ConditionalUpdate("gender=other", &models.Patient{Gender: "other"})
+	util.CheckErr(err)
+	c.Assert(createdNew, Equals, true)
+
+	updatedID, createdNew, err := s.Client.ConditionalUpdate("gender=other", &models.Patient{Gender: "other", Active: new(bool)})
+	util.CheckErr(err)
+	c.Assert(createdNew, Equals, false)
+	c.Assert(updatedID, Equals, id)
+}
+
+func (s *ClientSuite) TestConditionalCreate(c *C) {
+	identifier := models.Identifier{System: "http://example.org/mrn", Value: "123"}
+	id, err := s.Client.ConditionalCreate("identifier=http://example.org/mrn|123", &models.Patient{Identifier: []models.Identifier{identifier}})
+	util.CheckErr(err)
+	c.Assert(id, Not(Equals), "")
+
+	// Creating it again returns the existing patient
+	patient := &models.Patient{Identifier: []models.Identifier{identifier}, Gender: "male"}
+	existingID, err := s.Client.ConditionalCreate("identifier=http://example.org/mrn|123", patient)
+	util.CheckErr(err)
+	c.Assert(existingID, Equals, id)
+	c.Assert(patient.Gender, Equals, "")
+	bundle, err := s.Client.Search("Patient", "")
+	util.CheckErr(err)
+	c.Assert(*bundle.Total, Equals, uint32(1))
+}
+
+func (s *ClientSuite) TestSearchPages(c *C) {
+	for i := 0; i < 5; i++ {
+		_, err := s.Client.Create(&models.Patient{Gender: "male"})
+		util.CheckErr(err)
+	}
+
+	bundle, err := s.Client.Search("Patient", "gender=male&_count=2")
+	util.CheckErr(err)
+	c.Assert(*bundle.Total, Equals, uint32(5))
+	c.Assert(bundle.Entry, HasLen, 2)
+	c.Assert(bundle.Entry[0].Resource, FitsTypeOf, &models.Patient{})
+
+	var pages, entries int
+	err = s.Client.EachPage("Patient", "gender=male&_count=2", func(bundle *models.Bundle) error {
+		pages++
+		entries += len(bundle.Entry)
+		return nil
+	})
+	util.CheckErr(err)
+	c.Assert(pages, Equals, 3)
+	c.Assert(entries, Equals, 5)
+}
+
+func (s *ClientSuite) TestOperationOutcomeErrors(c *C) {
+	_, err := s.Client.Search("Patient", "foo=bar")
+	c.Assert(err, FitsTypeOf, &Error{})
+	c.Assert(err.(*Error).StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(err.(*Error).Outcome, NotNil)
+	c.Assert(err, ErrorMatches, "400 Bad Request: .*foo.*")
+}
+
+func (s *ClientSuite) TestBatch(c *C) {
+	patient := &models.Patient{Gender: "male"}
+	condition := &models.Condition{Patient: &models.Reference{Reference: "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f2a"}}
+	response, err := s.Client.Batch(&models.Bundle{Type: "transaction", Entry: []models.BundleEntryComponent{
+		{
+			FullUrl:  "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f2a",
+			Resource: patient,
+			Request:  &models.BundleEntryRequestComponent{Method: "POST", Url: "Patient"},
+		},
+		{
+			Resource: condition,
+			Request:  &models.BundleEntryRequestComponent{Method: "POST", Url: "Condition"},
+		},
+	}})
+	util.CheckErr(err)
+	c.Assert(response.Type, Equals, "transaction-response")
+	c.Assert(response.Entry, HasLen, 2)
+	c.Assert(response.Entry[0].Response.Status, Equals, "201")
+
+	read := &models.Condition{}
+	util.CheckErr(s.Client.Read(IDFromLocation(response.Entry[1].Response.Location), read))
+	c.Assert(read.Patient.Reference, Equals, "Patient/"+IDFromLocation(response.Entry[0].Response.Location))
+}
+
+func (s *ClientSuite) TestBatchConditionalCreate(c *C) {
+	id, err := s.Client.Create(&models.Patient{Identifier: []models.Identifier{{System: "http://example.org/mrn", Value: "123"}}})
+	util.CheckErr(err)
+
+	response, err := s.Client.Batch(&models.Bundle{Type: "batch", Entry: []models.BundleEntryComponent{
+		{
+			Resource: &models.Patient{Identifier: []models.Identifier{{System: "http://example.org/mrn", Value: "123"}}},
+			Request:  &models.BundleEntryRequestComponent{Method: "POST", Url: "Patient", IfNoneExist: "identifier=http://example.org/mrn|123"},
+		},
+		{
+			Resource: &models.Patient{Identifier: []models.Identifier{{System: "http://example.org/mrn", Value: "456"}}},
+			Request:  &models.BundleEntryRequestComponent{Method: "POST", Url: "Patient", IfNoneExist: "identifier=http://example.org/mrn|456"},
+		},
+	}})
+	util.CheckErr(err)
+	c.Assert(response.Entry[0].Response.Status, Equals, "200")
+	c.Assert(IDFromLocation(response.Entry[0].Response.Location), Equals, id)
+	c.Assert(response.Entry[1].Response.Status, Equals, "201")
+	bundle, err := s.Client.Search("Patient", "")
+	util.CheckErr(err)
+	c.Assert(*bundle.Total, Equals, uint32(2))
+}
+
+func (s *ClientSuite) TestBearerToken(c *C) {
+	_, err := s.Client.Search("Patient", "")
+	util.CheckErr(err)
+	c.Assert(s.Authorization, Equals, "")
+
+	_, err = NewWithToken(s.Server.URL, "abc").Search("Patient", "")
+	util.CheckErr(err)
+	c.Assert(s.Authorization, Equals, "Bearer abc")
+}
+
+func (s *ClientSuite) TestIDFromLocation(c *C) {
+	c.Assert(IDFromLocation("http://localhost/Patient/123/_history/1"), Equals, "123")
+	c.Assert(IDFromLocation("http://localhost/fhir/Patient/123"), Equals, "123")
+	c.Assert(IDFromLocation("Patient/123"), Equals, "123")
+}
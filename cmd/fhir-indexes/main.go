@@ -0,0 +1,65 @@
+// Command fhir-indexes reports which of the search indexes that the FHIR server would create are missing from a
+// database, and which of the database's indexes are unused.  With -create, it also creates the missing indexes.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/intervention-engine/fhir/server"
+	"gopkg.in/mgo.v2"
+)
+
+func main() {
+	mongoHost := flag.String("mongohost", "localhost", "the hostname of the Mongo server")
+	dbName := flag.String("db", "fhir", "the name of the database")
+	params := flag.String("params", "", "comma-separated search parameters to index, as Resource.param or *.param (defaults to the server's defaults)")
+	create := flag.Bool("create", false, "create the missing indexes")
+	flag.Parse()
+
+	var config server.Config
+	if *params != "" {
+		config.SearchIndexes = strings.Split(*params, ",")
+	}
+	defs, err := server.ConfiguredSearchIndexes(config)
+	if err != nil {
+		fail(err)
+	}
+
+	session, err := mgo.Dial(*mongoHost)
+	if err != nil {
+		fail(err)
+	}
+	defer session.Close()
+	db := session.DB(*dbName)
+
+	report, err := server.CheckSearchIndexes(db, defs)
+	if err != nil {
+		fail(err)
+	}
+
+	fmt.Printf("Missing indexes (%d):\n", len(report.Missing))
+	for _, def := range report.Missing {
+		fmt.Printf("  %s\n", def)
+	}
+	fmt.Printf("Unused indexes (%d):\n", len(report.Unused))
+	for _, index := range report.Unused {
+		fmt.Printf("  %s\n", index)
+	}
+
+	if *create && len(report.Missing) > 0 {
+		if err = server.EnsureSearchIndexes(db, report.Missing); err != nil {
+			fail(err)
+		}
+		fmt.Printf("Created %d indexes\n", len(report.Missing))
+	} else if len(report.Missing) > 0 {
+		os.Exit(1)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(2)
+}
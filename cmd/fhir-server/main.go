@@ -0,0 +1,178 @@
+// Command fhir-server runs a FHIR server backed by Mongo.  Each flag can also be set with the environment variable
+// named in its usage; flags take precedence over the environment.  With -load, the server is seeded with the
+// resources in transaction or batch bundles (in the format of the fixtures directory) before it starts listening.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/auth"
+	"github.com/intervention-engine/fhir/server"
+	"gopkg.in/mgo.v2"
+)
+
+func main() {
+	mongoURL := stringFlag("mongo", "FHIR_MONGO_URL", "localhost", "the Mongo host or mongodb:// URL")
+	dbName := stringFlag("db", "FHIR_DB", "", "the name of the Mongo database (defaults to the one in the Mongo URL, or fhir)")
+	listen := stringFlag("listen", "FHIR_LISTEN", ":3001", "the address to listen on")
+	serverURL := stringFlag("server-url", "FHIR_SERVER_URL", "http://localhost:3001", "the full URL of the server's root")
+	origins := stringFlag("cors-origins", "FHIR_CORS_ORIGINS", "*", "comma-separated origins allowed to make cross-origin requests, or *")
+	resources := stringFlag("resources", "FHIR_RESOURCES", "", "comma-separated resource types to expose (defaults to all)")
+	load := stringFlag("load", "FHIR_LOAD", "", "comma-separated bundle files, or directories of them, to load at startup")
+
+	authMode := stringFlag("auth", "FHIR_AUTH", "none", "the authentication mode: none, oidc, or heart")
+	clientID := stringFlag("client-id", "FHIR_CLIENT_ID", "", "the client ID registered with the OpenID Connect provider (oidc and heart)")
+	clientSecret := stringFlag("client-secret", "FHIR_CLIENT_SECRET", "", "the client secret (oidc)")
+	authorizationURL := stringFlag("authorization-url", "FHIR_AUTHORIZATION_URL", "", "the OAuth 2.0 authorization endpoint (oidc)")
+	tokenURL := stringFlag("token-url", "FHIR_TOKEN_URL", "", "the OAuth 2.0 token endpoint (oidc)")
+	userInfoURL := stringFlag("userinfo-url", "FHIR_USERINFO_URL", "", "the OpenID Connect UserInfo endpoint (oidc)")
+	introspectionURL := stringFlag("introspection-url", "FHIR_INTROSPECTION_URL", "", "the OAuth 2.0 token introspection endpoint (oidc)")
+	jwkPath := stringFlag("jwk", "FHIR_JWK", "", "the path of the client's private key in JWK format (heart)")
+	opURL := stringFlag("op-url", "FHIR_OP_URL", "", "the URL of the OpenID Connect provider (heart)")
+	sessionSecret := stringFlag("session-secret", "FHIR_SESSION_SECRET", "", "the secret used to encrypt session cookies (oidc and heart)")
+	flag.Parse()
+
+	if *dbName == "" {
+		name, err := databaseName(*mongoURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*dbName = name
+	}
+	config := server.Config{
+		ServerURL:     *serverURL,
+		DatabaseName:  *dbName,
+		ListenAddress: *listen,
+	}
+	switch strings.ToLower(*authMode) {
+	case "none":
+		config.Auth = auth.None()
+	case "oidc":
+		config.Auth = auth.OIDC(*clientID, *clientSecret, *authorizationURL, *tokenURL, *userInfoURL, *introspectionURL, *sessionSecret)
+	case "heart":
+		config.Auth = auth.HEART(*clientID, *jwkPath, *opURL, *sessionSecret)
+	default:
+		log.Fatalf("Unknown auth mode %s: must be none, oidc, or heart", *authMode)
+	}
+	if *resources != "" {
+		config.ResourceTypes = splitList(*resources)
+	}
+
+	if *load != "" {
+		if err := loadBundles(*mongoURL, *dbName, splitList(*load)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	s := server.NewServerWithCORSOrigins(*mongoURL, *origins)
+	s.Run(config)
+}
+
+// stringFlag defines a string flag whose default is taken from the environment variable, if it is set
+func stringFlag(name, envVar, value, usage string) *string {
+	if env, ok := os.LookupEnv(envVar); ok {
+		value = env
+	}
+	return flag.String(name, value, fmt.Sprintf("%s [$%s]", usage, envVar))
+}
+
+// databaseName returns the name of the database in the Mongo URL, or "fhir" if the URL doesn't name one
+func databaseName(mongoURL string) (string, error) {
+	info, err := mgo.ParseURL(mongoURL)
+	if err != nil {
+		return "", err
+	}
+	if info.Database == "" {
+		return "fhir", nil
+	}
+	return info.Database, nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// loadBundles posts the bundles in the passed in files and directories to a batch endpoint backed by the database,
+// so they are processed the same way as batch and transaction requests to the server.  Loading bypasses the server's
+// authentication.
+func loadBundles(mongoURL, dbName string, paths []string) error {
+	files, err := bundleFiles(paths)
+	if err != nil {
+		return err
+	}
+
+	session, err := mgo.Dial(mongoURL)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.POST("/", server.NewBatchController(server.NewMongoDataAccessLayer(session.DB(dbName))).Post)
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		// Directories may hold other JSON files (e.g., single resources), which aren't loaded
+		var resource struct {
+			ResourceType string `json:"resourceType"`
+		}
+		if err := json.Unmarshal(data, &resource); err != nil {
+			return fmt.Errorf("Couldn't load %s: %s", file, err)
+		}
+		if resource.ResourceType != "Bundle" {
+			log.Printf("Skipping %s: it isn't a Bundle", file)
+			continue
+		}
+		request := httptest.NewRequest("POST", "/", bytes.NewReader(data))
+		request.Header.Set("Content-Type", "application/json+fhir")
+		response := httptest.NewRecorder()
+		engine.ServeHTTP(response, request)
+		if response.Code != http.StatusOK {
+			return fmt.Errorf("Couldn't load %s: %d %s", file, response.Code, response.Body.String())
+		}
+		log.Printf("Loaded %s", file)
+	}
+	return nil
+}
+
+// bundleFiles returns the passed in files, with each directory replaced by the JSON files in it
+func bundleFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
@@ -0,0 +1,116 @@
+// Command fhir-upload uploads FHIR resources to a FHIR server.  It reads JSON files holding single resources,
+// Bundles, or NDJSON from the files and directories passed as arguments, or from stdin if there are none, and prints
+// a JSON object mapping the resources' old IDs to their new locations on the server.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/client"
+	"github.com/intervention-engine/fhir/upload"
+)
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:3001", "the base URL of the FHIR server")
+	token := flag.String("token", "", "the OAuth 2.0 bearer token to authorize the uploads with")
+	concurrency := flag.Int("concurrency", 4, "the most resources to upload at once")
+	retries := flag.Int("retries", 3, "the number of times to retry a failed upload")
+	retryDelay := flag.Duration("retry-delay", time.Second, "the wait before the first retry, which doubles with each retry")
+	bundleType := flag.String("bundle", "", "upload the resources in Bundles of this type (batch or transaction) rather than one at a time")
+	bundleSize := flag.Int("bundle-size", 0, "the most resources in each Bundle (defaults to all of them)")
+	progress := flag.String("progress", "", "the file to record progress in, so an interrupted upload can be resumed")
+	matchIdentifiers := flag.Bool("match-identifiers", false, "only create resources whose identifier isn't already on the server (with conditional creates)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [file or directory ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *bundleType != "" && *bundleType != "batch" && *bundleType != "transaction" {
+		fail(fmt.Errorf("Unknown Bundle type %s: must be batch or transaction", *bundleType))
+	}
+
+	var resources []interface{}
+	if flag.NArg() == 0 {
+		read, err := upload.ReadResources(os.Stdin)
+		if err != nil {
+			fail(fmt.Errorf("Couldn't read stdin: %s", err))
+		}
+		resources = read
+	}
+	for _, path := range flag.Args() {
+		files, err := resourceFiles(path)
+		if err != nil {
+			fail(err)
+		}
+		for _, file := range files {
+			read, err := readFile(file)
+			if err != nil {
+				fail(fmt.Errorf("Couldn't read %s: %s", file, err))
+			}
+			resources = append(resources, read...)
+		}
+	}
+
+	uploader := &upload.Uploader{
+		BaseURL:          *baseURL,
+		Concurrency:      *concurrency,
+		BundleType:       *bundleType,
+		BundleSize:       *bundleSize,
+		Retries:          *retries,
+		RetryDelay:       *retryDelay,
+		ProgressLog:      *progress,
+		MatchIdentifiers: *matchIdentifiers,
+	}
+	if *token != "" {
+		uploader.Client = client.NewWithToken(*baseURL, *token)
+	}
+	refMap, err := uploader.Upload(resources)
+	printMap(refMap)
+	if err != nil {
+		fail(err)
+	}
+}
+
+// resourceFiles returns the path if it is a file, or the JSON and NDJSON files under it if it is a directory
+func resourceFiles(path string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == path && !info.IsDir() {
+			files = append(files, file)
+		} else if !info.IsDir() && (strings.HasSuffix(file, ".json") || strings.HasSuffix(file, ".ndjson")) {
+			files = append(files, file)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func readFile(path string) ([]interface{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return upload.ReadResources(file)
+}
+
+func printMap(refMap map[string]string) {
+	out, _ := json.MarshalIndent(refMap, "", "  ")
+	fmt.Println(string(out))
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
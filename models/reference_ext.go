@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"reflect"
 	"strings"
 )
 
@@ -32,3 +33,40 @@ func (r *Reference) UnmarshalJSON(data []byte) (err error) {
 	}
 	return err
 }
+
+// FindReferences returns pointers to all of the references in the resource, so they can be updated in place.  It
+// walks the whole resource, including backbone elements, extensions, and contained resources.
+func FindReferences(resource interface{}) []*Reference {
+	return findReferencesInValue(reflect.ValueOf(resource))
+}
+
+func findReferencesInValue(val reflect.Value) []*Reference {
+	var refs []*Reference
+
+	// Dereference pointers and interfaces (e.g., contained resources) in order to simplify things
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+
+	// Make sure it's a valid thing, else return right away
+	if !val.IsValid() {
+		return refs
+	}
+
+	// Handle it if it's a ref, otherwise iterate its members for refs
+	if val.Type() == reflect.TypeOf(Reference{}) {
+		if val.CanAddr() {
+			refs = append(refs, val.Addr().Interface().(*Reference))
+		}
+	} else if val.Kind() == reflect.Struct {
+		for i := 0; i < val.NumField(); i++ {
+			refs = append(refs, findReferencesInValue(val.Field(i))...)
+		}
+	} else if val.Kind() == reflect.Slice {
+		for i := 0; i < val.Len(); i++ {
+			refs = append(refs, findReferencesInValue(val.Index(i))...)
+		}
+	}
+
+	return refs
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"encoding/json"
+
+	"github.com/pebbe/util"
+	check "gopkg.in/check.v1"
+)
+
+type ReferenceSuite struct {
+}
+
+var _ = check.Suite(&ReferenceSuite{})
+
+func (s *ReferenceSuite) TestFindReferences(c *check.C) {
+	data := []byte(`{
+		"resourceType": "Encounter",
+		"patient": {"reference": "Patient/1"},
+		"participant": [{"individual": {"reference": "Practitioner/2"}}],
+		"extension": [{"url": "http://example.org/fhir/extensions/referrer", "valueReference": {"reference": "Practitioner/3"}}],
+		"contained": [{"resourceType": "Condition", "id": "c1", "patient": {"reference": "Patient/1"}}],
+		"indication": [{"reference": "#c1"}]
+	}`)
+	encounter := &Encounter{}
+	util.CheckErr(json.Unmarshal(data, encounter))
+
+	refs := FindReferences(encounter)
+	var found []string
+	for _, ref := range refs {
+		found = append(found, ref.Reference)
+	}
+	// Contained resources and extensions come first, since DomainResource is embedded first
+	c.Assert(found, check.DeepEquals, []string{"Patient/1", "Practitioner/3", "Patient/1", "Practitioner/2", "#c1"})
+
+	// The references can be updated in place
+	for _, ref := range refs {
+		ref.Reference = "updated"
+	}
+	c.Assert(encounter.Participant[0].Individual.Reference, check.Equals, "updated")
+	c.Assert(encounter.Extension[0].ValueReference.Reference, check.Equals, "updated")
+	c.Assert(encounter.Contained[0].(*Condition).Patient.Reference, check.Equals, "updated")
+}
@@ -0,0 +1,211 @@
+package search
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Cursor identifies a position in sorted search results, allowing results to be paged through by position (keyset
+// paging) rather than by offset.  Keyset paging stays fast on deep pages and doesn't skip or repeat results when
+// resources are added or removed between pages.  Cursors are passed to and from clients as opaque tokens in the
+// _cursor parameter.
+type Cursor struct {
+	// Values holds the values of the sort fields at the position, in sort order
+	Values bson.D `bson:"v,omitempty"`
+	// ID is the ID of the resource at the position, which breaks ties between resources with the same sort values
+	ID string `bson:"i,omitempty"`
+	// Backward indicates that the page ends just before the position, rather than starting just after it
+	Backward bool `bson:"b,omitempty"`
+	// Last indicates the last page of results.  It does not have a position.
+	Last bool `bson:"l,omitempty"`
+}
+
+// ParseCursor parses a cursor token, as returned by Cursor.String.
+func ParseCursor(token string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &Cursor{}
+	if err = bson.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+	if cursor.ID == "" && !cursor.Last {
+		return nil, errors.New("Cursor has no position")
+	}
+	return cursor, nil
+}
+
+// String encodes the cursor as an opaque token, suitable for use in a URL.
+func (c *Cursor) String() string {
+	data, err := bson.Marshal(c)
+	if err != nil {
+		// This can only happen if the values can't be marshaled, and they came from a marshaled resource
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// pagesBackward indicates that the results should be found in reverse sort order, and then reversed.
+func (c *Cursor) pagesBackward() bool {
+	return c != nil && (c.Backward || c.Last)
+}
+
+// keysetField is a field that results are ordered by when paging with cursors
+type keysetField struct {
+	Name       string
+	Descending bool
+}
+
+// keysetFields returns the fields that results are ordered by when paging with cursors: the sort fields followed by
+// _id.  Sorts on repeating elements can't be paged with cursors, since the value a resource sorts by depends on the
+// sort direction.
+func keysetFields(o *QueryOptions) ([]keysetField, bool) {
+	fields := make([]keysetField, 0, len(o.Sort)+1)
+	for _, sort := range o.Sort {
+		// Note: If there are multiple paths, we only look at the first one, just like the sort itself
+		path := sort.Parameter.Paths[0].Path
+		if strings.Contains(path, "[") {
+			return nil, false
+		}
+		fields = append(fields, keysetField{Name: convertSearchPathToMongoField(path), Descending: sort.Descending})
+	}
+	fields = append(fields, keysetField{Name: "_id"})
+	return fields, true
+}
+
+// SupportsCursorPaging indicates whether the results of the query can be paged through with cursors.
+func (q *Query) SupportsCursorPaging() bool {
+	_, ok := keysetFields(q.Options())
+	return ok
+}
+
+// NewCursor returns a cursor positioned at the passed in resource, which must be one of the results of the query.
+// If backward is true, the cursor identifies the page of results preceding the resource.  Otherwise it identifies
+// the page following the resource.
+func (q *Query) NewCursor(resource interface{}, backward bool) (*Cursor, error) {
+	fields, ok := keysetFields(q.Options())
+	if !ok {
+		return nil, errors.New("Query does not support cursor paging")
+	}
+
+	// Marshal the resource the same way it is stored, so the values match those in the database
+	data, err := bson.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err = bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	cursor := &Cursor{Backward: backward}
+	for _, field := range fields[:len(fields)-1] {
+		cursor.Values = append(cursor.Values, bson.DocElem{Name: field.Name, Value: lookupField(doc, field.Name)})
+	}
+	id, _ := lookupField(doc, "_id").(string)
+	if id == "" {
+		return nil, errors.New("Resource has no ID")
+	}
+	cursor.ID = id
+	return cursor, nil
+}
+
+// lookupField returns the value at the dotted path in the document, or nil if there is no value there.
+func lookupField(doc bson.D, path string) interface{} {
+	var value interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		d, ok := value.(bson.D)
+		if !ok {
+			return nil
+		}
+		value = nil
+		for _, elem := range d {
+			if elem.Name == name {
+				value = elem.Value
+				break
+			}
+		}
+	}
+	return value
+}
+
+// keysetSort returns the Mongo sort fields for paging with the passed in cursor.
+func keysetSort(fields []keysetField, cursor *Cursor) bson.D {
+	sort := make(bson.D, len(fields))
+	for i, field := range fields {
+		order := 1
+		if field.Descending != cursor.pagesBackward() {
+			order = -1
+		}
+		sort[i] = bson.DocElem{Name: field.Name, Value: order}
+	}
+	return sort
+}
+
+// keysetCriteria returns the Mongo criteria selecting the results that come after the cursor's position, in the
+// order that the results are found.  If the cursor has no position, it returns nil.
+func keysetCriteria(fields []keysetField, cursor *Cursor) bson.M {
+	values := cursorValues(fields, cursor)
+	if values == nil {
+		return nil
+	}
+
+	// A result comes after the position if its values are equal up to some field, and come after it on that field
+	var clauses []interface{}
+	for i, field := range fields {
+		after := keysetAfter(field, values[i], field.Descending != cursor.Backward)
+		if after == nil {
+			continue
+		}
+		clause := bson.M{}
+		for j := 0; j < i; j++ {
+			clause[fields[j].Name] = values[j]
+		}
+		for k, v := range after {
+			clause[k] = v
+		}
+		clauses = append(clauses, clause)
+	}
+	return bson.M{"$or": clauses}
+}
+
+// cursorValues returns the values of the fields at the cursor's position, or nil if the cursor has no position.  It
+// panics with a search error if the cursor doesn't match the fields.
+func cursorValues(fields []keysetField, cursor *Cursor) []interface{} {
+	if cursor == nil || cursor.Last {
+		return nil
+	}
+	if len(cursor.Values) != len(fields)-1 {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_cursor\" content is invalid"))
+	}
+	values := make([]interface{}, len(fields))
+	for i, elem := range cursor.Values {
+		if elem.Name != fields[i].Name {
+			panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_cursor\" content is invalid"))
+		}
+		values[i] = elem.Value
+	}
+	values[len(fields)-1] = cursor.ID
+	return values
+}
+
+// keysetAfter returns the criteria selecting values of the field that come after the passed in value, or nil if no
+// values do.  Mongo sorts missing and null values before all others, but _id is never missing.
+func keysetAfter(field keysetField, value interface{}, descending bool) bson.M {
+	switch {
+	case field.Name == "_id" && descending:
+		return bson.M{field.Name: bson.M{"$lt": value}}
+	case value == nil && descending:
+		return nil
+	case value == nil:
+		return bson.M{field.Name: bson.M{"$ne": nil}}
+	case descending:
+		return bson.M{"$or": []bson.M{{field.Name: bson.M{"$lt": value}}, {field.Name: nil}}}
+	default:
+		return bson.M{field.Name: bson.M{"$gt": value}}
+	}
+}
@@ -0,0 +1,60 @@
+package search
+
+import (
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type CursorSuite struct{}
+
+var _ = Suite(&CursorSuite{})
+
+func (s *CursorSuite) TestCursorRoundTrip(c *C) {
+	cursor := &Cursor{Values: bson.D{{Name: "birthDate.time", Value: "1974-12-25"}}, ID: "123", Backward: true}
+	parsed, err := ParseCursor(cursor.String())
+	c.Assert(err, IsNil)
+	c.Assert(parsed, DeepEquals, cursor)
+}
+
+func (s *CursorSuite) TestParseInvalidCursor(c *C) {
+	_, err := ParseCursor("not a cursor")
+	c.Assert(err, NotNil)
+	_, err = ParseCursor((&Cursor{}).String())
+	c.Assert(err, NotNil)
+}
+
+func (s *CursorSuite) TestQueryOptionsWithCursor(c *C) {
+	cursor := &Cursor{ID: "123"}
+	q := Query{"Patient", "_cursor=" + cursor.String() + "&_count=10"}
+	o := q.Options()
+	c.Assert(o.Cursor, DeepEquals, cursor)
+	params := o.URLQueryParameters()
+	c.Assert(params.Get(CursorParam), Equals, cursor.String())
+	c.Assert(params.Get(OffsetParam), Equals, "")
+}
+
+func (s *CursorSuite) TestSupportsCursorPaging(c *C) {
+	q := Query{"Patient", "_sort=birthdate"}
+	c.Assert(q.SupportsCursorPaging(), Equals, true)
+	q = Query{"Patient", "_sort=family"}
+	c.Assert(q.SupportsCursorPaging(), Equals, false)
+}
+
+func (s *CursorSuite) TestKeysetCriteria(c *C) {
+	fields := []keysetField{{Name: "birthDate", Descending: true}, {Name: "_id"}}
+	cursor := &Cursor{Values: bson.D{{Name: "birthDate", Value: "1974"}}, ID: "123"}
+	c.Assert(keysetCriteria(fields, cursor), DeepEquals, bson.M{"$or": []interface{}{
+		bson.M{"$or": []bson.M{{"birthDate": bson.M{"$lt": "1974"}}, {"birthDate": nil}}},
+		bson.M{"birthDate": "1974", "_id": bson.M{"$gt": "123"}},
+	}})
+
+	// Paging backward reverses the comparisons, and nothing sorts before a missing value
+	cursor = &Cursor{Values: bson.D{{Name: "birthDate", Value: nil}}, ID: "123", Backward: true}
+	c.Assert(keysetCriteria(fields, cursor), DeepEquals, bson.M{"$or": []interface{}{
+		bson.M{"birthDate": bson.M{"$ne": nil}},
+		bson.M{"birthDate": nil, "_id": bson.M{"$lt": "123"}},
+	}})
+
+	// The last page has no position
+	c.Assert(keysetCriteria(fields, &Cursor{Last: true}), IsNil)
+}
@@ -0,0 +1,374 @@
+package search
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// matchDocument indicates whether the document matches the Mongo query criteria.  It supports the subset of the Mongo
+// query language that the MongoSearcher generates: $and, $or, $elemMatch, the $eq, $ne, $gt, $gte, $lt, $lte, $in,
+// and $exists operators, regular expressions, and equality, following Mongo's rules for paths through arrays and for
+// missing and null values.
+func matchDocument(doc bson.M, criteria bson.M) bool {
+	for key, condition := range criteria {
+		switch key {
+		case "$and":
+			for _, c := range criteriaList(condition) {
+				if !matchDocument(doc, c) {
+					return false
+				}
+			}
+		case "$or":
+			matched := false
+			for _, c := range criteriaList(condition) {
+				if matchDocument(doc, c) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		default:
+			if !matchField(lookupValues(doc, strings.Split(key, ".")), condition) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// criteriaList converts the operand of $and or $or to a list of criteria
+func criteriaList(operand interface{}) []bson.M {
+	switch operand := operand.(type) {
+	case []bson.M:
+		return operand
+	case []interface{}:
+		list := make([]bson.M, len(operand))
+		for i := range operand {
+			list[i] = operand[i].(bson.M)
+		}
+		return list
+	}
+	panic(createInternalServerError("", fmt.Sprintf("Unsupported logical operand %v", operand)))
+}
+
+// matchField indicates whether the values found at a field's path match the condition on the field
+func matchField(values []interface{}, condition interface{}) bool {
+	if ops, ok := condition.(bson.M); ok && isOperatorDocument(ops) {
+		for op, operand := range ops {
+			if !matchOperator(values, op, operand) {
+				return false
+			}
+		}
+		return true
+	}
+	return anyValue(values, func(value interface{}) bool {
+		return matchValue(value, condition)
+	})
+}
+
+func isOperatorDocument(doc bson.M) bool {
+	for key := range doc {
+		if !isQueryOperator(key) {
+			return false
+		}
+	}
+	return len(doc) > 0
+}
+
+func matchOperator(values []interface{}, op string, operand interface{}) bool {
+	switch op {
+	case "$eq":
+		return matchField(values, operand)
+	case "$ne":
+		return !matchField(values, operand)
+	case "$not":
+		return !matchField(values, operand)
+	case "$gt", "$gte", "$lt", "$lte":
+		return anyValue(values, func(value interface{}) bool {
+			if value == nil || typeOrder(value) != typeOrder(operand) {
+				return false
+			}
+			c := compareValues(value, operand)
+			switch op {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			default:
+				return c <= 0
+			}
+		})
+	case "$in":
+		list := reflect.ValueOf(operand)
+		for i := 0; i < list.Len(); i++ {
+			if matchField(values, list.Index(i).Interface()) {
+				return true
+			}
+		}
+		return false
+	case "$exists":
+		exists := false
+		for _, value := range values {
+			exists = exists || value != nil
+		}
+		return exists == operand.(bool)
+	case "$elemMatch":
+		criteria := operand.(bson.M)
+		for _, value := range values {
+			if array, ok := value.([]interface{}); ok {
+				for _, elem := range array {
+					if matchElement(elem, criteria) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	panic(createInternalServerError("", fmt.Sprintf("Unsupported query operator %s", op)))
+}
+
+// matchElement indicates whether an array element matches the criteria of an $elemMatch, which are operators for
+// elements that aren't documents.
+func matchElement(elem interface{}, criteria bson.M) bool {
+	if doc, ok := elem.(bson.M); ok && !isOperatorDocument(criteria) {
+		return matchDocument(doc, criteria)
+	}
+	if doc, ok := elem.(bson.D); ok && !isOperatorDocument(criteria) {
+		return matchDocument(doc.Map(), criteria)
+	}
+	return matchField([]interface{}{elem}, criteria)
+}
+
+// matchValue indicates whether a single value matches a regular expression or is equal to a value
+func matchValue(value interface{}, condition interface{}) bool {
+	switch condition := condition.(type) {
+	case nil:
+		return value == nil
+	case bson.RegEx:
+		s, ok := value.(string)
+		return ok && compileRegEx(condition).MatchString(s)
+	}
+	return value != nil && typeOrder(value) == typeOrder(condition) && compareValues(value, condition) == 0
+}
+
+// anyValue indicates whether any of the values, or the elements of any array values, satisfy the function
+func anyValue(values []interface{}, f func(value interface{}) bool) bool {
+	for _, value := range values {
+		if f(value) {
+			return true
+		}
+		if array, ok := value.([]interface{}); ok {
+			for _, elem := range array {
+				if f(elem) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// lookupValues returns the values at the path in the value, fanning out through arrays like Mongo does.  Missing
+// values are returned as nil.
+func lookupValues(value interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{value}
+	}
+	switch value := value.(type) {
+	case bson.M:
+		return lookupValues(value[path[0]], path[1:])
+	case bson.D:
+		for _, elem := range value {
+			if elem.Name == path[0] {
+				return lookupValues(elem.Value, path[1:])
+			}
+		}
+		return []interface{}{nil}
+	case []interface{}:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i >= 0 && i < len(value) {
+				return lookupValues(value[i], path[1:])
+			}
+			return []interface{}{nil}
+		}
+		var values []interface{}
+		for _, elem := range value {
+			switch elem.(type) {
+			case bson.M, bson.D:
+				values = append(values, lookupValues(elem, path)...)
+			}
+		}
+		if len(values) == 0 {
+			return []interface{}{nil}
+		}
+		return values
+	}
+	return []interface{}{nil}
+}
+
+// flattenValues replaces array values with their elements and drops missing values
+func flattenValues(values []interface{}) []interface{} {
+	var flat []interface{}
+	for _, value := range values {
+		if array, ok := value.([]interface{}); ok {
+			flat = append(flat, flattenValues(array)...)
+		} else if value != nil {
+			flat = append(flat, value)
+		}
+	}
+	return flat
+}
+
+// valuesIntersect indicates whether any value in one list is equal to a value in the other
+func valuesIntersect(values1, values2 []interface{}) bool {
+	for _, v1 := range values1 {
+		for _, v2 := range values2 {
+			if matchValue(v1, v2) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// typeOrder returns the position of the value's type in Mongo's ordering of BSON types.  Values can only be compared
+// by the query operators if they have the same type order, so all numbers share one.
+func typeOrder(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return 1
+	case int, int32, int64, float32, float64:
+		return 2
+	case string:
+		return 3
+	case bson.M, bson.D:
+		return 4
+	case []interface{}:
+		return 5
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	case bson.RegEx:
+		return 11
+	}
+	return 100
+}
+
+// compareValues compares two values the way Mongo does, returning a negative number if the first comes before the
+// second, a positive number if it comes after, and zero if they are equal.
+func compareValues(a, b interface{}) int {
+	if oa, ob := typeOrder(a), typeOrder(b); oa != ob {
+		return oa - ob
+	}
+	switch a := a.(type) {
+	case nil:
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case bson.ObjectId:
+		return strings.Compare(string(a), string(b.(bson.ObjectId)))
+	case bool:
+		switch {
+		case a == b.(bool):
+			return 0
+		case a:
+			return 1
+		default:
+			return -1
+		}
+	case time.Time:
+		switch t := b.(time.Time); {
+		case a.Before(t):
+			return -1
+		case a.After(t):
+			return 1
+		default:
+			return 0
+		}
+	case int, int32, int64, float32, float64:
+		fa, fb := toFloat64(a), toFloat64(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		default:
+			return 0
+		}
+	case bson.M, bson.D:
+		return compareDocuments(orderedDocument(a), orderedDocument(b))
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// compareDocuments compares two documents the way Mongo does: field by field, in order, comparing the types of the
+// values, then the field names, then the values.  If one document is a prefix of the other, it comes first.
+func compareDocuments(a, b bson.D) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := typeOrder(a[i].Value) - typeOrder(b[i].Value); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a[i].Name, b[i].Name); c != 0 {
+			return c
+		}
+		if c := compareValues(a[i].Value, b[i].Value); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// orderedDocument returns the fields of a document in order.  The order of a bson.M's fields is lost, so they are
+// put in the order of their names.
+func orderedDocument(doc interface{}) bson.D {
+	if d, ok := doc.(bson.D); ok {
+		return d
+	}
+	m := doc.(bson.M)
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	d := make(bson.D, len(names))
+	for i, name := range names {
+		d[i] = bson.DocElem{Name: name, Value: m[name]}
+	}
+	return d
+}
+
+func toFloat64(n interface{}) float64 {
+	return reflect.ValueOf(n).Convert(reflect.TypeOf(float64(0))).Float()
+}
+
+// compileRegEx compiles a BSON regular expression, which uses the "i", "m", and "s" options like Go does
+func compileRegEx(re bson.RegEx) *regexp.Regexp {
+	pattern := re.Pattern
+	if flags := strings.Map(func(r rune) rune {
+		if strings.ContainsRune("ims", r) {
+			return r
+		}
+		return -1
+	}, re.Options); flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	return regexp.MustCompile(pattern)
+}
@@ -0,0 +1,204 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MemorySearcher implements FHIR searches against documents held in memory, rather than in a Mongo database.  The
+// documents are resources as they would be stored in Mongo (i.e., resources marshaled to BSON and unmarshaled to
+// bson.M), and the searcher evaluates the very same criteria that the MongoSearcher sends to the database, so searches
+// behave the same way against both.  Embedded documents should be unmarshaled to bson.D, since Mongo compares
+// documents field by field, in order, when sorting and paging.
+type MemorySearcher struct {
+	documents func(collection string) []bson.M
+	builder   *MongoSearcher
+}
+
+// NewMemorySearcher creates a new instance of a MemorySearcher, given a function that returns the documents in a
+// collection (e.g., "patients").  The searcher doesn't modify the documents or the returned slice.
+func NewMemorySearcher(documents func(collection string) []bson.M) *MemorySearcher {
+	s := &MemorySearcher{documents: documents}
+	s.builder = &MongoSearcher{chainedIDs: s.findIDs}
+	return s
+}
+
+// SetCursorPaging determines whether queries without a _cursor are ordered for cursor (keyset) paging, just like
+// MongoSearcher's SetCursorPaging.
+func (s *MemorySearcher) SetCursorPaging(cursorPaging bool) {
+	s.builder.SetCursorPaging(cursorPaging)
+}
+
+// Find returns the documents matching the FHIR-based Query, obeying any options passed in through the query string
+// (such as _count and _offset) and the default options, in the same form as the results of MongoSearcher's
+// CreatePipeline.  Documents included by _include and _revinclude options are added to the results' fields, so the
+// results can be unmarshaled to the resources' "plus related resources" structs.
+//
+// Like MongoSearcher's queries, Find panics with an *Error when the query is invalid or unsupported.
+func (s *MemorySearcher) Find(query Query) []bson.M {
+	stages := s.builder.createPipelineStages(query)
+	return s.runStages(models.PluralizeLowerResourceName(query.Resource), stages)
+}
+
+// FindWithoutOptions returns the documents matching the FHIR-based Query, ignoring any options passed in through the
+// query string.  The documents are returned in collection order.
+func (s *MemorySearcher) FindWithoutOptions(query Query) []bson.M {
+	criteria := s.builder.createQueryObject(query)
+	return filterDocuments(s.documents(models.PluralizeLowerResourceName(query.Resource)), criteria)
+}
+
+// Count counts the documents matching the FHIR-based Query, ignoring any options passed in through the query string.
+// If limit is greater than zero, it counts no more than limit documents.
+func (s *MemorySearcher) Count(query Query, limit int) int {
+	count := len(s.FindWithoutOptions(query))
+	if limit > 0 && count > limit {
+		count = limit
+	}
+	return count
+}
+
+// findIDs finds the IDs of the documents matching the query, for chained searches
+func (s *MemorySearcher) findIDs(query Query) []string {
+	docs := s.FindWithoutOptions(query)
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		if id, ok := doc["_id"].(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// runStages runs the aggregation pipeline stages created by the MongoSearcher against the documents in the collection
+func (s *MemorySearcher) runStages(collection string, stages []bson.M) []bson.M {
+	docs := s.documents(collection)
+	for _, stage := range stages {
+		for op, arg := range stage {
+			switch op {
+			case "$match":
+				docs = filterDocuments(docs, arg.(bson.M))
+			case "$sort":
+				docs = sortDocuments(docs, arg.(bson.D))
+			case "$skip":
+				if n := arg.(int); n < len(docs) {
+					docs = docs[n:]
+				} else {
+					docs = nil
+				}
+			case "$limit":
+				if n := arg.(int); n < len(docs) {
+					docs = docs[:n]
+				}
+			case "$lookup":
+				docs = s.lookup(docs, arg.(bson.M))
+			default:
+				panic(createInternalServerError("", fmt.Sprintf("Unsupported pipeline stage %s", op)))
+			}
+		}
+	}
+	return docs
+}
+
+// lookup joins the documents to those in another collection, like Mongo's $lookup stage.  The joined documents are
+// added to copies of the documents.
+func (s *MemorySearcher) lookup(docs []bson.M, spec bson.M) []bson.M {
+	from := s.documents(spec["from"].(string))
+	localPath := strings.Split(spec["localField"].(string), ".")
+	foreignPath := strings.Split(spec["foreignField"].(string), ".")
+	as := spec["as"].(string)
+
+	results := make([]bson.M, len(docs))
+	for i, doc := range docs {
+		local := flattenValues(lookupValues(doc, localPath))
+		joined := []interface{}{}
+		for _, foreign := range from {
+			if valuesIntersect(local, flattenValues(lookupValues(foreign, foreignPath))) {
+				joined = append(joined, foreign)
+			}
+		}
+		result := make(bson.M, len(doc)+1)
+		for k, v := range doc {
+			result[k] = v
+		}
+		result[as] = joined
+		results[i] = result
+	}
+	return results
+}
+
+// filterDocuments returns the documents matching the Mongo query criteria
+func filterDocuments(docs []bson.M, criteria bson.M) []bson.M {
+	var results []bson.M
+	for _, doc := range docs {
+		if matchDocument(doc, criteria) {
+			results = append(results, doc)
+		}
+	}
+	return results
+}
+
+// sortDocuments returns the documents sorted by the Mongo sort fields.  Like Mongo, a document sorts by the lowest
+// of the values in a repeating field when sorting in ascending order, and by the highest in descending order.
+func sortDocuments(docs []bson.M, fields bson.D) []bson.M {
+	sorter := &documentSorter{docs: make([]bson.M, len(docs)), keys: make([][]interface{}, len(docs))}
+	copy(sorter.docs, docs)
+	for _, field := range fields {
+		sorter.descending = append(sorter.descending, field.Value == -1)
+	}
+	for i, doc := range docs {
+		sorter.keys[i] = make([]interface{}, len(fields))
+		for j, field := range fields {
+			sorter.keys[i][j] = sortKey(lookupValues(doc, strings.Split(field.Name, ".")), sorter.descending[j])
+		}
+	}
+	sort.Stable(sorter)
+	return sorter.docs
+}
+
+// sortKey returns the value that a field with the passed in values sorts by
+func sortKey(values []interface{}, descending bool) interface{} {
+	values = flattenValues(values)
+	if len(values) == 0 {
+		return nil
+	}
+	key := values[0]
+	for _, value := range values[1:] {
+		c := compareValues(value, key)
+		if (descending && c > 0) || (!descending && c < 0) {
+			key = value
+		}
+	}
+	return key
+}
+
+type documentSorter struct {
+	docs       []bson.M
+	keys       [][]interface{}
+	descending []bool
+}
+
+func (s *documentSorter) Len() int {
+	return len(s.docs)
+}
+
+func (s *documentSorter) Less(i, j int) bool {
+	for k := range s.descending {
+		c := compareValues(s.keys[i][k], s.keys[j][k])
+		if s.descending[k] {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+func (s *documentSorter) Swap(i, j int) {
+	s.docs[i], s.docs[j] = s.docs[j], s.docs[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
@@ -0,0 +1,266 @@
+package search
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type MemorySearchSuite struct {
+	Collections    map[string][]bson.M
+	MemorySearcher *MemorySearcher
+}
+
+var _ = Suite(&MemorySearchSuite{})
+
+func (m *MemorySearchSuite) SetUpSuite(c *C) {
+	// Read in the data in FHIR format, storing it as documents just like the MongoSearchSuite does
+	data, err := ioutil.ReadFile("../fixtures/search_test_data.json")
+	util.CheckErr(err)
+
+	var maps []interface{}
+	util.CheckErr(json.Unmarshal(data, &maps))
+
+	m.Collections = make(map[string][]bson.M)
+	for _, resourceMap := range maps {
+		r := models.MapToResource(resourceMap, true)
+		collection := models.PluralizeLowerResourceName(reflect.TypeOf(r).Elem().Name())
+		raw, err := bson.Marshal(r)
+		util.CheckErr(err)
+		doc := bson.M{}
+		util.CheckErr(bson.Unmarshal(raw, &doc))
+		m.Collections[collection] = append(m.Collections[collection], doc)
+	}
+
+	m.MemorySearcher = NewMemorySearcher(func(collection string) []bson.M {
+		return m.Collections[collection]
+	})
+}
+
+func (m *MemorySearchSuite) TestCountsMatchMongoSearcher(c *C) {
+	// These are the counts that the MongoSearchSuite expects for the same data
+	tests := []struct {
+		Resource string
+		Query    string
+		Count    int
+	}{
+		{"ImagingStudy", "bodysite=http://snomed.info/sct|67734004", 1},
+		{"ImagingStudy", "bodysite=http://hl7.org/fhir/sid/icd-9|67734004", 0},
+		{"Encounter", "identifier=http://acme.com|1", 1},
+		{"Encounter", "identifier=http://example.com|1", 0},
+		{"Condition", "code=123641001", 2},
+		{"Condition", "onset=2012-03-01", 5},
+		{"Condition", "onset=2012-03-01T08:00-05:00", 0},
+		{"Condition", "onset=gt2012-03-01T07:05-05:00", 1},
+		{"Condition", "onset=sa2012-03-01T07:05-05:00", 1},
+		{"Condition", "onset=lt2012-03-01T07:05-05:00", 2},
+		{"Condition", "onset=eb2012-03-01T07:05-05:00", 2},
+		{"Condition", "onset=ge2012-03-01T07:05-05:00", 4},
+		{"Condition", "onset=le2012-03-01T07:05-05:00", 5},
+		{"Encounter", "date=2012-11-01T08:50-05:00", 1},
+		{"Encounter", "date=2012-11-01T07:50:00-05:00", 0},
+		{"Encounter", "date=gt2012-11-01T08:50-05:00", 2},
+		{"Encounter", "date=sa2012-11-01T08:45-05:00", 1},
+		{"Encounter", "date=lt2012-11-01T08:50-05:00", 3},
+		{"Encounter", "date=eb2012-11-01T09:00-05:00", 3},
+		{"Encounter", "date=ge2012-11-01T08:50-05:00", 2},
+		{"Encounter", "date=le2012-11-01T08:50-05:00", 4},
+		{"Immunization", "dose-sequence=1", 1},
+		{"Device", "manufacturer=Acme", 1},
+		{"Device", "manufacturer=Zinc", 0},
+		{"Patient", "name=Peterson", 0},
+		{"Patient", "address=AK", 2},
+		{"Patient", "address=CA", 0},
+		{"Observation", "value-quantity=185||lbs", 1},
+		{"Observation", "value-quantity=185||[lb_av]", 1},
+		{"Observation", "value-quantity=186||lbs", 0},
+		{"Observation", "value-quantity=185|http://unitsofmeasure.org|[lb_av]", 1},
+		{"Observation", "value-quantity=185|http://loinc.org|[lb_av]", 0},
+		{"Subscription", "url=https://biliwatch.com/customers/mount-auburn-miu/on-result", 1},
+		{"Condition", "_id=8664777288161060797", 1},
+		{"Condition", "_tag=foo|bar", 1},
+		{"Condition", "patient=4954037118555241963", 5},
+		{"Condition", "patient=Patient/4954037118555241963", 5},
+		{"Condition", "patient.gender=male", 5},
+		{"Condition", "patient.gender=female", 1},
+		{"Bundle", "message.destination-uri=http://acme.com/ehr/fhir", 1},
+		{"Bundle", "message.destination-uri=http://acme.com/ehr/foo", 0},
+		{"Condition", "code=http://hl7.org/fhir/sid/icd-9|428.0,http://snomed.info/sct|981000124106,http://hl7.org/fhir/sid/icd-10|I20.0", 4},
+		{"Condition", "patient=4954037118555241963&code=http://hl7.org/fhir/sid/icd-9|428.0&onset=2012-03-01T07:00-05:00", 1},
+		{"Condition", "patient=4954037118555241963&code=http://hl7.org/fhir/sid/icd-9|428.0&onset=2012-03-01T07:05-05:00", 0},
+		{"Encounter", "type=http://www.ama-assn.org/go/cpt|99201", 3},
+	}
+	for _, test := range tests {
+		q := Query{test.Resource, test.Query}
+		c.Assert(m.MemorySearcher.FindWithoutOptions(q), HasLen, test.Count, Commentf("%s?%s", test.Resource, test.Query))
+		c.Assert(m.MemorySearcher.Count(q, 0), Equals, test.Count, Commentf("%s?%s", test.Resource, test.Query))
+	}
+}
+
+func (m *MemorySearchSuite) TestFindWithOptions(c *C) {
+	q := Query{"Encounter", "type=http://www.ama-assn.org/go/cpt|99201&_count=2"}
+	c.Assert(m.MemorySearcher.Find(q), HasLen, 2)
+	q = Query{"Encounter", "type=http://www.ama-assn.org/go/cpt|99201&_offset=1"}
+	c.Assert(m.MemorySearcher.Find(q), HasLen, 2)
+	q = Query{"Encounter", "type=http://www.ama-assn.org/go/cpt|99201&_offset=5"}
+	c.Assert(m.MemorySearcher.Find(q), HasLen, 0)
+}
+
+func (m *MemorySearchSuite) TestSortWithMultipleSortParams(c *C) {
+	var conditions []*models.Condition
+	m.unmarshal(m.MemorySearcher.Find(Query{"Condition", "_sort=patient&_sort=onset&_sort=code"}), &conditions)
+	c.Assert(conditions, HasLen, 6)
+	var lastPatient string
+	var lastOnset time.Time
+	var lastCode string
+	for _, cond := range conditions {
+		thisPatient := getReferenceComparisonValue(cond.Patient)
+		thisOnset := cond.OnsetDateTime.Time
+		thisCode := getCodeableConceptComparisonValue(cond.Code)
+		c.Assert(strings.Compare(lastPatient, thisPatient), Not(Equals), 1)
+		if thisPatient == lastPatient {
+			c.Assert(thisOnset.Before(lastOnset), Equals, false)
+			if thisOnset.Equal(lastOnset) {
+				c.Assert(strings.Compare(lastCode, thisCode), Not(Equals), 1)
+			}
+		}
+		lastPatient = thisPatient
+		lastOnset = thisOnset
+		lastCode = thisCode
+	}
+
+	m.unmarshal(m.MemorySearcher.Find(Query{"Condition", "_sort:desc=_id"}), &conditions)
+	c.Assert(conditions, HasLen, 6)
+	for i := 1; i < len(conditions); i++ {
+		c.Assert(conditions[i-1].Id > conditions[i].Id, Equals, true)
+	}
+}
+
+func (m *MemorySearchSuite) TestInclude(c *C) {
+	var results []models.ObservationPlus
+	q := Query{"Observation", "code=http://loinc.org|17856-6&_include=Observation:patient&_include=Observation:encounter"}
+	m.unmarshal(m.MemorySearcher.Find(q), &results)
+	c.Assert(results, HasLen, 1)
+
+	obs := results[0]
+	c.Assert(obs.GetIncludedResources(), HasLen, 2)
+	c.Assert(obs.GetRevIncludedResources(), HasLen, 0)
+	patient, err := obs.GetIncludedPatientResourceReferencedByPatient()
+	util.CheckErr(err)
+	c.Assert(patient.Id, Equals, "4954037118555241963")
+	encounter, err := obs.GetIncludedEncounterResourceReferencedByEncounter()
+	util.CheckErr(err)
+	c.Assert(encounter.Id, Equals, "6648204100111387580")
+}
+
+func (m *MemorySearchSuite) TestRevInclude(c *C) {
+	var results []models.PatientPlus
+	q := Query{"Patient", "gender=male&_revinclude=Condition:patient&_revinclude=Encounter:patient"}
+	m.unmarshal(m.MemorySearcher.Find(q), &results)
+	c.Assert(results, HasLen, 1)
+
+	patient := results[0]
+	c.Assert(patient.Id, Equals, "4954037118555241963")
+	c.Assert(patient.GetIncludedResources(), HasLen, 0)
+	conditions, err := patient.GetRevIncludedConditionResourcesReferencingPatient()
+	util.CheckErr(err)
+	c.Assert(conditions, HasLen, 5)
+	encounters, err := patient.GetRevIncludedEncounterResourcesReferencingPatient()
+	util.CheckErr(err)
+	c.Assert(encounters, HasLen, 4)
+}
+
+func (m *MemorySearchSuite) TestUnsupportedSearchPanics(c *C) {
+	c.Assert(func() { m.MemorySearcher.Find(Query{"Condition", "onset=ap2012"}) }, Panics, createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"onset\" content is invalid"))
+}
+
+func (m *MemorySearchSuite) TestCompositeSearch(c *C) {
+	var observations []bson.M
+	for _, bp := range []string{
+		`{"resourceType": "Observation", "id": "1",
+		  "code": {"coding": [{"system": "http://loinc.org", "code": "55284-4"}]},
+		  "component": [
+		    {"code": {"coding": [{"system": "http://loinc.org", "code": "8480-6"}]}, "valueQuantity": {"value": 150, "unit": "mm[Hg]"}},
+		    {"code": {"coding": [{"system": "http://loinc.org", "code": "8462-4"}]}, "valueQuantity": {"value": 80, "unit": "mm[Hg]"}}]}`,
+		`{"resourceType": "Observation", "id": "2",
+		  "code": {"coding": [{"system": "http://loinc.org", "code": "55284-4"}]},
+		  "component": [
+		    {"code": {"coding": [{"system": "http://loinc.org", "code": "8480-6"}]}, "valueQuantity": {"value": 120, "unit": "mm[Hg]"}},
+		    {"code": {"coding": [{"system": "http://loinc.org", "code": "8462-4"}]}, "valueQuantity": {"value": 95, "unit": "mm[Hg]"}}]}`,
+		`{"resourceType": "Observation", "id": "3",
+		  "code": {"coding": [{"system": "http://loinc.org", "code": "8480-6"}]},
+		  "valueQuantity": {"value": 150, "unit": "mm[Hg]"}}`,
+	} {
+		var resourceMap interface{}
+		util.CheckErr(json.Unmarshal([]byte(bp), &resourceMap))
+		raw, err := bson.Marshal(models.MapToResource(resourceMap, true))
+		util.CheckErr(err)
+		doc := bson.M{}
+		util.CheckErr(bson.Unmarshal(raw, &doc))
+		observations = append(observations, doc)
+	}
+	searcher := NewMemorySearcher(func(collection string) []bson.M {
+		return observations
+	})
+
+	tests := []struct {
+		Query string
+		IDs   []string
+	}{
+		{"code-value-quantity=http://loinc.org|8480-6$150", []string{"3"}},
+		{"code-value-quantity=http://loinc.org|8480-6$150||mm[Hg]", []string{"3"}},
+		{"code-value-quantity=http://loinc.org|8480-6$120", []string{}},
+		{"component-code-value-quantity=http://loinc.org|8480-6$150", []string{"1"}},
+		{"component-code-value-quantity=8480-6$120||mm[Hg]", []string{"2"}},
+		{"component-code-value-quantity=8480-6$150,8462-4$95", []string{"1", "2"}},
+		// The code and value must be in the same component
+		{"component-code-value-quantity=8480-6$95", []string{}},
+		{"component-code-value-quantity=8462-4$150", []string{}},
+	}
+	for _, test := range tests {
+		ids := []string{}
+		for _, doc := range searcher.FindWithoutOptions(Query{"Observation", test.Query}) {
+			ids = append(ids, doc["_id"].(string))
+		}
+		c.Assert(ids, DeepEquals, test.IDs, Commentf("Observation?%s", test.Query))
+	}
+}
+
+func (m *MemorySearchSuite) TestMatchDocument(c *C) {
+	doc := bson.M{
+		"name": []interface{}{
+			bson.M{"given": []interface{}{"John", "Q"}, "family": "Peters"},
+			bson.M{"family": "Smith"},
+		},
+		"count": 3,
+	}
+	c.Assert(matchDocument(doc, bson.M{"name.family": "Smith"}), Equals, true)
+	c.Assert(matchDocument(doc, bson.M{"name.given": cisw("q")}), Equals, true)
+	c.Assert(matchDocument(doc, bson.M{"name.0.family": "Smith"}), Equals, false)
+	c.Assert(matchDocument(doc, bson.M{"name": bson.M{"$elemMatch": bson.M{"given": "John", "family": "Smith"}}}), Equals, false)
+	c.Assert(matchDocument(doc, bson.M{"name": bson.M{"$elemMatch": bson.M{"given": "John", "family": "Peters"}}}), Equals, true)
+	// Missing values match null, and numbers of different types compare by value
+	c.Assert(matchDocument(doc, bson.M{"name.given": nil}), Equals, true)
+	c.Assert(matchDocument(doc, bson.M{"gender": nil}), Equals, true)
+	c.Assert(matchDocument(doc, bson.M{"gender": bson.M{"$ne": nil}}), Equals, false)
+	c.Assert(matchDocument(doc, bson.M{"count": bson.M{"$gte": 2.5, "$lt": 3.5}}), Equals, true)
+	c.Assert(matchDocument(doc, bson.M{"count": bson.M{"$gt": "2"}}), Equals, false)
+	c.Assert(matchDocument(doc, bson.M{"$or": []bson.M{{"count": 4}, {"name.family": bson.M{"$in": []string{"Jones", "Peters"}}}}}), Equals, true)
+}
+
+func (m *MemorySearchSuite) unmarshal(docs []bson.M, result interface{}) {
+	data, err := bson.Marshal(bson.M{"results": docs})
+	util.CheckErr(err)
+	var wrapper struct {
+		Results bson.Raw `bson:"results"`
+	}
+	util.CheckErr(bson.Unmarshal(data, &wrapper))
+	util.CheckErr(wrapper.Results.Unmarshal(result))
+}
@@ -0,0 +1,42 @@
+package search
+
+// MongoIndexKeys returns the fields that Mongo indexes on to support searches on the search parameter, one for each
+// of the parameter's paths that can use an index.  The fields are derived from the paths the same way that searches
+// derive their criteria, indexing the element within each path type that searches match on (e.g., the code of a
+// Coding or the referenceid of a Reference).  Composite parameters and paths to whole resources aren't indexed, and
+// neither is _id, since Mongo always indexes it.  String parameters aren't indexed either, since they are searched
+// with case-insensitive regular expressions (over several fields, for names and addresses), which can't use an index.
+func MongoIndexKeys(info SearchParamInfo) []string {
+	if info.Type == "composite" || info.Type == "string" || info.Name == "_id" {
+		return nil
+	}
+
+	var keys []string
+	seen := make(map[string]bool)
+	for _, path := range info.Paths {
+		key := convertSearchPathToMongoField(path.Path)
+		switch path.Type {
+		case "Coding":
+			key += ".code"
+		case "CodeableConcept":
+			key += ".coding.code"
+		case "Identifier", "ContactPoint", "Quantity", "SimpleQuantity", "Money", "Duration":
+			key += ".value"
+		case "Reference":
+			key += ".referenceid"
+		case "date", "dateTime", "instant":
+			key += ".time"
+		case "Period":
+			key += ".start.time"
+		case "Timing":
+			key += ".event.time"
+		case "Resource":
+			continue
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/intervention-engine/fhir/models"
 	mgo "gopkg.in/mgo.v2"
@@ -13,15 +14,35 @@ import (
 
 // MongoSearcher implements FHIR searches using the Mongo database.
 type MongoSearcher struct {
-	db *mgo.Database
+	db           *mgo.Database
+	cursorPaging bool
+	maxTime      time.Duration
+	// chainedIDs finds the IDs matching chained queries, when they aren't found in the database (see MemorySearcher)
+	chainedIDs func(query Query) []string
 }
 
 // NewMongoSearcher creates a new instance of a MongoSearcher, given a pointer
 // to an mgo.Database.
 func NewMongoSearcher(db *mgo.Database) *MongoSearcher {
-	return &MongoSearcher{db}
+	return &MongoSearcher{db: db}
 }
 
+// SetCursorPaging determines whether queries without a _cursor are ordered for cursor (keyset) paging, with _id
+// breaking ties between the sort fields.  Queries with a _cursor always use cursor paging.
+func (m *MongoSearcher) SetCursorPaging(cursorPaging bool) {
+	m.cursorPaging = cursorPaging
+}
+
+// SetMaxTime limits how long the database spends executing the queries created by the searcher, as well as
+// RunPipeline and Count.  If it is zero, there is no limit.  Queries that run out of time fail with an error whose
+// code is MaxTimeExpiredCode.
+func (m *MongoSearcher) SetMaxTime(maxTime time.Duration) {
+	m.maxTime = maxTime
+}
+
+// MaxTimeExpiredCode is the code of the mgo.QueryError returned when a query exceeds its max time
+const MaxTimeExpiredCode = 50
+
 // GetDB returns a pointer to the Mongo database.  This is helpful for custom search
 // implementations.
 func (m *MongoSearcher) GetDB() *mgo.Database {
@@ -36,7 +57,9 @@ func (m *MongoSearcher) GetDB() *mgo.Database {
 // additional flexibility in how results are returned).
 //
 // CreateQuery CANNOT be used when the _include and _revinclude options
-// are used (since CreateQuery can't support joins).
+// are used (since CreateQuery can't support joins).  When a _cursor pages
+// backward, the returned mgo.Query finds the results in reverse order, while
+// CreatePipeline returns them in order.
 func (m *MongoSearcher) CreateQuery(query Query) *mgo.Query {
 	return m.createQuery(query, true)
 }
@@ -61,10 +84,31 @@ func (m *MongoSearcher) createQuery(query Query, withOptions bool) *mgo.Query {
 	c := m.db.C(models.PluralizeLowerResourceName(query.Resource))
 	q := m.createQueryObject(query)
 	mgoQuery := c.Find(q)
+	if m.maxTime > 0 {
+		mgoQuery = mgoQuery.SetMaxTime(m.maxTime)
+	}
 
 	if withOptions {
 		o := query.Options()
 		removeParallelArraySorts(o)
+		if fields, ok := m.keysetFields(o); ok {
+			// Note: When paging backward, the results are found in reverse order
+			if criteria := keysetCriteria(fields, o.Cursor); criteria != nil {
+				mgoQuery = c.Find(bson.M{"$and": []bson.M{q, criteria}})
+				if m.maxTime > 0 {
+					mgoQuery = mgoQuery.SetMaxTime(m.maxTime)
+				}
+			}
+			sort := keysetSort(fields, o.Cursor)
+			sortFields := make([]string, len(sort))
+			for i := range sort {
+				sortFields[i] = sort[i].Name
+				if sort[i].Value == -1 {
+					sortFields[i] = "-" + sortFields[i]
+				}
+			}
+			return mgoQuery.Sort(sortFields...).Limit(o.Count)
+		}
 		if len(o.Sort) > 0 {
 			fields := make([]string, len(o.Sort))
 			for i := range o.Sort {
@@ -96,13 +140,77 @@ func (m *MongoSearcher) createQuery(query Query, withOptions bool) *mgo.Query {
 // are used (since CreateQuery can't support joins).
 func (m *MongoSearcher) CreatePipeline(query Query) *mgo.Pipe {
 	c := m.db.C(models.PluralizeLowerResourceName(query.Resource))
+	return c.Pipe(m.createPipelineStages(query))
+}
+
+// RunPipeline runs the pipeline that CreatePipeline would create for the
+// FHIR-based Query, unmarshaling all of the results into result.  Unlike
+// mgo.Pipe, it honors the searcher's max time.
+func (m *MongoSearcher) RunPipeline(query Query, result interface{}) error {
+	if m.maxTime <= 0 {
+		return m.CreatePipeline(query).All(result)
+	}
+
+	c := m.db.C(models.PluralizeLowerResourceName(query.Resource))
+	cmd := bson.D{
+		{Name: "aggregate", Value: c.Name},
+		{Name: "pipeline", Value: m.createPipelineStages(query)},
+		{Name: "cursor", Value: bson.M{}},
+		{Name: "maxTimeMS", Value: int64(m.maxTime / time.Millisecond)},
+	}
+	var response struct {
+		Cursor struct {
+			FirstBatch []bson.Raw `bson:"firstBatch"`
+			ID         int64      `bson:"id"`
+		} `bson:"cursor"`
+	}
+	if err := m.db.Run(cmd, &response); err != nil {
+		return err
+	}
+	return c.NewIter(nil, response.Cursor.FirstBatch, response.Cursor.ID, nil).All(result)
+}
+
+// Count counts the resources matching the FHIR-based Query, ignoring any
+// options passed in through the query string.  If limit is greater than zero,
+// it counts no more than limit resources.  Unlike mgo.Query's Count, it honors
+// the searcher's max time.
+func (m *MongoSearcher) Count(query Query, limit int) (int, error) {
+	cmd := bson.D{
+		{Name: "count", Value: models.PluralizeLowerResourceName(query.Resource)},
+		{Name: "query", Value: m.createQueryObject(query)},
+	}
+	if limit > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "limit", Value: limit})
+	}
+	if m.maxTime > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: int64(m.maxTime / time.Millisecond)})
+	}
+	var response struct {
+		N int `bson:"n"`
+	}
+	err := m.db.Run(cmd, &response)
+	return response.N, err
+}
+
+func (m *MongoSearcher) createPipelineStages(query Query) []bson.M {
 	p := []bson.M{{"$match": m.createQueryObject(query)}}
 
 	o := query.Options()
 
 	// support for _sort
 	removeParallelArraySorts(o)
-	if len(o.Sort) > 0 {
+	if fields, ok := m.keysetFields(o); ok {
+		// support for _cursor
+		if criteria := keysetCriteria(fields, o.Cursor); criteria != nil {
+			p = append(p, bson.M{"$match": criteria})
+		}
+		p = append(p, bson.M{"$sort": keysetSort(fields, o.Cursor)})
+		p = append(p, bson.M{"$limit": o.Count})
+		if o.Cursor.pagesBackward() {
+			// The results were found in reverse order, so put them back in order
+			p = append(p, bson.M{"$sort": keysetSort(fields, nil)})
+		}
+	} else if len(o.Sort) > 0 {
 		var sortBSOND bson.D
 		for _, sort := range o.Sort {
 			// Note: If there are multiple paths, we only look at the first one -- not ideal, but otherwise it gets tricky
@@ -116,12 +224,14 @@ func (m *MongoSearcher) CreatePipeline(query Query) *mgo.Pipe {
 		p = append(p, bson.M{"$sort": sortBSOND})
 	}
 
-	// support for _offset
-	if o.Offset > 0 {
-		p = append(p, bson.M{"$skip": o.Offset})
+	if _, ok := m.keysetFields(o); !ok {
+		// support for _offset
+		if o.Offset > 0 {
+			p = append(p, bson.M{"$skip": o.Offset})
+		}
+		// support for _count
+		p = append(p, bson.M{"$limit": o.Count})
 	}
-	// support for _count
-	p = append(p, bson.M{"$limit": o.Count})
 
 	// support for _include
 	if len(o.Include) > 0 {
@@ -194,7 +304,7 @@ func (m *MongoSearcher) CreatePipeline(query Query) *mgo.Pipe {
 		}
 	}
 
-	return c.Pipe(p)
+	return p
 }
 
 func (m *MongoSearcher) createQueryObject(query Query) bson.M {
@@ -246,11 +356,14 @@ func (m *MongoSearcher) createParamObjects(params []SearchParam) []bson.M {
 }
 
 func panicOnUnsupportedFeatures(p SearchParam) {
-	// No prefixes are supported except EQ (the default) and date prefixes
-	_, isDate := p.(*DateParam)
-	prefix := p.getInfo().Prefix
-	if prefix != "" && prefix != EQ && !isDate {
-		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", p.getInfo().Name)))
+	// No prefixes are supported except EQ (the default) and date, number, and quantity prefixes
+	switch p.(type) {
+	case *DateParam, *NumberParam, *QuantityParam:
+	default:
+		prefix := p.getInfo().Prefix
+		if prefix != "" && prefix != EQ {
+			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", p.getInfo().Name)))
+		}
 	}
 
 	// No modifiers are supported except for resource types in reference parameters
@@ -263,8 +376,64 @@ func panicOnUnsupportedFeatures(p SearchParam) {
 	}
 }
 
+// Composite components must match the same array element when they are in one (e.g., the code and value of the same
+// Observation.component), so their criteria are built relative to that element and combined in an $elemMatch.
 func (m *MongoSearcher) createCompositeQueryObject(c *CompositeParam) bson.M {
-	panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", c.Name)))
+	infos := c.ComponentInfos()
+	array := sharedArrayPath(infos)
+	if array != "" {
+		for i := range infos {
+			infos[i].Paths = relativePaths(infos[i].Paths, array)
+		}
+	}
+
+	criteria := bson.M{}
+	for _, p := range m.createParamObjects(c.parseComponents(infos)) {
+		merge(criteria, p)
+	}
+	if array == "" {
+		return criteria
+	}
+	return bson.M{convertSearchPathToMongoField(array): bson.M{"$elemMatch": criteria}}
+}
+
+// sharedArrayPath returns the longest path to an array that contains all of the components' paths (e.g.,
+// "[]component" for "[]component.code" and "[]component.valueQuantity"), or "" if they aren't in the same array
+func sharedArrayPath(infos []SearchParamInfo) string {
+	var shared []string
+	first := true
+	for _, info := range infos {
+		for _, p := range info.Paths {
+			parents := strings.Split(p.Path, ".")
+			parents = parents[:len(parents)-1]
+			if first {
+				shared, first = parents, false
+				continue
+			}
+			n := 0
+			for n < len(shared) && n < len(parents) && shared[n] == parents[n] {
+				n++
+			}
+			shared = shared[:n]
+		}
+	}
+
+	for i := len(shared) - 1; i >= 0; i-- {
+		if strings.HasPrefix(shared[i], "[]") {
+			return strings.Join(shared[:i+1], ".")
+		}
+	}
+	return ""
+}
+
+// relativePaths returns copies of the paths relative to the array path that contains them
+func relativePaths(paths []SearchParamPath, array string) []SearchParamPath {
+	relative := make([]SearchParamPath, len(paths))
+	for i, p := range paths {
+		p.Path = strings.TrimPrefix(p.Path, array+".")
+		relative[i] = p
+	}
+	return relative
 }
 
 func (m *MongoSearcher) createDateQueryObject(d *DateParam) bson.M {
@@ -428,33 +597,56 @@ func periodSelector(d *DateParam) bson.M {
 
 func (m *MongoSearcher) createNumberQueryObject(n *NumberParam) bson.M {
 	single := func(p SearchParamPath) bson.M {
-		l, _ := n.Number.RangeLowIncl().Float64()
-		h, _ := n.Number.RangeHighExcl().Float64()
-		return buildBSON(p.Path, bson.M{
-			"$gte": l,
-			"$lt":  h,
-		})
+		return buildBSON(p.Path, numberSelector(n.Number, n.Prefix))
 	}
 
 	return orPaths(single, n.Paths)
 }
 
+// Numbers are compared as the range of values that equal them at their precision (e.g., 100 is [99.5, 100.5)), so
+// gt100 matches values of 100.5 and above, and le100 matches values below 100.5.
+func numberSelector(n *Number, prefix Prefix) bson.M {
+	l, _ := n.RangeLowIncl().Float64()
+	h, _ := n.RangeHighExcl().Float64()
+	switch prefix {
+	case GT, SA:
+		return bson.M{"$gte": h}
+	case LT, EB:
+		return bson.M{"$lt": l}
+	case GE:
+		return bson.M{"$gte": l}
+	case LE:
+		return bson.M{"$lt": h}
+	case NE:
+		return bson.M{
+			"$not":    bson.M{"$gte": l, "$lt": h},
+			"$exists": true,
+		}
+	case AP:
+		low, high := n.ApproximateRange()
+		l, _ = low.Float64()
+		h, _ = high.Float64()
+	}
+	return bson.M{
+		"$gte": l,
+		"$lt":  h,
+	}
+}
+
 func (m *MongoSearcher) createQuantityQueryObject(q *QuantityParam) bson.M {
 	single := func(p SearchParamPath) bson.M {
-		l, _ := q.Number.RangeLowIncl().Float64()
-		h, _ := q.Number.RangeHighExcl().Float64()
 		criteria := bson.M{
-			"value": bson.M{
-				"$gte": l,
-				"$lt":  h,
-			},
+			"value": numberSelector(q.Number, q.Prefix),
 		}
-		if q.System == "" {
+		switch {
+		case q.System == "" && q.Code == "":
+			// A value without units matches the value in any units
+		case q.System == "":
 			criteria["$or"] = []bson.M{
 				bson.M{"code": ci(q.Code)},
 				bson.M{"unit": ci(q.Code)},
 			}
-		} else {
+		default:
 			criteria["code"] = ci(q.Code)
 			criteria["system"] = ci(q.System)
 		}
@@ -483,16 +675,7 @@ func (m *MongoSearcher) createReferenceQueryObject(r *ReferenceParam) bson.M {
 			// (1) perform search against referenced collection using chained search Query
 			// (2) use ID results from first query to build second query
 			// TODO: Investigate if new Mongo 3.2 $lookup pipeline feature might be an improvement
-			var idObjs []struct {
-				ID string `bson:"_id"`
-			}
-			q := m.CreateQueryWithoutOptions(ref.ChainedQuery)
-			q.Select(bson.M{"_id": 1}).All(&idObjs)
-			ids := make([]string, len(idObjs))
-			for i := range idObjs {
-				ids[i] = idObjs[i].ID
-			}
-			criteria["referenceid"] = bson.M{"$in": ids}
+			criteria["referenceid"] = bson.M{"$in": m.findChainedIDs(ref.ChainedQuery)}
 			if ref.Type != "" {
 				criteria["type"] = ref.Type
 			}
@@ -503,6 +686,23 @@ func (m *MongoSearcher) createReferenceQueryObject(r *ReferenceParam) bson.M {
 	return orPaths(single, r.Paths)
 }
 
+// findChainedIDs finds the IDs of the resources matching a chained query
+func (m *MongoSearcher) findChainedIDs(query Query) []string {
+	if m.chainedIDs != nil {
+		return m.chainedIDs(query)
+	}
+	var idObjs []struct {
+		ID string `bson:"_id"`
+	}
+	q := m.CreateQueryWithoutOptions(query)
+	q.Select(bson.M{"_id": 1}).All(&idObjs)
+	ids := make([]string, len(idObjs))
+	for i := range idObjs {
+		ids[i] = idObjs[i].ID
+	}
+	return ids
+}
+
 func (m *MongoSearcher) createInlinedReferenceQueryObject(r *ReferenceParam, p SearchParamPath) bson.M {
 	criteria := bson.M{}
 	switch ref := r.Reference.(type) {
@@ -580,7 +780,23 @@ func (m *MongoSearcher) createTokenQueryObject(t *TokenParam) bson.M {
 				criteria["system"] = ci(t.System)
 			}
 		case "ContactPoint":
-			criteria["value"] = ci(t.Code)
+			// Phone numbers are matched regardless of their formatting
+			system := p.ContactPointSystem
+			phone := NormalizePhone(t.Code)
+			switch {
+			case phone == "" || (system != "" && system != "phone"):
+				criteria["value"] = ci(t.Code)
+			case system == "phone":
+				criteria["value"] = phoneRegex(phone)
+			default:
+				criteria["$or"] = []bson.M{
+					bson.M{"value": ci(t.Code)},
+					bson.M{"system": "phone", "value": phoneRegex(phone)},
+				}
+			}
+			if system != "" {
+				criteria["system"] = system
+			}
 			if !t.AnySystem {
 				criteria["use"] = ci(t.System)
 			}
@@ -731,6 +947,19 @@ func convertSearchPathToMongoField(path string) string {
 	return strings.Replace(indexedPath, "[]", "", -1)
 }
 
+// keysetFields returns the fields that the query's results are ordered by, if they should be paged through with
+// cursors.  If a cursor is passed in, but the sort doesn't support cursors, it panics with a search error.
+func (m *MongoSearcher) keysetFields(o *QueryOptions) ([]keysetField, bool) {
+	if o.Cursor == nil && !m.cursorPaging {
+		return nil, false
+	}
+	fields, ok := keysetFields(o)
+	if !ok && o.Cursor != nil {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_cursor\" cannot be used when sorting on repeating elements"))
+	}
+	return fields, ok
+}
+
 // Fixes just the indexers so "[]element.[0]target.[]product.element" becomes "element.target.0.product.element"
 func convertBracketIndexesToDotIndexes(path string) string {
 	re := regexp.MustCompile("\\[(\\d+)\\]([^\\.]+)")
@@ -792,10 +1021,12 @@ func processQueryOperatorCriteria(path string, key string, value interface{}, re
 	case "$or":
 		processOrCriteria(path, value, result)
 	default:
-		criteria, ok := result[path]
+		// Mongo fields don't have the array markers, so remove them
+		field := convertSearchPathToMongoField(path)
+		criteria, ok := result[field]
 		if !ok {
 			criteria = bson.M{}
-			result[path] = criteria
+			result[field] = criteria
 		}
 		criteria.(bson.M)[key] = value
 	}
@@ -823,6 +1054,12 @@ func cisw(s string) bson.RegEx {
 	return bson.RegEx{Pattern: fmt.Sprintf("^%s", regexp.QuoteMeta(s)), Options: "i"}
 }
 
+// Phone number with the digits, ignoring any formatting characters around them (e.g., "5555551234" matches
+// "(555) 555-1234")
+func phoneRegex(digits string) bson.RegEx {
+	return bson.RegEx{Pattern: fmt.Sprintf("^\\D*%s\\D*$", strings.Join(strings.Split(digits, ""), "\\D*"))}
+}
+
 // When multiple paths are present, they should be represented as an OR.
 // objFunc is a function that generates a single query for a path
 func orPaths(objFunc func(SearchParamPath) bson.M, paths []SearchParamPath) bson.M {
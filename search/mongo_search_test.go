@@ -326,7 +326,44 @@ func (m *MongoSearchSuite) TestInvalidBooleanValuePanics(c *C) {
 	c.Assert(func() { m.MongoSearcher.CreateQuery(q) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"notgiven\" content is invalid"))
 }
 
-// TODO: Test token searches on code, string, and ContactPoint
+// Tests token searches on ContactPoint
+
+func (m *MongoSearchSuite) TestPatientEmailQueryObject(c *C) {
+	q := Query{"Patient", "email=work|pat@example.com"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"telecom": bson.M{
+			"$elemMatch": bson.M{
+				"value":  bson.RegEx{Pattern: "^pat@example\\.com$", Options: "i"},
+				"system": "email",
+				"use":    bson.RegEx{Pattern: "^work$", Options: "i"},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestPractitionerPhoneQueryObject(c *C) {
+	q := Query{"Practitioner", "phone=(555) 555-1234"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"telecom": bson.M{
+			"$elemMatch": bson.M{
+				"value":  bson.RegEx{Pattern: "^\\D*5\\D*5\\D*5\\D*5\\D*5\\D*5\\D*1\\D*2\\D*3\\D*4\\D*$"},
+				"system": "phone",
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestOrganizationTelecomQueryObject(c *C) {
+	q := Query{"Organization", "telecom=555-555-1234"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"telecom.value": bson.RegEx{Pattern: "^555-555-1234$", Options: "i"},
+	})
+}
+
+// TODO: Test token searches on code and string
 
 // Tests reference searches by reference id
 
@@ -1039,7 +1076,56 @@ func (m *MongoSearchSuite) TestImmunizationDoseSequenceWrongNumberQuery(c *C) {
 	c.Assert(num, Equals, 0)
 }
 
-// TODO: Test number searches on decimal, integer, and unsignedInt
+func (m *MongoSearchSuite) TestImmunizationDoseSequencePrefixedNumberQueryObjects(c *C) {
+	elemMatch := func(criteria bson.M) bson.M {
+		return bson.M{"vaccinationProtocol": bson.M{"$elemMatch": bson.M{"doseSequence": criteria}}}
+	}
+	tests := []struct {
+		Value  string
+		Object bson.M
+	}{
+		{"gt1", bson.M{"vaccinationProtocol.doseSequence": bson.M{"$gte": float64(1.5)}}},
+		{"sa1", bson.M{"vaccinationProtocol.doseSequence": bson.M{"$gte": float64(1.5)}}},
+		{"lt1", bson.M{"vaccinationProtocol.doseSequence": bson.M{"$lt": float64(0.5)}}},
+		{"eb1", bson.M{"vaccinationProtocol.doseSequence": bson.M{"$lt": float64(0.5)}}},
+		{"ge1", bson.M{"vaccinationProtocol.doseSequence": bson.M{"$gte": float64(0.5)}}},
+		{"le1", bson.M{"vaccinationProtocol.doseSequence": bson.M{"$lt": float64(1.5)}}},
+		{"ne1", elemMatch(bson.M{"$not": bson.M{"$gte": float64(0.5), "$lt": float64(1.5)}, "$exists": true})},
+		{"ap1", elemMatch(bson.M{"$gte": float64(0.5), "$lt": float64(1.5)})},
+		{"ap100", elemMatch(bson.M{"$gte": float64(90), "$lt": float64(110)})},
+	}
+	for _, test := range tests {
+		q := Query{"Immunization", "dose-sequence=" + test.Value}
+		o := m.MongoSearcher.createQueryObject(q)
+		c.Assert(o, DeepEquals, test.Object, Commentf(test.Value))
+	}
+}
+
+func (m *MongoSearchSuite) TestImmunizationDoseSequencePrefixedNumberQuery(c *C) {
+	q := Query{"Immunization", "dose-sequence=gt0"}
+	mq := m.MongoSearcher.CreateQuery(q)
+	num, err := mq.Count()
+	util.CheckErr(err)
+	c.Assert(num, Equals, 1)
+
+	q = Query{"Immunization", "dose-sequence=lt1"}
+	mq = m.MongoSearcher.CreateQuery(q)
+	num, err = mq.Count()
+	util.CheckErr(err)
+	c.Assert(num, Equals, 0)
+}
+
+// Test number searches on decimal
+
+func (m *MongoSearchSuite) TestRiskAssessmentProbabilityQueryObject(c *C) {
+	q := Query{"RiskAssessment", "probability=ge0.8"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"prediction.probabilityDecimal": bson.M{"$gte": float64(0.75)},
+	})
+}
+
+// TODO: Test number searches on integer and unsignedInt
 
 // Test string searches on string
 
@@ -1360,6 +1446,54 @@ func (m *MongoSearchSuite) TestObservationSortByValueQuantityDescending(c *C) {
 	}
 }
 
+func (m *MongoSearchSuite) TestPrefixedValueQuantityQueryObject(c *C) {
+	q := Query{"Observation", "value-quantity=gt140|http://unitsofmeasure.org|mm[Hg]"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"valueQuantity.value":  bson.M{"$gte": float64(140.5)},
+		"valueQuantity.code":   bson.RegEx{Pattern: "^mm\\[Hg\\]$", Options: "i"},
+		"valueQuantity.system": bson.RegEx{Pattern: "^http://unitsofmeasure\\.org$", Options: "i"},
+	})
+
+	q = Query{"Observation", "value-quantity=ap1||mg"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"valueQuantity.value": bson.M{"$gte": float64(0.5), "$lt": float64(1.5)},
+		"$or": []bson.M{
+			bson.M{"valueQuantity.code": bson.RegEx{Pattern: "^mg$", Options: "i"}},
+			bson.M{"valueQuantity.unit": bson.RegEx{Pattern: "^mg$", Options: "i"}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestPrefixedValueQuantityQuery(c *C) {
+	q := Query{"Observation", "value-quantity=gt180||lbs"}
+	mq := m.MongoSearcher.CreateQuery(q)
+	num, err := mq.Count()
+	util.CheckErr(err)
+	c.Assert(num, Equals, 1)
+
+	q = Query{"Observation", "value-quantity=gt185||lbs"}
+	mq = m.MongoSearcher.CreateQuery(q)
+	num, err = mq.Count()
+	util.CheckErr(err)
+	c.Assert(num, Equals, 0)
+}
+
+func (m *MongoSearchSuite) TestPrefixedCodeValueQuantityQueryObject(c *C) {
+	q := Query{"Observation", "code-value-quantity=http://loinc.org|8480-6$gt140"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"code.coding": bson.M{
+			"$elemMatch": bson.M{
+				"system": bson.RegEx{Pattern: "^http://loinc\\.org$", Options: "i"},
+				"code":   bson.RegEx{Pattern: "^8480-6$", Options: "i"},
+			},
+		},
+		"valueQuantity.value": bson.M{"$gte": float64(140.5)},
+	})
+}
+
 // Approximating MongoDB sort strategy
 func getQuantityComparisonValue(q *models.Quantity) string {
 	if q == nil {
@@ -1393,7 +1527,96 @@ func (m *MongoSearchSuite) TestSubscriptionURLQuery(c *C) {
 	c.Assert(num, Equals, 1)
 }
 
-// TODO: Test composite searches
+// Test composite searches
+
+func (m *MongoSearchSuite) TestCodeValueQuantityQueryObject(c *C) {
+	q := Query{"Observation", "code-value-quantity=http://loinc.org|8480-6$140"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"code.coding": bson.M{
+			"$elemMatch": bson.M{
+				"system": bson.RegEx{Pattern: "^http://loinc\\.org$", Options: "i"},
+				"code":   bson.RegEx{Pattern: "^8480-6$", Options: "i"},
+			},
+		},
+		"valueQuantity.value": bson.M{
+			"$gte": float64(139.5),
+			"$lt":  float64(140.5),
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestComponentCodeValueQuantityQueryObject(c *C) {
+	q := Query{"Observation", "component-code-value-quantity=http://loinc.org|8480-6$140||mm[Hg]"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"component": bson.M{
+			"$elemMatch": bson.M{
+				"code.coding": bson.M{
+					"$elemMatch": bson.M{
+						"system": bson.RegEx{Pattern: "^http://loinc\\.org$", Options: "i"},
+						"code":   bson.RegEx{Pattern: "^8480-6$", Options: "i"},
+					},
+				},
+				"valueQuantity.value": bson.M{
+					"$gte": float64(139.5),
+					"$lt":  float64(140.5),
+				},
+				"$or": []bson.M{
+					bson.M{"valueQuantity.code": bson.RegEx{Pattern: "^mm\\[Hg\\]$", Options: "i"}},
+					bson.M{"valueQuantity.unit": bson.RegEx{Pattern: "^mm\\[Hg\\]$", Options: "i"}},
+				},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestRelatedQueryObject(c *C) {
+	q := Query{"Observation", "related=Observation/123$has-member"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"related": bson.M{
+			"$elemMatch": bson.M{
+				"target.referenceid": bson.RegEx{Pattern: "^123$", Options: "i"},
+				"target.type":        "Observation",
+				"type":               bson.RegEx{Pattern: "^has-member$", Options: "i"},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestCompositeQueryObjectWithMultipleValues(c *C) {
+	q := Query{"Observation", "component-code-value-quantity=8480-6$140,8462-4$90"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"component": bson.M{"$elemMatch": bson.M{
+				"code.coding.code":    bson.RegEx{Pattern: "^8480-6$", Options: "i"},
+				"valueQuantity.value": bson.M{"$gte": float64(139.5), "$lt": float64(140.5)},
+			}}},
+			bson.M{"component": bson.M{"$elemMatch": bson.M{
+				"code.coding.code":    bson.RegEx{Pattern: "^8462-4$", Options: "i"},
+				"valueQuantity.value": bson.M{"$gte": float64(89.5), "$lt": float64(90.5)},
+			}}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestCompositeQueryObjectWithWrongNumberOfValuesPanics(c *C) {
+	q := Query{"Observation", "component-code-value-quantity=http://loinc.org|8480-6"}
+	c.Assert(func() { m.MongoSearcher.createQueryObject(q) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"component-code-value-quantity\" content is invalid"))
+}
+
+func (m *MongoSearchSuite) TestValueQuantityQueryObjectByValueOnly(c *C) {
+	q := Query{"Observation", "value-quantity=185"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"valueQuantity.value": bson.M{
+			"$gte": float64(184.5),
+			"$lt":  float64(185.5),
+		},
+	})
+}
 
 // Test custom search
 
@@ -2161,16 +2384,6 @@ func (m *MongoSearchSuite) TestPrefixedDateSearchPanicsForUnsupportedPrefix(c *C
 	c.Assert(func() { m.MongoSearcher.CreateQuery(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"onset\" content is invalid"))
 }
 
-func (m *MongoSearchSuite) TestPrefixedNumberSearchPanics(c *C) {
-	q := Query{"Immunization", "dose-sequence=gt1"}
-	c.Assert(func() { m.MongoSearcher.CreateQuery(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"dose-sequence\" content is invalid"))
-}
-
-func (m *MongoSearchSuite) TestPrefixedQuantitySearchPanics(c *C) {
-	q := Query{"Observation", "value-quantity=ap1||mg"}
-	c.Assert(func() { m.MongoSearcher.CreateQuery(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"value-quantity\" content is invalid"))
-}
-
 func (m *MongoSearchSuite) TestModifierSearchPanics(c *C) {
 	q := Query{"Condition", "code:text=headache"}
 	c.Assert(func() { m.MongoSearcher.CreateQuery(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", "Parameter \"code\" modifier is invalid"))
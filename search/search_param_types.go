@@ -30,6 +30,8 @@ const (
 	ContainedParam     = "_contained"
 	ContainedTypeParam = "_containedType"
 	OffsetParam        = "_offset" // Custom param, not in FHIR spec
+	CursorParam        = "_cursor" // Custom param, not in FHIR spec
+	TotalParam         = "_total"
 	FormatParam        = "_format"
 )
 
@@ -44,7 +46,7 @@ func isGlobalSearchParam(param string) bool {
 
 var searchResultParams = map[string]bool{SortParam: true, CountParam: true, IncludeParam: true,
 	RevIncludeParam: true, SummaryParam: true, ElementsParam: true, ContainedParam: true,
-	ContainedTypeParam: true, OffsetParam: true, FormatParam: true}
+	ContainedTypeParam: true, OffsetParam: true, CursorParam: true, TotalParam: true, FormatParam: true}
 
 func isSearchResultParam(param string) bool {
 	_, found := searchResultParams[param]
@@ -120,13 +122,30 @@ func (q *Query) Options() *QueryOptions {
 				options.Offset = offset
 			}
 
+		case CursorParam:
+			if queryParam.Value != "" {
+				cursor, err := ParseCursor(queryParam.Value)
+				if err != nil {
+					panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_cursor\" content is invalid"))
+				}
+				options.Cursor = cursor
+			}
+
+		case TotalParam:
+			switch queryParam.Value {
+			case TotalNone, TotalEstimate, TotalAccurate:
+				options.Total = queryParam.Value
+			default:
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_total\" content is invalid"))
+			}
+
 		case SortParam:
 			// The following supports both DSTU2-style sorts and STU3-style sorts
 			keys := strings.Split(queryParam.Value, ",")
 			for _, key := range keys {
 				desc := strings.HasPrefix(key, "-") || modifier == "desc"
 				sortParam, ok := SearchParameterDictionary[q.Resource][strings.TrimPrefix(key, "-")]
-				if !ok {
+				if !ok || len(sortParam.Paths) == 0 {
 					panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" content is invalid"))
 				}
 				options.Sort = append(options.Sort, SortOption{Descending: desc, Parameter: sortParam})
@@ -237,10 +256,20 @@ func (q *Query) URLQueryParameters(withOptions bool) URLQueryParameters {
 	return queryParams
 }
 
-// QueryOptions contains option values such as count and offset.
+// Values of the _total parameter, indicating how precisely the total number of matches should be reported
+const (
+	TotalNone     = "none"
+	TotalEstimate = "estimate"
+	TotalAccurate = "accurate"
+)
+
+// QueryOptions contains option values such as count and offset.  If a Cursor is set, the Offset is ignored.  If
+// Total is empty, the total should be accurate.
 type QueryOptions struct {
 	Count      int
 	Offset     int
+	Cursor     *Cursor
+	Total      string
 	Sort       []SortOption
 	Include    []IncludeOption
 	RevInclude []RevIncludeOption
@@ -274,8 +303,15 @@ func (o *QueryOptions) URLQueryParameters() URLQueryParameters {
 			queryParams.Add(sortParamKey, sort.Parameter.Name)
 		}
 	}
-	queryParams.Set(OffsetParam, strconv.Itoa(o.Offset))
+	if o.Cursor != nil {
+		queryParams.Set(CursorParam, o.Cursor.String())
+	} else {
+		queryParams.Set(OffsetParam, strconv.Itoa(o.Offset))
+	}
 	queryParams.Set(CountParam, strconv.Itoa(o.Count))
+	if o.Total != "" {
+		queryParams.Set(TotalParam, o.Total)
+	}
 	for _, incl := range o.Include {
 		queryParams.Add(IncludeParam, fmt.Sprintf("%s:%s", incl.Resource, incl.Parameter.Name))
 	}
@@ -379,10 +415,14 @@ func (s SearchParamInfo) CreateSearchParam(paramStr string) SearchParam {
 // be searched, as well as the FHIR type of that property (e.g., "dateTime").
 // The path indicates elements that are arrays by prefixing the element name
 // with "[]" (e.g., "order.[]item.name").  In the rare case that the search
-// path has an indexer, it will be in the brackets (e.g.,"[0]item.entry")
+// path has an indexer, it will be in the brackets (e.g.,"[0]item.entry").
+// ContactPointSystem limits a ContactPoint path to the contacts with that
+// system, as in the definition of Patient?email= (whose expression is
+// "Patient.telecom.where(system='email')").
 type SearchParamPath struct {
-	Path string
-	Type string
+	Path               string
+	Type               string
+	ContactPointSystem string
 }
 
 // CompositeParam represents a composite-flavored search parameter.  The
@@ -416,6 +456,42 @@ func ParseCompositeParam(paramString string, info SearchParamInfo) *CompositePar
 	return &CompositeParam{info, escapeFriendlySplit(paramString, '$')}
 }
 
+// ComponentInfos returns the definitions of the search parameters that make up
+// the composite, in the same order as its values.
+func (c *CompositeParam) ComponentInfos() []SearchParamInfo {
+	if len(c.CompositeValues) != len(c.Composites) {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", c.Name)))
+	}
+
+	infos := make([]SearchParamInfo, len(c.Composites))
+	for i, name := range c.Composites {
+		info, ok := SearchParameterDictionary[c.Resource][name]
+		if !ok {
+			panic(createInternalServerError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", c.Name)))
+		}
+		infos[i] = info
+	}
+	return infos
+}
+
+// Components parses each of the composite's values (e.g., "http://loinc.org|8480-6"
+// and "140" in "http://loinc.org|8480-6$140") as its corresponding component
+// search parameter.
+func (c *CompositeParam) Components() []SearchParam {
+	return c.parseComponents(c.ComponentInfos())
+}
+
+// parseComponents parses each of the composite's values using the passed in
+// component definitions, which may be adjusted from the dictionary's (e.g., to
+// make their paths relative to an array element).
+func (c *CompositeParam) parseComponents(infos []SearchParamInfo) []SearchParam {
+	components := make([]SearchParam, len(infos))
+	for i, info := range infos {
+		components[i] = info.CreateSearchParam(c.CompositeValues[i])
+	}
+	return components
+}
+
 // DateParam represents a date-flavored search parameter.  The following
 // description is from the FHIR DSTU2 specification:
 //
@@ -664,6 +740,18 @@ func (n *Number) RangeHighExcl() *big.Rat {
 	return new(big.Rat).Add(n.Value, n.rangeDelta())
 }
 
+// ApproximateRange represents the range to match against for the ap prefix:
+// within 10% of the number, or within the range implied by its precision when
+// that is wider.  The low end of the range is inclusive and the high end is
+// exclusive.
+func (n *Number) ApproximateRange() (*big.Rat, *big.Rat) {
+	delta := new(big.Rat).Abs(new(big.Rat).Quo(n.Value, big.NewRat(10, 1)))
+	if rangeDelta := n.rangeDelta(); delta.Cmp(rangeDelta) < 0 {
+		delta = rangeDelta
+	}
+	return new(big.Rat).Sub(n.Value, delta), new(big.Rat).Add(n.Value, delta)
+}
+
 // The FHIR spec defines equality for 100 to be the range [99.5, 100.5) so we
 // must support min/max using rounding semantics. The basic algorithm for
 // determining low/high is:
@@ -807,17 +895,16 @@ func findReferencedType(typeFromVal string, info SearchParamInfo) string {
 	}
 
 	valid := false
-	if len(info.Targets) == 1 {
+	if len(info.Targets) == 1 && info.Targets[0] != "Any" {
 		target := info.Targets[0]
-		if target != "Any" {
-			if t == "" {
-				t = target
-			}
-			valid = (t == target)
+		if t == "" {
+			t = target
 		}
-	} else if len(info.Targets) > 1 {
+		valid = (t == target)
+	} else {
 		for _, target := range info.Targets {
-			if t == target {
+			// References to any type of resource must say which type they refer to
+			if t == target || (target == "Any" && t != "") {
 				valid = true
 			}
 		}
@@ -920,6 +1007,18 @@ func ParseTokenParam(paramString string, info SearchParamInfo) *TokenParam {
 	return t
 }
 
+// NormalizePhone returns the digits in a phone number, so that numbers can be
+// compared regardless of their formatting (e.g., "(555) 555-1234" and
+// "555.555.1234").
+func NormalizePhone(phone string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+}
+
 // URIParam represents a uri-flavored search parameter.  The
 // following description is from the FHIR DSTU2 specification:
 //
@@ -548,6 +548,21 @@ func (s *SearchPTSuite) TestNumbersThatAreNegativeDecimals(c *C) {
 	c.Assert(n.RangeHighExcl().FloatString(22), Equals, "-0.1234567889999999999950")
 }
 
+func (s *SearchPTSuite) TestNumberApproximateRanges(c *C) {
+	low, high := ParseNumber("100").ApproximateRange()
+	c.Assert(low.RatString(), Equals, "90")
+	c.Assert(high.RatString(), Equals, "110")
+
+	low, high = ParseNumber("-100").ApproximateRange()
+	c.Assert(low.RatString(), Equals, "-110")
+	c.Assert(high.RatString(), Equals, "-90")
+
+	// When 10% is smaller than the number's precision, its precision is used
+	low, high = ParseNumber("1").ApproximateRange()
+	c.Assert(low.RatString(), Equals, "1/2")
+	c.Assert(high.RatString(), Equals, "3/2")
+}
+
 /******************************************************************************
  * NUMBER (Param)
  ******************************************************************************/
@@ -983,6 +998,21 @@ func (s *SearchPTSuite) TestReferenceTypeAndIDWithMismatchedType(c *C) {
 	c.Assert(func() { ParseReferenceParam("Condition/23", modInfo) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"foo\" content is invalid"))
 }
 
+func (s *SearchPTSuite) TestReferenceTypeAndIDWithAnyTarget(c *C) {
+	anyInfo := referenceParamInfo
+	anyInfo.Targets = []string{"Any"}
+	r := ParseReferenceParam("Patient/23", anyInfo)
+	c.Assert(r.Reference, DeepEquals, LocalReference{Type: "Patient", ID: "23"})
+
+	anyInfo.Modifier = "Patient"
+	r = ParseReferenceParam("23", anyInfo)
+	c.Assert(r.Reference, DeepEquals, LocalReference{Type: "Patient", ID: "23"})
+
+	// Without a type, the reference can't be resolved
+	anyInfo.Modifier = ""
+	c.Assert(func() { ParseReferenceParam("23", anyInfo) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"foo\" content is invalid"))
+}
+
 func (s *SearchPTSuite) TestReferenceTypeAndIdWithModifier(c *C) {
 	modInfo := referenceParamInfo
 	modInfo.Modifier = "Patient"
@@ -1576,6 +1606,19 @@ func (s *SearchPTSuite) TestQueryOptions(c *C) {
 	c.Assert(o.RevInclude[1].Parameter.Name, Equals, "patient")
 }
 
+func (s *SearchPTSuite) TestQueryOptionsWithTotal(c *C) {
+	q := Query{Resource: "Patient", Query: "gender=male"}
+	c.Assert(q.Options().Total, Equals, "")
+	q = Query{Resource: "Patient", Query: "gender=male&_total=estimate"}
+	o := q.Options()
+	c.Assert(o.Total, Equals, TotalEstimate)
+	params := o.URLQueryParameters()
+	c.Assert(params.Get(TotalParam), Equals, TotalEstimate)
+
+	q = Query{Resource: "Patient", Query: "_total=sometimes"}
+	c.Assert(func() { q.Options() }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_total\" content is invalid"))
+}
+
 func (s *SearchPTSuite) TestQueryOptionsWithSTU3Sort(c *C) {
 	q := Query{Resource: "Patient", Query: "_sort=family,given,-birthdate"}
 	o := q.Options()
@@ -0,0 +1,189 @@
+package search
+
+// The generated SearchParameterDictionary leaves out some parameters that the
+// server supports.  They are listed here, instead of in the generated file, so
+// that they survive regeneration of the dictionary.
+var extensionSearchParameters = []SearchParamInfo{
+	// Observation composites, matched against the same element (see CompositeParam)
+	SearchParamInfo{
+		Resource: "Observation",
+		Name:     "code-value-concept",
+		Type:     "composite",
+		Composites: []string{
+			"code",
+			"value-concept",
+		},
+	},
+	SearchParamInfo{
+		Resource: "Observation",
+		Name:     "code-value-date",
+		Type:     "composite",
+		Composites: []string{
+			"code",
+			"value-date",
+		},
+	},
+	SearchParamInfo{
+		Resource: "Observation",
+		Name:     "code-value-quantity",
+		Type:     "composite",
+		Composites: []string{
+			"code",
+			"value-quantity",
+		},
+	},
+	SearchParamInfo{
+		Resource: "Observation",
+		Name:     "code-value-string",
+		Type:     "composite",
+		Composites: []string{
+			"code",
+			"value-string",
+		},
+	},
+	SearchParamInfo{
+		Resource: "Observation",
+		Name:     "component-code-value-concept",
+		Type:     "composite",
+		Composites: []string{
+			"component-code",
+			"component-value-concept",
+		},
+	},
+	SearchParamInfo{
+		Resource: "Observation",
+		Name:     "component-code-value-quantity",
+		Type:     "composite",
+		Composites: []string{
+			"component-code",
+			"component-value-quantity",
+		},
+	},
+	SearchParamInfo{
+		Resource: "Observation",
+		Name:     "component-code-value-string",
+		Type:     "composite",
+		Composites: []string{
+			"component-code",
+			"component-value-string",
+		},
+	},
+	SearchParamInfo{
+		Resource: "Observation",
+		Name:     "related",
+		Type:     "composite",
+		Composites: []string{
+			"related-target",
+			"related-type",
+		},
+	},
+	// Contact parameters; email and phone only match the contacts with that system
+	SearchParamInfo{
+		Resource: "Organization",
+		Name:     "email",
+		Type:     "token",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: "[]telecom", Type: "ContactPoint", ContactPointSystem: "email"},
+		},
+	},
+	SearchParamInfo{
+		Resource: "Organization",
+		Name:     "phone",
+		Type:     "token",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: "[]telecom", Type: "ContactPoint", ContactPointSystem: "phone"},
+		},
+	},
+	SearchParamInfo{
+		Resource: "Organization",
+		Name:     "telecom",
+		Type:     "token",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: "[]telecom", Type: "ContactPoint"},
+		},
+	},
+	SearchParamInfo{
+		Resource: "Patient",
+		Name:     "email",
+		Type:     "token",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: "[]telecom", Type: "ContactPoint", ContactPointSystem: "email"},
+		},
+	},
+	SearchParamInfo{
+		Resource: "Patient",
+		Name:     "phone",
+		Type:     "token",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: "[]telecom", Type: "ContactPoint", ContactPointSystem: "phone"},
+		},
+	},
+	SearchParamInfo{
+		Resource: "Person",
+		Name:     "email",
+		Type:     "token",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: "[]telecom", Type: "ContactPoint", ContactPointSystem: "email"},
+		},
+	},
+	SearchParamInfo{
+		Resource: "Person",
+		Name:     "phone",
+		Type:     "token",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: "[]telecom", Type: "ContactPoint", ContactPointSystem: "phone"},
+		},
+	},
+	SearchParamInfo{
+		Resource: "Practitioner",
+		Name:     "email",
+		Type:     "token",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: "[]telecom", Type: "ContactPoint", ContactPointSystem: "email"},
+		},
+	},
+	SearchParamInfo{
+		Resource: "Practitioner",
+		Name:     "phone",
+		Type:     "token",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: "[]telecom", Type: "ContactPoint", ContactPointSystem: "phone"},
+		},
+	},
+	SearchParamInfo{
+		Resource: "RelatedPerson",
+		Name:     "email",
+		Type:     "token",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: "[]telecom", Type: "ContactPoint", ContactPointSystem: "email"},
+		},
+	},
+	SearchParamInfo{
+		Resource: "RelatedPerson",
+		Name:     "phone",
+		Type:     "token",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: "[]telecom", Type: "ContactPoint", ContactPointSystem: "phone"},
+		},
+	},
+	// RiskAssessment probability, searched with number prefixes (e.g., probability=gt0.8)
+	SearchParamInfo{
+		Resource: "RiskAssessment",
+		Name:     "probability",
+		Type:     "number",
+		Paths: []SearchParamPath{
+			SearchParamPath{Path: "[]prediction.probabilityDecimal", Type: "decimal"},
+		},
+	},
+}
+
+func init() {
+	for _, info := range extensionSearchParameters {
+		params, ok := SearchParameterDictionary[info.Resource]
+		if !ok {
+			params = make(map[string]SearchParamInfo)
+			SearchParameterDictionary[info.Resource] = params
+		}
+		params[info.Name] = info
+	}
+}
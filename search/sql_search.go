@@ -0,0 +1,805 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SQLSchema holds the statements that create the tables searched by the SQLSearcher.  Resources are stored in the
+// resources table, identified by their collection (as in Mongo, e.g. "patients") and ID, with their content as JSON.
+// The values of each resource's search parameters are extracted into an index table per parameter type, so that
+// searches can be translated into SQL.  The statements are written for SQLite, and are safe to run repeatedly.
+var SQLSchema = []string{
+	`CREATE TABLE IF NOT EXISTS resources (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		collection TEXT NOT NULL,
+		id TEXT NOT NULL,
+		content TEXT NOT NULL,
+		UNIQUE (collection, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS string_index (resource_seq INTEGER NOT NULL, param TEXT NOT NULL, path TEXT NOT NULL, element INTEGER, value TEXT)`,
+	`CREATE TABLE IF NOT EXISTS token_index (resource_seq INTEGER NOT NULL, param TEXT NOT NULL, path TEXT NOT NULL, element INTEGER, system TEXT, code TEXT)`,
+	`CREATE TABLE IF NOT EXISTS date_index (resource_seq INTEGER NOT NULL, param TEXT NOT NULL, path TEXT NOT NULL, element INTEGER, low INTEGER, high INTEGER)`,
+	`CREATE TABLE IF NOT EXISTS number_index (resource_seq INTEGER NOT NULL, param TEXT NOT NULL, path TEXT NOT NULL, element INTEGER, value REAL)`,
+	`CREATE TABLE IF NOT EXISTS quantity_index (resource_seq INTEGER NOT NULL, param TEXT NOT NULL, path TEXT NOT NULL, element INTEGER, value REAL, system TEXT, code TEXT, unit TEXT)`,
+	`CREATE TABLE IF NOT EXISTS reference_index (resource_seq INTEGER NOT NULL, param TEXT NOT NULL, path TEXT NOT NULL, element INTEGER, target_type TEXT, target_id TEXT, url TEXT)`,
+	`CREATE TABLE IF NOT EXISTS uri_index (resource_seq INTEGER NOT NULL, param TEXT NOT NULL, path TEXT NOT NULL, element INTEGER, value TEXT)`,
+	`CREATE INDEX IF NOT EXISTS string_index_seq ON string_index (resource_seq)`,
+	`CREATE INDEX IF NOT EXISTS string_index_value ON string_index (param, value)`,
+	`CREATE INDEX IF NOT EXISTS token_index_seq ON token_index (resource_seq)`,
+	`CREATE INDEX IF NOT EXISTS token_index_code ON token_index (param, code)`,
+	`CREATE INDEX IF NOT EXISTS date_index_seq ON date_index (resource_seq)`,
+	`CREATE INDEX IF NOT EXISTS date_index_low ON date_index (param, low)`,
+	`CREATE INDEX IF NOT EXISTS number_index_seq ON number_index (resource_seq)`,
+	`CREATE INDEX IF NOT EXISTS quantity_index_seq ON quantity_index (resource_seq)`,
+	`CREATE INDEX IF NOT EXISTS reference_index_seq ON reference_index (resource_seq)`,
+	`CREATE INDEX IF NOT EXISTS reference_index_target ON reference_index (target_id)`,
+	`CREATE INDEX IF NOT EXISTS uri_index_seq ON uri_index (resource_seq)`,
+	`CREATE INDEX IF NOT EXISTS uri_index_value ON uri_index (param, value)`,
+}
+
+// sqlIndexTable describes the index table holding the values of one type of search parameter
+type sqlIndexTable struct {
+	Name    string
+	Columns []string
+	// SortColumn is the column that the parameter's results are sorted by
+	SortColumn string
+}
+
+var sqlIndexTables = map[string]sqlIndexTable{
+	"string":    {"string_index", []string{"value"}, "value"},
+	"token":     {"token_index", []string{"system", "code"}, "code"},
+	"date":      {"date_index", []string{"low", "high"}, "low"},
+	"number":    {"number_index", []string{"value"}, "value"},
+	"quantity":  {"quantity_index", []string{"value", "system", "code", "unit"}, "value"},
+	"reference": {"reference_index", []string{"target_type", "target_id", "url"}, "url"},
+	"uri":       {"uri_index", []string{"value"}, "value"},
+}
+
+// SQLStatement is a SQL statement along with the arguments for its placeholders
+type SQLStatement struct {
+	SQL  string
+	Args []interface{}
+}
+
+// SQLSearcher implements FHIR searches against resources stored in a SQL database with the SQLSchema, translating
+// them into SQL.  It supports the same search parameters, prefixes, and modifiers as the MongoSearcher, except for
+// chained searches into contained resources and custom search parameters.  Results are sorted by the indexed values
+// of the sort parameters, which cursors are positioned by as well.
+type SQLSearcher struct {
+	// builder creates the stages that define how related resources are included
+	builder *MongoSearcher
+}
+
+// NewSQLSearcher creates a new instance of a SQLSearcher.
+func NewSQLSearcher() *SQLSearcher {
+	return &SQLSearcher{builder: &MongoSearcher{chainedIDs: func(Query) []string { return nil }}}
+}
+
+// SetCursorPaging determines whether queries without a _cursor are ordered for cursor (keyset) paging, just like
+// MongoSearcher's SetCursorPaging.
+func (s *SQLSearcher) SetCursorPaging(cursorPaging bool) {
+	s.builder.SetCursorPaging(cursorPaging)
+}
+
+// CreateQuery takes a FHIR-based Query and returns the statement selecting the seq and content of the matching
+// resources.  The statement obeys any options passed in through the query string (such as _count, _offset, _sort,
+// and _cursor), and uses the default options when none are passed in.  The results of backward cursors are selected
+// in order.  The _include and _revinclude options are handled by AddRelated.
+//
+// Like MongoSearcher's CreateQuery, CreateQuery panics with an *Error when the query is invalid or unsupported.
+func (s *SQLSearcher) CreateQuery(query Query) SQLStatement {
+	o := query.Options()
+	if fields, ok := s.builder.keysetFields(o); ok {
+		return s.createKeysetQuery(query, o, fields)
+	}
+
+	b := &sqlBuilder{}
+	where := s.whereClause(b, query)
+	var order []string
+	for _, sortOption := range o.Sort {
+		if expr, ok := sortExpression(b, sortOption); ok {
+			direction := "ASC"
+			if sortOption.Descending {
+				direction = "DESC"
+			}
+			order = append(order, expr+" "+direction)
+		}
+	}
+	order = append(order, "r.seq")
+	sql := fmt.Sprintf("SELECT r.seq, r.content FROM resources r WHERE %s ORDER BY %s LIMIT %s OFFSET %s",
+		where, strings.Join(order, ", "), b.arg(o.Count), b.arg(o.Offset))
+	return SQLStatement{SQL: sql, Args: b.args}
+}
+
+// sortExpression returns the expression selecting the value that a resource sorts by for the sort option, or false
+// if the parameter has no index table to sort by.  Resources sort by their lowest indexed value, or their highest
+// when sorting in descending order.
+func sortExpression(b *sqlBuilder, sortOption SortOption) (string, bool) {
+	table, ok := sqlIndexTables[sortOption.Parameter.Type]
+	if !ok {
+		return "", false
+	}
+	// Note: If there are multiple paths, we only look at the first one, just like the MongoSearcher
+	aggregate := "MIN"
+	if sortOption.Descending {
+		aggregate = "MAX"
+	}
+	return fmt.Sprintf("(SELECT %s(i.%s) FROM %s i WHERE i.resource_seq = r.seq AND i.param = %s AND i.path = %s)",
+		aggregate, table.SortColumn, table.Name, b.arg(sortOption.Parameter.Name), b.arg(sortOption.Parameter.Paths[0].Path)), true
+}
+
+// sortValue returns the value that a resource whose sort field holds the passed in value (as stored in Mongo) sorts
+// by for the sort option, the same way that its sortExpression computes it from the index table
+func sortValue(sortOption SortOption, value interface{}) interface{} {
+	info := sortOption.Parameter
+	table := sqlIndexTables[info.Type]
+	column := 0
+	for i, name := range table.Columns {
+		if name == table.SortColumn {
+			column = i
+		}
+	}
+	var result interface{}
+	for _, row := range indexRows(info, info.Paths[0], flattenValues([]interface{}{value})) {
+		v := row[column]
+		if v == nil {
+			continue
+		}
+		if result == nil || (compareValues(v, result) > 0) == sortOption.Descending {
+			result = v
+		}
+	}
+	return result
+}
+
+// keysetColumn is a column of the keyset query's page that results are ordered by, along with its value at the
+// cursor's position
+type keysetColumn struct {
+	Name       string
+	Descending bool
+	Value      interface{}
+}
+
+// createKeysetQuery returns the statement selecting the page of results at the query's cursor, if any.  The results
+// are ordered by the sort values and then by ID, like the MongoSearcher's keyset paging.  The sort values are
+// selected as columns of a subquery, so that the cursor's position can be compared with them.
+func (s *SQLSearcher) createKeysetQuery(query Query, o *QueryOptions, fields []keysetField) SQLStatement {
+	b := &sqlBuilder{}
+	values := cursorValues(fields, o.Cursor)
+	columns := []string{"r.seq", "r.content", "r.id AS sort_id"}
+	var keys []keysetColumn
+	for i, sortOption := range o.Sort {
+		expr, ok := sortExpression(b, sortOption)
+		if !ok {
+			continue
+		}
+		key := keysetColumn{Name: fmt.Sprintf("sort_%d", i), Descending: sortOption.Descending}
+		if values != nil {
+			key.Value = sortValue(sortOption, values[i])
+		}
+		columns = append(columns, expr+" AS "+key.Name)
+		keys = append(keys, key)
+	}
+	id := keysetColumn{Name: "sort_id"}
+	if values != nil {
+		id.Value = values[len(values)-1]
+	}
+	keys = append(keys, id)
+
+	sql := fmt.Sprintf("SELECT * FROM (SELECT %s FROM resources r WHERE %s)", strings.Join(columns, ", "), s.whereClause(b, query))
+	if values != nil {
+		sql += " WHERE " + keysetCondition(b, keys, o.Cursor.Backward)
+	}
+	sql += fmt.Sprintf(" ORDER BY %s LIMIT %s", keysetOrder(keys, o.Cursor.pagesBackward()), b.arg(o.Count))
+	// Backward pages are found in reverse order, so put them back in order
+	sql = fmt.Sprintf("SELECT seq, content FROM (%s) ORDER BY %s", sql, keysetOrder(keys, false))
+	return SQLStatement{SQL: sql, Args: b.args}
+}
+
+// keysetOrder returns the ORDER BY terms for the keyset columns, in reverse order if backward is true.  Like Mongo,
+// SQLite sorts nulls before all other values.
+func keysetOrder(keys []keysetColumn, backward bool) string {
+	order := make([]string, len(keys))
+	for i, key := range keys {
+		direction := "ASC"
+		if key.Descending != backward {
+			direction = "DESC"
+		}
+		order[i] = key.Name + " " + direction
+	}
+	return strings.Join(order, ", ")
+}
+
+// keysetCondition returns the condition selecting the results that come after the cursor's position, in the order
+// that the results are found, just like keysetCriteria.  The last key is the ID, which is never null.
+func keysetCondition(b *sqlBuilder, keys []keysetColumn, backward bool) string {
+	var clauses []string
+	for i, key := range keys {
+		descending := key.Descending != backward
+		if key.Value == nil && descending && i < len(keys)-1 {
+			// No values come after null
+			continue
+		}
+		var conditions []string
+		for _, earlier := range keys[:i] {
+			if earlier.Value == nil {
+				conditions = append(conditions, earlier.Name+" IS NULL")
+			} else {
+				conditions = append(conditions, earlier.Name+" = "+b.arg(earlier.Value))
+			}
+		}
+		switch {
+		case key.Value == nil:
+			conditions = append(conditions, key.Name+" IS NOT NULL")
+		case descending && i < len(keys)-1:
+			conditions = append(conditions, fmt.Sprintf("(%s < %s OR %s IS NULL)", key.Name, b.arg(key.Value), key.Name))
+		case descending:
+			conditions = append(conditions, key.Name+" < "+b.arg(key.Value))
+		default:
+			conditions = append(conditions, key.Name+" > "+b.arg(key.Value))
+		}
+		clauses = append(clauses, "("+strings.Join(conditions, " AND ")+")")
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")"
+}
+
+// CreateQueryWithoutOptions takes a FHIR-based Query and returns the statement selecting the seq and content of the
+// matching resources, ignoring any options passed in through the query string.
+func (s *SQLSearcher) CreateQueryWithoutOptions(query Query) SQLStatement {
+	b := &sqlBuilder{}
+	where := s.whereClause(b, query)
+	return SQLStatement{SQL: "SELECT r.seq, r.content FROM resources r WHERE " + where + " ORDER BY r.seq", Args: b.args}
+}
+
+// CreateCountQuery takes a FHIR-based Query and returns the statement counting the matching resources, ignoring any
+// options passed in through the query string.
+func (s *SQLSearcher) CreateCountQuery(query Query) SQLStatement {
+	b := &sqlBuilder{}
+	where := s.whereClause(b, query)
+	return SQLStatement{SQL: "SELECT COUNT(*) FROM resources r WHERE " + where, Args: b.args}
+}
+
+// AddRelated adds the resources included by the query's _include and _revinclude options to the documents found by
+// the query, in the same form as the results of MongoSearcher's CreatePipeline.  The documents are resources as they
+// would be stored in Mongo.  The find function runs a statement created by AddRelated, which selects the seq and
+// content of resources, returning the resources as documents.
+func (s *SQLSearcher) AddRelated(query Query, docs []bson.M, find func(statement SQLStatement) ([]bson.M, error)) ([]bson.M, error) {
+	o := query.Options()
+	if len(o.Include) == 0 && len(o.RevInclude) == 0 {
+		return docs, nil
+	}
+
+	// The MongoSearcher's $lookup stages define the related resources, so find the candidates for each lookup in the
+	// database and then join them to the documents in memory
+	for _, stage := range s.builder.createPipelineStages(query) {
+		spec, ok := stage["$lookup"].(bson.M)
+		if !ok {
+			continue
+		}
+		from := spec["from"].(string)
+		var candidates []bson.M
+		var err error
+		if spec["foreignField"] == "_id" {
+			ids := flattenValues(collectValues(docs, spec["localField"].(string)))
+			candidates, err = find(s.createCandidatesQuery(from, "lower(r.id) IN (%s)", ids))
+		} else {
+			ids := flattenValues(collectValues(docs, "_id"))
+			candidates, err = find(s.createCandidatesQuery(from,
+				"EXISTS (SELECT 1 FROM reference_index i WHERE i.resource_seq = r.seq AND i.target_id IN (%s))", ids))
+		}
+		if err != nil {
+			return nil, err
+		}
+		searcher := NewMemorySearcher(func(string) []bson.M { return candidates })
+		docs = searcher.lookup(docs, spec)
+	}
+	return docs, nil
+}
+
+// createCandidatesQuery creates the statement selecting the resources in the collection meeting the condition, whose
+// %s placeholder is replaced by the list of IDs
+func (s *SQLSearcher) createCandidatesQuery(collection, condition string, ids []interface{}) SQLStatement {
+	b := &sqlBuilder{}
+	placeholders := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id, ok := id.(string); ok {
+			placeholders = append(placeholders, b.arg(strings.ToLower(id)))
+		}
+	}
+	if len(placeholders) == 0 {
+		placeholders = append(placeholders, "NULL")
+	}
+	sql := fmt.Sprintf("SELECT r.seq, r.content FROM resources r WHERE r.collection = ? AND "+condition+" ORDER BY r.seq",
+		strings.Join(placeholders, ", "))
+	b.args = append([]interface{}{collection}, b.args...)
+	return SQLStatement{SQL: sql, Args: b.args}
+}
+
+func collectValues(docs []bson.M, path string) []interface{} {
+	var values []interface{}
+	for _, doc := range docs {
+		values = append(values, lookupValues(doc, strings.Split(path, "."))...)
+	}
+	return values
+}
+
+// IndexStatements returns the statements that insert the values of a resource's search parameters into the index
+// tables.  The resource is passed in as a document, as it would be stored in Mongo, and seq is its seq in the
+// resources table.
+func (s *SQLSearcher) IndexStatements(seq int64, resourceType string, doc bson.M) []SQLStatement {
+	params := SearchParameterDictionary[resourceType]
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var statements []SQLStatement
+	for _, name := range names {
+		info := params[name]
+		table, ok := sqlIndexTables[info.Type]
+		if !ok {
+			continue
+		}
+		insert := fmt.Sprintf("INSERT INTO %s (resource_seq, param, path, element, %s) VALUES (?, ?, ?, ?%s)",
+			table.Name, strings.Join(table.Columns, ", "), strings.Repeat(", ?", len(table.Columns)))
+		for _, path := range info.Paths {
+			for _, element := range pathElements(doc, path.Path) {
+				for _, row := range indexRows(info, path, flattenValues(element.Values)) {
+					args := append([]interface{}{seq, info.Name, path.Path, element.Position}, row...)
+					statements = append(statements, SQLStatement{SQL: insert, Args: args})
+				}
+			}
+		}
+	}
+	return statements
+}
+
+// sqlElement holds the values at a search path that are in one element of the path's first array.  Position is the
+// index of that element, or nil if the path has no array.  Composite parameters use it to match their components
+// against the same element.
+type sqlElement struct {
+	Position interface{}
+	Values   []interface{}
+}
+
+// pathElements returns the values at a search path in the document, grouped by the element of the path's first
+// array that they are in
+func pathElements(doc bson.M, path string) []sqlElement {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "[]") {
+			continue
+		}
+		array := strings.Split(convertSearchPathToMongoField(strings.Join(parts[:i+1], ".")), ".")
+		rest := strings.Split(convertSearchPathToMongoField(strings.Join(parts[i+1:], ".")), ".")
+		var elements []sqlElement
+		for _, value := range lookupValues(doc, array) {
+			values, ok := value.([]interface{})
+			if !ok {
+				values = []interface{}{value}
+			}
+			for position, value := range values {
+				if value == nil {
+					continue
+				}
+				if len(parts) == i+1 {
+					elements = append(elements, sqlElement{position, []interface{}{value}})
+				} else {
+					elements = append(elements, sqlElement{position, lookupValues(value, rest)})
+				}
+			}
+		}
+		return elements
+	}
+	return []sqlElement{{nil, lookupValues(doc, strings.Split(convertSearchPathToMongoField(path), "."))}}
+}
+
+// DeleteIndexStatements returns the statements that delete the values of a resource's search parameters from the
+// index tables, given its seq in the resources table.
+func (s *SQLSearcher) DeleteIndexStatements(seq int64) []SQLStatement {
+	names := make([]string, 0, len(sqlIndexTables))
+	for _, table := range sqlIndexTables {
+		names = append(names, table.Name)
+	}
+	sort.Strings(names)
+	statements := make([]SQLStatement, len(names))
+	for i, name := range names {
+		statements[i] = SQLStatement{SQL: "DELETE FROM " + name + " WHERE resource_seq = ?", Args: []interface{}{seq}}
+	}
+	return statements
+}
+
+// indexRows returns the index table rows (without the resource_seq, param, and path) for the values at a path
+func indexRows(info SearchParamInfo, path SearchParamPath, values []interface{}) [][]interface{} {
+	pathType := path.Type
+	var rows [][]interface{}
+	for _, value := range values {
+		switch info.Type {
+		case "string":
+			var strs []interface{}
+			switch pathType {
+			case "HumanName":
+				strs = fieldValues(value, "text", "family", "given")
+			case "Address":
+				strs = fieldValues(value, "text", "line", "city", "state", "postalCode", "country")
+			default:
+				strs = []interface{}{value}
+			}
+			for _, str := range strs {
+				if str, ok := str.(string); ok {
+					rows = append(rows, []interface{}{strings.ToLower(str)})
+				}
+			}
+		case "token":
+			switch pathType {
+			case "Coding":
+				rows = append(rows, []interface{}{lowerField(value, "system"), lowerField(value, "code")})
+			case "CodeableConcept":
+				for _, coding := range fieldValues(value, "coding") {
+					rows = append(rows, []interface{}{lowerField(coding, "system"), lowerField(coding, "code")})
+				}
+			case "Identifier":
+				rows = append(rows, []interface{}{lowerField(value, "system"), lowerField(value, "value")})
+			case "ContactPoint":
+				// Contact parameters like email and phone only index the contacts with their system, and phone
+				// numbers are indexed as their digits
+				system := stringField(value, "system")
+				if path.ContactPointSystem != "" && system != path.ContactPointSystem {
+					continue
+				}
+				code := lowerField(value, "value")
+				if str, ok := code.(string); ok && system == "phone" && NormalizePhone(str) != "" {
+					code = NormalizePhone(str)
+				}
+				rows = append(rows, []interface{}{lowerField(value, "use"), code})
+			case "boolean":
+				if b, ok := value.(bool); ok {
+					rows = append(rows, []interface{}{nil, fmt.Sprint(b)})
+				}
+			case "code", "string", "id":
+				if str, ok := value.(string); ok {
+					rows = append(rows, []interface{}{nil, strings.ToLower(str)})
+				}
+			}
+		case "date":
+			switch pathType {
+			case "Period":
+				rows = append(rows, []interface{}{timeField(value, "start"), timeField(value, "end")})
+			case "Timing":
+				for _, event := range fieldValues(value, "event") {
+					t := timeField(event, "")
+					rows = append(rows, []interface{}{t, t})
+				}
+			default:
+				t := timeField(value, "")
+				rows = append(rows, []interface{}{t, t})
+			}
+		case "number":
+			if typeOrder(value) == typeOrder(0) {
+				rows = append(rows, []interface{}{toFloat64(value)})
+			}
+		case "quantity":
+			var number interface{}
+			if n := fieldValues(value, "value"); len(n) > 0 && typeOrder(n[0]) == typeOrder(0) {
+				number = toFloat64(n[0])
+			}
+			rows = append(rows, []interface{}{number, lowerField(value, "system"), lowerField(value, "code"), lowerField(value, "unit")})
+		case "reference":
+			if pathType == "Reference" {
+				rows = append(rows, []interface{}{stringField(value, "type"), lowerField(value, "referenceid"), lowerField(value, "reference")})
+			}
+		case "uri":
+			if str, ok := value.(string); ok {
+				rows = append(rows, []interface{}{str})
+			}
+		}
+	}
+	return rows
+}
+
+// fieldValues returns the values of the fields in the document, with arrays flattened
+func fieldValues(doc interface{}, fields ...string) []interface{} {
+	var values []interface{}
+	for _, field := range fields {
+		values = append(values, flattenValues(lookupValues(doc, []string{field}))...)
+	}
+	return values
+}
+
+// stringField returns the document's string field, or nil if it has none
+func stringField(doc interface{}, field string) interface{} {
+	if values := fieldValues(doc, field); len(values) > 0 {
+		if str, ok := values[0].(string); ok {
+			return str
+		}
+	}
+	return nil
+}
+
+// lowerField returns the document's string field in lower case, or nil if it has none
+func lowerField(doc interface{}, field string) interface{} {
+	if str, ok := stringField(doc, field).(string); ok {
+		return strings.ToLower(str)
+	}
+	return nil
+}
+
+// timeField returns the time of the document's date field (or the document itself, if field is empty) in
+// milliseconds since the epoch, or nil if it has none
+func timeField(doc interface{}, field string) interface{} {
+	if field != "" {
+		values := fieldValues(doc, field)
+		if len(values) == 0 {
+			return nil
+		}
+		doc = values[0]
+	}
+	if values := fieldValues(doc, "time"); len(values) > 0 {
+		if t, ok := values[0].(time.Time); ok {
+			return sqlTime(t)
+		}
+	}
+	return nil
+}
+
+// sqlTime returns the time in milliseconds since the epoch, which is the precision stored in Mongo
+func sqlTime(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond()/int(time.Millisecond))
+}
+
+// sqlBuilder accumulates the arguments of a statement as it is built
+type sqlBuilder struct {
+	args []interface{}
+	// element, if set, is the expression for the array element that index rows have to be in (see compositeCondition)
+	element string
+}
+
+// arg adds an argument, returning its placeholder
+func (b *sqlBuilder) arg(value interface{}) string {
+	b.args = append(b.args, value)
+	return "?"
+}
+
+func (s *SQLSearcher) whereClause(b *sqlBuilder, query Query) string {
+	// A chained query is about other resources, so it isn't held to the element of a composite containing it
+	element := b.element
+	b.element = ""
+	defer func() { b.element = element }()
+
+	conditions := []string{"r.collection = " + b.arg(models.PluralizeLowerResourceName(query.Resource))}
+	for _, p := range query.Params() {
+		conditions = append(conditions, s.paramCondition(b, p))
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+func (s *SQLSearcher) paramCondition(b *sqlBuilder, p SearchParam) string {
+	panicOnUnsupportedFeatures(p)
+	switch p := p.(type) {
+	case *CompositeParam:
+		return s.compositeCondition(b, p)
+	case *DateParam:
+		return s.pathsCondition(b, p.SearchParamInfo, func(path SearchParamPath) string {
+			if path.Type == "Period" {
+				return periodCondition(b, p)
+			}
+			return dateCondition(b, p)
+		})
+	case *NumberParam:
+		return s.pathsCondition(b, p.SearchParamInfo, func(path SearchParamPath) string {
+			return numberCondition(b, p.Number, p.Prefix)
+		})
+	case *QuantityParam:
+		return s.pathsCondition(b, p.SearchParamInfo, func(path SearchParamPath) string {
+			condition := numberCondition(b, p.Number, p.Prefix)
+			code := strings.ToLower(p.Code)
+			if p.System == "" && p.Code == "" {
+				// Like the MongoSearcher, a value without units matches the value in any units
+				return condition
+			}
+			if p.System == "" {
+				return condition + fmt.Sprintf(" AND (i.code = %s OR i.unit = %s)", b.arg(code), b.arg(code))
+			}
+			return condition + fmt.Sprintf(" AND i.code = %s AND i.system = %s", b.arg(code), b.arg(strings.ToLower(p.System)))
+		})
+	case *ReferenceParam:
+		return s.pathsCondition(b, p.SearchParamInfo, func(path SearchParamPath) string {
+			if path.Type == "Resource" {
+				panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", p.Name)))
+			}
+			var condition string
+			var refType string
+			switch ref := p.Reference.(type) {
+			case LocalReference:
+				condition = "i.target_id = " + b.arg(strings.ToLower(ref.ID))
+				refType = ref.Type
+			case ExternalReference:
+				return "i.url = " + b.arg(strings.ToLower(ref.URL))
+			case ChainedQueryReference:
+				condition = fmt.Sprintf("i.target_id IN (SELECT lower(r.id) FROM resources r WHERE %s)", s.whereClause(b, ref.ChainedQuery))
+				refType = ref.Type
+			}
+			if refType != "" {
+				condition += " AND i.target_type = " + b.arg(refType)
+			}
+			return condition
+		})
+	case *StringParam:
+		return s.pathsCondition(b, p.SearchParamInfo, func(path SearchParamPath) string {
+			str := strings.ToLower(p.String)
+			if p.Name == "_id" {
+				return "i.value = " + b.arg(str)
+			}
+			return fmt.Sprintf("substr(i.value, 1, %s) = %s", b.arg(utf8.RuneCountInString(str)), b.arg(str))
+		})
+	case *TokenParam:
+		return s.pathsCondition(b, p.SearchParamInfo, func(path SearchParamPath) string {
+			switch path.Type {
+			case "Coding", "CodeableConcept", "Identifier", "ContactPoint":
+				code := strings.ToLower(p.Code)
+				condition := "i.code = " + b.arg(code)
+				if phone := NormalizePhone(code); path.Type == "ContactPoint" && phone != "" {
+					// Phone numbers are indexed as their digits
+					switch path.ContactPointSystem {
+					case "phone":
+						b.args[len(b.args)-1] = phone
+					case "":
+						condition = fmt.Sprintf("(%s OR i.code = %s)", condition, b.arg(phone))
+					}
+				}
+				if !p.AnySystem {
+					condition += " AND i.system = " + b.arg(strings.ToLower(p.System))
+				}
+				return condition
+			case "boolean":
+				if p.Code != "true" && p.Code != "false" {
+					panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", p.Name)))
+				}
+				return "i.code = " + b.arg(p.Code)
+			case "code", "string", "id":
+				return "i.code = " + b.arg(strings.ToLower(p.Code))
+			}
+			// Like the MongoSearcher, there are no criteria for other types
+			return ""
+		})
+	case *URIParam:
+		return s.pathsCondition(b, p.SearchParamInfo, func(path SearchParamPath) string {
+			return "i.value = " + b.arg(p.URI)
+		})
+	case *OrParam:
+		conditions := make([]string, len(p.Items))
+		for i, item := range p.Items {
+			conditions[i] = s.paramCondition(b, item)
+		}
+		return "(" + strings.Join(conditions, " OR ") + ")"
+	}
+	panic(createInternalServerError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", p.getInfo().Name)))
+}
+
+// compositeCondition returns the condition that all of a composite's components match.  Like the MongoSearcher,
+// components in the same array have to match the same element of it (e.g., the code and value of one component of an
+// Observation), which is done by holding their index rows to the elements that the first component has rows in.
+func (s *SQLSearcher) compositeCondition(b *sqlBuilder, c *CompositeParam) string {
+	infos := c.ComponentInfos()
+	array := sharedArrayPath(infos)
+	if strings.Count(array, "[]") > 1 {
+		// Only the element of a path's first array is indexed
+		panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", c.Name)))
+	}
+
+	var conditions []string
+	if array == "" {
+		for _, p := range c.parseComponents(infos) {
+			conditions = append(conditions, s.paramCondition(b, p))
+		}
+		return "(" + strings.Join(conditions, " AND ") + ")"
+	}
+
+	elements := fmt.Sprintf("SELECT i.element FROM %s i WHERE i.resource_seq = r.seq AND i.param = %s",
+		sqlIndexTables[infos[0].Type].Name, b.arg(infos[0].Name))
+	element := b.element
+	b.element = "e.element"
+	defer func() { b.element = element }()
+	for _, p := range c.parseComponents(infos) {
+		conditions = append(conditions, s.paramCondition(b, p))
+	}
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM (%s) e WHERE %s)", elements, strings.Join(conditions, " AND "))
+}
+
+// pathsCondition returns the condition that any of the parameter's paths have an index row meeting the condition
+// created by rowCondition.  If rowCondition returns an empty condition, every resource matches that path.
+func (s *SQLSearcher) pathsCondition(b *sqlBuilder, info SearchParamInfo, rowCondition func(path SearchParamPath) string) string {
+	table := sqlIndexTables[info.Type]
+	conditions := make([]string, len(info.Paths))
+	for i, path := range info.Paths {
+		prefix := fmt.Sprintf("EXISTS (SELECT 1 FROM %s i WHERE i.resource_seq = r.seq AND i.param = %s AND i.path = %s AND ",
+			table.Name, b.arg(info.Name), b.arg(path.Path))
+		if b.element != "" {
+			prefix += "i.element = " + b.element + " AND "
+		}
+		condition := rowCondition(path)
+		if condition == "" {
+			// The arguments of the prefix have to go, since it is being dropped
+			b.args = b.args[:len(b.args)-2]
+			conditions[i] = "1 = 1"
+		} else {
+			conditions[i] = prefix + "(" + condition + "))"
+		}
+	}
+	if len(conditions) == 1 {
+		return conditions[0]
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")"
+}
+
+// dateCondition is the equivalent of the MongoSearcher's dateSelector, for dates indexed as their low values
+func dateCondition(b *sqlBuilder, d *DateParam) string {
+	low, high := sqlTime(d.Date.RangeLowIncl()), sqlTime(d.Date.RangeHighExcl())
+	switch d.Prefix {
+	case EQ:
+		return fmt.Sprintf("i.low >= %s AND i.low < %s", b.arg(low), b.arg(high))
+	case GT, SA:
+		return "i.low > " + b.arg(low)
+	case LT, EB:
+		return "i.low < " + b.arg(low)
+	case GE:
+		return "i.low >= " + b.arg(low)
+	case LE:
+		return "i.low < " + b.arg(high)
+	}
+	panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", d.Name)))
+}
+
+// numberCondition is the equivalent of the MongoSearcher's numberSelector, for numbers indexed as their value
+func numberCondition(b *sqlBuilder, n *Number, prefix Prefix) string {
+	l, _ := n.RangeLowIncl().Float64()
+	h, _ := n.RangeHighExcl().Float64()
+	switch prefix {
+	case GT, SA:
+		return "i.value >= " + b.arg(h)
+	case LT, EB:
+		return "i.value < " + b.arg(l)
+	case GE:
+		return "i.value >= " + b.arg(l)
+	case LE:
+		return "i.value < " + b.arg(h)
+	case NE:
+		return fmt.Sprintf("NOT (i.value >= %s AND i.value < %s)", b.arg(l), b.arg(h))
+	case AP:
+		low, high := n.ApproximateRange()
+		l, _ = low.Float64()
+		h, _ = high.Float64()
+	}
+	return fmt.Sprintf("i.value >= %s AND i.value < %s", b.arg(l), b.arg(h))
+}
+
+// periodCondition is the equivalent of the MongoSearcher's periodSelector, for periods indexed as their start (low)
+// and end (high) values
+func periodCondition(b *sqlBuilder, d *DateParam) string {
+	low, high := sqlTime(d.Date.RangeLowIncl()), sqlTime(d.Date.RangeHighExcl())
+	switch d.Prefix {
+	case EQ:
+		return fmt.Sprintf("i.low >= %s AND i.high < %s", b.arg(low), b.arg(high))
+	case GT:
+		return fmt.Sprintf("i.high > %s OR i.high IS NULL", b.arg(low))
+	case LT:
+		return fmt.Sprintf("i.low < %s OR i.low IS NULL", b.arg(low))
+	case GE:
+		return fmt.Sprintf("i.low >= %s OR i.high > %s OR i.high IS NULL", b.arg(low), b.arg(low))
+	case LE:
+		return fmt.Sprintf("i.high < %s OR i.low < %s OR i.low IS NULL", b.arg(high), b.arg(low))
+	case SA:
+		return "i.low >= " + b.arg(high)
+	case EB:
+		return "i.high < " + b.arg(low)
+	}
+	panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", d.Name)))
+}
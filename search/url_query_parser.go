@@ -86,6 +86,17 @@ func (u *URLQueryParameters) Set(key string, value string) {
 	}
 }
 
+// Del removes all of the query parameters with the specified key.
+func (u *URLQueryParameters) Del(key string) {
+	var params []URLQueryParameter
+	for _, param := range u.params {
+		if param.Key != key {
+			params = append(params, param)
+		}
+	}
+	u.params = params
+}
+
 // Get returns the value of the first query parameter with the specified key.  If no query parameters have the specified
 // key, an empty string is returned.
 func (u *URLQueryParameters) Get(key string) string {
@@ -109,6 +109,18 @@ func (s *URLQueryParserSuite) TestSetExistingMultipleParams(c *C) {
 	c.Assert(all[2], DeepEquals, URLQueryParameter{Key: "foo3", Value: "bar3"})
 }
 
+func (s *URLQueryParserSuite) TestDel(c *C) {
+	p := URLQueryParameters{}
+	p.Add("foo", "bar")
+	p.Add("foo2", "bar2")
+	p.Add("foo", "baz")
+	p.Del("foo")
+	p.Del("foo4")
+	all := p.All()
+	c.Assert(all, HasLen, 1)
+	c.Assert(all[0], DeepEquals, URLQueryParameter{Key: "foo2", Value: "bar2"})
+}
+
 func (s *URLQueryParserSuite) TestGet(c *C) {
 	p := URLQueryParameters{}
 	p.Add("foo", "bar")
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"reflect"
 	"regexp"
 	"sort"
 	"strings"
@@ -29,6 +28,7 @@ func NewBatchController(dal DataAccessLayer) *BatchController {
 
 // Post processes and incoming batch request
 func (b *BatchController) Post(c *gin.Context) {
+	dal := WithContext(c.Request.Context(), requestDAL(c, b.DAL))
 	bundle := &models.Bundle{}
 	err := FHIRBind(c, bundle)
 	if err != nil {
@@ -71,16 +71,46 @@ func (b *BatchController) Post(c *gin.Context) {
 		entries[i] = &bundle.Entry[i]
 	}
 
-	sort.Sort(byRequestMethod(entries))
+	// Keep the order of the entries within each method, since clients may depend on it
+	sort.Stable(byRequestMethod(entries))
+
+	// Conditional creates are checked for matching resources here, but only created later on, so hold the lock for
+	// the rest of the batch
+	for _, entry := range entries {
+		if entry.Request.Method == "POST" && entry.Request.IfNoneExist != "" {
+			conditionalCreateLock.Lock()
+			defer conditionalCreateLock.Unlock()
+			break
+		}
+	}
 
 	// Now loop through the entries, assigning new IDs to those that are POST or Conditional PUT and fixing any
 	// references to reference the new ID.
 	refMap := make(map[string]models.Reference)
 	newIDs := make([]string, len(entries))
+	existing := make([]bool, len(entries))
 	for i, entry := range entries {
 		if entry.Request.Method == "POST" {
+			// A conditional create refers to the matching resource, if there is one, rather than creating another
+			var id string
+			if entry.Request.IfNoneExist != "" {
+				var err error
+				if id, err = b.resolveConditionalCreate(dal, entry); abortOnContextError(c, err) {
+					return
+				} else if err == ErrMultipleMatches {
+					c.AbortWithStatus(http.StatusPreconditionFailed)
+					return
+				} else if err != nil {
+					c.AbortWithError(http.StatusInternalServerError, err)
+					return
+				}
+				existing[i] = id != ""
+			}
+
 			// Create a new ID and add it to the reference map
-			id := bson.NewObjectId().Hex()
+			if id == "" {
+				id = bson.NewObjectId().Hex()
+			}
 			newIDs[i] = id
 			refMap[entry.FullUrl] = models.Reference{
 				Reference:    entry.Request.Url + "/" + id,
@@ -97,7 +127,9 @@ func (b *BatchController) Post(c *gin.Context) {
 				continue
 			}
 
-			if err := b.resolveConditionalPut(c.Request, i, entry, newIDs, refMap); err != nil {
+			if err := b.resolveConditionalPut(dal, c.Request, i, entry, newIDs, refMap); abortOnContextError(c, err) {
+				return
+			} else if err != nil {
 				c.AbortWithError(http.StatusInternalServerError, err)
 				return
 			}
@@ -121,7 +153,9 @@ func (b *BatchController) Post(c *gin.Context) {
 				return
 			}
 
-			if err := b.resolveConditionalPut(c.Request, i, entry, newIDs, refMap); err != nil {
+			if err := b.resolveConditionalPut(dal, c.Request, i, entry, newIDs, refMap); abortOnContextError(c, err) {
+				return
+			} else if err != nil {
 				c.AbortWithError(http.StatusInternalServerError, err)
 				return
 			}
@@ -131,8 +165,26 @@ func (b *BatchController) Post(c *gin.Context) {
 	// Update all the references to the entries (to reflect newly assigned IDs)
 	updateAllReferences(entries, refMap)
 
+	// Entries may refer to resources written by later entries, so let the referential integrity checks, if any, know
+	// which resources the batch is about to write
+	pending := make(map[string]bool)
+	for i, entry := range entries {
+		switch entry.Request.Method {
+		case "POST":
+			pending[entry.Request.Url+"/"+newIDs[i]] = true
+		case "PUT":
+			pending[entry.Request.Url] = true
+		}
+	}
+	dal = WithContext(withPendingResources(c.Request.Context(), pending), requestDAL(c, b.DAL))
+
 	// Then make the changes in the database and update the entry response
 	for i, entry := range entries {
+		// Stop processing entries once the request has been cancelled or timed out
+		if abortOnContextError(c, c.Request.Context().Err()) {
+			return
+		}
+
 		switch entry.Request.Method {
 		case "DELETE":
 			if !isConditional(entry) {
@@ -143,7 +195,12 @@ func (b *BatchController) Post(c *gin.Context) {
 						fmt.Errorf("Couldn't identify resource and id to delete from %s", entry.Request.Url))
 					return
 				}
-				if err := b.DAL.Delete(parts[1], parts[0]); err != nil && err != ErrNotFound {
+				err := dal.Delete(parts[1], parts[0])
+				if abortOnOutcomeError(c, err) {
+					return
+				} else if abortOnContextError(c, err) {
+					return
+				} else if err != nil && err != ErrNotFound && err != ErrInvalidID {
 					c.AbortWithError(http.StatusInternalServerError, err)
 					return
 				}
@@ -151,7 +208,11 @@ func (b *BatchController) Post(c *gin.Context) {
 				// It's a conditional (query-based) delete
 				parts := strings.SplitN(entry.Request.Url, "?", 2)
 				query := search.Query{Resource: parts[0], Query: parts[1]}
-				if _, err := b.DAL.ConditionalDelete(query); err != nil {
+				if _, err := dal.ConditionalDelete(query); abortOnOutcomeError(c, err) {
+					return
+				} else if abortOnContextError(c, err) {
+					return
+				} else if err != nil {
 					c.AbortWithError(http.StatusInternalServerError, err)
 					return
 				}
@@ -162,7 +223,30 @@ func (b *BatchController) Post(c *gin.Context) {
 				Status: "204",
 			}
 		case "POST":
-			if err := b.DAL.PostWithID(newIDs[i], entry.Resource); err != nil {
+			if existing[i] {
+				resource, err := dal.Get(newIDs[i], entry.Request.Url)
+				if abortOnContextError(c, err) {
+					return
+				} else if err != nil {
+					c.AbortWithError(http.StatusInternalServerError, err)
+					return
+				}
+				entry.Resource = resource
+				entry.Request = nil
+				entry.Response = &models.BundleEntryResponseComponent{
+					Status:   "200",
+					Location: entry.FullUrl,
+				}
+				if meta, ok := models.GetResourceMeta(entry.Resource); ok {
+					entry.Response.LastModified = meta.LastUpdated
+				}
+				continue
+			}
+			if err := dal.PostWithID(newIDs[i], entry.Resource); abortOnOutcomeError(c, err) {
+				return
+			} else if abortOnContextError(c, err) {
+				return
+			} else if err != nil {
 				c.AbortWithError(http.StatusInternalServerError, err)
 				return
 			}
@@ -183,8 +267,16 @@ func (b *BatchController) Post(c *gin.Context) {
 					fmt.Errorf("Couldn't identify resource and id to put from %s", entry.Request.Url))
 				return
 			}
-			createdNew, err := b.DAL.Put(parts[1], entry.Resource)
-			if err != nil {
+			createdNew, err := dal.Put(parts[1], entry.Resource)
+			if err == ErrInvalidID {
+				c.JSON(http.StatusBadRequest, models.NewOperationOutcome("error", "invalid", err.Error()))
+				c.Abort()
+				return
+			} else if abortOnOutcomeError(c, err) {
+				return
+			} else if abortOnContextError(c, err) {
+				return
+			} else if err != nil {
 				c.AbortWithError(http.StatusInternalServerError, err)
 				return
 			}
@@ -216,13 +308,31 @@ func (b *BatchController) Post(c *gin.Context) {
 	c.JSON(http.StatusOK, bundle)
 }
 
-func (b *BatchController) resolveConditionalPut(request *http.Request, entryIndex int, entry *models.BundleEntryComponent, newIDs []string, refMap map[string]models.Reference) error {
+// resolveConditionalCreate returns the ID of the resource matching the If-None-Exist query of a POST entry, or an
+// empty string if no resource matches
+func (b *BatchController) resolveConditionalCreate(dal DataAccessLayer, entry *models.BundleEntryComponent) (string, error) {
+	query := search.Query{Resource: entry.Request.Url, Query: entry.Request.IfNoneExist}
+	IDs, err := dal.FindIDs(query)
+	if err != nil {
+		return "", err
+	}
+	switch len(IDs) {
+	case 0:
+		return "", nil
+	case 1:
+		return IDs[0], nil
+	default:
+		return "", ErrMultipleMatches
+	}
+}
+
+func (b *BatchController) resolveConditionalPut(dal DataAccessLayer, request *http.Request, entryIndex int, entry *models.BundleEntryComponent, newIDs []string, refMap map[string]models.Reference) error {
 	// Do a preflight to either get the existing ID, get a new ID, or detect multiple matches (not allowed)
 	parts := strings.SplitN(entry.Request.Url, "?", 2)
 	query := search.Query{Resource: parts[0], Query: parts[1]}
 
 	var id string
-	if IDs, err := b.DAL.FindIDs(query); err == nil {
+	if IDs, err := dal.FindIDs(query); err == nil {
 		switch len(IDs) {
 		case 0:
 			id = bson.NewObjectId().Hex()
@@ -259,7 +369,7 @@ func updateAllReferences(entries []*models.BundleEntryComponent, refMap map[stri
 	for _, entry := range entries {
 		model := entry.Resource
 		if model != nil {
-			entryRefs := findRefsInValue(reflect.ValueOf(model))
+			entryRefs := models.FindReferences(model)
 			refs = append(refs, entryRefs...)
 		}
 	}
@@ -272,37 +382,6 @@ func updateAllReferences(entries []*models.BundleEntryComponent, refMap map[stri
 	}
 }
 
-func findRefsInValue(val reflect.Value) []*models.Reference {
-	var refs []*models.Reference
-
-	// Dereference pointers in order to simplify things
-	if val.Kind() == reflect.Ptr {
-		val = val.Elem()
-	}
-
-	// Make sure it's a valid thing, else return right away
-	if !val.IsValid() {
-		return refs
-	}
-
-	// Handle it if it's a ref, otherwise iterate its members for refs
-	if val.Type() == reflect.TypeOf(models.Reference{}) {
-		refs = append(refs, val.Addr().Interface().(*models.Reference))
-	} else if val.Kind() == reflect.Struct {
-		for i := 0; i < val.NumField(); i++ {
-			subRefs := findRefsInValue(val.Field(i))
-			refs = append(refs, subRefs...)
-		}
-	} else if val.Kind() == reflect.Slice {
-		for i := 0; i < val.Len(); i++ {
-			subRefs := findRefsInValue(val.Index(i))
-			refs = append(refs, subRefs...)
-		}
-	}
-
-	return refs
-}
-
 func isConditional(entry *models.BundleEntryComponent) bool {
 	if entry.Request == nil {
 		return false
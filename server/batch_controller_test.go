@@ -759,6 +759,61 @@ func (s *BatchControllerSuite) TestAllSupportedMethodsBundle(c *C) {
 	s.checkReference(c, responseBundle.Entry[4].Resource.(*models.Condition).Patient, patientID, "Patient")
 }
 
+func (s *BatchControllerSuite) TestPutEntriesWithClientAssignedIDs(c *C) {
+	bundle := `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [
+			{
+				"fullUrl": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e3009a5d12",
+				"resource": {"resourceType": "Patient", "gender": "female"},
+				"request": {"method": "PUT", "url": "Patient/example"}
+			},
+			{
+				"resource": {"resourceType": "Condition", "verificationStatus": "confirmed", "patient": {"reference": "Patient/example"}},
+				"request": {"method": "PUT", "url": "Condition/ehr-12.34"}
+			}
+		]
+	}`
+
+	res, err := http.Post(s.Server.URL+"/", "application/json", strings.NewReader(bundle))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	responseBundle := &models.Bundle{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(responseBundle))
+	c.Assert(responseBundle.Entry, HasLen, 2)
+	c.Assert(responseBundle.Entry[0].FullUrl, Equals, s.Server.URL+"/Patient/example")
+	c.Assert(responseBundle.Entry[0].Response.Status, Equals, "201")
+	c.Assert(responseBundle.Entry[1].FullUrl, Equals, s.Server.URL+"/Condition/ehr-12.34")
+
+	condition := &models.Condition{}
+	util.CheckErr(s.Database.C("conditions").FindId("ehr-12.34").One(condition))
+	s.checkReference(c, condition.Patient, "example", "Patient")
+}
+
+func (s *BatchControllerSuite) TestPutEntryWithInvalidID(c *C) {
+	bundle := `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [
+			{
+				"resource": {"resourceType": "Patient", "gender": "female"},
+				"request": {"method": "PUT", "url": "Patient/not_valid"}
+			}
+		]
+	}`
+
+	res, err := http.Post(s.Server.URL+"/", "application/json", strings.NewReader(bundle))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+	oo := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(oo))
+	c.Assert(oo.Issue, HasLen, 1)
+	c.Assert(oo.Issue[0].Severity, Equals, "error")
+	c.Assert(oo.Issue[0].Code, Equals, "invalid")
+}
+
 func (s *BatchControllerSuite) checkReference(c *C, ref *models.Reference, id string, typ string) {
 	c.Assert(ref.ReferencedID, Equals, id)
 	c.Assert(ref.Type, Equals, typ)
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+)
+
+// MIMEOctetStream is the content type used for Binary resources that don't specify one
+const MIMEOctetStream = "application/octet-stream"
+
+// isFHIRMediaType indicates if the passed in media type (with or without parameters) is one of the FHIR media types.
+// Generic types like application/json and text/xml aren't FHIR types, since browsers ask for them and documents like
+// C-CDAs are sent as them.
+func isFHIRMediaType(mediaType string) bool {
+	if i := strings.Index(mediaType, ";"); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+	switch strings.ToLower(strings.TrimSpace(mediaType)) {
+	case MIMEJSONFHIR, MIMEXMLFHIR, "application/fhir+json", "application/fhir+xml":
+		return true
+	}
+	return false
+}
+
+// wantsRawBinary indicates if the request is for the raw content of a Binary resource rather than its FHIR
+// representation.  This is the case whenever the request specifies an Accept header that doesn't include any FHIR
+// formats (and doesn't specify the _format parameter).
+func wantsRawBinary(r *http.Request) bool {
+	if r.URL.Query().Get("_format") != "" {
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return false
+	}
+	for _, mediaType := range strings.Split(accept, ",") {
+		if isFHIRMediaType(mediaType) {
+			return false
+		}
+	}
+	return true
+}
+
+// bindRawBinary populates the binary using the raw request body, base64 encoding the body as its content.  Since
+// clients used to send Binary resources as application/json, a JSON body holding a Binary resource is still read as
+// the resource rather than as raw content.
+func bindRawBinary(c *gin.Context, binary *models.Binary) error {
+	data, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+	if c.ContentType() == gin.MIMEJSON && isBinaryResource(data) {
+		return json.Unmarshal(data, binary)
+	}
+
+	binary.ResourceType = "Binary"
+	binary.ContentType = c.Request.Header.Get("Content-Type")
+	if binary.ContentType == "" {
+		binary.ContentType = MIMEOctetStream
+	}
+	binary.Content = base64.StdEncoding.EncodeToString(data)
+	return nil
+}
+
+// isBinaryResource indicates if the JSON data is a FHIR Binary resource
+func isBinaryResource(data []byte) bool {
+	var resource struct {
+		ResourceType string `json:"resourceType"`
+	}
+	return json.Unmarshal(data, &resource) == nil && resource.ResourceType == "Binary"
+}
+
+// writeRawBinary responds with the decoded content of the binary, using the binary's content type.
+func writeRawBinary(c *gin.Context, binary *models.Binary) {
+	data, err := base64.StdEncoding.DecodeString(binary.Content)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	contentType := binary.ContentType
+	if contentType == "" {
+		contentType = MIMEOctetStream
+	}
+
+	// The content is arbitrary and served from the server's origin, so don't let browsers run any of it
+	c.Header("Content-Security-Policy", "sandbox")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// streamRawBinary responds with the content of the Binary identified by the request's ID, streaming it from the
+// DataAccessLayer.  It returns false, without responding, if the content isn't stored separately from the Binary and
+// must be read normally instead.
+func streamRawBinary(c *gin.Context, streamer BinaryStreamer) bool {
+	content, contentType, err := streamer.OpenBinaryContent(c.Param("id"))
+	if err == ErrNotFound || err == ErrInvalidID {
+		// let the normal read report it
+		return false
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return true
+	}
+	if content == nil {
+		return false
+	}
+	defer content.Close()
+
+	if contentType == "" {
+		contentType = MIMEOctetStream
+	}
+
+	c.Set("Resource", "Binary")
+	c.Header("Content-Security-Policy", "sandbox")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Type", contentType)
+	c.Status(http.StatusOK)
+	io.Copy(c.Writer, content)
+	return true
+}
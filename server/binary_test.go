@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type BinarySuite struct {
+	Database *mgo.Database
+	Session  *mgo.Session
+	Engine   *gin.Engine
+	Server   *httptest.Server
+}
+
+var _ = Suite(&BinarySuite{})
+
+var pngBytes = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0xff}
+
+func (s *BinarySuite) SetUpSuite(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+
+	// Set up the database
+	var err error
+	s.Session, err = mgo.Dial("localhost")
+	util.CheckErr(err)
+	s.Database = s.Session.DB("fhir-test")
+
+	// Build routes for testing
+	s.Engine = gin.New()
+	RegisterRoutes(s.Engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.Database), Config{})
+
+	// Create httptest server
+	s.Server = httptest.NewServer(s.Engine)
+}
+
+func (s *BinarySuite) TearDownTest(c *C) {
+	s.Database.C("binaries").DropCollection()
+}
+
+func (s *BinarySuite) TearDownSuite(c *C) {
+	s.Database.DropDatabase()
+	s.Session.Close()
+	s.Server.Close()
+}
+
+func (s *BinarySuite) TestCreateFromRawContent(c *C) {
+	res, err := http.Post(s.Server.URL+"/Binary", "image/png", bytes.NewReader(pngBytes))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+
+	created := &models.Binary{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(created))
+	res.Body.Close()
+	c.Assert(created.ContentType, Equals, "image/png")
+	c.Assert(created.Content, Equals, base64.StdEncoding.EncodeToString(pngBytes))
+
+	stored := &models.Binary{}
+	util.CheckErr(s.Database.C("binaries").FindId(created.Id).One(stored))
+	c.Assert(stored.ContentType, Equals, "image/png")
+	c.Assert(stored.Content, Equals, created.Content)
+}
+
+func (s *BinarySuite) TestCreateFromFHIRContent(c *C) {
+	body := `{"resourceType":"Binary","contentType":"text/plain","content":"` + base64.StdEncoding.EncodeToString([]byte("hello")) + `"}`
+	res, err := http.Post(s.Server.URL+"/Binary", "application/json+fhir", strings.NewReader(body))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+
+	created := &models.Binary{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(created))
+	res.Body.Close()
+	c.Assert(created.ContentType, Equals, "text/plain")
+	c.Assert(created.Content, Equals, base64.StdEncoding.EncodeToString([]byte("hello")))
+}
+
+func (s *BinarySuite) TestCreateFromGenericJSONContent(c *C) {
+	// A Binary resource sent as application/json is still read as the resource
+	body := `{"resourceType":"Binary","contentType":"text/plain","content":"` + base64.StdEncoding.EncodeToString([]byte("hello")) + `"}`
+	res, err := http.Post(s.Server.URL+"/Binary", "application/json", strings.NewReader(body))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+	created := &models.Binary{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(created))
+	res.Body.Close()
+	c.Assert(created.ContentType, Equals, "text/plain")
+	c.Assert(created.Content, Equals, base64.StdEncoding.EncodeToString([]byte("hello")))
+
+	// Other JSON is raw content
+	document := `{"title": "Summary"}`
+	res, err = http.Post(s.Server.URL+"/Binary", "application/json", strings.NewReader(document))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+	created = &models.Binary{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(created))
+	res.Body.Close()
+	c.Assert(created.ContentType, Equals, "application/json")
+	c.Assert(created.Content, Equals, base64.StdEncoding.EncodeToString([]byte(document)))
+}
+
+func (s *BinarySuite) TestCreateFromRawXMLContent(c *C) {
+	document := `<ClinicalDocument xmlns="urn:hl7-org:v3"><title>Summary</title></ClinicalDocument>`
+	res, err := http.Post(s.Server.URL+"/Binary", "text/xml", strings.NewReader(document))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+
+	created := &models.Binary{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(created))
+	res.Body.Close()
+	c.Assert(created.ContentType, Equals, "text/xml")
+	c.Assert(created.Content, Equals, base64.StdEncoding.EncodeToString([]byte(document)))
+}
+
+func (s *BinarySuite) TestUpdateFromRawContent(c *C) {
+	id := s.insertBinary("image/png", pngBytes)
+
+	req, err := http.NewRequest("PUT", s.Server.URL+"/Binary/"+id, strings.NewReader("plain text"))
+	util.CheckErr(err)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	stored := &models.Binary{}
+	util.CheckErr(s.Database.C("binaries").FindId(id).One(stored))
+	c.Assert(stored.ContentType, Equals, "text/plain; charset=utf-8")
+	c.Assert(stored.Content, Equals, base64.StdEncoding.EncodeToString([]byte("plain text")))
+}
+
+func (s *BinarySuite) TestReadRawContent(c *C) {
+	id := s.insertBinary("image/png", pngBytes)
+
+	res := s.get(c, "/Binary/"+id, "image/png,image/*;q=0.8,*/*;q=0.5")
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "image/png")
+	data, err := ioutil.ReadAll(res.Body)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(data, DeepEquals, pngBytes)
+
+	// Browsers navigating to the Binary get its raw content too
+	res = s.get(c, "/Binary/"+id, "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8")
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "image/png")
+	res.Body.Close()
+}
+
+func (s *BinarySuite) TestReadFHIRContent(c *C) {
+	id := s.insertBinary("image/png", pngBytes)
+
+	for _, accept := range []string{"", "application/json+fhir", "application/fhir+json"} {
+		res := s.get(c, "/Binary/"+id, accept)
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+		c.Assert(strings.HasPrefix(res.Header.Get("Content-Type"), "application/json"), Equals, true)
+		binary := &models.Binary{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(binary))
+		res.Body.Close()
+		c.Assert(binary.ContentType, Equals, "image/png")
+		c.Assert(binary.Content, Equals, base64.StdEncoding.EncodeToString(pngBytes))
+	}
+
+	// The _format parameter also asks for the FHIR representation
+	res := s.get(c, "/Binary/"+id+"?_format=json", "image/png")
+	c.Assert(strings.HasPrefix(res.Header.Get("Content-Type"), "application/json"), Equals, true)
+	res.Body.Close()
+}
+
+func (s *BinarySuite) TestWantsRawBinary(c *C) {
+	for accept, expected := range map[string]bool{
+		"":                                    false,
+		"*/*":                                 true,
+		"image/png":                           true,
+		"text/html,application/xhtml+xml,*/*": true,
+		"application/json+fhir":               false,
+		"application/fhir+xml;q=0.9, */*":     false,
+		"application/xml":                     true,
+		"application/json":                    true,
+		// The Accept header sent by browsers when navigating to a page
+		"text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8": true,
+	} {
+		r, _ := http.NewRequest("GET", "/Binary/123", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		c.Assert(wantsRawBinary(r), Equals, expected, Commentf("Accept: %s", accept))
+	}
+}
+
+func (s *BinarySuite) insertBinary(contentType string, data []byte) string {
+	binary := &models.Binary{ContentType: contentType, Content: base64.StdEncoding.EncodeToString(data)}
+	binary.Id = bson.NewObjectId().Hex()
+	util.CheckErr(s.Database.C("binaries").Insert(binary))
+	return binary.Id
+}
+
+func (s *BinarySuite) get(c *C, path string, accept string) *http.Response {
+	req, err := http.NewRequest("GET", s.Server.URL+path, nil)
+	util.CheckErr(err)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	return res
+}
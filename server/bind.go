@@ -3,6 +3,7 @@ package server
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
+	"github.com/intervention-engine/fhir/models"
 )
 
 const (
@@ -14,6 +15,10 @@ func FHIRBind(c *gin.Context, obj interface{}) error {
 	if c.Request.Method == "GET" {
 		return c.BindWith(obj, binding.Form)
 	}
+	// Binary resources can be sent as their raw content, using the content's own type
+	if binary, ok := obj.(*models.Binary); ok && !isFHIRMediaType(c.ContentType()) {
+		return bindRawBinary(c, binary)
+	}
 	switch c.ContentType() {
 	case MIMEJSONFHIR:
 		return c.BindJSON(obj)
@@ -0,0 +1,621 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MIMENDJSON is the content type of the files produced by a bulk data export
+const MIMENDJSON = "application/fhir+ndjson"
+
+// exportPageSize is the number of resources requested from the DataAccessLayer per search during an export
+const exportPageSize = 500
+
+// exportPatientBatchSize is the number of patient IDs ORed together when searching a patient compartment
+const exportPatientBatchSize = 50
+
+// exportExpiry is how long after its transaction time an export's files are kept, as advertised in the Expires
+// header of the status response
+const exportExpiry = 24 * time.Hour
+
+// BulkExportController implements the FHIR Bulk Data Access $export operation at the system, Patient, and Group
+// levels.  Exports are processed asynchronously: the kick-off request returns a status URL that the client polls
+// until the export completes, at which point the status URL returns a manifest listing one NDJSON file per resource
+// type.  The NDJSON files are written to, and served from, a local directory.  Finished exports, and their files, are
+// removed once they expire, the next time that any export is requested.
+type BulkExportController struct {
+	DAL       DataAccessLayer
+	OutputDir string
+
+	jobsLock sync.RWMutex
+	jobs     map[string]*exportJob
+}
+
+// NewBulkExportController creates a new BulkExportController based on the passed in DAL, writing its files to the
+// passed in output directory.  If the output directory is empty, a directory in the system's temp directory is used.
+func NewBulkExportController(dal DataAccessLayer, outputDir string) *BulkExportController {
+	if outputDir == "" {
+		outputDir = filepath.Join(os.TempDir(), "fhir-bulk-export")
+	}
+	return &BulkExportController{
+		DAL:       dal,
+		OutputDir: outputDir,
+		jobs:      make(map[string]*exportJob),
+	}
+}
+
+// ExportManifest is the response body returned by the status endpoint once an export has completed, as described
+// in the Bulk Data Access specification.
+type ExportManifest struct {
+	TransactionTime     string               `json:"transactionTime"`
+	Request             string               `json:"request"`
+	RequiresAccessToken bool                 `json:"requiresAccessToken"`
+	Output              []ExportManifestFile `json:"output"`
+	Error               []ExportManifestFile `json:"error"`
+}
+
+// ExportManifestFile describes a single NDJSON file listed in an ExportManifest.
+type ExportManifestFile struct {
+	Type  string `json:"type"`
+	URL   string `json:"url,omitempty"`
+	Count int    `json:"count,omitempty"`
+}
+
+// exportJob tracks the state of a single asynchronous export.
+type exportJob struct {
+	sync.Mutex
+	ID              string
+	Request         string
+	TransactionTime time.Time
+	Types           []string
+	Since           string
+	PatientIDs      []string
+	PatientLevel    bool
+	Tenant          string
+	Progress        string
+	Manifest        *ExportManifest
+	Err             error
+	cancelled       bool
+	dal             DataAccessLayer
+}
+
+func (j *exportJob) isCancelled() bool {
+	j.Lock()
+	defer j.Unlock()
+	return j.cancelled
+}
+
+func (j *exportJob) setProgress(progress string) {
+	j.Lock()
+	defer j.Unlock()
+	j.Progress = progress
+}
+
+func (j *exportJob) expires() time.Time {
+	return j.TransactionTime.Add(exportExpiry)
+}
+
+// SystemExportHandler handles kick-off requests to export data from all resource types on the server.
+func (b *BulkExportController) SystemExportHandler(c *gin.Context) {
+	job, ok := b.newJob(c)
+	if !ok {
+		return
+	}
+	b.kickOff(c, job)
+}
+
+// PatientExportHandler handles kick-off requests to export the patient compartments of all patients on the server.
+func (b *BulkExportController) PatientExportHandler(c *gin.Context) {
+	job, ok := b.newJob(c)
+	if !ok {
+		return
+	}
+	job.PatientLevel = true
+	b.kickOff(c, job)
+}
+
+// GroupExportHandler handles kick-off requests to export the patient compartments of the patients that are members
+// of the group identified by the request's ID.
+func (b *BulkExportController) GroupExportHandler(c *gin.Context) {
+	job, ok := b.newJob(c)
+	if !ok {
+		return
+	}
+
+	result, err := job.dal.Get(c.Param("id"), "Group")
+	if err == ErrNotFound || err == ErrInvalidID {
+		c.JSON(http.StatusNotFound, models.NewOperationOutcome("error", "not-found", "Group not found"))
+		return
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	group := result.(*models.Group)
+	job.PatientLevel = true
+	job.PatientIDs = make([]string, 0, len(group.Member))
+	for _, member := range group.Member {
+		if member.Entity != nil && member.Entity.Type == "Patient" && member.Entity.ReferencedID != "" {
+			job.PatientIDs = append(job.PatientIDs, member.Entity.ReferencedID)
+		}
+	}
+	b.kickOff(c, job)
+}
+
+// StatusHandler handles requests polling for the status of an export.  While the export is in progress, it responds
+// with 202 Accepted and an X-Progress header.  Once the export is complete, it responds with the export manifest.
+func (b *BulkExportController) StatusHandler(c *gin.Context) {
+	job := b.getJob(c, c.Param("id"))
+	if job == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	job.Lock()
+	defer job.Unlock()
+	switch {
+	case job.Err != nil:
+		c.JSON(http.StatusInternalServerError, models.NewOperationOutcome("fatal", "exception", job.Err.Error()))
+	case job.Manifest != nil:
+		c.Header("Expires", job.expires().UTC().Format(http.TimeFormat))
+		c.JSON(http.StatusOK, job.Manifest)
+	default:
+		c.Header("X-Progress", job.Progress)
+		c.Header("Retry-After", "5")
+		c.Status(http.StatusAccepted)
+	}
+}
+
+// CancelHandler handles requests to cancel an export in progress, or to signal that the client is done with the
+// files of a completed export.  In both cases, the export's files are removed.
+func (b *BulkExportController) CancelHandler(c *gin.Context) {
+	id := c.Param("id")
+	job := b.getJob(c, id)
+	if job == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	job.Lock()
+	job.cancelled = true
+	done := job.Manifest != nil || job.Err != nil
+	job.Unlock()
+
+	b.jobsLock.Lock()
+	delete(b.jobs, id)
+	b.jobsLock.Unlock()
+
+	// A job still in progress cleans up after itself when it notices the cancellation
+	if done {
+		os.RemoveAll(b.jobDir(id))
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// FileHandler serves the NDJSON files produced by an export.
+func (b *BulkExportController) FileHandler(c *gin.Context) {
+	id, file := c.Param("id"), c.Param("file")
+	if b.getJob(c, id) == nil || file != filepath.Base(file) || !strings.HasSuffix(file, ".ndjson") {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	path := filepath.Join(b.jobDir(id), file)
+	if _, err := os.Stat(path); err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Content-Type", MIMENDJSON)
+	c.File(path)
+}
+
+// newJob validates the kick-off request parameters and creates a job from them.  If the request is invalid, an
+// OperationOutcome is written to the response and ok is false.
+func (b *BulkExportController) newJob(c *gin.Context) (job *exportJob, ok bool) {
+	if !strings.Contains(c.Request.Header.Get("Prefer"), "respond-async") {
+		c.JSON(http.StatusBadRequest, models.NewOperationOutcome("error", "invalid", "The Prefer header must be set to respond-async"))
+		return nil, false
+	}
+
+	query := c.Request.URL.Query()
+	switch query.Get("_outputFormat") {
+	case "", "ndjson", "application/ndjson", MIMENDJSON:
+		// these are all supported
+	default:
+		c.JSON(http.StatusBadRequest, models.NewOperationOutcome("error", "not-supported", "Parameter \"_outputFormat\" content is invalid"))
+		return nil, false
+	}
+
+	// Exports are complete copies of the resources, so content kept outside of them is included
+	job = &exportJob{
+		ID:              bson.NewObjectId().Hex(),
+		Request:         requestURL(c.Request).String(),
+		TransactionTime: time.Now(),
+		Progress:        "queued",
+		Tenant:          TenantFromRequest(c.Request),
+		dal:             WithContext(withFullContent(context.Background()), requestDAL(c, b.DAL)),
+	}
+
+	if since := query.Get("_since"); since != "" {
+		if _, err := time.Parse(time.RFC3339, since); err != nil {
+			c.JSON(http.StatusBadRequest, models.NewOperationOutcome("error", "invalid", "Parameter \"_since\" content is invalid"))
+			return nil, false
+		}
+		job.Since = since
+	}
+
+	if types := query.Get("_type"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			t = strings.TrimSpace(t)
+			if _, ok := search.SearchParameterDictionary[t]; !ok {
+				c.JSON(http.StatusBadRequest, models.NewOperationOutcome("error", "invalid", "Parameter \"_type\" content is invalid"))
+				return nil, false
+			}
+			job.Types = append(job.Types, t)
+		}
+	}
+
+	return job, true
+}
+
+func (b *BulkExportController) kickOff(c *gin.Context, job *exportJob) {
+	if job.PatientLevel {
+		job.Types = patientCompartmentTypes(job.Types)
+	} else if len(job.Types) == 0 {
+		job.Types = allResourceTypes()
+	}
+
+	b.removeExpiredJobs(time.Now())
+	b.jobsLock.Lock()
+	b.jobs[job.ID] = job
+	b.jobsLock.Unlock()
+
+	fileBaseURL := *responseURL(c.Request, "$export-files", job.ID)
+	go b.run(job, fileBaseURL)
+
+	c.Set("Resource", "Bundle")
+	c.Set("Action", "export")
+
+	c.Header("Content-Location", responseURL(c.Request, "$export-poll-status", job.ID).String())
+	c.Status(http.StatusAccepted)
+}
+
+// getJob returns the job with the given ID, provided it belongs to the request's tenant.
+func (b *BulkExportController) getJob(c *gin.Context, id string) *exportJob {
+	b.removeExpiredJobs(time.Now())
+	b.jobsLock.RLock()
+	defer b.jobsLock.RUnlock()
+	job := b.jobs[id]
+	if job == nil || job.Tenant != TenantFromRequest(c.Request) {
+		return nil
+	}
+	return job
+}
+
+// removeExpiredJobs removes the finished jobs that have expired by the given time, along with their files.  Jobs
+// still in progress are left alone.
+func (b *BulkExportController) removeExpiredJobs(now time.Time) {
+	var expired []string
+	b.jobsLock.Lock()
+	for id, job := range b.jobs {
+		job.Lock()
+		done := job.Manifest != nil || job.Err != nil
+		job.Unlock()
+		if done && !now.Before(job.expires()) {
+			delete(b.jobs, id)
+			expired = append(expired, id)
+		}
+	}
+	b.jobsLock.Unlock()
+
+	for _, id := range expired {
+		os.RemoveAll(b.jobDir(id))
+	}
+}
+
+func (b *BulkExportController) jobDir(id string) string {
+	return filepath.Join(b.OutputDir, id)
+}
+
+// run performs the export, writing one NDJSON file per resource type to the job's directory and building the
+// manifest as it goes.
+func (b *BulkExportController) run(job *exportJob, fileBaseURL url.URL) {
+	dir := b.jobDir(job.ID)
+	manifest := &ExportManifest{
+		TransactionTime:     job.TransactionTime.UTC().Format(time.RFC3339),
+		Request:             job.Request,
+		RequiresAccessToken: false,
+		Output:              []ExportManifestFile{},
+		Error:               []ExportManifestFile{},
+	}
+
+	err := func() (err error) {
+		// The search package reports invalid searches by panicking, so convert those to errors
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("Export failed: %v", r)
+			}
+		}()
+
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		var failures []string
+		for i, resourceType := range job.Types {
+			if job.isCancelled() {
+				return nil
+			}
+			job.setProgress(fmt.Sprintf("exporting %s (%d of %d resource types)", resourceType, i+1, len(job.Types)))
+
+			fileName := resourceType + ".ndjson"
+			count, err := b.exportResourceType(job, resourceType, filepath.Join(dir, fileName))
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("Failed to export %s: %s", resourceType, err.Error()))
+				continue
+			}
+			if count > 0 {
+				manifest.Output = append(manifest.Output, ExportManifestFile{
+					Type:  resourceType,
+					URL:   fileURL(fileBaseURL, fileName),
+					Count: count,
+				})
+			}
+		}
+
+		if len(failures) > 0 {
+			if err = writeExportErrors(filepath.Join(dir, "OperationOutcome.ndjson"), failures); err != nil {
+				return err
+			}
+			manifest.Error = append(manifest.Error, ExportManifestFile{
+				Type:  "OperationOutcome",
+				URL:   fileURL(fileBaseURL, "OperationOutcome.ndjson"),
+				Count: len(failures),
+			})
+		}
+		return nil
+	}()
+
+	job.Lock()
+	defer job.Unlock()
+	if job.cancelled {
+		os.RemoveAll(dir)
+		return
+	}
+	if err != nil {
+		job.Err = err
+		job.Progress = "failed"
+		return
+	}
+	job.Manifest = manifest
+	job.Progress = "complete"
+}
+
+// exportResourceType writes all the resources of the given type that belong in the export to the file at the
+// given path, returning the number of resources written.  Files that would be empty are not kept.
+func (b *BulkExportController) exportResourceType(job *exportJob, resourceType string, path string) (count int, err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(file)
+
+	write := func(resource interface{}) error {
+		line, err := json.Marshal(resource)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(line); err != nil {
+			return err
+		}
+		count++
+		return w.WriteByte('\n')
+	}
+
+	if job.PatientLevel {
+		err = b.exportPatientCompartment(job, resourceType, write)
+	} else {
+		err = b.exportSearch(job, resourceType, url.Values{}, write)
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || count == 0 {
+		os.Remove(path)
+	}
+	return count, err
+}
+
+// exportPatientCompartment exports the resources of the given type that are in the compartments of the job's
+// patients (or of all patients, if the job doesn't specify any).
+func (b *BulkExportController) exportPatientCompartment(job *exportJob, resourceType string, write func(interface{}) error) error {
+	param := "patient"
+	if resourceType == "Patient" {
+		param = search.IDParam
+	}
+
+	patientIDs := job.PatientIDs
+	if patientIDs == nil {
+		var err error
+		if patientIDs, err = b.findAllPatientIDs(job); err != nil {
+			return err
+		}
+	}
+
+	// Since a resource may reference more than one patient, keep track of what has already been written
+	written := make(map[string]bool)
+	for start := 0; start < len(patientIDs); start += exportPatientBatchSize {
+		end := start + exportPatientBatchSize
+		if end > len(patientIDs) {
+			end = len(patientIDs)
+		}
+
+		values := make([]string, 0, end-start)
+		for _, id := range patientIDs[start:end] {
+			if param == search.IDParam {
+				values = append(values, id)
+			} else {
+				values = append(values, "Patient/"+id)
+			}
+		}
+
+		criteria := url.Values{}
+		criteria.Set(param, strings.Join(values, ","))
+		err := b.exportSearch(job, resourceType, criteria, func(resource interface{}) error {
+			if id, ok := models.GetResourceID(resource); ok {
+				if written[id] {
+					return nil
+				}
+				written[id] = true
+			}
+			return write(resource)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BulkExportController) findAllPatientIDs(job *exportJob) ([]string, error) {
+	var patientIDs []string
+	for offset := 0; ; offset += exportPageSize {
+		if job.isCancelled() {
+			return patientIDs, nil
+		}
+		query := search.Query{Resource: "Patient", Query: exportQuery(url.Values{}, "", offset)}
+		ids, err := job.dal.FindIDs(query)
+		if err != nil {
+			return nil, err
+		}
+		patientIDs = append(patientIDs, ids...)
+		if len(ids) < exportPageSize {
+			return patientIDs, nil
+		}
+	}
+}
+
+// exportSearch pages through the results of a search on the given resource type, calling write for each resource.
+func (b *BulkExportController) exportSearch(job *exportJob, resourceType string, criteria url.Values, write func(interface{}) error) error {
+	for offset := 0; ; offset += exportPageSize {
+		if job.isCancelled() {
+			return nil
+		}
+		query := search.Query{Resource: resourceType, Query: exportQuery(criteria, job.Since, offset)}
+		bundle, err := job.dal.Search(url.URL{}, query)
+		if err != nil {
+			return err
+		}
+		for _, entry := range bundle.Entry {
+			if err = write(entry.Resource); err != nil {
+				return err
+			}
+		}
+		if len(bundle.Entry) < exportPageSize {
+			return nil
+		}
+	}
+}
+
+// exportQuery builds the query string for a page of exported resources.  Results are sorted by ID so that paging
+// is stable.
+func exportQuery(criteria url.Values, since string, offset int) string {
+	params := url.Values{}
+	for k, v := range criteria {
+		params[k] = v
+	}
+	if since != "" {
+		params.Set(search.LastUpdatedParam, "ge"+since)
+	}
+	params.Set(search.SortParam, search.IDParam)
+	params.Set(search.CountParam, fmt.Sprint(exportPageSize))
+	params.Set(search.OffsetParam, fmt.Sprint(offset))
+	return params.Encode()
+}
+
+func writeExportErrors(path string, messages []string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, message := range messages {
+		if err := encoder.Encode(models.NewOperationOutcome("error", "exception", message)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fileURL(base url.URL, fileName string) string {
+	base.Path = base.Path + "/" + fileName
+	return base.String()
+}
+
+// allResourceTypes returns the names of all resource types known to the server, in alphabetical order.
+func allResourceTypes() []string {
+	types := make([]string, 0, len(search.SearchParameterDictionary))
+	for t := range search.SearchParameterDictionary {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// patientCompartmentTypes returns the resource types that are in the patient compartment, limited to the requested
+// types (if any were requested).  A resource type is considered to be in the patient compartment if it is the
+// Patient resource or it has a "patient" search parameter that references Patient.
+func patientCompartmentTypes(requested []string) []string {
+	candidates := requested
+	if len(candidates) == 0 {
+		candidates = allResourceTypes()
+	}
+
+	var types []string
+	for _, t := range candidates {
+		if t == "Patient" {
+			types = append(types, t)
+			continue
+		}
+		if param, ok := search.SearchParameterDictionary[t]["patient"]; ok && param.Type == "reference" {
+			for _, target := range param.Targets {
+				if target == "Patient" {
+					types = append(types, t)
+					break
+				}
+			}
+		}
+	}
+	return types
+}
+
+// requestURL reconstructs the full URL of the incoming request.
+func requestURL(r *http.Request) *url.URL {
+	u := responseURL(r)
+	u.Path = r.URL.Path
+	u.RawQuery = r.URL.RawQuery
+	return u
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type BulkExportSuite struct {
+	Database   *mgo.Database
+	Session    *mgo.Session
+	Engine     *gin.Engine
+	Server     *httptest.Server
+	PatientIDs []string
+	GroupID    string
+}
+
+var _ = Suite(&BulkExportSuite{})
+
+func (s *BulkExportSuite) SetUpSuite(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+
+	// Set up the database
+	var err error
+	s.Session, err = mgo.Dial("localhost")
+	util.CheckErr(err)
+	s.Database = s.Session.DB("fhir-test")
+
+	// Build routes for testing
+	s.Engine = gin.New()
+	RegisterRoutes(s.Engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.Database), Config{BulkExportDir: c.MkDir()})
+
+	// Create httptest server
+	s.Server = httptest.NewServer(s.Engine)
+}
+
+func (s *BulkExportSuite) SetUpTest(c *C) {
+	// Three patients, each with a condition, and a group containing the first two patients
+	s.PatientIDs = nil
+	group := &models.Group{Type: "person", Actual: new(bool)}
+	group.Id = bson.NewObjectId().Hex()
+	for i := 0; i < 3; i++ {
+		patient := loadPatientFromFixture("../fixtures/patient-example-a.json")
+		patient.Id = bson.NewObjectId().Hex()
+		util.CheckErr(s.Database.C("patients").Insert(patient))
+		s.PatientIDs = append(s.PatientIDs, patient.Id)
+
+		condition := &models.Condition{
+			VerificationStatus: "confirmed",
+			Patient:            &models.Reference{Reference: "Patient/" + patient.Id, Type: "Patient", ReferencedID: patient.Id, External: new(bool)},
+		}
+		condition.Id = bson.NewObjectId().Hex()
+		util.CheckErr(s.Database.C("conditions").Insert(condition))
+
+		if i < 2 {
+			group.Member = append(group.Member, models.GroupMemberComponent{
+				Entity: &models.Reference{Reference: "Patient/" + patient.Id, Type: "Patient", ReferencedID: patient.Id, External: new(bool)},
+			})
+		}
+	}
+	util.CheckErr(s.Database.C("groups").Insert(group))
+	s.GroupID = group.Id
+}
+
+func (s *BulkExportSuite) TearDownTest(c *C) {
+	s.Database.DropDatabase()
+}
+
+func (s *BulkExportSuite) TearDownSuite(c *C) {
+	s.Session.Close()
+	s.Server.Close()
+}
+
+func (s *BulkExportSuite) TestKickOffRequiresRespondAsync(c *C) {
+	res, err := http.Get(s.Server.URL + "/$export")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *BulkExportSuite) TestKickOffRejectsUnknownType(c *C) {
+	res := s.kickOff(c, "/$export?_type=Patient,Foo")
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *BulkExportSuite) TestSystemExport(c *C) {
+	manifest := s.export(c, "/$export")
+	counts := s.manifestCounts(c, manifest)
+	c.Assert(counts, DeepEquals, map[string]int{"Condition": 3, "Group": 1, "Patient": 3})
+	c.Assert(manifest.Error, HasLen, 0)
+}
+
+func (s *BulkExportSuite) TestSystemExportWithType(c *C) {
+	manifest := s.export(c, "/$export?_type=Patient")
+	c.Assert(s.manifestCounts(c, manifest), DeepEquals, map[string]int{"Patient": 3})
+}
+
+func (s *BulkExportSuite) TestSystemExportWithSince(c *C) {
+	since := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	manifest := s.export(c, "/$export?_since="+since)
+	c.Assert(manifest.Output, HasLen, 0)
+}
+
+func (s *BulkExportSuite) TestPatientExport(c *C) {
+	manifest := s.export(c, "/Patient/$export")
+	c.Assert(s.manifestCounts(c, manifest), DeepEquals, map[string]int{"Condition": 3, "Patient": 3})
+}
+
+func (s *BulkExportSuite) TestGroupExport(c *C) {
+	manifest := s.export(c, "/Group/"+s.GroupID+"/$export")
+	c.Assert(s.manifestCounts(c, manifest), DeepEquals, map[string]int{"Condition": 2, "Patient": 2})
+}
+
+func (s *BulkExportSuite) TestDeleteExport(c *C) {
+	res := s.kickOff(c, "/$export")
+	c.Assert(res.StatusCode, Equals, http.StatusAccepted)
+	statusURL := res.Header.Get("Content-Location")
+
+	req, err := http.NewRequest("DELETE", statusURL, nil)
+	util.CheckErr(err)
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusAccepted)
+
+	res, err = http.Get(statusURL)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *BulkExportSuite) TestExpiredExportsAreRemoved(c *C) {
+	export := NewBulkExportController(NewMemoryDataAccessLayer(), c.MkDir())
+	now := time.Now()
+	jobs := map[string]*exportJob{
+		"expired":     {TransactionTime: now.Add(-exportExpiry), Manifest: &ExportManifest{}},
+		"failed":      {TransactionTime: now.Add(-exportExpiry), Err: errors.New("Export failed")},
+		"in-progress": {TransactionTime: now.Add(-exportExpiry)},
+		"current":     {TransactionTime: now.Add(-time.Hour), Manifest: &ExportManifest{}},
+	}
+	for id, job := range jobs {
+		job.ID = id
+		export.jobs[id] = job
+		util.CheckErr(os.MkdirAll(export.jobDir(id), 0755))
+		util.CheckErr(ioutil.WriteFile(filepath.Join(export.jobDir(id), "Patient.ndjson"), []byte("{}\n"), 0644))
+	}
+
+	export.removeExpiredJobs(now)
+	for id := range jobs {
+		_, err := os.Stat(export.jobDir(id))
+		_, ok := export.jobs[id]
+		kept := id == "in-progress" || id == "current"
+		c.Assert(ok, Equals, kept, Commentf(id))
+		c.Assert(err == nil, Equals, kept, Commentf(id))
+	}
+}
+
+func (s *BulkExportSuite) kickOff(c *C, path string) *http.Response {
+	req, err := http.NewRequest("GET", s.Server.URL+path, nil)
+	util.CheckErr(err)
+	req.Header.Set("Accept", "application/fhir+json")
+	req.Header.Set("Prefer", "respond-async")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	return res
+}
+
+// export kicks off an export and polls its status until it completes, returning the manifest
+func (s *BulkExportSuite) export(c *C, path string) *ExportManifest {
+	res := s.kickOff(c, path)
+	c.Assert(res.StatusCode, Equals, http.StatusAccepted)
+	statusURL := res.Header.Get("Content-Location")
+	c.Assert(statusURL, Not(Equals), "")
+
+	for i := 0; i < 100; i++ {
+		res, err := http.Get(statusURL)
+		util.CheckErr(err)
+		if res.StatusCode == http.StatusAccepted {
+			c.Assert(res.Header.Get("X-Progress"), Not(Equals), "")
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+		manifest := &ExportManifest{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(manifest))
+		res.Body.Close()
+		return manifest
+	}
+
+	c.Fatal("Export did not complete")
+	return nil
+}
+
+// manifestCounts downloads each file in the manifest, verifying each line is a resource of the expected type, and
+// returns the number of resources found in each file
+func (s *BulkExportSuite) manifestCounts(c *C, manifest *ExportManifest) map[string]int {
+	counts := make(map[string]int)
+	for _, output := range manifest.Output {
+		res, err := http.Get(output.URL)
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+		c.Assert(res.Header.Get("Content-Type"), Equals, MIMENDJSON)
+
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			var resource map[string]interface{}
+			util.CheckErr(json.Unmarshal(scanner.Bytes(), &resource))
+			c.Assert(resource["resourceType"], Equals, output.Type)
+			counts[output.Type]++
+		}
+		res.Body.Close()
+		c.Assert(counts[output.Type], Equals, output.Count)
+	}
+	return counts
+}
@@ -0,0 +1,395 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// defaultImportBatchSize is the number of resources of a single type that are buffered before they are written to
+// the DataAccessLayer
+const defaultImportBatchSize = 1000
+
+// BulkImporter streams NDJSON (one resource per line) into a DataAccessLayer, writing resources in batches.  By
+// default every imported resource is assigned a new server ID and local references between imported resources are
+// rewritten to the new IDs.  To find out which resources are part of the import, the input is first spooled to a
+// temporary file, so references to resources that aren't in the import (e.g., resources already on the server) are
+// left unchanged.  A single BulkImporter may be used to import several files that refer to each other, as long as
+// each file is imported after the files it refers to.
+type BulkImporter struct {
+	DAL DataAccessLayer
+	// BatchSize is the number of resources of a single type written to the DataAccessLayer at once.  If it is zero,
+	// a default batch size is used.
+	BatchSize int
+	// KeepIDs indicates that resources should be stored using the IDs supplied in the NDJSON, leaving references
+	// unchanged.  Resources without an ID are still assigned a new one.
+	KeepIDs bool
+
+	idMap map[string]string
+}
+
+// NewBulkImporter creates a new BulkImporter based on the passed in DAL
+func NewBulkImporter(dal DataAccessLayer, keepIDs bool) *BulkImporter {
+	return &BulkImporter{
+		DAL:       dal,
+		BatchSize: defaultImportBatchSize,
+		KeepIDs:   keepIDs,
+		idMap:     make(map[string]string),
+	}
+}
+
+// ImportResult summarizes the outcome of importing an NDJSON stream.
+type ImportResult struct {
+	// Counts is the number of resources imported, keyed by resource type
+	Counts map[string]int
+	// Errors is the number of lines that could not be imported
+	Errors int
+}
+
+// importLine is a resource waiting to be written, along with the line it came from (for reporting errors)
+type importLine struct {
+	Number   int
+	Resource interface{}
+}
+
+// Import reads NDJSON resources from r and writes them to the DataAccessLayer.  Each line that can't be unmarshaled
+// to a resource, or that can't be stored, results in an OperationOutcome written as a line of NDJSON to errOut.  The
+// source is used to identify the input in those OperationOutcomes.  An error is only returned if r or errOut fail.
+func (i *BulkImporter) Import(r io.Reader, source string, errOut io.Writer) (*ImportResult, error) {
+	if i.idMap == nil {
+		i.idMap = make(map[string]string)
+	}
+	batchSize := i.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	if !i.KeepIDs {
+		spooled, err := i.spool(r)
+		if err != nil {
+			return &ImportResult{Counts: make(map[string]int)}, err
+		}
+		defer os.Remove(spooled.Name())
+		defer spooled.Close()
+		r = spooled
+	}
+
+	result := &ImportResult{Counts: make(map[string]int)}
+	encoder := json.NewEncoder(errOut)
+	reportError := func(lineNumber int, message string) error {
+		result.Errors++
+		diagnostics := fmt.Sprintf("%s line %d: %s", source, lineNumber, message)
+		return encoder.Encode(models.NewOperationOutcome("error", "processing", diagnostics))
+	}
+
+	pending := make(map[string][]importLine)
+	flush := func(resourceType string) error {
+		lines := pending[resourceType]
+		delete(pending, resourceType)
+		failures := i.write(resourceType, lines)
+		result.Counts[resourceType] += len(lines) - len(failures)
+		for _, failure := range failures {
+			if err := reportError(failure.Number, failure.Err.Error()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	reader := bufio.NewReader(r)
+	for lineNumber := 1; ; lineNumber++ {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return result, readErr
+		}
+
+		if trimmed := strings.TrimSpace(string(line)); trimmed != "" {
+			resource, err := unmarshalImportLine([]byte(trimmed))
+			if err != nil {
+				if err = reportError(lineNumber, err.Error()); err != nil {
+					return result, err
+				}
+			} else {
+				resourceType := reflect.TypeOf(resource).Elem().Name()
+				i.assignIDs(resourceType, resource)
+				pending[resourceType] = append(pending[resourceType], importLine{Number: lineNumber, Resource: resource})
+				if len(pending[resourceType]) >= batchSize {
+					if err = flush(resourceType); err != nil {
+						return result, err
+					}
+				}
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	for resourceType := range pending {
+		if err := flush(resourceType); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// spool copies the input to a temporary file, assigning new IDs to the resources in it along the way, so that
+// references to them can be rewritten even if they appear before the resources they refer to.  The returned file is
+// positioned at its beginning.
+func (i *BulkImporter) spool(r io.Reader) (*os.File, error) {
+	file, err := ioutil.TempFile("", "fhir-import")
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(io.TeeReader(r, file))
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			err = readErr
+			break
+		}
+		// Lines that aren't resources are skipped here, and reported when they are imported
+		var resource struct {
+			ResourceType string `json:"resourceType"`
+			ID           string `json:"id"`
+		}
+		if json.Unmarshal(line, &resource) == nil && resource.ResourceType != "" && resource.ID != "" {
+			i.newID(resource.ResourceType, resource.ID)
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// importFailure identifies a line whose resource could not be stored
+type importFailure struct {
+	Number int
+	Err    error
+}
+
+// write stores a batch of resources of the same type, returning the lines that failed.  If the batch as a whole
+// fails, each resource is retried individually so that the failures can be attributed to specific lines.  Since
+// resources are always stored by ID, retrying resources that were already stored is harmless.
+func (i *BulkImporter) write(resourceType string, lines []importLine) (failures []importFailure) {
+	if batchDAL, ok := i.DAL.(BatchDataAccessLayer); ok {
+		resources := make([]interface{}, len(lines))
+		for j := range lines {
+			resources[j] = lines[j].Resource
+		}
+		if err := batchDAL.PutBatch(resourceType, resources); err == nil {
+			return nil
+		}
+	}
+
+	for _, line := range lines {
+		id, _ := models.GetResourceID(line.Resource)
+		if _, err := i.DAL.Put(id, line.Resource); err != nil {
+			failures = append(failures, importFailure{Number: line.Number, Err: err})
+		}
+	}
+	return failures
+}
+
+// assignIDs sets the ID of the resource and, if new IDs are being assigned, rewrites its local references to resources
+// in the import to use their new IDs.
+func (i *BulkImporter) assignIDs(resourceType string, resource interface{}) {
+	id, _ := models.GetResourceID(resource)
+	switch {
+	case id == "":
+		id = bson.NewObjectId().Hex()
+	case !i.KeepIDs:
+		id = i.newID(resourceType, id)
+	}
+	reflect.ValueOf(resource).Elem().FieldByName("Id").SetString(id)
+
+	if i.KeepIDs {
+		return
+	}
+
+	for _, ref := range models.FindReferences(resource) {
+		if ref.External != nil && *ref.External {
+			continue
+		}
+		parts := strings.Split(ref.Reference, "/")
+		if len(parts) != 2 || parts[1] == "" {
+			continue
+		}
+		newID, ok := i.idMap[parts[0]+"/"+parts[1]]
+		if !ok {
+			continue
+		}
+		*ref = models.Reference{
+			Reference:    parts[0] + "/" + newID,
+			Display:      ref.Display,
+			Type:         parts[0],
+			ReferencedID: newID,
+			External:     new(bool),
+		}
+	}
+}
+
+// newID returns the new ID for the resource with the given type and original ID, assigning one the first time the
+// resource (or a reference to it) is encountered.
+func (i *BulkImporter) newID(resourceType, oldID string) string {
+	key := resourceType + "/" + oldID
+	id, ok := i.idMap[key]
+	if !ok {
+		id = bson.NewObjectId().Hex()
+		i.idMap[key] = id
+	}
+	return id
+}
+
+func unmarshalImportLine(line []byte) (interface{}, error) {
+	var resourceMap map[string]interface{}
+	if err := json.Unmarshal(line, &resourceMap); err != nil {
+		return nil, fmt.Errorf("Invalid JSON: %s", err.Error())
+	}
+	resourceType, _ := resourceMap["resourceType"].(string)
+	if resourceType == "" {
+		return nil, fmt.Errorf("Missing resourceType")
+	}
+	if models.StructForResourceName(resourceType) == nil {
+		return nil, fmt.Errorf("Unsupported resourceType: %s", resourceType)
+	}
+	resource := models.NewStructForResourceName(resourceType)
+	if err := json.Unmarshal(line, resource); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", resourceType, err.Error())
+	}
+	return resource, nil
+}
+
+// BulkImportController accepts NDJSON uploads via the $import operation, writing them to the DAL using a
+// BulkImporter.  Lines that fail to import are written to an NDJSON file of OperationOutcomes that is served
+// from a local directory.
+type BulkImportController struct {
+	DAL       DataAccessLayer
+	OutputDir string
+}
+
+// NewBulkImportController creates a new BulkImportController based on the passed in DAL, writing its error files to
+// the passed in output directory.  If the output directory is empty, a directory in the system's temp directory is
+// used.
+func NewBulkImportController(dal DataAccessLayer, outputDir string) *BulkImportController {
+	if outputDir == "" {
+		outputDir = filepath.Join(os.TempDir(), "fhir-bulk-import")
+	}
+	return &BulkImportController{DAL: dal, OutputDir: outputDir}
+}
+
+// ImportManifest is the response body returned once an import has completed.
+type ImportManifest struct {
+	TransactionTime string               `json:"transactionTime"`
+	Request         string               `json:"request"`
+	Output          []ExportManifestFile `json:"output"`
+	Error           []ExportManifestFile `json:"error"`
+}
+
+// ImportHandler handles requests to import the NDJSON in the request body.  Set the _keepIds parameter to true to
+// store the resources using their supplied IDs.
+func (b *BulkImportController) ImportHandler(c *gin.Context) {
+	importID := bson.NewObjectId().Hex()
+	dir := b.importDir(c, importID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	errorPath := filepath.Join(dir, "OperationOutcome.ndjson")
+	errorFile, err := os.Create(errorPath)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	transactionTime := time.Now()
+	importer := NewBulkImporter(requestDAL(c, b.DAL), c.Query("_keepIds") == "true")
+	errOut := bufio.NewWriter(errorFile)
+	result, err := importer.Import(c.Request.Body, "request", errOut)
+	if err == nil {
+		err = errOut.Flush()
+	}
+	if closeErr := errorFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	manifest := &ImportManifest{
+		TransactionTime: transactionTime.UTC().Format(time.RFC3339),
+		Request:         requestURL(c.Request).String(),
+		Output:          []ExportManifestFile{},
+		Error:           []ExportManifestFile{},
+	}
+	for _, resourceType := range allResourceTypes() {
+		if count := result.Counts[resourceType]; count > 0 {
+			manifest.Output = append(manifest.Output, ExportManifestFile{Type: resourceType, Count: count})
+		}
+	}
+	if result.Errors > 0 {
+		manifest.Error = append(manifest.Error, ExportManifestFile{
+			Type:  "OperationOutcome",
+			URL:   fileURL(*responseURL(c.Request, "$import-files", importID), "OperationOutcome.ndjson"),
+			Count: result.Errors,
+		})
+	} else {
+		os.RemoveAll(dir)
+	}
+
+	c.Set("Resource", "Bundle")
+	c.Set("Action", "import")
+
+	c.JSON(http.StatusOK, manifest)
+}
+
+// FileHandler serves the NDJSON error files produced by an import.
+func (b *BulkImportController) FileHandler(c *gin.Context) {
+	id, file := c.Param("id"), c.Param("file")
+	if !bson.IsObjectIdHex(id) || file != filepath.Base(file) || !strings.HasSuffix(file, ".ndjson") {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	path := filepath.Join(b.importDir(c, id), file)
+	if _, err := os.Stat(path); err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Content-Type", MIMENDJSON)
+	c.File(path)
+}
+
+// importDir returns the directory holding the files of the import with the given ID.  Each tenant's imports are kept
+// in a separate directory.
+func (b *BulkImportController) importDir(c *gin.Context, id string) string {
+	return filepath.Join(b.OutputDir, TenantFromRequest(c.Request), id)
+}
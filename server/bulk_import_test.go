@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type BulkImportSuite struct {
+	Database *mgo.Database
+	Session  *mgo.Session
+	Engine   *gin.Engine
+	Server   *httptest.Server
+}
+
+var _ = Suite(&BulkImportSuite{})
+
+func (s *BulkImportSuite) SetUpSuite(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+
+	// Set up the database
+	var err error
+	s.Session, err = mgo.Dial("localhost")
+	util.CheckErr(err)
+	s.Database = s.Session.DB("fhir-test")
+
+	// Build routes for testing
+	s.Engine = gin.New()
+	RegisterRoutes(s.Engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.Database), Config{BulkImportDir: c.MkDir()})
+
+	// Create httptest server
+	s.Server = httptest.NewServer(s.Engine)
+}
+
+func (s *BulkImportSuite) TearDownTest(c *C) {
+	s.Database.DropDatabase()
+}
+
+func (s *BulkImportSuite) TearDownSuite(c *C) {
+	s.Session.Close()
+	s.Server.Close()
+}
+
+func (s *BulkImportSuite) TestImportKeepingIDs(c *C) {
+	patientID, conditionID := bson.NewObjectId().Hex(), bson.NewObjectId().Hex()
+	ndjson := `{"resourceType":"Patient","id":"` + patientID + `","gender":"female"}
+{"resourceType":"Condition","id":"` + conditionID + `","patient":{"reference":"Patient/` + patientID + `"},"verificationStatus":"confirmed"}
+`
+	importer := NewBulkImporter(NewMongoDataAccessLayer(s.Database), true)
+	errOut := &bytes.Buffer{}
+	result, err := importer.Import(strings.NewReader(ndjson), "test", errOut)
+	util.CheckErr(err)
+	c.Assert(result.Counts, DeepEquals, map[string]int{"Patient": 1, "Condition": 1})
+	c.Assert(result.Errors, Equals, 0)
+	c.Assert(errOut.Len(), Equals, 0)
+
+	condition := &models.Condition{}
+	util.CheckErr(s.Database.C("conditions").FindId(conditionID).One(condition))
+	c.Assert(condition.Patient.Reference, Equals, "Patient/"+patientID)
+	c.Assert(condition.Patient.ReferencedID, Equals, patientID)
+	c.Assert(condition.Meta, NotNil)
+	c.Assert(condition.Meta.LastUpdated, NotNil)
+
+	count, err := s.Database.C("patients").FindId(patientID).Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+}
+
+func (s *BulkImportSuite) TestImportAssigningNewIDs(c *C) {
+	// The condition refers to the patient before the patient appears in the stream
+	ndjson := `{"resourceType":"Condition","id":"c1","patient":{"reference":"Patient/p1"},"verificationStatus":"confirmed"}
+{"resourceType":"Patient","id":"p1","gender":"female"}
+{"resourceType":"Condition","id":"c2","patient":{"reference":"Patient/p1"},"verificationStatus":"confirmed"}
+`
+	importer := NewBulkImporter(NewMongoDataAccessLayer(s.Database), false)
+	importer.BatchSize = 1
+	errOut := &bytes.Buffer{}
+	result, err := importer.Import(strings.NewReader(ndjson), "test", errOut)
+	util.CheckErr(err)
+	c.Assert(result.Counts, DeepEquals, map[string]int{"Patient": 1, "Condition": 2})
+	c.Assert(result.Errors, Equals, 0)
+
+	var patients []models.Patient
+	util.CheckErr(s.Database.C("patients").Find(nil).All(&patients))
+	c.Assert(patients, HasLen, 1)
+	c.Assert(bson.IsObjectIdHex(patients[0].Id), Equals, true)
+
+	var conditions []models.Condition
+	util.CheckErr(s.Database.C("conditions").Find(nil).All(&conditions))
+	c.Assert(conditions, HasLen, 2)
+	for _, condition := range conditions {
+		c.Assert(bson.IsObjectIdHex(condition.Id), Equals, true)
+		c.Assert(condition.Patient.Reference, Equals, "Patient/"+patients[0].Id)
+		c.Assert(condition.Patient.ReferencedID, Equals, patients[0].Id)
+		c.Assert(condition.Patient.Type, Equals, "Patient")
+	}
+}
+
+func (s *BulkImportSuite) TestImportAssigningNewIDsKeepsReferencesOutsideImport(c *C) {
+	ndjson := `{"resourceType":"Patient","id":"p1","gender":"female","managingOrganization":{"reference":"Organization/existing"}}
+{"resourceType":"Condition","id":"c1","patient":{"reference":"Patient/p1"},"asserter":{"reference":"Practitioner/p1"},"verificationStatus":"confirmed"}
+`
+	importer := NewBulkImporter(NewMongoDataAccessLayer(s.Database), false)
+	result, err := importer.Import(strings.NewReader(ndjson), "test", &bytes.Buffer{})
+	util.CheckErr(err)
+	c.Assert(result.Errors, Equals, 0)
+
+	patient := &models.Patient{}
+	util.CheckErr(s.Database.C("patients").Find(nil).One(patient))
+	c.Assert(patient.ManagingOrganization.Reference, Equals, "Organization/existing")
+
+	condition := &models.Condition{}
+	util.CheckErr(s.Database.C("conditions").Find(nil).One(condition))
+	c.Assert(condition.Patient.Reference, Equals, "Patient/"+patient.Id)
+	c.Assert(condition.Asserter.Reference, Equals, "Practitioner/p1")
+}
+
+func (s *BulkImportSuite) TestImportReportsBadLines(c *C) {
+	ndjson := `{"resourceType":"Patient","gender":"female"}
+this is not json
+{"gender":"male"}
+{"resourceType":"Foo"}
+
+{"resourceType":"Patient","id":"not a valid id","gender":"male"}
+{"resourceType":"Patient","birthDate":5}
+`
+	importer := NewBulkImporter(NewMongoDataAccessLayer(s.Database), true)
+	errOut := &bytes.Buffer{}
+	result, err := importer.Import(strings.NewReader(ndjson), "test", errOut)
+	util.CheckErr(err)
+	c.Assert(result.Counts, DeepEquals, map[string]int{"Patient": 1})
+	c.Assert(result.Errors, Equals, 5)
+
+	var diagnostics []string
+	scanner := bufio.NewScanner(errOut)
+	for scanner.Scan() {
+		outcome := &models.OperationOutcome{}
+		util.CheckErr(json.Unmarshal(scanner.Bytes(), outcome))
+		c.Assert(outcome.Issue, HasLen, 1)
+		diagnostics = append(diagnostics, outcome.Issue[0].Diagnostics)
+	}
+	c.Assert(diagnostics, HasLen, 5)
+	c.Assert(strings.HasPrefix(diagnostics[0], "test line 2: Invalid JSON"), Equals, true)
+	c.Assert(diagnostics[1], Equals, "test line 3: Missing resourceType")
+	c.Assert(diagnostics[2], Equals, "test line 4: Unsupported resourceType: Foo")
+	c.Assert(strings.HasPrefix(diagnostics[3], "test line 6: "), Equals, true)
+	c.Assert(strings.HasPrefix(diagnostics[4], "test line 7: Invalid Patient"), Equals, true)
+}
+
+func (s *BulkImportSuite) TestImportHandler(c *C) {
+	ndjson := `{"resourceType":"Patient","id":"p1","gender":"female"}
+{"resourceType":"Patient","id":"p2","gender":"male"}
+{"resourceType":"Foo"}
+`
+	res, err := http.Post(s.Server.URL+"/$import", MIMENDJSON, strings.NewReader(ndjson))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	manifest := &ImportManifest{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(manifest))
+	res.Body.Close()
+	c.Assert(manifest.Output, DeepEquals, []ExportManifestFile{{Type: "Patient", Count: 2}})
+	c.Assert(manifest.Error, HasLen, 1)
+	c.Assert(manifest.Error[0].Count, Equals, 1)
+
+	res, err = http.Get(manifest.Error[0].URL)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), Equals, MIMENDJSON)
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	res.Body.Close()
+	c.Assert(outcome.Issue[0].Diagnostics, Equals, "request line 3: Unsupported resourceType: Foo")
+
+	count, err := s.Database.C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 2)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+)
+
+// CascadeParam is the query parameter that requests a cascading delete.  Its only supported value is "delete".
+const CascadeParam = "_cascade"
+
+// CascadeDelete deletes the resource with the given type and ID, along with every resource that refers to it, and
+// every resource that refers to those, and so on.  Referring resources are found using the reference search
+// parameters in the search.SearchParameterDictionary, the same way _revinclude finds them.  It returns the resources
+// that were deleted, in the order that they were deleted, with the referring resources deleted first.
+func CascadeDelete(dal DataAccessLayer, resourceType, id string) ([]Referrer, error) {
+	// Since all the referrers are deleted, the deletes can bypass any integrity checks
+	dal = withoutIntegrity(dal)
+
+	// Walk the referrers breadth-first, keeping track of those already visited so cycles terminate
+	target := Referrer{ResourceType: resourceType, ID: id}
+	visited := map[string]bool{resourceType + "/" + id: true}
+	order := []Referrer{target}
+	frontier := []Referrer{target}
+	for len(frontier) > 0 {
+		byType := make(map[string][]string)
+		for _, r := range frontier {
+			byType[r.ResourceType] = append(byType[r.ResourceType], r.ID)
+		}
+
+		frontier = nil
+		for _, t := range sortedKeys(byType) {
+			referrers, err := findReferrers(dal, t, byType[t], 0)
+			if err != nil {
+				return nil, err
+			}
+			for _, referrer := range referrers {
+				key := referrer.ResourceType + "/" + referrer.ID
+				if !visited[key] {
+					visited[key] = true
+					order = append(order, referrer)
+					frontier = append(frontier, referrer)
+				}
+			}
+		}
+	}
+
+	// Delete the most distant referrers first, so a failure part way through doesn't leave dangling references
+	var deleted []Referrer
+	for i := len(order) - 1; i >= 0; i-- {
+		err := dal.Delete(order[i].ID, order[i].ResourceType)
+		if err == ErrNotFound || err == ErrInvalidID {
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, order[i])
+	}
+	return deleted, nil
+}
+
+// isCascadeDelete identifies requests for cascading deletes, which require the admin scope
+func isCascadeDelete(c *gin.Context) bool {
+	return c.Request.Method == "DELETE" && c.Query(CascadeParam) != ""
+}
+
+// cascadeDeleteHandler handles a cascading delete of the resource identified by the request, responding with an
+// OperationOutcome listing every resource that was deleted.
+func (rc *ResourceController) cascadeDeleteHandler(c *gin.Context) {
+	if cascade := c.Query(CascadeParam); cascade != "delete" {
+		oo := models.NewOperationOutcome("fatal", "not-supported", fmt.Sprintf("Unsupported %s value: %s", CascadeParam, cascade))
+		c.JSON(http.StatusBadRequest, oo)
+		return
+	}
+
+	id := c.Param("id")
+	deleted, err := CascadeDelete(rc.dal(c), rc.Name, id)
+	if abortOnOutcomeError(c, err) {
+		return
+	} else if abortOnContextError(c, err) {
+		return
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Set(rc.Name, id)
+	c.Set("Resource", rc.Name)
+	c.Set("Action", "delete")
+
+	report := &models.OperationOutcome{Issue: []models.OperationOutcomeIssueComponent{}}
+	for _, r := range deleted {
+		report.Issue = append(report.Issue, models.OperationOutcomeIssueComponent{
+			Severity:    "information",
+			Code:        "informational",
+			Diagnostics: fmt.Sprintf("Deleted %s/%s", r.ResourceType, r.ID),
+		})
+	}
+	if len(report.Issue) == 0 {
+		report = models.NewOperationOutcome("information", "informational", "No resources were deleted")
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"time"
+
 	"github.com/intervention-engine/fhir/auth"
 	"gopkg.in/mgo.v2"
 )
@@ -18,4 +20,69 @@ type Config struct {
 	// Auth determines what, if any authentication and authorization will be used
 	// by the FHIR server
 	Auth auth.Config
+	// BulkExportDir is the local directory where the NDJSON files produced by the $export operation are written
+	// and served from.  If it is empty, a directory in the system's temp directory is used.
+	BulkExportDir string
+	// BulkImportDir is the local directory where the NDJSON error files produced by the $import operation are
+	// written and served from.  If it is empty, a directory in the system's temp directory is used.
+	BulkImportDir string
+	// GridFSThreshold is the size, in bytes of base64-encoded data, above which Binary content and Attachment data
+	// are stored in GridFS rather than inline in the resource's document.  Content stored in GridFS is returned
+	// when a resource is read, but is left out of search results.  If it is zero, all content is stored inline.
+	GridFSThreshold int
+	// MultiTenant indicates that the server hosts data for several tenants, each in its own Mongo database named
+	// "fhir-" followed by the tenant ID.  It is only used if TenantResolver is nil.
+	MultiTenant bool
+	// TenantResolver maps tenants to the DataAccessLayers holding their data.  If it is set, the server is
+	// multi-tenant.
+	TenantResolver TenantResolver
+	// AllowDefaultTenant indicates that, on a multi-tenant server, requests that don't identify a tenant use the
+	// server's default database rather than being rejected.
+	AllowDefaultTenant bool
+	// TenantHeader is the name of the header identifying the tenant of requests that don't use the /t/:tenant URL
+	// prefix.  If it is empty, tenants can only be identified by the URL prefix.
+	TenantHeader string
+	// EnforceReferentialIntegrity indicates that resources may only be written if their local references resolve,
+	// and may only be deleted if no other resources refer to them.
+	EnforceReferentialIntegrity bool
+	// CursorPaging indicates that the next and previous links of search results use opaque cursors, positioned by
+	// the sort values of the results, rather than offsets.  Cursors stay fast on deep pages and don't skip or repeat
+	// results when data changes between pages.  Searches sorted on repeating elements still use offsets.
+	CursorPaging bool
+	// RequestTimeout is the longest that the server spends processing a request's data access operations before
+	// abandoning them and responding with a 503.  Mongo queries are given the remaining time as their maxTimeMS.  If
+	// it is zero, requests have no deadline.
+	RequestTimeout time.Duration
+	// Interceptors are called around the operations of the server's DataAccessLayers, keyed by the resource type
+	// that they apply to, or AllResources for those that apply to every type.
+	Interceptors map[string][]Interceptor
+	// SearchIndexes lists the search parameters whose Mongo indexes are created (or verified) at startup, as
+	// "Resource.param", or "*.param" for every resource type with that parameter.  The indexes are derived from the
+	// parameters' paths.  If it is nil, DefaultSearchIndexes are used.  The _id and meta.lastUpdated fields are
+	// always indexed.
+	SearchIndexes []string
+	// SkipSearchIndexes indicates that the server doesn't create any indexes at startup, for deployments that manage
+	// their indexes themselves.
+	SkipSearchIndexes bool
+	// MongoPoolLimit is the most sockets that the server opens to each Mongo server.  Each data access operation uses
+	// its own socket, so this limits how many operations run at once.  If it is zero, mgo's default limit is used.
+	MongoPoolLimit int
+	// MongoReadPreference determines which members of a replica set reads are sent to: "primary",
+	// "primaryPreferred", "secondary", "secondaryPreferred", or "nearest".  If it is empty, reads go to the primary.
+	MongoReadPreference string
+	// MongoWriteConcern determines how writes are acknowledged.  If it is nil, writes are acknowledged by the primary.
+	MongoWriteConcern *mgo.Safe
+	// DatabaseName is the name of the Mongo database that holds the server's data.  If it is empty, the database is
+	// named "fhir".
+	DatabaseName string
+	// ListenAddress is the TCP address that the server listens on.  If it is empty, the server listens on ":3001".
+	ListenAddress string
+	// ResourceTypes lists the resource types whose REST routes are registered.  If it is nil, the routes of every
+	// resource type are registered.  Batch requests and bulk data operations aren't restricted to these types.
+	ResourceTypes []string
+}
+
+// exposes reports whether the REST routes of the resource type are registered
+func (config Config) exposes(resourceType string) bool {
+	return config.ResourceTypes == nil || containsString(config.ResourceTypes, resourceType)
 }
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+)
+
+// WithContext returns a DataAccessLayer whose Get, Post, Put, Delete, Search, and FindIDs operations are bound to
+// the context.  If the DataAccessLayer is not a ContextDataAccessLayer, it is returned as is.
+func WithContext(ctx context.Context, dal DataAccessLayer) DataAccessLayer {
+	if binder, ok := dal.(contextBinder); ok {
+		return binder.bindContext(ctx)
+	}
+	if ctxDAL, ok := dal.(ContextDataAccessLayer); ok {
+		return &boundDataAccessLayer{DataAccessLayer: dal, ctxDAL: ctxDAL, ctx: ctx}
+	}
+	return dal
+}
+
+// fullContentKey is the context key set by withFullContent
+type fullContentKey struct{}
+
+// withFullContent returns a context under which searches also return the content that a data access layer keeps
+// outside of the resources' documents, such as Binary content stored in GridFS.  It is otherwise left out of search
+// results.
+func withFullContent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fullContentKey{}, true)
+}
+
+// contextBinder is implemented by the data access layers in this package that can bind all of their operations to a
+// context, not just those in ContextDataAccessLayer.
+type contextBinder interface {
+	bindContext(ctx context.Context) DataAccessLayer
+}
+
+type boundDataAccessLayer struct {
+	DataAccessLayer
+	ctxDAL ContextDataAccessLayer
+	ctx    context.Context
+}
+
+func (dal *boundDataAccessLayer) unwrapIntegrity() DataAccessLayer {
+	return WithContext(dal.ctx, withoutIntegrity(dal.DataAccessLayer))
+}
+
+func (dal *boundDataAccessLayer) Get(id, resourceType string) (result interface{}, err error) {
+	return dal.ctxDAL.GetContext(dal.ctx, id, resourceType)
+}
+
+func (dal *boundDataAccessLayer) Post(resource interface{}) (id string, err error) {
+	return dal.ctxDAL.PostContext(dal.ctx, resource)
+}
+
+func (dal *boundDataAccessLayer) Put(id string, resource interface{}) (createdNew bool, err error) {
+	return dal.ctxDAL.PutContext(dal.ctx, id, resource)
+}
+
+func (dal *boundDataAccessLayer) Delete(id, resourceType string) error {
+	return dal.ctxDAL.DeleteContext(dal.ctx, id, resourceType)
+}
+
+func (dal *boundDataAccessLayer) Search(baseURL url.URL, searchQuery search.Query) (*models.Bundle, error) {
+	return dal.ctxDAL.SearchContext(dal.ctx, baseURL, searchQuery)
+}
+
+func (dal *boundDataAccessLayer) FindIDs(searchQuery search.Query) ([]string, error) {
+	return dal.ctxDAL.FindIDsContext(dal.ctx, searchQuery)
+}
+
+// PutBatch passes through to the underlying DataAccessLayer, writing the resources one at a time if it is not a
+// BatchDataAccessLayer.
+func (dal *boundDataAccessLayer) PutBatch(resourceType string, resources []interface{}) error {
+	if batchDAL, ok := dal.DataAccessLayer.(BatchDataAccessLayer); ok {
+		if err := dal.ctx.Err(); err != nil {
+			return err
+		}
+		return batchDAL.PutBatch(resourceType, resources)
+	}
+	for _, resource := range resources {
+		id, _ := models.GetResourceID(resource)
+		if _, err := dal.Put(id, resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenBinaryContent passes through to the underlying DataAccessLayer, if it is a BinaryStreamer.
+func (dal *boundDataAccessLayer) OpenBinaryContent(id string) (content io.ReadCloser, contentType string, err error) {
+	if streamer, ok := dal.DataAccessLayer.(BinaryStreamer); ok {
+		return streamer.OpenBinaryContent(id)
+	}
+	return nil, "", nil
+}
+
+// TimeoutHandler middleware gives each request a deadline, after which its data access operations are abandoned.
+// The request's context is also cancelled when the client disconnects.
+func TimeoutHandler(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// abortOnContextError responds with an OperationOutcome if the error indicates that the request's context is done,
+// returning true if it was.
+func abortOnContextError(c *gin.Context, err error) bool {
+	switch err {
+	case context.DeadlineExceeded:
+		oo := models.NewOperationOutcome("error", "timeout", "The request took too long to process")
+		c.JSON(http.StatusServiceUnavailable, oo)
+		c.Abort()
+		return true
+	case context.Canceled:
+		// The client has gone away, so there's no one to respond to
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+type ContextSuite struct {
+	Database *mgo.Database
+	Session  *mgo.Session
+	DAL      DataAccessLayer
+}
+
+var _ = Suite(&ContextSuite{})
+
+func (s *ContextSuite) SetUpSuite(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+
+	var err error
+	s.Session, err = mgo.Dial("localhost")
+	util.CheckErr(err)
+	s.Database = s.Session.DB("fhir-test")
+	s.DAL = NewMongoDataAccessLayer(s.Database)
+}
+
+func (s *ContextSuite) TearDownTest(c *C) {
+	s.Database.DropDatabase()
+}
+
+func (s *ContextSuite) TearDownSuite(c *C) {
+	s.Session.Close()
+}
+
+func (s *ContextSuite) TestCancelledContext(c *C) {
+	_, err := s.DAL.Post(&models.Patient{Gender: "female"})
+	util.CheckErr(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dal := WithContext(ctx, s.DAL)
+
+	_, err = dal.Search(url.URL{Path: "/Patient"}, search.Query{Resource: "Patient"})
+	c.Assert(err, Equals, context.Canceled)
+	_, err = dal.Post(&models.Patient{Gender: "male"})
+	c.Assert(err, Equals, context.Canceled)
+
+	// Nothing was written, and the unbound DataAccessLayer is unaffected
+	count, err := s.Database.C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+	_, err = s.DAL.Search(url.URL{Path: "/Patient"}, search.Query{Resource: "Patient"})
+	c.Assert(err, IsNil)
+}
+
+func (s *ContextSuite) TestExpiredRequestTimeout(c *C) {
+	config := Config{RequestTimeout: time.Nanosecond}
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), s.DAL, config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/Patient")
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Code, Equals, "timeout")
+
+	// Batches stop before making any changes
+	body := `{"resourceType":"Bundle","type":"batch","entry":[{"resource":{"resourceType":"Patient"},"request":{"method":"POST","url":"Patient"}}]}`
+	res, err = http.Post(server.URL+"/", "application/json", strings.NewReader(body))
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusServiceUnavailable)
+	count, err := s.Database.C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 0)
+}
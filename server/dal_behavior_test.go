@@ -0,0 +1,450 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+// DALBehaviorSuite holds the tests that every DataAccessLayer implementation must pass.  Each implementation gets
+// its own suite, which embeds the DALBehaviorSuite and provides a function to create an empty DataAccessLayer with
+// the passed in config.
+type DALBehaviorSuite struct {
+	NewDAL func(c *C, config Config) DataAccessLayer
+	DAL    DataAccessLayer
+}
+
+type MemoryBehaviorSuite struct {
+	DALBehaviorSuite
+}
+
+var _ = Suite(&MemoryBehaviorSuite{DALBehaviorSuite{NewDAL: func(c *C, config Config) DataAccessLayer {
+	return NewMemoryDataAccessLayerWithConfig(config)
+}}})
+
+type SQLiteBehaviorSuite struct {
+	DALBehaviorSuite
+}
+
+var _ = Suite(&SQLiteBehaviorSuite{DALBehaviorSuite{NewDAL: func(c *C, config Config) DataAccessLayer {
+	db, err := sql.Open("sqlite3", filepath.Join(c.MkDir(), "fhir.db"))
+	util.CheckErr(err)
+	dal, err := NewSQLiteDataAccessLayerWithConfig(db, config)
+	util.CheckErr(err)
+	return dal
+}}})
+
+type MongoBehaviorSuite struct {
+	DALBehaviorSuite
+	Session *mgo.Session
+}
+
+var _ = Suite(&MongoBehaviorSuite{})
+
+func (s *MongoBehaviorSuite) SetUpSuite(c *C) {
+	var err error
+	s.Session, err = mgo.Dial("localhost")
+	util.CheckErr(err)
+	s.NewDAL = func(c *C, config Config) DataAccessLayer {
+		return NewMongoDataAccessLayerWithConfig(s.Session.DB("fhir-test"), config)
+	}
+}
+
+func (s *MongoBehaviorSuite) TearDownTest(c *C) {
+	s.Session.DB("fhir-test").DropDatabase()
+}
+
+func (s *MongoBehaviorSuite) TearDownSuite(c *C) {
+	s.Session.Close()
+}
+
+func (s *DALBehaviorSuite) SetUpTest(c *C) {
+	s.DAL = s.NewDAL(c, Config{})
+}
+
+// loadSearchTestData stores the resources used by the search tests
+func (s *DALBehaviorSuite) loadSearchTestData() {
+	data, err := ioutil.ReadFile("../fixtures/search_test_data.json")
+	util.CheckErr(err)
+	var maps []interface{}
+	util.CheckErr(json.Unmarshal(data, &maps))
+	for _, resourceMap := range maps {
+		resource := models.MapToResource(resourceMap, true)
+		id, _ := models.GetResourceID(resource)
+		util.CheckErr(s.DAL.PostWithID(id, resource))
+	}
+}
+
+func (s *DALBehaviorSuite) search(c *C, resource, query string) *models.Bundle {
+	bundle, err := s.DAL.Search(url.URL{Path: "/" + resource}, search.Query{Resource: resource, Query: query})
+	util.CheckErr(err)
+	return bundle
+}
+
+func (s *DALBehaviorSuite) TestCRUD(c *C) {
+	patient := loadPatientFromFixture("../fixtures/patient-example-a.json")
+	id, err := s.DAL.Post(patient)
+	util.CheckErr(err)
+
+	result, err := s.DAL.Get(id, "Patient")
+	util.CheckErr(err)
+	c.Assert(result.(*models.Patient).Id, Equals, id)
+	c.Assert(result.(*models.Patient).Name[0].Family, DeepEquals, patient.Name[0].Family)
+	c.Assert(result.(*models.Patient).Meta.LastUpdated, NotNil)
+
+	patient.Gender = "female"
+	createdNew, err := s.DAL.Put(id, patient)
+	util.CheckErr(err)
+	c.Assert(createdNew, Equals, false)
+	result, _ = s.DAL.Get(id, "Patient")
+	c.Assert(result.(*models.Patient).Gender, Equals, "female")
+	createdNew, err = s.DAL.Put("new-id", &models.Patient{Gender: "male"})
+	util.CheckErr(err)
+	c.Assert(createdNew, Equals, true)
+
+	err = s.DAL.PostWithID(id, loadPatientFromFixture("../fixtures/patient-example-a.json"))
+	c.Assert(mgo.IsDup(err), Equals, true)
+
+	util.CheckErr(s.DAL.Delete(id, "Patient"))
+	_, err = s.DAL.Get(id, "Patient")
+	c.Assert(err, Equals, ErrNotFound)
+	c.Assert(s.DAL.Delete(id, "Patient"), Equals, ErrNotFound)
+	_, err = s.DAL.Get("bad id!", "Patient")
+	c.Assert(err, Equals, ErrInvalidID)
+}
+
+func (s *DALBehaviorSuite) TestConditionalOperations(c *C) {
+	for i := 0; i < 3; i++ {
+		_, err := s.DAL.Post(loadPatientFromFixture("../fixtures/patient-example-a.json"))
+		util.CheckErr(err)
+	}
+	_, err := s.DAL.Post(&models.Patient{Gender: "female"})
+	util.CheckErr(err)
+
+	_, _, err = s.DAL.ConditionalPut(search.Query{Resource: "Patient", Query: "gender=male"}, &models.Patient{})
+	c.Assert(err, Equals, ErrMultipleMatches)
+	id, createdNew, err := s.DAL.ConditionalPut(search.Query{Resource: "Patient", Query: "gender=female"}, &models.Patient{Gender: "other"})
+	util.CheckErr(err)
+	c.Assert(createdNew, Equals, false)
+	ids, err := s.DAL.FindIDs(search.Query{Resource: "Patient", Query: "gender=other"})
+	util.CheckErr(err)
+	c.Assert(ids, DeepEquals, []string{id})
+
+	count, err := s.DAL.ConditionalDelete(search.Query{Resource: "Patient", Query: "gender=male"})
+	util.CheckErr(err)
+	c.Assert(count, Equals, 3)
+	ids, err = s.DAL.FindIDs(search.Query{Resource: "Patient"})
+	util.CheckErr(err)
+	c.Assert(ids, DeepEquals, []string{id})
+}
+
+func (s *DALBehaviorSuite) TestSearchCounts(c *C) {
+	s.loadSearchTestData()
+
+	// These are the counts that the MongoSearchSuite expects for the same data
+	tests := []struct {
+		Resource string
+		Query    string
+		Count    int
+	}{
+		{"ImagingStudy", "bodysite=http://snomed.info/sct|67734004", 1},
+		{"ImagingStudy", "bodysite=http://hl7.org/fhir/sid/icd-9|67734004", 0},
+		{"Encounter", "identifier=http://acme.com|1", 1},
+		{"Encounter", "identifier=http://example.com|1", 0},
+		{"Condition", "code=123641001", 2},
+		{"Condition", "onset=2012-03-01", 5},
+		{"Condition", "onset=2012-03-01T08:00-05:00", 0},
+		{"Condition", "onset=gt2012-03-01T07:05-05:00", 1},
+		{"Condition", "onset=sa2012-03-01T07:05-05:00", 1},
+		{"Condition", "onset=lt2012-03-01T07:05-05:00", 2},
+		{"Condition", "onset=eb2012-03-01T07:05-05:00", 2},
+		{"Condition", "onset=ge2012-03-01T07:05-05:00", 4},
+		{"Condition", "onset=le2012-03-01T07:05-05:00", 5},
+		{"Encounter", "date=2012-11-01T08:50-05:00", 1},
+		{"Encounter", "date=2012-11-01T07:50:00-05:00", 0},
+		{"Encounter", "date=gt2012-11-01T08:50-05:00", 2},
+		{"Encounter", "date=sa2012-11-01T08:45-05:00", 1},
+		{"Encounter", "date=lt2012-11-01T08:50-05:00", 3},
+		{"Encounter", "date=eb2012-11-01T09:00-05:00", 3},
+		{"Encounter", "date=ge2012-11-01T08:50-05:00", 2},
+		{"Encounter", "date=le2012-11-01T08:50-05:00", 4},
+		{"Immunization", "dose-sequence=1", 1},
+		{"Device", "manufacturer=Acme", 1},
+		{"Device", "manufacturer=Zinc", 0},
+		{"Patient", "name=Peterson", 0},
+		{"Patient", "address=AK", 2},
+		{"Patient", "address=CA", 0},
+		{"Observation", "value-quantity=185||lbs", 1},
+		{"Observation", "value-quantity=185||[lb_av]", 1},
+		{"Observation", "value-quantity=186||lbs", 0},
+		{"Observation", "value-quantity=185|http://unitsofmeasure.org|[lb_av]", 1},
+		{"Observation", "value-quantity=185|http://loinc.org|[lb_av]", 0},
+		{"Subscription", "url=https://biliwatch.com/customers/mount-auburn-miu/on-result", 1},
+		{"Condition", "_id=8664777288161060797", 1},
+		{"Condition", "_tag=foo|bar", 1},
+		{"Condition", "patient=4954037118555241963", 5},
+		{"Condition", "patient=Patient/4954037118555241963", 5},
+		{"Condition", "patient.gender=male", 5},
+		{"Condition", "patient.gender=female", 1},
+		{"Condition", "code=http://hl7.org/fhir/sid/icd-9|428.0,http://snomed.info/sct|981000124106,http://hl7.org/fhir/sid/icd-10|I20.0", 4},
+		{"Condition", "patient=4954037118555241963&code=http://hl7.org/fhir/sid/icd-9|428.0&onset=2012-03-01T07:00-05:00", 1},
+		{"Condition", "patient=4954037118555241963&code=http://hl7.org/fhir/sid/icd-9|428.0&onset=2012-03-01T07:05-05:00", 0},
+		{"Encounter", "type=http://www.ama-assn.org/go/cpt|99201", 3},
+	}
+	for _, test := range tests {
+		bundle := s.search(c, test.Resource, test.Query)
+		comment := Commentf("%s?%s", test.Resource, test.Query)
+		c.Assert(bundle.Entry, HasLen, test.Count, comment)
+		c.Assert(*bundle.Total, Equals, uint32(test.Count), comment)
+	}
+}
+
+func (s *DALBehaviorSuite) TestSearchPagingAndSort(c *C) {
+	s.loadSearchTestData()
+
+	bundle := s.search(c, "Condition", "_count=2&_offset=2")
+	c.Assert(bundle.Entry, HasLen, 2)
+	c.Assert(*bundle.Total, Equals, uint32(6))
+	c.Assert(getLink(bundle, "next"), Not(Equals), "")
+	bundle = s.search(c, "Condition", "_offset=10")
+	c.Assert(bundle.Entry, HasLen, 0)
+	c.Assert(*bundle.Total, Equals, uint32(6))
+
+	bundle = s.search(c, "Condition", "_sort:desc=_id")
+	c.Assert(bundle.Entry, HasLen, 6)
+	for i := 1; i < len(bundle.Entry); i++ {
+		c.Assert(bundle.Entry[i-1].Resource.(*models.Condition).Id > bundle.Entry[i].Resource.(*models.Condition).Id, Equals, true)
+	}
+	bundle = s.search(c, "Condition", "_sort=onset")
+	for i := 1; i < len(bundle.Entry); i++ {
+		prev := bundle.Entry[i-1].Resource.(*models.Condition).OnsetDateTime.Time
+		c.Assert(bundle.Entry[i].Resource.(*models.Condition).OnsetDateTime.Time.Before(prev), Equals, false)
+	}
+}
+
+func (s *DALBehaviorSuite) TestSearchCursorPagingByDate(c *C) {
+	s.loadBirthDates(c)
+
+	// Follow the next links, which must neither repeat nor skip patients
+	var ids []string
+	for _, page := range s.followCursorLinks(c, "_sort=birthdate&_count=2", "next") {
+		ids = append(ids, page...)
+	}
+	c.Assert(ids, DeepEquals, []string{"p4", "p2", "p1", "p3", "p5"})
+}
+
+func (s *DALBehaviorSuite) TestSearchCursorPagingBackward(c *C) {
+	s.loadBirthDates(c)
+
+	// Start from the last page and follow the previous links, which must return each page in order
+	bundle := s.search(c, "Patient", "_sort=-birthdate&_count=2")
+	last, err := url.Parse(getLink(bundle, "last"))
+	util.CheckErr(err)
+	pages := s.followCursorLinks(c, last.RawQuery, "previous")
+	c.Assert(pages, DeepEquals, [][]string{{"p2", "p4"}, {"p1", "p3"}, {"p5"}})
+}
+
+// loadBirthDates switches to a DAL that pages with cursors, and creates patients whose birth dates (which are stored
+// as documents) are shared by some and missing for one
+func (s *DALBehaviorSuite) loadBirthDates(c *C) {
+	s.DAL = s.NewDAL(c, Config{CursorPaging: true})
+	birthDates := map[string]string{"p1": "1980-05-01", "p2": "1975-01-15", "p3": "1980-05-01", "p4": "", "p5": "1990-12-31"}
+	for id, birthDate := range birthDates {
+		patient := &models.Patient{Gender: "female"}
+		if birthDate != "" {
+			patient.BirthDate = &models.FHIRDateTime{}
+			util.CheckErr(patient.BirthDate.UnmarshalJSON([]byte(`"` + birthDate + `"`)))
+		}
+		util.CheckErr(s.DAL.PostWithID(id, patient))
+	}
+}
+
+// followCursorLinks searches for patients with the query, and then follows the links with the passed in relation,
+// which must use cursors, returning the IDs on each page
+func (s *DALBehaviorSuite) followCursorLinks(c *C, query, relation string) [][]string {
+	var pages [][]string
+	for len(pages) < 5 {
+		bundle := s.search(c, "Patient", query)
+		var ids []string
+		for _, entry := range bundle.Entry {
+			id, _ := models.GetResourceID(entry.Resource)
+			ids = append(ids, id)
+		}
+		pages = append(pages, ids)
+
+		link := getLink(bundle, relation)
+		if link == "" {
+			break
+		}
+		u, err := url.Parse(link)
+		util.CheckErr(err)
+		c.Assert(u.Query().Get("_cursor"), Not(Equals), "")
+		query = u.RawQuery
+	}
+	return pages
+}
+
+func (s *DALBehaviorSuite) TestSearchIncludes(c *C) {
+	s.loadSearchTestData()
+
+	bundle := s.search(c, "Observation", "code=http://loinc.org|17856-6&_include=Observation:patient&_include=Observation:encounter")
+	c.Assert(bundle.Entry, HasLen, 3)
+	c.Assert(bundle.Entry[0].Search.Mode, Equals, "match")
+	included := map[string]bool{}
+	for _, entry := range bundle.Entry[1:] {
+		c.Assert(entry.Search.Mode, Equals, "include")
+		id, _ := models.GetResourceID(entry.Resource)
+		included[id] = true
+	}
+	c.Assert(included, DeepEquals, map[string]bool{"4954037118555241963": true, "6648204100111387580": true})
+
+	bundle = s.search(c, "Patient", "gender=male&_revinclude=Condition:patient&_revinclude=Encounter:patient")
+	c.Assert(bundle.Entry, HasLen, 10)
+	c.Assert(*bundle.Total, Equals, uint32(1))
+	id, _ := models.GetResourceID(bundle.Entry[0].Resource)
+	c.Assert(id, Equals, "4954037118555241963")
+}
+
+func (s *DALBehaviorSuite) TestContactSearches(c *C) {
+	_, err := s.DAL.Post(&models.Patient{Telecom: []models.ContactPoint{
+		{System: "phone", Value: "(555) 555-1234", Use: "home"},
+		{System: "email", Value: "pat@example.com", Use: "work"},
+	}})
+	util.CheckErr(err)
+	_, err = s.DAL.Post(&models.Patient{Telecom: []models.ContactPoint{
+		{System: "email", Value: "555-555-1234"},
+	}})
+	util.CheckErr(err)
+	_, err = s.DAL.Post(&models.Organization{Telecom: []models.ContactPoint{
+		{System: "fax", Value: "555.555.9876"},
+		{System: "phone", Value: "555.555.1234"},
+	}})
+	util.CheckErr(err)
+
+	tests := []struct {
+		Resource string
+		Query    string
+		Count    int
+	}{
+		{"Patient", "email=pat@example.com", 1},
+		{"Patient", "email=PAT@example.com", 1},
+		{"Patient", "email=work|pat@example.com", 1},
+		{"Patient", "email=home|pat@example.com", 0},
+		{"Patient", "phone=pat@example.com", 0},
+		{"Patient", "phone=5555551234", 1},
+		{"Patient", "phone=555.555.1234", 1},
+		{"Patient", "phone=home|555 555 1234", 1},
+		{"Patient", "phone=555555123", 0},
+		{"Patient", "telecom=pat@example.com", 1},
+		{"Patient", "telecom=555-555-1234", 2},
+		{"Patient", "telecom=5555551234", 1},
+		{"Patient", "telecom=(555) 555-1234", 1},
+		{"Organization", "telecom=555.555.9876", 1},
+		{"Organization", "telecom=5555559876", 0},
+		{"Organization", "telecom=(555) 555-1234", 1},
+		{"Organization", "phone=5555559876", 0},
+		{"Organization", "phone=5555551234", 1},
+	}
+	for _, test := range tests {
+		bundle := s.search(c, test.Resource, test.Query)
+		c.Assert(bundle.Entry, HasLen, test.Count, Commentf("%s?%s", test.Resource, test.Query))
+	}
+}
+
+func (s *DALBehaviorSuite) TestPrefixedNumberAndQuantitySearches(c *C) {
+	for _, value := range []float64{120, 140, 160} {
+		v := value
+		_, err := s.DAL.Post(&models.Observation{
+			Code:          &models.CodeableConcept{Coding: []models.Coding{{System: "http://loinc.org", Code: "8480-6"}}},
+			ValueQuantity: &models.Quantity{Value: &v, Unit: "mm[Hg]", System: "http://unitsofmeasure.org", Code: "mm[Hg]"},
+		})
+		util.CheckErr(err)
+	}
+	for _, probability := range []float64{0.5, 0.85} {
+		p := probability
+		_, err := s.DAL.Post(&models.RiskAssessment{Prediction: []models.RiskAssessmentPredictionComponent{{ProbabilityDecimal: &p}}})
+		util.CheckErr(err)
+	}
+
+	tests := []struct {
+		Resource string
+		Query    string
+		Count    int
+	}{
+		{"Observation", "value-quantity=140", 1},
+		{"Observation", "value-quantity=gt140", 1},
+		{"Observation", "value-quantity=gt139", 2},
+		{"Observation", "value-quantity=ge140", 2},
+		{"Observation", "value-quantity=lt140", 1},
+		{"Observation", "value-quantity=le140", 2},
+		{"Observation", "value-quantity=sa140", 1},
+		{"Observation", "value-quantity=eb140", 1},
+		{"Observation", "value-quantity=ne140", 2},
+		{"Observation", "value-quantity=ap130", 2},
+		{"Observation", "value-quantity=gt140||mm[Hg]", 1},
+		{"Observation", "value-quantity=gt140|http://unitsofmeasure.org|mm[Hg]", 1},
+		{"Observation", "value-quantity=gt140||kg", 0},
+		{"RiskAssessment", "probability=ge0.8", 1},
+		{"RiskAssessment", "probability=lt0.8", 1},
+		{"RiskAssessment", "probability=gt0.9", 0},
+	}
+	for _, test := range tests {
+		bundle := s.search(c, test.Resource, test.Query)
+		c.Assert(bundle.Entry, HasLen, test.Count, Commentf("%s?%s", test.Resource, test.Query))
+	}
+}
+
+func (s *DALBehaviorSuite) TestCompositeSearches(c *C) {
+	quantity := func(value float64) *models.Quantity {
+		return &models.Quantity{Value: &value, Unit: "mm[Hg]"}
+	}
+	loinc := func(code string) *models.CodeableConcept {
+		return &models.CodeableConcept{Coding: []models.Coding{{System: "http://loinc.org", Code: code}}}
+	}
+	for _, bp := range [][]float64{{150, 80}, {120, 95}} {
+		_, err := s.DAL.Post(&models.Observation{
+			Code: loinc("55284-4"),
+			Component: []models.ObservationComponentComponent{
+				{Code: loinc("8480-6"), ValueQuantity: quantity(bp[0])},
+				{Code: loinc("8462-4"), ValueQuantity: quantity(bp[1])},
+			},
+		})
+		util.CheckErr(err)
+	}
+	_, err := s.DAL.Post(&models.Observation{Code: loinc("8480-6"), ValueQuantity: quantity(150)})
+	util.CheckErr(err)
+
+	tests := []struct {
+		Query string
+		Count int
+	}{
+		{"code-value-quantity=http://loinc.org|8480-6$150", 1},
+		{"code-value-quantity=http://loinc.org|8480-6$150||mm[Hg]", 1},
+		{"code-value-quantity=http://loinc.org|8480-6$120", 0},
+		{"component-code-value-quantity=http://loinc.org|8480-6$150", 1},
+		{"component-code-value-quantity=8480-6$120||mm[Hg]", 1},
+		{"component-code-value-quantity=8480-6$gt100", 2},
+		{"component-code-value-quantity=8480-6$150,8462-4$95", 2},
+		// The code and value must be in the same component
+		{"component-code-value-quantity=8480-6$95", 0},
+		{"component-code-value-quantity=8462-4$150", 0},
+	}
+	for _, test := range tests {
+		bundle := s.search(c, "Observation", test.Query)
+		c.Assert(bundle.Entry, HasLen, test.Count, Commentf("Observation?%s", test.Query))
+	}
+}
+
+func (s *DALBehaviorSuite) TestInvalidSearchPanics(c *C) {
+	c.Assert(func() { s.search(c, "Condition", "onset=ap2012") }, PanicMatches, `.*content is invalid.*`)
+}
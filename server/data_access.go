@@ -1,8 +1,12 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net/url"
+	"regexp"
 
 	"github.com/intervention-engine/fhir/models"
 	"github.com/intervention-engine/fhir/search"
@@ -35,8 +39,77 @@ type DataAccessLayer interface {
 	FindIDs(searchQuery search.Query) (result []string, err error)
 }
 
+// BatchDataAccessLayer is an optional interface for data stores that can create or update many resources of the
+// same type in a single operation.  Bulk operations use it when the DataAccessLayer supports it.
+type BatchDataAccessLayer interface {
+	// PutBatch creates or updates the given resources, all of which must be of the given resource type and have
+	// their IDs set.
+	PutBatch(resourceType string, resources []interface{}) error
+}
+
+// BinaryStreamer is an optional interface for data stores that can keep the content of Binary resources outside of
+// the resources themselves, allowing the content to be streamed rather than loaded into memory.
+type BinaryStreamer interface {
+	// OpenBinaryContent opens the decoded content of the Binary resource with the given ID, also returning its content
+	// type.  If the Binary's content is stored in the resource itself, content is nil.  Callers must close content.
+	OpenBinaryContent(id string) (content io.ReadCloser, contentType string, err error)
+}
+
+// ContextDataAccessLayer is an optional interface for data stores whose operations can be cancelled or given a
+// deadline using a context.  Use WithContext to bind a context to a DataAccessLayer.  Operations that are cut short
+// return the context's error.
+type ContextDataAccessLayer interface {
+	// GetContext is Get, bound to the context
+	GetContext(ctx context.Context, id, resourceType string) (result interface{}, err error)
+	// PostContext is Post, bound to the context
+	PostContext(ctx context.Context, resource interface{}) (id string, err error)
+	// PutContext is Put, bound to the context
+	PutContext(ctx context.Context, id string, resource interface{}) (createdNew bool, err error)
+	// DeleteContext is Delete, bound to the context
+	DeleteContext(ctx context.Context, id, resourceType string) error
+	// SearchContext is Search, bound to the context
+	SearchContext(ctx context.Context, baseURL url.URL, searchQuery search.Query) (result *models.Bundle, err error)
+	// FindIDsContext is FindIDs, bound to the context
+	FindIDsContext(ctx context.Context, searchQuery search.Query) (result []string, err error)
+}
+
 // ErrNotFound indicates an error
 var ErrNotFound = errors.New("Resource Not Found")
 
+// ErrInvalidID indicates that a resource ID does not meet the requirements of the FHIR specification
+var ErrInvalidID = errors.New("Id must be 1 to 64 letters, digits, '-' or '.'")
+
+// validIDRegex matches the resource IDs allowed by the FHIR specification
+var validIDRegex = regexp.MustCompile(`^[A-Za-z0-9\-\.]{1,64}$`)
+
+// validateID returns ErrInvalidID if the passed in ID is not a valid FHIR resource ID.  Any valid ID can be assigned
+// by clients, but IDs assigned by the server are always BSON ObjectIds.
+func validateID(id string) error {
+	if !validIDRegex.MatchString(id) {
+		return ErrInvalidID
+	}
+	return nil
+}
+
 // ErrMultipleMatches indicates that the conditional update query returned multiple matches
 var ErrMultipleMatches = errors.New("Multiple Matches")
+
+// OutcomeError indicates that an operation was rejected, such as by the referential integrity checks or an
+// interceptor.  The server responds with its HTTP status and OperationOutcome.
+type OutcomeError struct {
+	HTTPStatus       int
+	OperationOutcome *models.OperationOutcome
+}
+
+// NewOutcomeError returns an OutcomeError with the HTTP status, whose OperationOutcome has a single issue with the
+// code and diagnostics.
+func NewOutcomeError(httpStatus int, code, diagnostics string) *OutcomeError {
+	return &OutcomeError{
+		HTTPStatus:       httpStatus,
+		OperationOutcome: models.NewOperationOutcome("error", code, diagnostics),
+	}
+}
+
+func (e *OutcomeError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.HTTPStatus, e.OperationOutcome.Error())
+}
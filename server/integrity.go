@@ -0,0 +1,407 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+)
+
+// maxListedReferrers is the maximum number of referrers listed when a delete is rejected
+const maxListedReferrers = 100
+
+// integrityIDBatchSize is the number of referenced resources ORed together when searching for their referrers
+const integrityIDBatchSize = 50
+
+// integrityPageSize is the number of IDs requested from the DataAccessLayer per search when paging through referrers
+const integrityPageSize = 500
+
+// Referrer identifies a resource that refers to another resource, and the search parameter through which it does.
+type Referrer struct {
+	ResourceType string
+	ID           string
+	Param        string
+}
+
+// NewIntegrityDataAccessLayer returns a DataAccessLayer that enforces referential integrity on top of the passed in
+// DataAccessLayer.  Resources can only be written if all of their local references resolve, and resources can only
+// be deleted if no other resources refer to them.  Referring resources are found using the reference search
+// parameters in the search.SearchParameterDictionary, so references that can't be searched on do not prevent
+// deletes.  Entries of a batch may refer to resources written by any other entry of the batch, in any order.
+func NewIntegrityDataAccessLayer(dal DataAccessLayer) DataAccessLayer {
+	return &integrityDataAccessLayer{DataAccessLayer: dal}
+}
+
+type integrityDataAccessLayer struct {
+	DataAccessLayer
+	// pending holds the resources, as "Type/id", that the current batch is about to write
+	pending map[string]bool
+}
+
+func (dal *integrityDataAccessLayer) bindContext(ctx context.Context) DataAccessLayer {
+	pending, _ := ctx.Value(pendingResourcesKey{}).(map[string]bool)
+	return &integrityDataAccessLayer{DataAccessLayer: WithContext(ctx, dal.DataAccessLayer), pending: pending}
+}
+
+func (dal *integrityDataAccessLayer) unwrapIntegrity() DataAccessLayer {
+	return withoutIntegrity(dal.DataAccessLayer)
+}
+
+// integrityUnwrapper is implemented by the data access layers in this package that enforce referential integrity,
+// or wrap one that might.  Wrappers return a copy of themselves wrapping the unwrapped DataAccessLayer, so that
+// their own behavior is kept.
+type integrityUnwrapper interface {
+	unwrapIntegrity() DataAccessLayer
+}
+
+// withoutIntegrity returns the DataAccessLayer with any referential integrity checks removed from it
+func withoutIntegrity(dal DataAccessLayer) DataAccessLayer {
+	if unwrapper, ok := dal.(integrityUnwrapper); ok {
+		return unwrapper.unwrapIntegrity()
+	}
+	return dal
+}
+
+// pendingResourcesKey is the context key set by withPendingResources
+type pendingResourcesKey struct{}
+
+// withPendingResources returns a context under which references to the given resources, identified as "Type/id",
+// are treated as resolved.  Batches use it for the resources they are about to write, since an entry may refer to a
+// resource that is written after it.
+func withPendingResources(ctx context.Context, pending map[string]bool) context.Context {
+	return context.WithValue(ctx, pendingResourcesKey{}, pending)
+}
+
+func (dal *integrityDataAccessLayer) Post(resource interface{}) (id string, err error) {
+	if err = dal.checkReferences(resource); err != nil {
+		return "", err
+	}
+	return dal.DataAccessLayer.Post(resource)
+}
+
+func (dal *integrityDataAccessLayer) PostWithID(id string, resource interface{}) error {
+	if err := dal.checkReferences(resource, id); err != nil {
+		return err
+	}
+	return dal.DataAccessLayer.PostWithID(id, resource)
+}
+
+func (dal *integrityDataAccessLayer) Put(id string, resource interface{}) (createdNew bool, err error) {
+	if err = dal.checkReferences(resource, id); err != nil {
+		return false, err
+	}
+	return dal.DataAccessLayer.Put(id, resource)
+}
+
+func (dal *integrityDataAccessLayer) ConditionalPut(query search.Query, resource interface{}) (id string, createdNew bool, err error) {
+	// The ID isn't known until the conditional is resolved, so a resource referring to itself is rejected
+	if err = dal.checkReferences(resource); err != nil {
+		return "", false, err
+	}
+	return dal.DataAccessLayer.ConditionalPut(query, resource)
+}
+
+func (dal *integrityDataAccessLayer) Delete(id, resourceType string) error {
+	referrers, err := findReferrers(dal.DataAccessLayer, resourceType, []string{id}, maxListedReferrers)
+	if err != nil {
+		return err
+	}
+	if len(referrers) > 0 {
+		return newReferrersError(resourceType, referrers)
+	}
+	return dal.DataAccessLayer.Delete(id, resourceType)
+}
+
+func (dal *integrityDataAccessLayer) ConditionalDelete(query search.Query) (count int, err error) {
+	ids, err := findAllIDs(dal.DataAccessLayer, query)
+	if err != nil {
+		return 0, err
+	}
+	referrers, err := findReferrers(dal.DataAccessLayer, query.Resource, ids, maxListedReferrers)
+	if err != nil {
+		return 0, err
+	}
+	if len(referrers) > 0 {
+		return 0, newReferrersError(query.Resource, referrers)
+	}
+	return dal.DataAccessLayer.ConditionalDelete(query)
+}
+
+// PutBatch checks the references of all the resources before writing any of them.  If the underlying
+// DataAccessLayer can't write batches, the resources are written one at a time.
+func (dal *integrityDataAccessLayer) PutBatch(resourceType string, resources []interface{}) error {
+	for _, resource := range resources {
+		id, _ := models.GetResourceID(resource)
+		if err := dal.checkReferences(resource, id); err != nil {
+			return err
+		}
+	}
+
+	if batchDAL, ok := dal.DataAccessLayer.(BatchDataAccessLayer); ok {
+		return batchDAL.PutBatch(resourceType, resources)
+	}
+	for _, resource := range resources {
+		id, _ := models.GetResourceID(resource)
+		if _, err := dal.DataAccessLayer.Put(id, resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenBinaryContent passes through to the underlying DataAccessLayer, if it is a BinaryStreamer.
+func (dal *integrityDataAccessLayer) OpenBinaryContent(id string) (content io.ReadCloser, contentType string, err error) {
+	if streamer, ok := dal.DataAccessLayer.(BinaryStreamer); ok {
+		return streamer.OpenBinaryContent(id)
+	}
+	return nil, "", nil
+}
+
+// checkReferences returns an OutcomeError if any of the resource's local references don't resolve.  References
+// from the resource to itself (identified by the optional ID) and to resources pending in the same batch are allowed.
+func (dal *integrityDataAccessLayer) checkReferences(resource interface{}, selfID ...string) error {
+	resourceType := reflect.TypeOf(resource).Elem().Name()
+
+	// Group the referenced IDs by type so each type can be checked with a single search
+	referenced := make(map[string]map[string]bool)
+	for _, ref := range models.FindReferences(resource) {
+		if ref.External != nil && *ref.External {
+			continue
+		}
+		if ref.Type == "" || ref.ReferencedID == "" || strings.HasPrefix(ref.Reference, "#") {
+			continue
+		}
+		if len(selfID) > 0 && ref.Type == resourceType && ref.ReferencedID == selfID[0] {
+			continue
+		}
+		if dal.pending[ref.Type+"/"+ref.ReferencedID] {
+			continue
+		}
+		if referenced[ref.Type] == nil {
+			referenced[ref.Type] = make(map[string]bool)
+		}
+		referenced[ref.Type][ref.ReferencedID] = true
+	}
+
+	var unresolved []string
+	for _, refType := range sortedKeys(referenced) {
+		ids := sortedKeys(referenced[refType])
+		found := make(map[string]bool)
+		if _, ok := search.SearchParameterDictionary[refType]; ok {
+			var valid []string
+			for _, id := range ids {
+				if validateID(id) == nil {
+					valid = append(valid, id)
+				}
+			}
+			if len(valid) > 0 {
+				query := search.Query{
+					Resource: refType,
+					Query:    url.Values{search.IDParam: {strings.Join(valid, ",")}, search.CountParam: {fmt.Sprint(len(valid))}}.Encode(),
+				}
+				foundIDs, err := findIDs(dal.DataAccessLayer, query)
+				if err != nil {
+					return err
+				}
+				for _, id := range foundIDs {
+					found[id] = true
+				}
+			}
+		}
+		for _, id := range ids {
+			if !found[id] {
+				unresolved = append(unresolved, refType+"/"+id)
+			}
+		}
+	}
+
+	if len(unresolved) == 0 {
+		return nil
+	}
+	outcome := &models.OperationOutcome{}
+	for _, ref := range unresolved {
+		outcome.Issue = append(outcome.Issue, models.OperationOutcomeIssueComponent{
+			Severity:    "error",
+			Code:        "not-found",
+			Diagnostics: fmt.Sprintf("Reference to %s does not resolve", ref),
+		})
+	}
+	return &OutcomeError{HTTPStatus: http.StatusUnprocessableEntity, OperationOutcome: outcome}
+}
+
+func newReferrersError(resourceType string, referrers []Referrer) *OutcomeError {
+	outcome := &models.OperationOutcome{}
+	for _, referrer := range referrers {
+		outcome.Issue = append(outcome.Issue, models.OperationOutcomeIssueComponent{
+			Severity:    "error",
+			Code:        "conflict",
+			Diagnostics: fmt.Sprintf("%s/%s refers to this %s (%s)", referrer.ResourceType, referrer.ID, resourceType, referrer.Param),
+		})
+	}
+	if len(referrers) >= maxListedReferrers {
+		outcome.Issue = append(outcome.Issue, models.OperationOutcomeIssueComponent{
+			Severity:    "information",
+			Code:        "conflict",
+			Diagnostics: fmt.Sprintf("Only the first %d referring resources are listed", maxListedReferrers),
+		})
+	}
+	return &OutcomeError{HTTPStatus: http.StatusConflict, OperationOutcome: outcome}
+}
+
+// reverseReference identifies a reference search parameter that can refer to a given resource type
+type reverseReference struct {
+	Resource string
+	Param    string
+}
+
+// reverseReferences maps each resource type to the reference search parameters that can refer to it
+var reverseReferences = buildReverseReferences()
+
+func buildReverseReferences() map[string][]reverseReference {
+	reverse := make(map[string][]reverseReference)
+	for _, resourceType := range allResourceTypes() {
+		params := search.SearchParameterDictionary[resourceType]
+		names := make([]string, 0, len(params))
+		for name := range params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			param := params[name]
+			if param.Type != "reference" {
+				continue
+			}
+			for _, target := range param.Targets {
+				if target == "Any" {
+					for _, t := range allResourceTypes() {
+						reverse[t] = append(reverse[t], reverseReference{Resource: resourceType, Param: name})
+					}
+				} else {
+					reverse[target] = append(reverse[target], reverseReference{Resource: resourceType, Param: name})
+				}
+			}
+		}
+	}
+	return reverse
+}
+
+// findReferrers finds up to limit resources that refer to any of the resources with the given type and IDs.  If limit
+// is zero, all of the referring resources are found.  Resources that are among those being referred to are not
+// counted as referrers.
+func findReferrers(dal DataAccessLayer, resourceType string, ids []string, limit int) ([]Referrer, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	excluded := make(map[string]bool)
+	for _, id := range ids {
+		excluded[resourceType+"/"+id] = true
+	}
+
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = resourceType + "/" + id
+	}
+
+	var referrers []Referrer
+	found := make(map[string]bool)
+	for _, reverse := range reverseReferences[resourceType] {
+		// Search in chunks, since the list of IDs may be long
+		for start := 0; start < len(values); start += integrityIDBatchSize {
+			end := start + integrityIDBatchSize
+			if end > len(values) {
+				end = len(values)
+			}
+
+			params := url.Values{reverse.Param: {strings.Join(values[start:end], ",")}}
+			var referrerIDs []string
+			var err error
+			if limit > 0 {
+				params.Set(search.CountParam, fmt.Sprint(limit+len(excluded)))
+				referrerIDs, err = findIDs(dal, search.Query{Resource: reverse.Resource, Query: params.Encode()})
+			} else {
+				referrerIDs, err = findAllIDs(dal, search.Query{Resource: reverse.Resource, Query: params.Encode()})
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range referrerIDs {
+				key := reverse.Resource + "/" + id
+				if excluded[key] || found[key] {
+					continue
+				}
+				found[key] = true
+				referrers = append(referrers, Referrer{ResourceType: reverse.Resource, ID: id, Param: reverse.Param})
+				if limit > 0 && len(referrers) >= limit {
+					return referrers, nil
+				}
+			}
+		}
+	}
+	return referrers, nil
+}
+
+// findAllIDs pages through the results of the query, returning all of the matching IDs.
+func findAllIDs(dal DataAccessLayer, query search.Query) ([]string, error) {
+	var ids []string
+	for offset := 0; ; offset += integrityPageSize {
+		values, err := url.ParseQuery(query.Query)
+		if err != nil {
+			return nil, err
+		}
+		values.Set(search.CountParam, fmt.Sprint(integrityPageSize))
+		values.Set(search.OffsetParam, fmt.Sprint(offset))
+		page, err := findIDs(dal, search.Query{Resource: query.Resource, Query: values.Encode()})
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, page...)
+		if len(page) < integrityPageSize {
+			return ids, nil
+		}
+	}
+}
+
+// findIDs calls FindIDs on the DataAccessLayer, converting search panics to errors.
+func findIDs(dal DataAccessLayer, query search.Query) (ids []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if searchErr, ok := r.(*search.Error); ok {
+				err = searchErr
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+	return dal.FindIDs(query)
+}
+
+// abortOnOutcomeError responds with the OperationOutcome of the error if it is an OutcomeError, returning true if it
+// was.
+func abortOnOutcomeError(c *gin.Context, err error) bool {
+	if err, ok := err.(*OutcomeError); ok {
+		c.JSON(err.HTTPStatus, err.OperationOutcome)
+		c.Abort()
+		return true
+	}
+	return false
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	result := make([]string, len(keys))
+	for i, key := range keys {
+		result[i] = key.String()
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+type IntegritySuite struct {
+	Database *mgo.Database
+	Session  *mgo.Session
+	Engine   *gin.Engine
+	Server   *httptest.Server
+}
+
+var _ = Suite(&IntegritySuite{})
+
+func (s *IntegritySuite) SetUpSuite(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+
+	// Set up the database
+	var err error
+	s.Session, err = mgo.Dial("localhost")
+	util.CheckErr(err)
+	s.Database = s.Session.DB("fhir-test")
+
+	// Build routes for testing, enforcing referential integrity
+	config := Config{EnforceReferentialIntegrity: true}
+	s.Engine = gin.New()
+	RegisterRoutes(s.Engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayerWithConfig(s.Database, config), config)
+
+	// Create httptest server
+	s.Server = httptest.NewServer(s.Engine)
+}
+
+func (s *IntegritySuite) TearDownTest(c *C) {
+	s.Database.DropDatabase()
+}
+
+func (s *IntegritySuite) TearDownSuite(c *C) {
+	s.Session.Close()
+	s.Server.Close()
+}
+
+func (s *IntegritySuite) TestWriteWithUnresolvedReference(c *C) {
+	res := s.do(c, "PUT", "/Condition/c1", `{"resourceType":"Condition","patient":{"reference":"Patient/missing"},"verificationStatus":"confirmed"}`)
+	c.Assert(res.StatusCode, Equals, http.StatusUnprocessableEntity)
+	outcome := s.decodeOutcome(c, res)
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Code, Equals, "not-found")
+	c.Assert(strings.Contains(outcome.Issue[0].Diagnostics, "Patient/missing"), Equals, true)
+
+	count, err := s.Database.C("conditions").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 0)
+}
+
+func (s *IntegritySuite) TestWriteWithResolvedReference(c *C) {
+	res := s.do(c, "PUT", "/Patient/p1", `{"resourceType":"Patient","gender":"female"}`)
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+	res = s.do(c, "POST", "/Condition", `{"resourceType":"Condition","patient":{"reference":"Patient/p1"},"verificationStatus":"confirmed"}`)
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+
+	// External and contained references aren't checked
+	res = s.do(c, "POST", "/Condition", `{"resourceType":"Condition","patient":{"reference":"http://example.org/fhir/Patient/1"},"verificationStatus":"confirmed"}`)
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+}
+
+func (s *IntegritySuite) TestBatchWithReferencesToLaterEntries(c *C) {
+	// The POST is processed before the PUT it refers to, and the Patient POST is listed after the Condition
+	bundle := `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [
+			{
+				"fullUrl": "urn:uuid:c1",
+				"resource": {"resourceType": "Condition", "patient": {"reference": "urn:uuid:p1"}, "asserter": {"reference": "Practitioner/pr1"}, "verificationStatus": "confirmed"},
+				"request": {"method": "POST", "url": "Condition"}
+			},
+			{
+				"fullUrl": "urn:uuid:p1",
+				"resource": {"resourceType": "Patient", "gender": "female"},
+				"request": {"method": "POST", "url": "Patient"}
+			},
+			{
+				"resource": {"resourceType": "Practitioner", "active": true},
+				"request": {"method": "PUT", "url": "Practitioner/pr1"}
+			}
+		]
+	}`
+	res := s.do(c, "POST", "/", bundle)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	count, err := s.Database.C("conditions").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+
+	// References to resources that neither exist nor are in the batch are still rejected
+	bundle = `{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [
+			{
+				"resource": {"resourceType": "Condition", "patient": {"reference": "Patient/missing"}, "verificationStatus": "confirmed"},
+				"request": {"method": "POST", "url": "Condition"}
+			}
+		]
+	}`
+	res = s.do(c, "POST", "/", bundle)
+	c.Assert(res.StatusCode, Equals, http.StatusUnprocessableEntity)
+}
+
+func (s *IntegritySuite) TestDeleteWithReferrers(c *C) {
+	s.do(c, "PUT", "/Patient/p1", `{"resourceType":"Patient","gender":"female"}`)
+	s.do(c, "PUT", "/Condition/c1", `{"resourceType":"Condition","patient":{"reference":"Patient/p1"},"verificationStatus":"confirmed"}`)
+
+	res := s.do(c, "DELETE", "/Patient/p1", "")
+	c.Assert(res.StatusCode, Equals, http.StatusConflict)
+	outcome := s.decodeOutcome(c, res)
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Code, Equals, "conflict")
+	c.Assert(strings.HasPrefix(outcome.Issue[0].Diagnostics, "Condition/c1 refers to this Patient"), Equals, true)
+
+	count, err := s.Database.C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+
+	// Once the referrer is gone, the delete succeeds
+	res = s.do(c, "DELETE", "/Condition/c1", "")
+	c.Assert(res.StatusCode, Equals, http.StatusNoContent)
+	res = s.do(c, "DELETE", "/Patient/p1", "")
+	c.Assert(res.StatusCode, Equals, http.StatusNoContent)
+}
+
+func (s *IntegritySuite) TestConditionalDeleteIgnoresReferrersBeingDeleted(c *C) {
+	s.do(c, "PUT", "/Patient/p1", `{"resourceType":"Patient","gender":"female"}`)
+	s.do(c, "PUT", "/Patient/p2", `{"resourceType":"Patient","gender":"female","link":[{"other":{"reference":"Patient/p1"},"type":"seealso"}]}`)
+
+	res := s.do(c, "DELETE", "/Patient?gender=female", "")
+	c.Assert(res.StatusCode, Equals, http.StatusNoContent)
+
+	count, err := s.Database.C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 0)
+}
+
+func (s *IntegritySuite) TestCascadeDelete(c *C) {
+	s.do(c, "PUT", "/Patient/p1", `{"resourceType":"Patient","gender":"female"}`)
+	s.do(c, "PUT", "/Patient/p2", `{"resourceType":"Patient","gender":"female","link":[{"other":{"reference":"Patient/p1"},"type":"seealso"}]}`)
+	s.do(c, "PUT", "/Patient/p3", `{"resourceType":"Patient","gender":"male"}`)
+	s.do(c, "PUT", "/Encounter/e1", `{"resourceType":"Encounter","patient":{"reference":"Patient/p1"}}`)
+	s.do(c, "PUT", "/Condition/c1", `{"resourceType":"Condition","patient":{"reference":"Patient/p3"},"encounter":{"reference":"Encounter/e1"},"verificationStatus":"confirmed"}`)
+	// Make a cycle between the two linked patients
+	res := s.do(c, "PUT", "/Patient/p1", `{"resourceType":"Patient","gender":"female","link":[{"other":{"reference":"Patient/p2"},"type":"seealso"}]}`)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	res = s.do(c, "DELETE", "/Patient/p1?_cascade=delete", "")
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	outcome := s.decodeOutcome(c, res)
+	var deleted []string
+	for _, issue := range outcome.Issue {
+		deleted = append(deleted, issue.Diagnostics)
+	}
+	c.Assert(deleted, HasLen, 4)
+	c.Assert(deleted[0], Equals, "Deleted Condition/c1")
+	c.Assert(deleted[3], Equals, "Deleted Patient/p1")
+
+	var patients []models.Patient
+	util.CheckErr(s.Database.C("patients").Find(nil).All(&patients))
+	c.Assert(patients, HasLen, 1)
+	c.Assert(patients[0].Id, Equals, "p3")
+	count, err := s.Database.C("encounters").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 0)
+	count, err = s.Database.C("conditions").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 0)
+}
+
+func (s *IntegritySuite) TestUnsupportedCascade(c *C) {
+	s.do(c, "PUT", "/Patient/p1", `{"resourceType":"Patient","gender":"female"}`)
+	res := s.do(c, "DELETE", "/Patient/p1?_cascade=restrict", "")
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+
+	count, err := s.Database.C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+}
+
+func (s *IntegritySuite) TestConditionalCascadeNotSupported(c *C) {
+	s.do(c, "PUT", "/Patient/p1", `{"resourceType":"Patient","gender":"female"}`)
+	res := s.do(c, "DELETE", "/Patient?gender=female&_cascade=delete", "")
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+	outcome := s.decodeOutcome(c, res)
+	c.Assert(outcome.Issue[0].Code, Equals, "not-supported")
+
+	count, err := s.Database.C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+}
+
+func (s *IntegritySuite) do(c *C, method, path, body string) *http.Response {
+	req, err := http.NewRequest(method, s.Server.URL+path, strings.NewReader(body))
+	util.CheckErr(err)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json+fhir")
+	}
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	return res
+}
+
+func (s *IntegritySuite) decodeOutcome(c *C, res *http.Response) *models.OperationOutcome {
+	defer res.Body.Close()
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	return outcome
+}
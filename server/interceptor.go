@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"reflect"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// AllResources is the key in an interceptors map for the interceptors that apply to every resource type.
+const AllResources = "*"
+
+// Interceptor hooks into the operations of a DataAccessLayer.  Unlike middleware, interceptors see parsed resources
+// and the results of operations, and they apply to every way that the operations are reached, including batch and
+// transaction entries.  Each hook is optional.  The "Before" hooks may change the resource being written, or
+// return an error to stop the operation; return an OutcomeError to control the response.  Errors returned by the
+// AfterSearch hook replace the search results.  The context is the one bound to the DataAccessLayer with
+// WithContext, or context.Background() if there is none.
+type Interceptor struct {
+	// BeforeCreate is called before a resource is created.  The resource's ID is not yet set.
+	BeforeCreate func(ctx context.Context, resource interface{}) error
+	// AfterCreate is called after a resource has been created.
+	AfterCreate func(ctx context.Context, id string, resource interface{})
+	// BeforeUpdate is called before a resource is updated, or created with a client-assigned ID.  For conditional
+	// updates, it is called once the conditional is resolved to an ID.
+	BeforeUpdate func(ctx context.Context, id string, resource interface{}) error
+	// AfterUpdate is called after a resource has been updated, or created with a client-assigned ID.
+	AfterUpdate func(ctx context.Context, id string, resource interface{}, createdNew bool)
+	// BeforeDelete is called before a resource is deleted.  For conditional deletes, it is called for each of the
+	// matching resources before any of them are deleted.
+	BeforeDelete func(ctx context.Context, id, resourceType string) error
+	// AfterSearch is called with the Bundle of search results, which it may change, before they are returned.
+	AfterSearch func(ctx context.Context, query search.Query, bundle *models.Bundle) error
+}
+
+// NewInterceptorDataAccessLayer returns a DataAccessLayer that calls the interceptors around the operations of the
+// passed in DataAccessLayer.  The interceptors are keyed by the resource type that they apply to, or AllResources,
+// and are called in order, with those for AllResources first.  Batch writes are done one resource at a time, so
+// the interceptors see each of them.
+func NewInterceptorDataAccessLayer(dal DataAccessLayer, interceptors map[string][]Interceptor) DataAccessLayer {
+	return &interceptorDataAccessLayer{DataAccessLayer: dal, interceptors: interceptors, ctx: context.Background()}
+}
+
+type interceptorDataAccessLayer struct {
+	DataAccessLayer
+	interceptors map[string][]Interceptor
+	ctx          context.Context
+}
+
+func (dal *interceptorDataAccessLayer) bindContext(ctx context.Context) DataAccessLayer {
+	return &interceptorDataAccessLayer{
+		DataAccessLayer: WithContext(ctx, dal.DataAccessLayer),
+		interceptors:    dal.interceptors,
+		ctx:             ctx,
+	}
+}
+
+func (dal *interceptorDataAccessLayer) unwrapIntegrity() DataAccessLayer {
+	return &interceptorDataAccessLayer{
+		DataAccessLayer: withoutIntegrity(dal.DataAccessLayer),
+		interceptors:    dal.interceptors,
+		ctx:             dal.ctx,
+	}
+}
+
+// interceptorsFor returns the interceptors that apply to the resource type
+func (dal *interceptorDataAccessLayer) interceptorsFor(resourceType string) []Interceptor {
+	all := dal.interceptors[AllResources]
+	typed := dal.interceptors[resourceType]
+	result := make([]Interceptor, 0, len(all)+len(typed))
+	return append(append(result, all...), typed...)
+}
+
+func (dal *interceptorDataAccessLayer) Post(resource interface{}) (id string, err error) {
+	interceptors := dal.interceptorsFor(resourceTypeOf(resource))
+	for _, interceptor := range interceptors {
+		if interceptor.BeforeCreate != nil {
+			if err = interceptor.BeforeCreate(dal.ctx, resource); err != nil {
+				return "", err
+			}
+		}
+	}
+	if id, err = dal.DataAccessLayer.Post(resource); err != nil {
+		return "", err
+	}
+	for _, interceptor := range interceptors {
+		if interceptor.AfterCreate != nil {
+			interceptor.AfterCreate(dal.ctx, id, resource)
+		}
+	}
+	return id, nil
+}
+
+// PostWithID is a create, so it calls the BeforeCreate and AfterCreate hooks.
+func (dal *interceptorDataAccessLayer) PostWithID(id string, resource interface{}) error {
+	interceptors := dal.interceptorsFor(resourceTypeOf(resource))
+	for _, interceptor := range interceptors {
+		if interceptor.BeforeCreate != nil {
+			if err := interceptor.BeforeCreate(dal.ctx, resource); err != nil {
+				return err
+			}
+		}
+	}
+	if err := dal.DataAccessLayer.PostWithID(id, resource); err != nil {
+		return err
+	}
+	for _, interceptor := range interceptors {
+		if interceptor.AfterCreate != nil {
+			interceptor.AfterCreate(dal.ctx, id, resource)
+		}
+	}
+	return nil
+}
+
+func (dal *interceptorDataAccessLayer) Put(id string, resource interface{}) (createdNew bool, err error) {
+	interceptors := dal.interceptorsFor(resourceTypeOf(resource))
+	for _, interceptor := range interceptors {
+		if interceptor.BeforeUpdate != nil {
+			if err = interceptor.BeforeUpdate(dal.ctx, id, resource); err != nil {
+				return false, err
+			}
+		}
+	}
+	if createdNew, err = dal.DataAccessLayer.Put(id, resource); err != nil {
+		return false, err
+	}
+	for _, interceptor := range interceptors {
+		if interceptor.AfterUpdate != nil {
+			interceptor.AfterUpdate(dal.ctx, id, resource, createdNew)
+		}
+	}
+	return createdNew, nil
+}
+
+// ConditionalPut resolves the conditional to an ID itself, so that the BeforeUpdate hooks know which resource is
+// being updated.
+func (dal *interceptorDataAccessLayer) ConditionalPut(query search.Query, resource interface{}) (id string, createdNew bool, err error) {
+	ids, err := dal.DataAccessLayer.FindIDs(query)
+	if err != nil {
+		return "", false, err
+	}
+	switch len(ids) {
+	case 0:
+		id = bson.NewObjectId().Hex()
+	case 1:
+		id = ids[0]
+	default:
+		return "", false, ErrMultipleMatches
+	}
+
+	createdNew, err = dal.Put(id, resource)
+	return id, createdNew, err
+}
+
+func (dal *interceptorDataAccessLayer) Delete(id, resourceType string) error {
+	for _, interceptor := range dal.interceptorsFor(resourceType) {
+		if interceptor.BeforeDelete != nil {
+			if err := interceptor.BeforeDelete(dal.ctx, id, resourceType); err != nil {
+				return err
+			}
+		}
+	}
+	return dal.DataAccessLayer.Delete(id, resourceType)
+}
+
+func (dal *interceptorDataAccessLayer) ConditionalDelete(query search.Query) (count int, err error) {
+	interceptors := dal.interceptorsFor(query.Resource)
+	hasBeforeDelete := false
+	for _, interceptor := range interceptors {
+		hasBeforeDelete = hasBeforeDelete || interceptor.BeforeDelete != nil
+	}
+	if hasBeforeDelete {
+		ids, err := findAllIDs(dal.DataAccessLayer, query)
+		if err != nil {
+			return 0, err
+		}
+		for _, id := range ids {
+			for _, interceptor := range interceptors {
+				if interceptor.BeforeDelete != nil {
+					if err := interceptor.BeforeDelete(dal.ctx, id, query.Resource); err != nil {
+						return 0, err
+					}
+				}
+			}
+		}
+	}
+	return dal.DataAccessLayer.ConditionalDelete(query)
+}
+
+func (dal *interceptorDataAccessLayer) Search(baseURL url.URL, searchQuery search.Query) (*models.Bundle, error) {
+	bundle, err := dal.DataAccessLayer.Search(baseURL, searchQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, interceptor := range dal.interceptorsFor(searchQuery.Resource) {
+		if interceptor.AfterSearch != nil {
+			if err = interceptor.AfterSearch(dal.ctx, searchQuery, bundle); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return bundle, nil
+}
+
+// PutBatch writes the resources one at a time, so that the interceptors see each of them.
+func (dal *interceptorDataAccessLayer) PutBatch(resourceType string, resources []interface{}) error {
+	for _, resource := range resources {
+		id, _ := models.GetResourceID(resource)
+		if _, err := dal.Put(id, resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenBinaryContent passes through to the underlying DataAccessLayer, if it is a BinaryStreamer.
+func (dal *interceptorDataAccessLayer) OpenBinaryContent(id string) (content io.ReadCloser, contentType string, err error) {
+	if streamer, ok := dal.DataAccessLayer.(BinaryStreamer); ok {
+		return streamer.OpenBinaryContent(id)
+	}
+	return nil, "", nil
+}
+
+func resourceTypeOf(resource interface{}) string {
+	return reflect.TypeOf(resource).Elem().Name()
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+)
+
+type InterceptorSuite struct {
+	DAL    DataAccessLayer
+	Server *httptest.Server
+	Events []string
+}
+
+var _ = Suite(&InterceptorSuite{})
+
+func (s *InterceptorSuite) SetUpTest(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+	s.Events = nil
+
+	interceptors := map[string][]Interceptor{
+		AllResources: {{
+			AfterCreate: func(ctx context.Context, id string, resource interface{}) {
+				s.Events = append(s.Events, "create "+resourceTypeOf(resource)+"/"+id)
+			},
+			AfterUpdate: func(ctx context.Context, id string, resource interface{}, createdNew bool) {
+				s.Events = append(s.Events, "update "+resourceTypeOf(resource)+"/"+id)
+			},
+		}},
+		"Patient": {{
+			BeforeCreate: func(ctx context.Context, resource interface{}) error {
+				patient := resource.(*models.Patient)
+				if patient.Gender == "" {
+					return NewOutcomeError(http.StatusUnprocessableEntity, "required", "Patient.gender is required")
+				}
+				patient.Active = new(bool)
+				return nil
+			},
+			BeforeUpdate: func(ctx context.Context, id string, resource interface{}) error {
+				resource.(*models.Patient).Active = new(bool)
+				return nil
+			},
+			BeforeDelete: func(ctx context.Context, id, resourceType string) error {
+				if id == "keep" {
+					return NewOutcomeError(http.StatusForbidden, "forbidden", "Patient/keep can't be deleted")
+				}
+				return nil
+			},
+			AfterSearch: func(ctx context.Context, query search.Query, bundle *models.Bundle) error {
+				for _, entry := range bundle.Entry {
+					entry.Resource.(*models.Patient).Name = nil
+				}
+				return nil
+			},
+		}},
+	}
+	s.DAL = NewMemoryDataAccessLayerWithConfig(Config{Interceptors: interceptors})
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), s.DAL, Config{})
+	s.Server = httptest.NewServer(engine)
+}
+
+func (s *InterceptorSuite) TearDownTest(c *C) {
+	s.Server.Close()
+}
+
+func (s *InterceptorSuite) TestCreateAndUpdate(c *C) {
+	_, err := s.DAL.Post(&models.Patient{})
+	c.Assert(err, FitsTypeOf, &OutcomeError{})
+	c.Assert(s.Events, HasLen, 0)
+
+	// The interceptor's changes are stored
+	id, err := s.DAL.Post(&models.Patient{Gender: "male"})
+	util.CheckErr(err)
+	result, err := s.DAL.Get(id, "Patient")
+	util.CheckErr(err)
+	c.Assert(*result.(*models.Patient).Active, Equals, false)
+
+	_, err = s.DAL.Put(id, &models.Patient{Gender: "female"})
+	util.CheckErr(err)
+	_, err = s.DAL.Post(&models.Condition{})
+	util.CheckErr(err)
+	c.Assert(s.Events, HasLen, 3)
+	c.Assert(s.Events[0], Equals, "create Patient/"+id)
+	c.Assert(s.Events[1], Equals, "update Patient/"+id)
+	c.Assert(strings.HasPrefix(s.Events[2], "create Condition/"), Equals, true)
+
+	// Conditional updates are resolved before the hooks are called
+	id, createdNew, err := s.DAL.ConditionalPut(search.Query{Resource: "Patient", Query: "gender=other"}, &models.Patient{Gender: "other"})
+	util.CheckErr(err)
+	c.Assert(createdNew, Equals, true)
+	c.Assert(s.Events[3], Equals, "update Patient/"+id)
+}
+
+func (s *InterceptorSuite) TestRejectionsThroughServer(c *C) {
+	res, err := http.Post(s.Server.URL+"/Patient", "application/json", strings.NewReader(`{"resourceType": "Patient"}`))
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusUnprocessableEntity)
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	c.Assert(outcome.Issue[0].Diagnostics, Equals, "Patient.gender is required")
+
+	util.CheckErr(s.DAL.PostWithID("keep", &models.Patient{Gender: "male"}))
+	req, _ := http.NewRequest("DELETE", s.Server.URL+"/Patient/keep", nil)
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusForbidden)
+	req, _ = http.NewRequest("DELETE", s.Server.URL+"/Patient?gender=male", nil)
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusForbidden)
+	_, err = s.DAL.Get("keep", "Patient")
+	util.CheckErr(err)
+}
+
+func (s *InterceptorSuite) TestSearchResults(c *C) {
+	patient := loadPatientFromFixture("../fixtures/patient-example-a.json")
+	c.Assert(patient.Name, Not(HasLen), 0)
+	_, err := s.DAL.Post(patient)
+	util.CheckErr(err)
+
+	bundle := assertBundleCount(c, s.Server.URL+"/Patient", 1, 1)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Name, HasLen, 0)
+}
+
+func (s *InterceptorSuite) TestBatchEntries(c *C) {
+	bundle := `{
+		"resourceType": "Bundle",
+		"type": "batch",
+		"entry": [
+			{"resource": {"resourceType": "Patient", "gender": "male"}, "request": {"method": "POST", "url": "Patient"}},
+			{"resource": {"resourceType": "Patient"}, "request": {"method": "POST", "url": "Patient"}}
+		]
+	}`
+	res, err := http.Post(s.Server.URL+"/", "application/json", strings.NewReader(bundle))
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusUnprocessableEntity)
+	c.Assert(s.Events, HasLen, 1)
+	c.Assert(strings.HasPrefix(s.Events[0], "create Patient/"), Equals, true)
+}
+
+func (s *InterceptorSuite) TestCascadeDeleteWithIntegrity(c *C) {
+	// The interceptors wrap the integrity checks, which the cascade still has to bypass
+	var deleted []string
+	interceptors := map[string][]Interceptor{
+		AllResources: {{
+			BeforeDelete: func(ctx context.Context, id, resourceType string) error {
+				deleted = append(deleted, resourceType+"/"+id)
+				return nil
+			},
+		}},
+	}
+	dal := NewMemoryDataAccessLayerWithConfig(Config{Interceptors: interceptors, EnforceReferentialIntegrity: true})
+	util.CheckErr(dal.PostWithID("p1", &models.Patient{Gender: "female"}))
+	util.CheckErr(dal.PostWithID("c1", &models.Condition{Patient: &models.Reference{Reference: "Patient/p1", Type: "Patient", ReferencedID: "p1", External: new(bool)}}))
+	c.Assert(dal.Delete("p1", "Patient"), FitsTypeOf, &OutcomeError{})
+	deleted = nil
+
+	result, err := CascadeDelete(dal, "Patient", "p1")
+	util.CheckErr(err)
+	c.Assert(result, HasLen, 2)
+	c.Assert(deleted, DeepEquals, []string{"Condition/c1", "Patient/p1"})
+}
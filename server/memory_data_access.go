@@ -0,0 +1,300 @@
+package server
+
+import (
+	"net/url"
+	"reflect"
+	"sync"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NewMemoryDataAccessLayer returns an implementation of DataAccessLayer that keeps resources in memory.  It supports
+// the same searches as the Mongo DataAccessLayer, so it can stand in for a database when testing.  Resources are
+// lost when the DataAccessLayer is discarded.
+func NewMemoryDataAccessLayer() DataAccessLayer {
+	return &memoryDataAccessLayer{collections: make(map[string]*memoryCollection)}
+}
+
+// NewMemoryDataAccessLayerWithConfig returns an implementation of DataAccessLayer that keeps resources in memory,
+// using the paging and integrity options and interceptors in the passed in config
+func NewMemoryDataAccessLayerWithConfig(config Config) DataAccessLayer {
+	var dal DataAccessLayer = &memoryDataAccessLayer{
+		collections:  make(map[string]*memoryCollection),
+		CursorPaging: config.CursorPaging,
+	}
+	if config.EnforceReferentialIntegrity {
+		dal = NewIntegrityDataAccessLayer(dal)
+	}
+	if len(config.Interceptors) > 0 {
+		dal = NewInterceptorDataAccessLayer(dal, config.Interceptors)
+	}
+	return dal
+}
+
+type memoryDataAccessLayer struct {
+	// CursorPaging indicates that search results are paged through with opaque cursors rather than offsets, when
+	// the sort allows it.
+	CursorPaging bool
+	mutex        sync.RWMutex
+	collections  map[string]*memoryCollection
+}
+
+// memoryCollection holds the resources of one type as documents, just as they would be stored in Mongo, in the
+// order that they were created
+type memoryCollection struct {
+	ids  []string
+	docs map[string]bson.M
+}
+
+func (dal *memoryDataAccessLayer) Get(id, resourceType string) (result interface{}, err error) {
+	if err = validateID(id); err != nil {
+		return nil, err
+	}
+
+	dal.mutex.RLock()
+	defer dal.mutex.RUnlock()
+	var doc bson.M
+	collection, ok := dal.collections[models.PluralizeLowerResourceName(resourceType)]
+	if ok {
+		doc, ok = collection.docs[id]
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	result = models.NewStructForResourceName(resourceType)
+	if err = convertDocument(doc, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (dal *memoryDataAccessLayer) Post(resource interface{}) (id string, err error) {
+	id = bson.NewObjectId().Hex()
+	err = dal.PostWithID(id, resource)
+	return
+}
+
+func (dal *memoryDataAccessLayer) PostWithID(id string, resource interface{}) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+
+	reflect.ValueOf(resource).Elem().FieldByName("Id").SetString(id)
+	resourceType := reflect.TypeOf(resource).Elem().Name()
+	updateLastUpdatedDate(resource)
+	doc, err := storedDocument(resource)
+	if err != nil {
+		return err
+	}
+
+	dal.mutex.Lock()
+	defer dal.mutex.Unlock()
+	collection := dal.collection(resourceType)
+	if _, ok := collection.docs[id]; ok {
+		// Report the duplicate ID the same way as Mongo, so mgo.IsDup recognizes it
+		return &mgo.LastError{Code: 11000, Err: "duplicate key error: " + id}
+	}
+	collection.put(id, doc)
+	return nil
+}
+
+func (dal *memoryDataAccessLayer) Put(id string, resource interface{}) (createdNew bool, err error) {
+	if err = validateID(id); err != nil {
+		return false, err
+	}
+
+	reflect.ValueOf(resource).Elem().FieldByName("Id").SetString(id)
+	resourceType := reflect.TypeOf(resource).Elem().Name()
+	updateLastUpdatedDate(resource)
+	doc, err := storedDocument(resource)
+	if err != nil {
+		return false, err
+	}
+
+	dal.mutex.Lock()
+	defer dal.mutex.Unlock()
+	return dal.collection(resourceType).put(id, doc), nil
+}
+
+func (dal *memoryDataAccessLayer) ConditionalPut(query search.Query, resource interface{}) (id string, createdNew bool, err error) {
+	if IDs, err := dal.FindIDs(query); err == nil {
+		switch len(IDs) {
+		case 0:
+			id = bson.NewObjectId().Hex()
+		case 1:
+			id = IDs[0]
+		default:
+			return "", false, ErrMultipleMatches
+		}
+	} else {
+		return "", false, err
+	}
+
+	createdNew, err = dal.Put(id, resource)
+	return id, createdNew, err
+}
+
+func (dal *memoryDataAccessLayer) Delete(id, resourceType string) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+
+	dal.mutex.Lock()
+	defer dal.mutex.Unlock()
+	if !dal.collection(resourceType).remove(id) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (dal *memoryDataAccessLayer) ConditionalDelete(query search.Query) (count int, err error) {
+	dal.mutex.Lock()
+	defer dal.mutex.Unlock()
+	collection := dal.collection(query.Resource)
+	for _, doc := range dal.newSearcher().FindWithoutOptions(query) {
+		if collection.remove(doc["_id"].(string)) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (dal *memoryDataAccessLayer) Search(baseURL url.URL, searchQuery search.Query) (*models.Bundle, error) {
+	dal.mutex.RLock()
+	defer dal.mutex.RUnlock()
+	return searchBundle(baseURL, searchQuery, dal.CursorPaging, &memorySearchFinder{searcher: dal.newSearcher()})
+}
+
+func (dal *memoryDataAccessLayer) FindIDs(searchQuery search.Query) (IDs []string, err error) {
+	// First create a new query with the unsupported query options filtered out
+	oldParams := searchQuery.URLQueryParameters(true)
+	newParams := search.URLQueryParameters{}
+	for _, param := range oldParams.All() {
+		switch param.Key {
+		case search.ContainedParam, search.ContainedTypeParam, search.ElementsParam, search.IncludeParam,
+			search.RevIncludeParam, search.SummaryParam:
+			continue
+		default:
+			newParams.Add(param.Key, param.Value)
+		}
+	}
+	newQuery := search.Query{Resource: searchQuery.Resource, Query: newParams.Encode()}
+
+	dal.mutex.RLock()
+	defer dal.mutex.RUnlock()
+	docs := dal.newSearcher().Find(newQuery)
+	IDs = make([]string, len(docs))
+	for i := range docs {
+		IDs[i] = docs[i]["_id"].(string)
+	}
+	return IDs, nil
+}
+
+// newSearcher returns a MemorySearcher for the documents in the data access layer.  The caller must hold the lock.
+func (dal *memoryDataAccessLayer) newSearcher() *search.MemorySearcher {
+	searcher := search.NewMemorySearcher(dal.documents)
+	searcher.SetCursorPaging(dal.CursorPaging)
+	return searcher
+}
+
+// documents returns the documents in the collection with the given name.  The caller must hold the lock.
+func (dal *memoryDataAccessLayer) documents(name string) []bson.M {
+	collection, ok := dal.collections[name]
+	if !ok {
+		return nil
+	}
+	docs := make([]bson.M, len(collection.ids))
+	for i, id := range collection.ids {
+		docs[i] = collection.docs[id]
+	}
+	return docs
+}
+
+// collection returns the collection holding resources of the given type, creating it if needed.  The caller must
+// hold the lock.
+func (dal *memoryDataAccessLayer) collection(resourceType string) *memoryCollection {
+	name := models.PluralizeLowerResourceName(resourceType)
+	collection, ok := dal.collections[name]
+	if !ok {
+		collection = &memoryCollection{docs: make(map[string]bson.M)}
+		dal.collections[name] = collection
+	}
+	return collection
+}
+
+// put stores the document, returning true if it is new
+func (c *memoryCollection) put(id string, doc bson.M) bool {
+	_, exists := c.docs[id]
+	if !exists {
+		c.ids = append(c.ids, id)
+	}
+	c.docs[id] = doc
+	return !exists
+}
+
+// remove removes the document, returning true if it existed
+func (c *memoryCollection) remove(id string) bool {
+	if _, exists := c.docs[id]; !exists {
+		return false
+	}
+	delete(c.docs, id)
+	for i := range c.ids {
+		if c.ids[i] == id {
+			c.ids = append(c.ids[:i:i], c.ids[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// memorySearchFinder finds search results in memory
+type memorySearchFinder struct {
+	searcher *search.MemorySearcher
+}
+
+func (f *memorySearchFinder) find(query search.Query, related bool, result interface{}) error {
+	docs := f.searcher.Find(query)
+	if docs == nil {
+		docs = []bson.M{}
+	}
+	return convertDocument(docs, result)
+}
+
+func (f *memorySearchFinder) count(query search.Query) (int, error) {
+	return f.searcher.Count(query, 0), nil
+}
+
+func (f *memorySearchFinder) estimateTotal(query search.Query) (total uint32, exact bool, err error) {
+	// Counting is cheap in memory, so the estimate is always exact
+	return uint32(f.searcher.Count(query, 0)), true, nil
+}
+
+// storedDocument converts a resource to the document that is stored for it.  Like in Mongo, the fields of embedded
+// documents keep their order, since documents are compared field by field when sorting.
+func storedDocument(resource interface{}) (bson.M, error) {
+	var doc bson.D
+	if err := convertDocument(resource, &doc); err != nil {
+		return nil, err
+	}
+	return doc.Map(), nil
+}
+
+// convertDocument converts a value to another type by round-tripping it through BSON, just like storing it in Mongo
+// and loading it back out would.  This also ensures that stored documents don't share any state with resources.
+func convertDocument(in, out interface{}) error {
+	wrapped := bson.M{"v": in}
+	data, err := bson.Marshal(wrapped)
+	if err != nil {
+		return err
+	}
+	var raw struct {
+		V bson.Raw `bson:"v"`
+	}
+	if err = bson.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	return raw.V.Unmarshal(out)
+}
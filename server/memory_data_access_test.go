@@ -0,0 +1,205 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+type MemoryDataAccessSuite struct {
+	DAL    DataAccessLayer
+	Server *httptest.Server
+}
+
+var _ = Suite(&MemoryDataAccessSuite{})
+
+func (s *MemoryDataAccessSuite) SetUpTest(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+
+	// Every test gets a fresh (empty) data access layer
+	s.DAL = NewMemoryDataAccessLayer()
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), s.DAL, Config{})
+	s.Server = httptest.NewServer(engine)
+}
+
+func (s *MemoryDataAccessSuite) TearDownTest(c *C) {
+	s.Server.Close()
+}
+
+func (s *MemoryDataAccessSuite) TestCRUD(c *C) {
+	patient := loadPatientFromFixture("../fixtures/patient-example-a.json")
+	id, err := s.DAL.Post(patient)
+	util.CheckErr(err)
+
+	result, err := s.DAL.Get(id, "Patient")
+	util.CheckErr(err)
+	c.Assert(result.(*models.Patient).Name[0].Family, DeepEquals, patient.Name[0].Family)
+	c.Assert(result.(*models.Patient).Meta.LastUpdated, NotNil)
+
+	// Changing the resource doesn't change what is stored
+	patient.Gender = "female"
+	result, _ = s.DAL.Get(id, "Patient")
+	c.Assert(result.(*models.Patient).Gender, Equals, "male")
+
+	createdNew, err := s.DAL.Put(id, patient)
+	util.CheckErr(err)
+	c.Assert(createdNew, Equals, false)
+	result, _ = s.DAL.Get(id, "Patient")
+	c.Assert(result.(*models.Patient).Gender, Equals, "female")
+
+	err = s.DAL.PostWithID(id, loadPatientFromFixture("../fixtures/patient-example-a.json"))
+	c.Assert(mgo.IsDup(err), Equals, true)
+
+	util.CheckErr(s.DAL.Delete(id, "Patient"))
+	_, err = s.DAL.Get(id, "Patient")
+	c.Assert(err, Equals, ErrNotFound)
+	c.Assert(s.DAL.Delete(id, "Patient"), Equals, ErrNotFound)
+	_, err = s.DAL.Get("bad id!", "Patient")
+	c.Assert(err, Equals, ErrInvalidID)
+}
+
+func (s *MemoryDataAccessSuite) TestConditionalOperations(c *C) {
+	for i := 0; i < 3; i++ {
+		_, err := s.DAL.Post(loadPatientFromFixture("../fixtures/patient-example-a.json"))
+		util.CheckErr(err)
+	}
+	_, err := s.DAL.Post(&models.Patient{Gender: "female"})
+	util.CheckErr(err)
+
+	_, _, err = s.DAL.ConditionalPut(search.Query{Resource: "Patient", Query: "gender=male"}, &models.Patient{})
+	c.Assert(err, Equals, ErrMultipleMatches)
+	id, createdNew, err := s.DAL.ConditionalPut(search.Query{Resource: "Patient", Query: "gender=female"}, &models.Patient{Gender: "other"})
+	util.CheckErr(err)
+	c.Assert(createdNew, Equals, false)
+	ids, err := s.DAL.FindIDs(search.Query{Resource: "Patient", Query: "gender=other"})
+	util.CheckErr(err)
+	c.Assert(ids, DeepEquals, []string{id})
+
+	count, err := s.DAL.ConditionalDelete(search.Query{Resource: "Patient", Query: "gender=male"})
+	util.CheckErr(err)
+	c.Assert(count, Equals, 3)
+	ids, err = s.DAL.FindIDs(search.Query{Resource: "Patient"})
+	util.CheckErr(err)
+	c.Assert(ids, DeepEquals, []string{id})
+}
+
+// slowSearchDAL delays searches, widening the window between a conditional create's search and its create
+type slowSearchDAL struct {
+	DataAccessLayer
+}
+
+func (dal slowSearchDAL) FindIDs(query search.Query) ([]string, error) {
+	ids, err := dal.DataAccessLayer.FindIDs(query)
+	time.Sleep(10 * time.Millisecond)
+	return ids, err
+}
+
+func (s *MemoryDataAccessSuite) TestConditionalCreateThroughServer(c *C) {
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), slowSearchDAL{s.DAL}, Config{})
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	create := func(body string) *http.Response {
+		req, err := http.NewRequest("POST", server.URL+"/Patient", strings.NewReader(body))
+		util.CheckErr(err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-None-Exist", "identifier=http://example.org/mrn|123")
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		res.Body.Close()
+		return res
+	}
+	patient := `{"resourceType": "Patient", "identifier": [{"system": "http://example.org/mrn", "value": "123"}]}`
+
+	// Concurrent conditional creates only create one resource
+	var wg sync.WaitGroup
+	statuses := make([]int, 10)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = create(patient).StatusCode
+		}(i)
+	}
+	wg.Wait()
+	created := 0
+	for _, status := range statuses {
+		if status == http.StatusCreated {
+			created++
+		} else {
+			c.Assert(status, Equals, http.StatusOK)
+		}
+	}
+	c.Assert(created, Equals, 1)
+	ids, err := s.DAL.FindIDs(search.Query{Resource: "Patient"})
+	util.CheckErr(err)
+	c.Assert(ids, HasLen, 1)
+
+	res := create(patient)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Location"), Equals, server.URL+"/Patient/"+ids[0])
+
+	// Several matching resources fail the create, both on its own and in a batch
+	_, err = s.DAL.Post(&models.Patient{Identifier: []models.Identifier{{System: "http://example.org/mrn", Value: "123"}}})
+	util.CheckErr(err)
+	c.Assert(create(patient).StatusCode, Equals, http.StatusPreconditionFailed)
+
+	batch := `{"resourceType": "Bundle", "type": "batch", "entry": [{
+		"fullUrl": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a",
+		"resource": ` + patient + `,
+		"request": {"method": "POST", "url": "Patient", "ifNoneExist": "identifier=http://example.org/mrn|123"}}]}`
+	res, err = http.Post(server.URL+"/", "application/json", strings.NewReader(batch))
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusPreconditionFailed)
+}
+
+func (s *MemoryDataAccessSuite) TestSearchThroughServer(c *C) {
+	for i := 0; i < 5; i++ {
+		patient := loadPatientFromFixture("../fixtures/patient-example-a.json")
+		util.CheckErr(s.DAL.PostWithID(string(rune('a'+i)), patient))
+	}
+	_, err := s.DAL.Post(&models.Condition{Patient: &models.Reference{Reference: "Patient/a", ReferencedID: "a", Type: "Patient", External: new(bool)}})
+	util.CheckErr(err)
+
+	assertBundleCount(c, s.Server.URL+"/Patient", 5, 5)
+	assertBundleCount(c, s.Server.URL+"/Patient?gender=male", 5, 5)
+	assertBundleCount(c, s.Server.URL+"/Patient?gender=female", 0, 0)
+	bundle := assertBundleCount(c, s.Server.URL+"/Patient?_count=2&_offset=2", 2, 5)
+	c.Assert(getLink(bundle, "next"), Not(Equals), "")
+	bundle = assertBundleCount(c, s.Server.URL+"/Patient?_sort:desc=_id&_count=1", 1, 5)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Id, Equals, "e")
+
+	// Chained searches and includes
+	assertBundleCount(c, s.Server.URL+"/Condition?patient.gender=male", 1, 1)
+	assertBundleCount(c, s.Server.URL+"/Condition?patient.gender=female", 0, 0)
+	bundle = performSearch(c, s.Server.URL+"/Condition?_include=Condition:patient")
+	c.Assert(bundle.Entry, HasLen, 2)
+	c.Assert(bundle.Entry[1].Search.Mode, Equals, "include")
+	bundle = performSearch(c, s.Server.URL+"/Patient?_id=a&_revinclude=Condition:patient")
+	c.Assert(bundle.Entry, HasLen, 2)
+
+	// Invalid searches get the same response as from Mongo
+	res, err := http.Get(s.Server.URL + "/Patient?foo=bar")
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *MemoryDataAccessSuite) TestReferentialIntegrity(c *C) {
+	dal := NewMemoryDataAccessLayerWithConfig(Config{EnforceReferentialIntegrity: true})
+	_, err := dal.Post(&models.Condition{Patient: &models.Reference{Reference: "Patient/a", ReferencedID: "a", Type: "Patient", External: new(bool)}})
+	c.Assert(err, FitsTypeOf, &OutcomeError{})
+	c.Assert(strings.Contains(err.Error(), "Patient/a"), Equals, true)
+}
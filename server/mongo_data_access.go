@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"net/url"
 	"reflect"
 	"strconv"
@@ -17,19 +19,142 @@ func NewMongoDataAccessLayer(db *mgo.Database) DataAccessLayer {
 	return &mongoDataAccessLayer{Database: db}
 }
 
+// NewMongoDataAccessLayerWithConfig returns an implementation of DataAccessLayer that is backed by a Mongo database,
+// using the data storage and integrity options and interceptors in the passed in config
+func NewMongoDataAccessLayerWithConfig(db *mgo.Database, config Config) DataAccessLayer {
+	var dal DataAccessLayer = &mongoDataAccessLayer{
+		Database:        db,
+		GridFSThreshold: config.GridFSThreshold,
+		CursorPaging:    config.CursorPaging,
+	}
+	if config.EnforceReferentialIntegrity {
+		dal = NewIntegrityDataAccessLayer(dal)
+	}
+	if len(config.Interceptors) > 0 {
+		dal = NewInterceptorDataAccessLayer(dal, config.Interceptors)
+	}
+	return dal
+}
+
 type mongoDataAccessLayer struct {
 	Database *mgo.Database
+	// GridFSThreshold is the size above which Binary content and Attachment data are stored in GridFS.  If it is
+	// zero, all content is stored inline.
+	GridFSThreshold int
+	// CursorPaging indicates that search results are paged through with opaque cursors rather than offsets, when
+	// the sort allows it.
+	CursorPaging bool
+	// sessionCopied indicates that the Database uses a copy of the session made for the current operation
+	sessionCopied bool
+	// ctx is the context that operations are bound to, if any.  Since mgo can't interrupt an operation in progress,
+	// cancellation takes effect between operations, while deadlines are also passed to queries as their max time.
+	ctx context.Context
+}
+
+// withContext returns a copy of the data access layer whose operations are bound to the context
+func (dal *mongoDataAccessLayer) withContext(ctx context.Context) *mongoDataAccessLayer {
+	bound := *dal
+	bound.ctx = ctx
+	return &bound
+}
+
+func (dal *mongoDataAccessLayer) bindContext(ctx context.Context) DataAccessLayer {
+	return dal.withContext(ctx)
+}
+
+// contextErr returns the error of the bound context, if it is done
+func (dal *mongoDataAccessLayer) contextErr() error {
+	if dal.ctx == nil {
+		return nil
+	}
+	return dal.ctx.Err()
+}
+
+// maxTime returns the time left before the bound context's deadline, or zero if there is no deadline
+func (dal *mongoDataAccessLayer) maxTime() time.Duration {
+	if dal.ctx == nil {
+		return 0
+	}
+	deadline, ok := dal.ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	if remaining := deadline.Sub(time.Now()); remaining > time.Millisecond {
+		return remaining
+	}
+	// Zero would mean no limit, so use the smallest limit instead
+	return time.Millisecond
+}
+
+// withSession returns a copy of the data access layer whose Database uses its own copy of the session, along with a
+// function that closes the copy.  Each operation uses a copy, so concurrent operations use their own sockets from
+// the session's pool, and a connection error only affects the operation that hit it.  Operations called by other
+// operations share the caller's copy.
+func (dal *mongoDataAccessLayer) withSession() (*mongoDataAccessLayer, func()) {
+	if dal.sessionCopied {
+		return dal, func() {}
+	}
+	session := dal.Database.Session.Copy()
+	copied := *dal
+	copied.Database = dal.Database.With(session)
+	copied.sessionCopied = true
+	return &copied, session.Close
+}
+
+// newSearcher returns a MongoSearcher limited to the time left before the bound context's deadline
+func (dal *mongoDataAccessLayer) newSearcher() *search.MongoSearcher {
+	searcher := search.NewMongoSearcher(dal.Database)
+	searcher.SetCursorPaging(dal.CursorPaging)
+	searcher.SetMaxTime(dal.maxTime())
+	return searcher
+}
+
+func (dal *mongoDataAccessLayer) GetContext(ctx context.Context, id, resourceType string) (result interface{}, err error) {
+	return dal.withContext(ctx).Get(id, resourceType)
+}
+
+func (dal *mongoDataAccessLayer) PostContext(ctx context.Context, resource interface{}) (id string, err error) {
+	return dal.withContext(ctx).Post(resource)
+}
+
+func (dal *mongoDataAccessLayer) PutContext(ctx context.Context, id string, resource interface{}) (createdNew bool, err error) {
+	return dal.withContext(ctx).Put(id, resource)
+}
+
+func (dal *mongoDataAccessLayer) DeleteContext(ctx context.Context, id, resourceType string) error {
+	return dal.withContext(ctx).Delete(id, resourceType)
+}
+
+func (dal *mongoDataAccessLayer) SearchContext(ctx context.Context, baseURL url.URL, searchQuery search.Query) (*models.Bundle, error) {
+	return dal.withContext(ctx).Search(baseURL, searchQuery)
+}
+
+func (dal *mongoDataAccessLayer) FindIDsContext(ctx context.Context, searchQuery search.Query) ([]string, error) {
+	return dal.withContext(ctx).FindIDs(searchQuery)
 }
 
 func (dal *mongoDataAccessLayer) Get(id, resourceType string) (result interface{}, err error) {
-	bsonID, err := convertIDToBsonID(id)
-	if err != nil {
-		return nil, convertMongoErr(err)
+	dal, closeSession := dal.withSession()
+	defer closeSession()
+
+	if err = validateID(id); err != nil {
+		return nil, err
+	}
+
+	if err = dal.contextErr(); err != nil {
+		return nil, err
 	}
 
 	collection := dal.Database.C(models.PluralizeLowerResourceName(resourceType))
 	result = models.NewStructForResourceName(resourceType)
-	if err = collection.FindId(bsonID.Hex()).One(result); err != nil {
+	query := collection.FindId(id)
+	if maxTime := dal.maxTime(); maxTime > 0 {
+		query = query.SetMaxTime(maxTime)
+	}
+	if err = query.One(result); err != nil {
+		return nil, convertMongoErr(err)
+	}
+	if err = dal.loadGridFSContent(result); err != nil {
 		return nil, convertMongoErr(err)
 	}
 
@@ -43,36 +168,118 @@ func (dal *mongoDataAccessLayer) Post(resource interface{}) (id string, err erro
 }
 
 func (dal *mongoDataAccessLayer) PostWithID(id string, resource interface{}) error {
-	bsonID, err := convertIDToBsonID(id)
-	if err != nil {
-		return convertMongoErr(err)
+	dal, closeSession := dal.withSession()
+	defer closeSession()
+
+	if err := validateID(id); err != nil {
+		return err
+	}
+	if err := dal.contextErr(); err != nil {
+		return err
 	}
 
-	reflect.ValueOf(resource).Elem().FieldByName("Id").SetString(bsonID.Hex())
+	reflect.ValueOf(resource).Elem().FieldByName("Id").SetString(id)
 	resourceType := reflect.TypeOf(resource).Elem().Name()
 	collection := dal.Database.C(models.PluralizeLowerResourceName(resourceType))
 	updateLastUpdatedDate(resource)
-	return convertMongoErr(collection.Insert(resource))
+
+	restore, fileIDs, err := dal.storeGridFSContent(resourceType, id, resource)
+	if err != nil {
+		return convertMongoErr(err)
+	}
+	defer restore()
+
+	if err = collection.Insert(resource); err != nil {
+		dal.removeGridFSFiles(fileIDs)
+	}
+	return convertMongoErr(err)
 }
 
 func (dal *mongoDataAccessLayer) Put(id string, resource interface{}) (createdNew bool, err error) {
-	bsonID, err := convertIDToBsonID(id)
-	if err != nil {
-		return false, convertMongoErr(err)
+	dal, closeSession := dal.withSession()
+	defer closeSession()
+
+	if err = validateID(id); err != nil {
+		return false, err
+	}
+	if err = dal.contextErr(); err != nil {
+		return false, err
 	}
 
 	resourceType := reflect.TypeOf(resource).Elem().Name()
 	collection := dal.Database.C(models.PluralizeLowerResourceName(resourceType))
-	reflect.ValueOf(resource).Elem().FieldByName("Id").SetString(bsonID.Hex())
+	reflect.ValueOf(resource).Elem().FieldByName("Id").SetString(id)
 	updateLastUpdatedDate(resource)
-	info, err := collection.UpsertId(bsonID.Hex(), resource)
+
+	oldFileIDs, err := dal.findGridFSFiles(resourceType, id)
+	if err != nil {
+		return false, convertMongoErr(err)
+	}
+	restore, fileIDs, err := dal.storeGridFSContent(resourceType, id, resource)
+	if err != nil {
+		return false, convertMongoErr(err)
+	}
+	defer restore()
+
+	info, err := collection.UpsertId(id, resource)
 	if err == nil {
 		createdNew = (info.Updated == 0)
+		dal.removeGridFSFiles(oldFileIDs)
+	} else {
+		dal.removeGridFSFiles(fileIDs)
 	}
 	return createdNew, convertMongoErr(err)
 }
 
+func (dal *mongoDataAccessLayer) PutBatch(resourceType string, resources []interface{}) error {
+	dal, closeSession := dal.withSession()
+	defer closeSession()
+
+	if err := dal.contextErr(); err != nil {
+		return err
+	}
+
+	collection := dal.Database.C(models.PluralizeLowerResourceName(resourceType))
+	bulk := collection.Bulk()
+	bulk.Unordered()
+	ids := make([]string, len(resources))
+	for i, resource := range resources {
+		id, _ := models.GetResourceID(resource)
+		if err := validateID(id); err != nil {
+			return err
+		}
+		ids[i] = id
+	}
+
+	oldFileIDs, err := dal.findGridFSFiles(resourceType, ids...)
+	if err != nil {
+		return convertMongoErr(err)
+	}
+	var fileIDs []bson.ObjectId
+	for i, resource := range resources {
+		updateLastUpdatedDate(resource)
+		restore, resourceFileIDs, err := dal.storeGridFSContent(resourceType, ids[i], resource)
+		if err != nil {
+			dal.removeGridFSFiles(fileIDs)
+			return convertMongoErr(err)
+		}
+		defer restore()
+		fileIDs = append(fileIDs, resourceFileIDs...)
+		bulk.Upsert(bson.M{"_id": ids[i]}, resource)
+	}
+
+	if _, err = bulk.Run(); err != nil {
+		dal.removeGridFSFiles(fileIDs)
+		return convertMongoErr(err)
+	}
+	dal.removeGridFSFiles(oldFileIDs)
+	return nil
+}
+
 func (dal *mongoDataAccessLayer) ConditionalPut(query search.Query, resource interface{}) (id string, createdNew bool, err error) {
+	dal, closeSession := dal.withSession()
+	defer closeSession()
+
 	if IDs, err := dal.FindIDs(query); err == nil {
 		switch len(IDs) {
 		case 0:
@@ -91,103 +298,102 @@ func (dal *mongoDataAccessLayer) ConditionalPut(query search.Query, resource int
 }
 
 func (dal *mongoDataAccessLayer) Delete(id, resourceType string) error {
-	bsonID, err := convertIDToBsonID(id)
+	dal, closeSession := dal.withSession()
+	defer closeSession()
+
+	if err := validateID(id); err != nil {
+		return err
+	}
+	if err := dal.contextErr(); err != nil {
+		return err
+	}
+
+	oldFileIDs, err := dal.findGridFSFiles(resourceType, id)
 	if err != nil {
 		return convertMongoErr(err)
 	}
 
 	collection := dal.Database.C(models.PluralizeLowerResourceName(resourceType))
-	return convertMongoErr(collection.RemoveId(bsonID.Hex()))
+	if err = collection.RemoveId(id); err == nil {
+		dal.removeGridFSFiles(oldFileIDs)
+	}
+	return convertMongoErr(err)
 }
 
 func (dal *mongoDataAccessLayer) ConditionalDelete(query search.Query) (count int, err error) {
-	searcher := search.NewMongoSearcher(dal.Database)
-	queryObject := searcher.CreateQueryObject(query)
+	dal, closeSession := dal.withSession()
+	defer closeSession()
+
+	if err = dal.contextErr(); err != nil {
+		return 0, err
+	}
 
+	searcher := dal.newSearcher()
+	queryObject := searcher.CreateQueryObject(query)
 	collection := dal.Database.C(models.PluralizeLowerResourceName(query.Resource))
+
+	var oldFileIDs []bson.ObjectId
+	if dal.GridFSThreshold > 0 {
+		var results []struct {
+			ID string `bson:"_id"`
+		}
+		if err := collection.Find(queryObject).Select(bson.M{"_id": 1}).All(&results); err != nil {
+			return 0, convertMongoErr(err)
+		}
+		ids := make([]string, len(results))
+		for i := range results {
+			ids[i] = results[i].ID
+		}
+		if oldFileIDs, err = dal.findGridFSFiles(query.Resource, ids...); err != nil {
+			return 0, convertMongoErr(err)
+		}
+	}
+
 	info, err := collection.RemoveAll(queryObject)
 	if info != nil {
 		count = info.Removed
 	}
+	if err == nil {
+		dal.removeGridFSFiles(oldFileIDs)
+	}
 	return count, convertMongoErr(err)
 }
 
 func (dal *mongoDataAccessLayer) Search(baseURL url.URL, searchQuery search.Query) (*models.Bundle, error) {
-	searcher := search.NewMongoSearcher(dal.Database)
+	dal, closeSession := dal.withSession()
+	defer closeSession()
 
-	var result interface{}
-	var err error
-	usesIncludes := len(searchQuery.Options().Include) > 0
-	usesRevIncludes := len(searchQuery.Options().RevInclude) > 0
-	// Only use (slower) pipeline if it is needed
-	if usesIncludes || usesRevIncludes {
-		result = models.NewSlicePlusForResourceName(searchQuery.Resource, 0, 0)
-		err = searcher.CreatePipeline(searchQuery).All(result)
-	} else {
-		result = models.NewSliceForResourceName(searchQuery.Resource, 0, 0)
-		err = searcher.CreateQuery(searchQuery).All(result)
+	if err := dal.contextErr(); err != nil {
+		return nil, err
 	}
+
+	finder := &mongoSearchFinder{searcher: dal.newSearcher()}
+	bundle, err := searchBundle(baseURL, searchQuery, dal.CursorPaging, finder)
 	if err != nil {
 		return nil, convertMongoErr(err)
 	}
 
-	includesMap := make(map[string]interface{})
-	var entryList []models.BundleEntryComponent
-	resultVal := reflect.ValueOf(result).Elem()
-	for i := 0; i < resultVal.Len(); i++ {
-		var entry models.BundleEntryComponent
-		entry.Resource = resultVal.Index(i).Addr().Interface()
-		entry.Search = &models.BundleEntrySearchComponent{Mode: "match"}
-		entryList = append(entryList, entry)
-
-		if usesIncludes || usesRevIncludes {
-			rpi, ok := entry.Resource.(ResourcePlusRelatedResources)
-			if ok {
-				for k, v := range rpi.GetIncludedAndRevIncludedResources() {
-					includesMap[k] = v
-				}
-			}
-		}
-	}
-
-	for _, v := range includesMap {
-		var entry models.BundleEntryComponent
-		entry.Resource = v
-		entry.Search = &models.BundleEntrySearchComponent{Mode: "include"}
-		entryList = append(entryList, entry)
-	}
-
-	var bundle models.Bundle
-	bundle.Id = bson.NewObjectId().Hex()
-	bundle.Type = "searchset"
-	bundle.Entry = entryList
-
-	options := searchQuery.Options()
-
-	// Need to get the true total (not just how many were returned in this response)
-	var total uint32
-	if resultVal.Len() == options.Count || resultVal.Len() == 0 {
-		// Need to get total count from the server, since there may be more or the offset was too high
-		intTotal, err := searcher.CreateQueryWithoutOptions(searchQuery).Count()
-		if err != nil {
+	// Loading every GridFS file into a page of results would defeat the point of storing them separately, so the
+	// content is left out of search results unless it was asked for.  Clients read the individual resources to get
+	// it.  The paging cursors are positioned using the resources as they are stored, so this is only done now that
+	// the links have been generated.
+	for _, entry := range bundle.Entry {
+		if dal.ctx == nil || dal.ctx.Value(fullContentKey{}) == nil {
+			dropGridFSContent(entry.Resource)
+		} else if err = dal.loadGridFSContent(entry.Resource); err != nil {
 			return nil, convertMongoErr(err)
 		}
-		total = uint32(intTotal)
-	} else {
-		// We can figure out the total by adding the offset and # results returned
-		total = uint32(options.Offset + resultVal.Len())
 	}
-	bundle.Total = &total
-
-	// Add links for paging
-	bundle.Link = generatePagingLinks(baseURL, searchQuery, total)
 
-	return &bundle, nil
+	return bundle, nil
 }
 
 func (dal *mongoDataAccessLayer) FindIDs(searchQuery search.Query) (IDs []string, err error) {
+	dal, closeSession := dal.withSession()
+	defer closeSession()
+
 	// First create a new query with the unsupported query options filtered out
-	oldParams := searchQuery.URLQueryParameters(false)
+	oldParams := searchQuery.URLQueryParameters(true)
 	newParams := search.URLQueryParameters{}
 	for _, param := range oldParams.All() {
 		switch param.Key {
@@ -201,13 +407,16 @@ func (dal *mongoDataAccessLayer) FindIDs(searchQuery search.Query) (IDs []string
 	newQuery := search.Query{Resource: searchQuery.Resource, Query: newParams.Encode()}
 
 	// Now search on that query, unmarshaling to a temporary struct and converting results to []string
-	searcher := search.NewMongoSearcher(dal.Database)
+	if err := dal.contextErr(); err != nil {
+		return nil, err
+	}
+	searcher := dal.newSearcher()
 	mgoQuery := searcher.CreateQuery(newQuery).Select(bson.M{"_id": 1})
 	results := []struct {
 		ID string `bson:"_id"`
 	}{}
 	if err := mgoQuery.All(&results); err != nil {
-		return nil, err
+		return nil, convertMongoErr(err)
 	}
 	IDs = make([]string, len(results))
 	for i := range results {
@@ -225,7 +434,40 @@ type ResourcePlusRelatedResources interface {
 	GetRevIncludedResources() map[string]interface{}
 }
 
-func generatePagingLinks(baseURL url.URL, query search.Query, total uint32) []models.BundleLinkComponent {
+// mongoSearchFinder finds search results in the Mongo database
+type mongoSearchFinder struct {
+	searcher *search.MongoSearcher
+}
+
+func (f *mongoSearchFinder) find(query search.Query, related bool, result interface{}) error {
+	if related {
+		return f.searcher.RunPipeline(query, result)
+	}
+	return f.searcher.CreateQuery(query).All(result)
+}
+
+func (f *mongoSearchFinder) count(query search.Query) (int, error) {
+	return f.searcher.Count(query, 0)
+}
+
+// estimateCountLimit is the most matches counted when estimating the total number of search results
+const estimateCountLimit = 1000
+
+// estimateTotal estimates the total number of results for a search, for _total=estimate.  Searches on a whole
+// collection use the collection's metadata, which is fast but can be off after an unclean shutdown.  Other searches
+// count up to the estimateCountLimit, and the estimate is only exact if fewer matches are found.
+func (f *mongoSearchFinder) estimateTotal(query search.Query) (total uint32, exact bool, err error) {
+	if len(f.searcher.CreateQueryObject(query)) == 0 {
+		count, err := f.searcher.Count(query, 0)
+		return uint32(count), true, err
+	}
+	count, err := f.searcher.Count(query, estimateCountLimit)
+	return uint32(count), count < estimateCountLimit, err
+}
+
+// generatePagingLinks generates the paging links for a page of results found by offset.  If the total is nil, the
+// last link is left out and morePages determines whether there is a next link.
+func generatePagingLinks(baseURL url.URL, query search.Query, total *uint32, morePages bool) []models.BundleLinkComponent {
 	links := make([]models.BundleLinkComponent, 0, 5)
 	params := query.URLQueryParameters(true)
 	offset := 0
@@ -261,25 +503,80 @@ func generatePagingLinks(baseURL url.URL, query search.Query, total uint32) []mo
 	}
 
 	// Next Link
-	if total > uint32(offset+count) {
+	if (total == nil && morePages) || (total != nil && *total > uint32(offset+count)) {
 		nextOffset := offset + count
 		links = append(links, newLink("next", baseURL, params, nextOffset, count))
 	}
 
+	if total == nil {
+		// Without a total, the last page is unknown
+		return links
+	}
+
 	// Last Link
-	remainder := (int(total) - offset) % count
-	if int(total) < offset {
+	remainder := (int(*total) - offset) % count
+	if int(*total) < offset {
 		remainder = 0
 	}
-	newOffset := int(total) - remainder
-	if remainder == 0 && int(total) > count {
-		newOffset = int(total) - count
+	newOffset := int(*total) - remainder
+	if remainder == 0 && int(*total) > count {
+		newOffset = int(*total) - count
 	}
 	links = append(links, newLink("last", baseURL, params, newOffset, count))
 
 	return links
 }
 
+// generateCursorPagingLinks generates the paging links for a page of results found with cursor paging.  The first
+// and last resources on the page position the previous and next cursors.  morePages indicates that there are more
+// results in the direction that the page was found.
+func generateCursorPagingLinks(baseURL url.URL, query search.Query, first, last interface{}, morePages bool) ([]models.BundleLinkComponent, error) {
+	links := make([]models.BundleLinkComponent, 0, 5)
+	params := query.URLQueryParameters(true)
+	params.Del(search.OffsetParam)
+	cursor := query.Options().Cursor
+	backward := cursor != nil && (cursor.Backward || cursor.Last)
+
+	// Self link
+	links = append(links, newCursorLink("self", baseURL, params, cursor))
+
+	// First link
+	links = append(links, newCursorLink("first", baseURL, params, nil))
+
+	// Previous link
+	if first != nil && ((backward && morePages) || (!backward && cursor != nil)) {
+		prevCursor, err := query.NewCursor(first, true)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, newCursorLink("previous", baseURL, params, prevCursor))
+	}
+
+	// Next link
+	if last != nil && ((!backward && morePages) || (backward && !cursor.Last)) {
+		nextCursor, err := query.NewCursor(last, false)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, newCursorLink("next", baseURL, params, nextCursor))
+	}
+
+	// Last link
+	links = append(links, newCursorLink("last", baseURL, params, &search.Cursor{Last: true}))
+
+	return links, nil
+}
+
+func newCursorLink(relation string, baseURL url.URL, params search.URLQueryParameters, cursor *search.Cursor) models.BundleLinkComponent {
+	if cursor != nil {
+		params.Set(search.CursorParam, cursor.String())
+	} else {
+		params.Del(search.CursorParam)
+	}
+	baseURL.RawQuery = params.Encode()
+	return models.BundleLinkComponent{Relation: relation, Url: baseURL.String()}
+}
+
 func newLink(relation string, baseURL url.URL, params search.URLQueryParameters, offset int, count int) models.BundleLinkComponent {
 	params.Set(search.OffsetParam, strconv.Itoa(offset))
 	params.Set(search.CountParam, strconv.Itoa(count))
@@ -287,13 +584,6 @@ func newLink(relation string, baseURL url.URL, params search.URLQueryParameters,
 	return models.BundleLinkComponent{Relation: relation, Url: baseURL.String()}
 }
 
-func convertIDToBsonID(id string) (bson.ObjectId, error) {
-	if bson.IsObjectIdHex(id) {
-		return bson.ObjectIdHex(id), nil
-	}
-	return bson.ObjectId(""), models.NewOperationOutcome("fatal", "exception", "Id must be a valid BSON ObjectId")
-}
-
 func updateLastUpdatedDate(resource interface{}) {
 	m := reflect.ValueOf(resource).Elem().FieldByName("Meta")
 	if m.IsNil() {
@@ -305,6 +595,9 @@ func updateLastUpdatedDate(resource interface{}) {
 }
 
 func convertMongoErr(err error) error {
+	if queryErr, ok := err.(*mgo.QueryError); ok && queryErr.Code == search.MaxTimeExpiredCode {
+		return context.DeadlineExceeded
+	}
 	switch err {
 	default:
 		return err
@@ -312,3 +605,32 @@ func convertMongoErr(err error) error {
 		return ErrNotFound
 	}
 }
+
+// readPreferences maps the names of Mongo read preferences to mgo's modes
+var readPreferences = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primaryPreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondaryPreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
+
+// ConfigureMongoSession applies the pool limit, read preference, and write concern in the config to the session.
+// The Mongo DataAccessLayer copies the session of its database for each operation, and the copies inherit these
+// settings.
+func ConfigureMongoSession(session *mgo.Session, config Config) error {
+	if config.MongoPoolLimit > 0 {
+		session.SetPoolLimit(config.MongoPoolLimit)
+	}
+	if config.MongoReadPreference != "" {
+		mode, ok := readPreferences[config.MongoReadPreference]
+		if !ok {
+			return fmt.Errorf("Unknown Mongo read preference: %s", config.MongoReadPreference)
+		}
+		session.SetMode(mode, true)
+	}
+	if config.MongoWriteConcern != nil {
+		session.SetSafe(config.MongoWriteConcern)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// gridFSPrefix identifies content that has been moved to GridFS.  In the stored document, the content is replaced
+// with the prefix followed by the hex ID of the GridFS file.
+const gridFSPrefix = "gridfs:"
+
+// gridFSPayload is a base64-encoded string field of a resource that may be stored in GridFS
+type gridFSPayload struct {
+	Content     *string
+	ContentType string
+}
+
+// findGridFSPayloads returns the Binary content and Attachment data of the resource.
+func findGridFSPayloads(resource interface{}) []gridFSPayload {
+	switch binary := resource.(type) {
+	case *models.Binary:
+		return []gridFSPayload{{Content: &binary.Content, ContentType: binary.ContentType}}
+	case *models.BinaryPlus:
+		return []gridFSPayload{{Content: &binary.Content, ContentType: binary.ContentType}}
+	}
+	return findAttachmentPayloadsInValue(reflect.ValueOf(resource))
+}
+
+func findAttachmentPayloadsInValue(val reflect.Value) []gridFSPayload {
+	var payloads []gridFSPayload
+
+	// Dereference pointers in order to simplify things
+	if val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+
+	// Make sure it's a valid thing, else return right away
+	if !val.IsValid() {
+		return payloads
+	}
+
+	// Handle it if it's an attachment, otherwise iterate its members for attachments
+	if val.Type() == reflect.TypeOf(models.Attachment{}) {
+		attachment := val.Addr().Interface().(*models.Attachment)
+		payloads = append(payloads, gridFSPayload{Content: &attachment.Data, ContentType: attachment.ContentType})
+	} else if val.Kind() == reflect.Struct {
+		for i := 0; i < val.NumField(); i++ {
+			payloads = append(payloads, findAttachmentPayloadsInValue(val.Field(i))...)
+		}
+	} else if val.Kind() == reflect.Slice {
+		for i := 0; i < val.Len(); i++ {
+			payloads = append(payloads, findAttachmentPayloadsInValue(val.Index(i))...)
+		}
+	}
+
+	return payloads
+}
+
+func (dal *mongoDataAccessLayer) gridFS() *mgo.GridFS {
+	return dal.Database.GridFS("fs")
+}
+
+// storeGridFSContent moves the resource's payloads that are larger than the GridFS threshold into GridFS, replacing
+// them in the resource with pointers to the GridFS files.  The returned restore function puts the original payloads
+// back into the resource, and should be called once the resource has been stored.  If storing the resource fails,
+// the created files should be removed using the returned file IDs.
+func (dal *mongoDataAccessLayer) storeGridFSContent(resourceType, id string, resource interface{}) (restore func(), fileIDs []bson.ObjectId, err error) {
+	var originals []string
+	var replaced []*string
+	restore = func() {
+		for i := range replaced {
+			*replaced[i] = originals[i]
+		}
+	}
+
+	if dal.GridFSThreshold <= 0 {
+		return restore, nil, nil
+	}
+
+	for _, payload := range findGridFSPayloads(resource) {
+		if len(*payload.Content) <= dal.GridFSThreshold {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(*payload.Content)
+		if err != nil {
+			// Leave invalid content inline, exactly as it was received
+			continue
+		}
+
+		fileID, err := dal.createGridFSFile(resourceType, id, payload.ContentType, data)
+		if err != nil {
+			restore()
+			dal.removeGridFSFiles(fileIDs)
+			return restore, nil, err
+		}
+		fileIDs = append(fileIDs, fileID)
+		originals = append(originals, *payload.Content)
+		replaced = append(replaced, payload.Content)
+		*payload.Content = gridFSPrefix + fileID.Hex()
+	}
+
+	return restore, fileIDs, nil
+}
+
+func (dal *mongoDataAccessLayer) createGridFSFile(resourceType, id, contentType string, data []byte) (bson.ObjectId, error) {
+	file, err := dal.gridFS().Create("")
+	if err != nil {
+		return "", err
+	}
+	file.SetContentType(contentType)
+	file.SetMeta(bson.M{"resourceType": resourceType, "resourceId": id})
+	if _, err = file.Write(data); err != nil {
+		file.Abort()
+		file.Close()
+		return "", err
+	}
+	if err = file.Close(); err != nil {
+		return "", err
+	}
+	return file.Id().(bson.ObjectId), nil
+}
+
+// loadGridFSContent replaces any pointers to GridFS files in the resource with the files' content.
+func (dal *mongoDataAccessLayer) loadGridFSContent(resource interface{}) error {
+	for _, payload := range findGridFSPayloads(resource) {
+		fileID, ok := parseGridFSPointer(*payload.Content)
+		if !ok {
+			continue
+		}
+
+		file, err := dal.gridFS().OpenId(fileID)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		*payload.Content = base64.StdEncoding.EncodeToString(data)
+	}
+	return nil
+}
+
+// dropGridFSContent removes any pointers to GridFS files from the resource, leaving the content out of it.
+func dropGridFSContent(resource interface{}) {
+	for _, payload := range findGridFSPayloads(resource) {
+		if _, ok := parseGridFSPointer(*payload.Content); ok {
+			*payload.Content = ""
+		}
+	}
+}
+
+// findGridFSFiles returns the IDs of the GridFS files belonging to the resources with the given type and IDs.
+func (dal *mongoDataAccessLayer) findGridFSFiles(resourceType string, ids ...string) ([]bson.ObjectId, error) {
+	if dal.GridFSThreshold <= 0 || len(ids) == 0 {
+		return nil, nil
+	}
+
+	var results []struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	query := bson.M{"metadata.resourceType": resourceType, "metadata.resourceId": bson.M{"$in": ids}}
+	if err := dal.gridFS().Find(query).Select(bson.M{"_id": 1}).All(&results); err != nil {
+		return nil, err
+	}
+
+	fileIDs := make([]bson.ObjectId, len(results))
+	for i := range results {
+		fileIDs[i] = results[i].ID
+	}
+	return fileIDs, nil
+}
+
+// removeGridFSFiles removes the GridFS files with the given IDs.  Since the resources referring to these files have
+// already been changed or removed, failures only leave orphaned files behind and are not reported.
+func (dal *mongoDataAccessLayer) removeGridFSFiles(fileIDs []bson.ObjectId) {
+	for _, fileID := range fileIDs {
+		dal.gridFS().RemoveId(fileID)
+	}
+}
+
+// OpenBinaryContent implements the BinaryStreamer interface, opening the GridFS file holding the content of the
+// Binary with the given ID.
+func (dal *mongoDataAccessLayer) OpenBinaryContent(id string) (content io.ReadCloser, contentType string, err error) {
+	if err = validateID(id); err != nil {
+		return nil, "", err
+	}
+
+	// The session is closed along with the content, since the content is read after this returns
+	dal, closeSession := dal.withSession()
+	binary := &models.Binary{}
+	if err = dal.Database.C("binaries").FindId(id).One(binary); err != nil {
+		closeSession()
+		return nil, "", convertMongoErr(err)
+	}
+
+	fileID, ok := parseGridFSPointer(binary.Content)
+	if !ok {
+		closeSession()
+		return nil, binary.ContentType, nil
+	}
+	file, err := dal.gridFS().OpenId(fileID)
+	if err != nil {
+		closeSession()
+		return nil, "", convertMongoErr(err)
+	}
+	return &sessionReadCloser{ReadCloser: file, closeSession: closeSession}, binary.ContentType, nil
+}
+
+// sessionReadCloser closes the session that it is read from when it is closed
+type sessionReadCloser struct {
+	io.ReadCloser
+	closeSession func()
+}
+
+func (r *sessionReadCloser) Close() error {
+	defer r.closeSession()
+	return r.ReadCloser.Close()
+}
+
+func parseGridFSPointer(content string) (bson.ObjectId, bool) {
+	if !strings.HasPrefix(content, gridFSPrefix) {
+		return "", false
+	}
+	hex := strings.TrimPrefix(content, gridFSPrefix)
+	if !bson.IsObjectIdHex(hex) {
+		return "", false
+	}
+	return bson.ObjectIdHex(hex), true
+}
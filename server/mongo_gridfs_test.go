@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+type GridFSSuite struct {
+	Database *mgo.Database
+	Session  *mgo.Session
+	DAL      DataAccessLayer
+	Engine   *gin.Engine
+	Server   *httptest.Server
+}
+
+var _ = Suite(&GridFSSuite{})
+
+var largeContent = bytes.Repeat([]byte("0123456789"), 10)
+
+func (s *GridFSSuite) SetUpSuite(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+
+	// Set up the database
+	var err error
+	s.Session, err = mgo.Dial("localhost")
+	util.CheckErr(err)
+	s.Database = s.Session.DB("fhir-test")
+
+	// Build routes for testing, storing anything over 64 bytes in GridFS
+	config := Config{GridFSThreshold: 64}
+	s.DAL = NewMongoDataAccessLayerWithConfig(s.Database, config)
+	s.Engine = gin.New()
+	RegisterRoutes(s.Engine, make(map[string][]gin.HandlerFunc), s.DAL, config)
+
+	// Create httptest server
+	s.Server = httptest.NewServer(s.Engine)
+}
+
+func (s *GridFSSuite) TearDownTest(c *C) {
+	s.Database.DropDatabase()
+}
+
+func (s *GridFSSuite) TearDownSuite(c *C) {
+	s.Session.Close()
+	s.Server.Close()
+}
+
+func (s *GridFSSuite) TestLargeBinaryContentStoredInGridFS(c *C) {
+	binary := &models.Binary{ContentType: "text/plain", Content: base64.StdEncoding.EncodeToString(largeContent)}
+	id, err := s.DAL.Post(binary)
+	util.CheckErr(err)
+
+	// The resource passed in should still have its content
+	c.Assert(binary.Content, Equals, base64.StdEncoding.EncodeToString(largeContent))
+
+	// But the document should only point to the GridFS file
+	stored := &models.Binary{}
+	util.CheckErr(s.Database.C("binaries").FindId(id).One(stored))
+	c.Assert(strings.HasPrefix(stored.Content, gridFSPrefix), Equals, true)
+	c.Assert(s.fileCount(c), Equals, 1)
+
+	result, err := s.DAL.Get(id, "Binary")
+	util.CheckErr(err)
+	c.Assert(result.(*models.Binary).Content, Equals, base64.StdEncoding.EncodeToString(largeContent))
+}
+
+func (s *GridFSSuite) TestSmallBinaryContentStoredInline(c *C) {
+	binary := &models.Binary{ContentType: "text/plain", Content: base64.StdEncoding.EncodeToString([]byte("small"))}
+	id, err := s.DAL.Post(binary)
+	util.CheckErr(err)
+
+	stored := &models.Binary{}
+	util.CheckErr(s.Database.C("binaries").FindId(id).One(stored))
+	c.Assert(stored.Content, Equals, base64.StdEncoding.EncodeToString([]byte("small")))
+	c.Assert(s.fileCount(c), Equals, 0)
+}
+
+func (s *GridFSSuite) TestLargeAttachmentDataStoredInGridFS(c *C) {
+	patient := &models.Patient{Photo: []models.Attachment{
+		{ContentType: "image/png", Data: base64.StdEncoding.EncodeToString(largeContent)},
+		{ContentType: "image/png", Data: base64.StdEncoding.EncodeToString([]byte("small"))},
+	}}
+	id, err := s.DAL.Post(patient)
+	util.CheckErr(err)
+
+	stored := &models.Patient{}
+	util.CheckErr(s.Database.C("patients").FindId(id).One(stored))
+	c.Assert(strings.HasPrefix(stored.Photo[0].Data, gridFSPrefix), Equals, true)
+	c.Assert(stored.Photo[1].Data, Equals, base64.StdEncoding.EncodeToString([]byte("small")))
+	c.Assert(s.fileCount(c), Equals, 1)
+
+	// Reads return the content from GridFS
+	result, err := s.DAL.Get(id, "Patient")
+	util.CheckErr(err)
+	c.Assert(result.(*models.Patient).Photo[0].Data, Equals, base64.StdEncoding.EncodeToString(largeContent))
+
+	// But searches leave it out, and don't leak the pointer
+	bundle, err := s.DAL.Search(url.URL{}, search.Query{Resource: "Patient"})
+	util.CheckErr(err)
+	c.Assert(bundle.Entry, HasLen, 1)
+	found := bundle.Entry[0].Resource.(*models.Patient)
+	c.Assert(found.Photo[0].Data, Equals, "")
+	c.Assert(found.Photo[1].Data, Equals, base64.StdEncoding.EncodeToString([]byte("small")))
+
+	// Unless the content is asked for
+	bundle, err = WithContext(withFullContent(context.Background()), s.DAL).Search(url.URL{}, search.Query{Resource: "Patient"})
+	util.CheckErr(err)
+	found = bundle.Entry[0].Resource.(*models.Patient)
+	c.Assert(found.Photo[0].Data, Equals, base64.StdEncoding.EncodeToString(largeContent))
+}
+
+func (s *GridFSSuite) TestUpdateReplacesGridFSFiles(c *C) {
+	binary := &models.Binary{ContentType: "text/plain", Content: base64.StdEncoding.EncodeToString(largeContent)}
+	id, err := s.DAL.Post(binary)
+	util.CheckErr(err)
+
+	updated := append([]byte("updated"), largeContent...)
+	binary.Content = base64.StdEncoding.EncodeToString(updated)
+	_, err = s.DAL.Put(id, binary)
+	util.CheckErr(err)
+	c.Assert(s.fileCount(c), Equals, 1)
+
+	result, err := s.DAL.Get(id, "Binary")
+	util.CheckErr(err)
+	c.Assert(result.(*models.Binary).Content, Equals, base64.StdEncoding.EncodeToString(updated))
+}
+
+func (s *GridFSSuite) TestDeleteRemovesGridFSFiles(c *C) {
+	binary := &models.Binary{ContentType: "text/plain", Content: base64.StdEncoding.EncodeToString(largeContent)}
+	id, err := s.DAL.Post(binary)
+	util.CheckErr(err)
+	c.Assert(s.fileCount(c), Equals, 1)
+
+	util.CheckErr(s.DAL.Delete(id, "Binary"))
+	c.Assert(s.fileCount(c), Equals, 0)
+}
+
+func (s *GridFSSuite) TestConditionalDeleteRemovesGridFSFiles(c *C) {
+	for i := 0; i < 2; i++ {
+		patient := &models.Patient{Gender: "female", Photo: []models.Attachment{
+			{ContentType: "image/png", Data: base64.StdEncoding.EncodeToString(largeContent)},
+		}}
+		_, err := s.DAL.Post(patient)
+		util.CheckErr(err)
+	}
+	c.Assert(s.fileCount(c), Equals, 2)
+
+	count, err := s.DAL.ConditionalDelete(search.Query{Resource: "Patient", Query: "gender=female"})
+	util.CheckErr(err)
+	c.Assert(count, Equals, 2)
+	c.Assert(s.fileCount(c), Equals, 0)
+}
+
+func (s *GridFSSuite) TestRawBinaryReadStreamsFromGridFS(c *C) {
+	binary := &models.Binary{ContentType: "text/plain", Content: base64.StdEncoding.EncodeToString(largeContent)}
+	id, err := s.DAL.Post(binary)
+	util.CheckErr(err)
+
+	req, err := http.NewRequest("GET", s.Server.URL+"/Binary/"+id, nil)
+	util.CheckErr(err)
+	req.Header.Set("Accept", "text/plain")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "text/plain")
+	data, err := ioutil.ReadAll(res.Body)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(data, DeepEquals, largeContent)
+}
+
+func (s *GridFSSuite) fileCount(c *C) int {
+	count, err := s.Database.GridFS("fs").Find(nil).Count()
+	util.CheckErr(err)
+	return count
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultSearchIndexes lists the search parameters that are indexed when Config.SearchIndexes is nil: the code,
+// subject, and date of observations, which are the most common searches.  Other parameters can be listed in
+// Config.SearchIndexes as needed.
+var DefaultSearchIndexes = []string{"Observation.code", "Observation.subject", "Observation.date"}
+
+// alwaysIndexed lists the search parameters that are indexed regardless of the configuration, since paging and
+// _lastUpdated searches use them on every collection.  Mongo always indexes _id.
+var alwaysIndexed = []string{"*._lastUpdated"}
+
+// IndexDefinition describes a single-field Mongo index that supports searches on a collection.
+type IndexDefinition struct {
+	Collection string
+	Key        string
+	// Params lists the search parameters that the index supports, as "Resource.param"
+	Params []string
+}
+
+func (def IndexDefinition) String() string {
+	return fmt.Sprintf("%s.%s (%s)", def.Collection, def.Key, strings.Join(def.Params, ", "))
+}
+
+// UnusedIndex identifies an existing index that no query has used since the Mongo server started.
+type UnusedIndex struct {
+	Collection string
+	Name       string
+	Key        []string
+}
+
+func (index UnusedIndex) String() string {
+	return fmt.Sprintf("%s.%s (%s)", index.Collection, index.Name, strings.Join(index.Key, ", "))
+}
+
+// IndexReport lists the defined indexes that are missing from a database, and the indexes in the database that
+// aren't being used.
+type IndexReport struct {
+	Missing []IndexDefinition
+	Unused  []UnusedIndex
+}
+
+// SearchIndexDefinitions derives the definitions of the indexes supporting searches on the passed in search
+// parameters, which are given as "Resource.param", or "*.param" for every resource type with that parameter.  The
+// index keys are derived from the parameters' paths in the search.SearchParameterDictionary.  The definitions also
+// include the indexes that are always created, and are sorted by collection and key.
+func SearchIndexDefinitions(params []string) ([]IndexDefinition, error) {
+	byKey := make(map[string]*IndexDefinition)
+	for _, param := range append(append([]string{}, alwaysIndexed...), params...) {
+		parts := strings.SplitN(param, ".", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid search index %s: must be Resource.param or *.param", param)
+		}
+
+		var infos []search.SearchParamInfo
+		if parts[0] == "*" {
+			for _, resourceType := range allResourceTypes() {
+				if info, ok := search.SearchParameterDictionary[resourceType][parts[1]]; ok {
+					infos = append(infos, info)
+				}
+			}
+		} else if info, ok := search.SearchParameterDictionary[parts[0]][parts[1]]; ok {
+			infos = append(infos, info)
+		}
+		if len(infos) == 0 {
+			return nil, fmt.Errorf("Invalid search index %s: unknown search parameter", param)
+		}
+
+		for _, info := range infos {
+			collection := models.PluralizeLowerResourceName(info.Resource)
+			for _, key := range search.MongoIndexKeys(info) {
+				def, ok := byKey[collection+" "+key]
+				if !ok {
+					def = &IndexDefinition{Collection: collection, Key: key}
+					byKey[collection+" "+key] = def
+				}
+				name := info.Resource + "." + info.Name
+				if !containsString(def.Params, name) {
+					def.Params = append(def.Params, name)
+				}
+			}
+		}
+	}
+
+	defs := make([]IndexDefinition, 0, len(byKey))
+	for _, key := range sortedKeys(byKey) {
+		defs = append(defs, *byKey[key])
+	}
+	return defs, nil
+}
+
+// EnsureSearchIndexes creates the defined indexes in the database, if they don't already exist.  Indexes are built
+// in the background, so the database stays available while they are built.
+func EnsureSearchIndexes(db *mgo.Database, defs []IndexDefinition) error {
+	for _, def := range defs {
+		err := db.C(def.Collection).EnsureIndex(mgo.Index{Key: []string{def.Key}, Background: true})
+		if err != nil {
+			return fmt.Errorf("Couldn't create index %s: %s", def, err)
+		}
+	}
+	return nil
+}
+
+// CheckSearchIndexes reports which of the defined indexes are missing from the database, and which of the indexes
+// in the database have not been used since the Mongo server started.  An index counts as present if its first key is
+// the defined key.  The _id indexes are never reported as unused.
+func CheckSearchIndexes(db *mgo.Database, defs []IndexDefinition) (*IndexReport, error) {
+	names, err := db.CollectionNames()
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	for _, name := range names {
+		existing[name] = true
+	}
+
+	report := &IndexReport{}
+	indexed := make(map[string]bool)
+	for _, name := range names {
+		if strings.HasPrefix(name, "system.") {
+			continue
+		}
+		indexes, err := db.C(name).Indexes()
+		if err != nil {
+			return nil, err
+		}
+		keys := make(map[string][]string)
+		for _, index := range indexes {
+			keys[index.Name] = index.Key
+			if len(index.Key) > 0 {
+				indexed[name+" "+strings.TrimPrefix(index.Key[0], "-")] = true
+			}
+		}
+
+		var stats []indexStats
+		if err = db.C(name).Pipe([]bson.M{{"$indexStats": bson.M{}}}).All(&stats); err != nil {
+			return nil, err
+		}
+		sort.Sort(byIndexName(stats))
+		for _, stat := range stats {
+			if stat.Accesses.Ops == 0 && stat.Name != "_id_" {
+				report.Unused = append(report.Unused, UnusedIndex{Collection: name, Name: stat.Name, Key: keys[stat.Name]})
+			}
+		}
+	}
+
+	for _, def := range defs {
+		if !existing[def.Collection] || !indexed[def.Collection+" "+def.Key] {
+			report.Missing = append(report.Missing, def)
+		}
+	}
+	return report, nil
+}
+
+// indexStats holds the usage statistics of an index, as reported by $indexStats
+type indexStats struct {
+	Name     string `bson:"name"`
+	Accesses struct {
+		Ops int64 `bson:"ops"`
+	} `bson:"accesses"`
+}
+
+// byIndexName sorts index stats by name
+type byIndexName []indexStats
+
+func (s byIndexName) Len() int           { return len(s) }
+func (s byIndexName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s byIndexName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// ConfiguredSearchIndexes returns the definitions of the indexes for the search parameters listed in the config.
+func ConfiguredSearchIndexes(config Config) ([]IndexDefinition, error) {
+	params := config.SearchIndexes
+	if params == nil {
+		params = DefaultSearchIndexes
+	}
+	return SearchIndexDefinitions(params)
+}
+
+// ensureConfiguredSearchIndexes creates the indexes listed in the config in the database, unless the config says to
+// skip them
+func ensureConfiguredSearchIndexes(db *mgo.Database, config Config) error {
+	if config.SkipSearchIndexes {
+		return nil
+	}
+	defs, err := ConfiguredSearchIndexes(config)
+	if err != nil {
+		return err
+	}
+	return EnsureSearchIndexes(db, defs)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+type IndexDefinitionSuite struct{}
+
+var _ = Suite(&IndexDefinitionSuite{})
+
+func (s *IndexDefinitionSuite) TestSearchIndexDefinitions(c *C) {
+	defs, err := SearchIndexDefinitions([]string{"Observation.code", "Observation.patient", "Observation.date", "Patient.name"})
+	util.CheckErr(err)
+
+	keys := make(map[string][]string)
+	for _, def := range defs {
+		keys[def.Collection] = append(keys[def.Collection], def.Key)
+	}
+	c.Assert(keys["observations"], DeepEquals, []string{
+		"code.coding.code",
+		"effectiveDateTime.time",
+		"effectivePeriod.start.time",
+		"meta.lastUpdated.time",
+		"subject.referenceid",
+	})
+	// String parameters are searched with case-insensitive regular expressions, which can't use an index
+	c.Assert(keys["patients"], DeepEquals, []string{"meta.lastUpdated.time"})
+	// Every collection gets a meta.lastUpdated index
+	c.Assert(keys["conditions"], DeepEquals, []string{"meta.lastUpdated.time"})
+
+	for _, def := range defs {
+		if def.Collection == "observations" && def.Key == "subject.referenceid" {
+			c.Assert(def.Params, DeepEquals, []string{"Observation.patient"})
+		}
+	}
+}
+
+func (s *IndexDefinitionSuite) TestSearchIndexDefinitionsWithWildcard(c *C) {
+	defs, err := SearchIndexDefinitions([]string{"*.patient"})
+	util.CheckErr(err)
+	found := make(map[string]bool)
+	for _, def := range defs {
+		found[def.Collection+"."+def.Key] = true
+	}
+	c.Assert(found["conditions.patient.referenceid"], Equals, true)
+	c.Assert(found["encounters.patient.referenceid"], Equals, true)
+	c.Assert(found["observations.subject.referenceid"], Equals, true)
+}
+
+func (s *IndexDefinitionSuite) TestDefaultSearchIndexes(c *C) {
+	defs, err := ConfiguredSearchIndexes(Config{})
+	util.CheckErr(err)
+	var keys []string
+	for _, def := range defs {
+		if def.Collection == "observations" {
+			keys = append(keys, def.Key)
+		}
+	}
+	c.Assert(keys, DeepEquals, []string{
+		"code.coding.code",
+		"effectiveDateTime.time",
+		"effectivePeriod.start.time",
+		"meta.lastUpdated.time",
+		"subject.referenceid",
+	})
+}
+
+func (s *IndexDefinitionSuite) TestInvalidSearchIndexes(c *C) {
+	_, err := SearchIndexDefinitions([]string{"Observation"})
+	c.Assert(err, ErrorMatches, ".*must be Resource.param.*")
+	_, err = SearchIndexDefinitions([]string{"Observation.foo"})
+	c.Assert(err, ErrorMatches, ".*unknown search parameter.*")
+	_, err = ConfiguredSearchIndexes(Config{SearchIndexes: []string{"*.foo"}})
+	c.Assert(err, ErrorMatches, ".*unknown search parameter.*")
+}
+
+type MongoIndexSuite struct {
+	Session  *mgo.Session
+	Database *mgo.Database
+}
+
+var _ = Suite(&MongoIndexSuite{})
+
+func (s *MongoIndexSuite) SetUpSuite(c *C) {
+	var err error
+	s.Session, err = mgo.Dial("localhost")
+	util.CheckErr(err)
+	s.Database = s.Session.DB("fhir-test")
+}
+
+func (s *MongoIndexSuite) TearDownTest(c *C) {
+	s.Database.DropDatabase()
+}
+
+func (s *MongoIndexSuite) TearDownSuite(c *C) {
+	s.Session.Close()
+}
+
+func (s *MongoIndexSuite) TestEnsureAndCheckSearchIndexes(c *C) {
+	defs, err := SearchIndexDefinitions([]string{"Condition.code"})
+	util.CheckErr(err)
+	var conditionDefs []IndexDefinition
+	for _, def := range defs {
+		if def.Collection == "conditions" {
+			conditionDefs = append(conditionDefs, def)
+		}
+	}
+	c.Assert(conditionDefs, HasLen, 2)
+
+	report, err := CheckSearchIndexes(s.Database, conditionDefs)
+	util.CheckErr(err)
+	c.Assert(report.Missing, DeepEquals, conditionDefs)
+
+	util.CheckErr(EnsureSearchIndexes(s.Database, conditionDefs))
+	// Ensuring the indexes again verifies that they exist
+	util.CheckErr(EnsureSearchIndexes(s.Database, conditionDefs))
+	report, err = CheckSearchIndexes(s.Database, conditionDefs)
+	util.CheckErr(err)
+	c.Assert(report.Missing, HasLen, 0)
+	c.Assert(report.Unused, HasLen, 2)
+}
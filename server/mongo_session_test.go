@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+type MongoSessionSuite struct {
+	Session  *mgo.Session
+	Database *mgo.Database
+	DAL      DataAccessLayer
+}
+
+var _ = Suite(&MongoSessionSuite{})
+
+func (s *MongoSessionSuite) SetUpSuite(c *C) {
+	var err error
+	s.Session, err = mgo.Dial("localhost")
+	util.CheckErr(err)
+	util.CheckErr(ConfigureMongoSession(s.Session, Config{MongoPoolLimit: 8}))
+	s.Database = s.Session.DB("fhir-test")
+	s.DAL = NewMongoDataAccessLayer(s.Database)
+}
+
+func (s *MongoSessionSuite) TearDownTest(c *C) {
+	s.Database.DropDatabase()
+}
+
+func (s *MongoSessionSuite) TearDownSuite(c *C) {
+	s.Session.Close()
+}
+
+func (s *MongoSessionSuite) TestConfigureMongoSession(c *C) {
+	session := s.Session.Copy()
+	defer session.Close()
+	util.CheckErr(ConfigureMongoSession(session, Config{
+		MongoReadPreference: "secondaryPreferred",
+		MongoWriteConcern:   &mgo.Safe{WMode: "majority"},
+	}))
+	c.Assert(session.Mode(), Equals, mgo.SecondaryPreferred)
+	c.Assert(session.Safe().WMode, Equals, "majority")
+
+	c.Assert(ConfigureMongoSession(session, Config{MongoReadPreference: "fastest"}), ErrorMatches, "Unknown Mongo read preference: fastest")
+}
+
+func (s *MongoSessionSuite) TestConcurrentOperations(c *C) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := s.DAL.Post(&models.Patient{Gender: "female"})
+			if err == nil {
+				_, err = s.DAL.Get(id, "Patient")
+			}
+			if err == nil {
+				_, err = s.DAL.Search(url.URL{Path: "/Patient"}, search.Query{Resource: "Patient", Query: "gender=female"})
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		util.CheckErr(err)
+	}
+
+	count, err := s.Database.C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 40)
+}
+
+// BenchmarkConcurrentSearches searches from several goroutines at once.  Since each operation gets its own socket,
+// throughput should scale with the number of goroutines, up to the pool limit.
+func (s *MongoSessionSuite) BenchmarkConcurrentSearches(c *C) {
+	for i := 0; i < 100; i++ {
+		_, err := s.DAL.Post(&models.Patient{Gender: "female"})
+		util.CheckErr(err)
+	}
+	c.ResetTimer()
+
+	const workers = 8
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < c.N; i += workers {
+				_, err := s.DAL.Search(url.URL{Path: "/Patient"}, search.Query{Resource: "Patient", Query: "gender=female&_count=10"})
+				util.CheckErr(err)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/intervention-engine/fhir/models"
@@ -15,17 +16,27 @@ import (
 type ResourceController struct {
 	Name string
 	DAL  DataAccessLayer
+	// Operations holds handlers for type-level operations (e.g., "$export"), keyed by operation name.  Since
+	// type-level operations share their URLs with resource instances, ShowHandler dispatches to them.
+	Operations map[string]gin.HandlerFunc
 }
 
 // NewResourceController creates a new resource controller for the passed in resource name and the passed in
 // DataAccessLayer.
 func NewResourceController(name string, dal DataAccessLayer) *ResourceController {
 	return &ResourceController{
-		Name: name,
-		DAL:  dal,
+		Name:       name,
+		DAL:        dal,
+		Operations: make(map[string]gin.HandlerFunc),
 	}
 }
 
+// dal returns the DataAccessLayer to use for the request, which is the tenant's DataAccessLayer when the request has a
+// tenant.  It is bound to the request's context, so its operations are abandoned when the request is.
+func (rc *ResourceController) dal(c *gin.Context) DataAccessLayer {
+	return WithContext(c.Request.Context(), requestDAL(c, rc.DAL))
+}
+
 // IndexHandler handles requests to list resource instances or search for them.
 func (rc *ResourceController) IndexHandler(c *gin.Context) {
 	defer func() {
@@ -44,8 +55,12 @@ func (rc *ResourceController) IndexHandler(c *gin.Context) {
 
 	searchQuery := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
 	baseURL := responseURL(c.Request, rc.Name)
-	bundle, err := rc.DAL.Search(*baseURL, searchQuery)
-	if err != nil {
+	bundle, err := rc.dal(c).Search(*baseURL, searchQuery)
+	if abortOnOutcomeError(c, err) {
+		return
+	} else if abortOnContextError(c, err) {
+		return
+	} else if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
@@ -60,7 +75,7 @@ func (rc *ResourceController) IndexHandler(c *gin.Context) {
 // LoadResource uses the resource id in the request to get a resource from the DataAccessLayer and store it in the
 // context.
 func (rc *ResourceController) LoadResource(c *gin.Context) (interface{}, error) {
-	result, err := rc.DAL.Get(c.Param("id"), rc.Name)
+	result, err := rc.dal(c).Get(c.Param("id"), rc.Name)
 	if err != nil {
 		return nil, err
 	}
@@ -72,9 +87,26 @@ func (rc *ResourceController) LoadResource(c *gin.Context) (interface{}, error)
 
 // ShowHandler handles requests to get a particular resource by ID.
 func (rc *ResourceController) ShowHandler(c *gin.Context) {
+	if operation, ok := rc.Operations[c.Param("id")]; ok {
+		operation(c)
+		return
+	}
+
 	c.Set("Action", "read")
+	if streamer, ok := rc.dal(c).(BinaryStreamer); ok && rc.Name == "Binary" && wantsRawBinary(c.Request) {
+		if streamRawBinary(c, streamer) {
+			return
+		}
+	}
+
 	_, err := rc.LoadResource(c)
-	if err != nil && err != ErrNotFound {
+	if err == ErrInvalidID {
+		// No resource can exist with an invalid ID
+		err = ErrNotFound
+	}
+	if abortOnContextError(c, err) {
+		return
+	} else if err != nil && err != ErrNotFound {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
@@ -84,10 +116,16 @@ func (rc *ResourceController) ShowHandler(c *gin.Context) {
 		return
 	}
 	resource, _ := c.Get(rc.Name)
+	if binary, ok := resource.(*models.Binary); ok && wantsRawBinary(c.Request) {
+		writeRawBinary(c, binary)
+		return
+	}
 	c.JSON(http.StatusOK, resource)
 }
 
-// CreateHandler handles requests to create a new resource instance, assigning it a new ID.
+// CreateHandler handles requests to create a new resource instance, assigning it a new ID.  If the request has an
+// If-None-Exist header holding a search query (a conditional create), the resource is only created if no resource
+// matches the query.  If one does, it is returned instead.
 func (rc *ResourceController) CreateHandler(c *gin.Context) {
 	resource := models.NewStructForResourceName(rc.Name)
 	err := FHIRBind(c, resource)
@@ -97,8 +135,20 @@ func (rc *ResourceController) CreateHandler(c *gin.Context) {
 		return
 	}
 
-	id, err := rc.DAL.Post(resource)
-	if err != nil {
+	if ifNoneExist := c.Request.Header.Get("If-None-Exist"); ifNoneExist != "" {
+		conditionalCreateLock.Lock()
+		defer conditionalCreateLock.Unlock()
+		if rc.existingHandler(c, search.Query{Resource: rc.Name, Query: ifNoneExist}) {
+			return
+		}
+	}
+
+	id, err := rc.dal(c).Post(resource)
+	if abortOnOutcomeError(c, err) {
+		return
+	} else if abortOnContextError(c, err) {
+		return
+	} else if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
@@ -111,6 +161,44 @@ func (rc *ResourceController) CreateHandler(c *gin.Context) {
 	c.JSON(http.StatusCreated, resource)
 }
 
+// conditionalCreateLock is held from the search for a conditional create's matching resource until the resource is
+// created, so that concurrent conditional creates (e.g., from fhir-upload) can't both create a resource.  This only
+// serializes the conditional creates handled by this server process.
+var conditionalCreateLock sync.Mutex
+
+// existingHandler responds with the resource matching the query of a conditional create, if there is one, reporting
+// whether it responded.  If several resources match, the create fails.
+func (rc *ResourceController) existingHandler(c *gin.Context, query search.Query) bool {
+	IDs, err := rc.dal(c).FindIDs(query)
+	if abortOnContextError(c, err) {
+		return true
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return true
+	}
+
+	switch len(IDs) {
+	case 0:
+		return false
+	case 1:
+		resource, err := rc.dal(c).Get(IDs[0], rc.Name)
+		if abortOnContextError(c, err) {
+			return true
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return true
+		}
+		c.Set(rc.Name, resource)
+		c.Set("Resource", rc.Name)
+		c.Set("Action", "read")
+		c.Header("Location", responseURL(c.Request, rc.Name, IDs[0]).String())
+		c.JSON(http.StatusOK, resource)
+	default:
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+	}
+	return true
+}
+
 // UpdateHandler handles requests to update a resource having a given ID.  If the resource with that ID does not
 // exist, a new resource is created with that ID.
 func (rc *ResourceController) UpdateHandler(c *gin.Context) {
@@ -122,8 +210,16 @@ func (rc *ResourceController) UpdateHandler(c *gin.Context) {
 		return
 	}
 
-	createdNew, err := rc.DAL.Put(c.Param("id"), resource)
-	if err != nil {
+	createdNew, err := rc.dal(c).Put(c.Param("id"), resource)
+	if err == ErrInvalidID {
+		oo := models.NewOperationOutcome("error", "invalid", err.Error())
+		c.JSON(http.StatusBadRequest, oo)
+		return
+	} else if abortOnOutcomeError(c, err) {
+		return
+	} else if abortOnContextError(c, err) {
+		return
+	} else if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
@@ -155,10 +251,14 @@ func (rc *ResourceController) ConditionalUpdateHandler(c *gin.Context) {
 	}
 
 	query := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
-	id, createdNew, err := rc.DAL.ConditionalPut(query, resource)
+	id, createdNew, err := rc.dal(c).ConditionalPut(query, resource)
 	if err == ErrMultipleMatches {
 		c.AbortWithStatus(http.StatusPreconditionFailed)
 		return
+	} else if abortOnOutcomeError(c, err) {
+		return
+	} else if abortOnContextError(c, err) {
+		return
 	} else if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -176,11 +276,22 @@ func (rc *ResourceController) ConditionalUpdateHandler(c *gin.Context) {
 	}
 }
 
-// DeleteHandler handles requests to delete a resource instance identified by its ID.
+// DeleteHandler handles requests to delete a resource instance identified by its ID.  If the _cascade parameter is
+// set to "delete", the resources referring to it are deleted as well.
 func (rc *ResourceController) DeleteHandler(c *gin.Context) {
+	if c.Query(CascadeParam) != "" {
+		rc.cascadeDeleteHandler(c)
+		return
+	}
+
 	id := c.Param("id")
 
-	if err := rc.DAL.Delete(id, rc.Name); err != nil && err != ErrNotFound {
+	err := rc.dal(c).Delete(id, rc.Name)
+	if abortOnOutcomeError(c, err) {
+		return
+	} else if abortOnContextError(c, err) {
+		return
+	} else if err != nil && err != ErrNotFound && err != ErrInvalidID {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
@@ -193,11 +304,21 @@ func (rc *ResourceController) DeleteHandler(c *gin.Context) {
 }
 
 // ConditionalDeleteHandler handles requests to delete resources identified by search criteria.  All resources
-// matching the search criteria will be deleted.
+// matching the search criteria will be deleted.  Cascading deletes are only supported for single resources.
 func (rc *ResourceController) ConditionalDeleteHandler(c *gin.Context) {
+	if _, ok := c.Request.URL.Query()[CascadeParam]; ok {
+		oo := models.NewOperationOutcome("error", "not-supported", fmt.Sprintf("%s is not supported on conditional deletes", CascadeParam))
+		c.JSON(http.StatusBadRequest, oo)
+		return
+	}
+
 	query := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
-	_, err := rc.DAL.ConditionalDelete(query)
-	if err != nil {
+	_, err := rc.dal(c).ConditionalDelete(query)
+	if abortOnOutcomeError(c, err) {
+		return
+	} else if abortOnContextError(c, err) {
+		return
+	} else if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
@@ -216,6 +337,9 @@ func responseURL(r *http.Request, paths ...string) *url.URL {
 		responseURL.Scheme = "https"
 	}
 	responseURL.Host = r.Host
+	if prefix := tenantPath(r); prefix != "" {
+		paths = append([]string{prefix}, paths...)
+	}
 	responseURL.Path = fmt.Sprintf("/%s", strings.Join(paths, "/"))
 
 	return &responseURL
@@ -10,9 +10,13 @@ import (
 	"golang.org/x/oauth2"
 )
 
-// RegisterController registers the CRUD routes (and middleware) for a FHIR resource
-func RegisterController(name string, e *gin.Engine, m []gin.HandlerFunc, dal DataAccessLayer, config Config) {
+// RegisterController registers the CRUD routes (and middleware) for a FHIR resource, returning the controller so
+// that type-level operations can be added to it
+func RegisterController(name string, e gin.IRouter, m []gin.HandlerFunc, dal DataAccessLayer, config Config) *ResourceController {
 	rc := NewResourceController(name, dal)
+	if !config.exposes(name) {
+		return rc
+	}
 	rcBase := e.Group("/" + name)
 
 	if len(m) > 0 {
@@ -23,9 +27,9 @@ func RegisterController(name string, e *gin.Engine, m []gin.HandlerFunc, dal Dat
 	case auth.AuthTypeNone:
 		// do nothing
 	case auth.AuthTypeOIDC:
-		rcBase.Use(auth.HEARTScopesHandler(name))
+		rcBase.Use(auth.HEARTScopesHandler(name), auth.AdminScopesHandler(isCascadeDelete))
 	case auth.AuthTypeHEART:
-		rcBase.Use(auth.HEARTScopesHandler(name))
+		rcBase.Use(auth.HEARTScopesHandler(name), auth.AdminScopesHandler(isCascadeDelete))
 	}
 
 	rcBase.GET("", rc.IndexHandler)
@@ -37,6 +41,8 @@ func RegisterController(name string, e *gin.Engine, m []gin.HandlerFunc, dal Dat
 	rcItem.GET("", rc.ShowHandler)
 	rcItem.PUT("", rc.UpdateHandler)
 	rcItem.DELETE("", rc.DeleteHandler)
+
+	return rc
 }
 
 // RegisterRoutes registers the routes for each of the FHIR resources
@@ -81,6 +87,26 @@ func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal Data
 
 	}
 
+	if serverConfig.RequestTimeout > 0 {
+		e.Use(TimeoutHandler(serverConfig.RequestTimeout))
+	}
+
+	// Multi-tenant Support
+	var router gin.IRouter = e
+	if serverConfig.TenantResolver != nil {
+		// Tenants are identified by a URL prefix or, on the routes without the prefix, by a header.  The routes
+		// without the prefix require the header unless requests without a tenant are allowed to use the default
+		// DataAccessLayer.
+		tenantRouter := e.Group("/t/:tenant", TenantHandler(serverConfig.TenantResolver, "", true))
+		registerFHIRRoutes(tenantRouter, config, dal, serverConfig)
+		requireTenant := dal == nil || !serverConfig.AllowDefaultTenant
+		router = e.Group("/", TenantHandler(serverConfig.TenantResolver, serverConfig.TenantHeader, requireTenant))
+	}
+	registerFHIRRoutes(router, config, dal, serverConfig)
+}
+
+// registerFHIRRoutes registers the batch, bulk data, and resource routes with the passed in router
+func registerFHIRRoutes(e gin.IRouter, config map[string][]gin.HandlerFunc, dal DataAccessLayer, serverConfig Config) {
 	// Batch Support
 	batch := NewBatchController(dal)
 	batchHandlers := make([]gin.HandlerFunc, len(config["Batch"]))
@@ -88,6 +114,22 @@ func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal Data
 	batchHandlers = append(batchHandlers, batch.Post)
 	e.POST("/", batchHandlers...)
 
+	// Bulk Data Support
+	export := NewBulkExportController(dal, serverConfig.BulkExportDir)
+	bulkBase := e.Group("/")
+	if serverConfig.Auth.Method != auth.AuthTypeNone {
+		bulkBase.Use(auth.HEARTScopesHandler("*"))
+	}
+	bulkBase.GET("/$export", export.SystemExportHandler)
+	bulkBase.GET("/$export-poll-status/:id", export.StatusHandler)
+	bulkBase.DELETE("/$export-poll-status/:id", export.CancelHandler)
+	bulkBase.GET("/$export-files/:id/:file", export.FileHandler)
+
+	// Bulk Data Import Support
+	bulkImport := NewBulkImportController(dal, serverConfig.BulkImportDir)
+	bulkBase.POST("/$import", bulkImport.ImportHandler)
+	bulkBase.GET("/$import-files/:id/:file", bulkImport.FileHandler)
+
 	// Resources
 
 	RegisterController("Account", e, config["Account"], dal, serverConfig)
@@ -156,7 +198,7 @@ func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal Data
 	RegisterController("Order", e, config["Order"], dal, serverConfig)
 	RegisterController("OrderResponse", e, config["OrderResponse"], dal, serverConfig)
 	RegisterController("Organization", e, config["Organization"], dal, serverConfig)
-	RegisterController("Patient", e, config["Patient"], dal, serverConfig)
+	patientController := RegisterController("Patient", e, config["Patient"], dal, serverConfig)
 	RegisterController("PaymentNotice", e, config["PaymentNotice"], dal, serverConfig)
 	RegisterController("PaymentReconciliation", e, config["PaymentReconciliation"], dal, serverConfig)
 	RegisterController("Person", e, config["Person"], dal, serverConfig)
@@ -184,4 +226,17 @@ func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal Data
 	RegisterController("ValueSet", e, config["ValueSet"], dal, serverConfig)
 	RegisterController("VisionPrescription", e, config["VisionPrescription"], dal, serverConfig)
 
+	// Operations
+	patientController.Operations["$export"] = export.PatientExportHandler
+
+	if !serverConfig.exposes("Group") {
+		return
+	}
+	groupExportHandlers := make([]gin.HandlerFunc, len(config["Group"]))
+	copy(groupExportHandlers, config["Group"])
+	if serverConfig.Auth.Method != auth.AuthTypeNone {
+		groupExportHandlers = append(groupExportHandlers, auth.HEARTScopesHandler("Group"))
+	}
+	groupExportHandlers = append(groupExportHandlers, export.GroupExportHandler)
+	e.GET("/Group/:id/$export", groupExportHandlers...)
 }
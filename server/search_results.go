@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net/url"
+	"reflect"
+	"strconv"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// searchFinder finds the results of searches for searchBundle, in whatever data store a DataAccessLayer uses
+type searchFinder interface {
+	// find finds a page of results for the query, unmarshaling them into result.  If related is true, result is a
+	// slice of "plus related resources" structs, which also hold the resources matched by any _include and
+	// _revinclude options, and the results of backward cursors are returned in order.
+	find(query search.Query, related bool, result interface{}) error
+	// count counts all of the results for the query, ignoring its options
+	count(query search.Query) (int, error)
+	// estimateTotal estimates the number of results for the query, for _total=estimate, also indicating whether
+	// the estimate is exact.  An inexact estimate is a lower bound.
+	estimateTotal(query search.Query) (total uint32, exact bool, err error)
+}
+
+// searchBundle performs a search, returning the page of results as a searchset Bundle with its total and paging
+// links.  If cursorPaging is true, the paging links use cursors whenever the query's sort allows it.
+func searchBundle(baseURL url.URL, searchQuery search.Query, cursorPaging bool, finder searchFinder) (*models.Bundle, error) {
+	options := searchQuery.Options()
+	usesCursor := (cursorPaging || options.Cursor != nil) && searchQuery.SupportsCursorPaging()
+	accurateTotal := options.Total == "" || options.Total == search.TotalAccurate
+	pageQuery := searchQuery
+	if usesCursor || !accurateTotal {
+		// Ask for one extra result, to find out whether there is another page beyond this one without counting
+		params := searchQuery.URLQueryParameters(true)
+		params.Set(search.CountParam, strconv.Itoa(options.Count+1))
+		pageQuery = search.Query{Resource: searchQuery.Resource, Query: params.Encode()}
+	}
+
+	var result interface{}
+	usesIncludes := len(options.Include) > 0
+	usesRevIncludes := len(options.RevInclude) > 0
+	// Only find related resources (which is slower) if it is needed
+	related := usesIncludes || usesRevIncludes || usesCursor
+	if related {
+		result = models.NewSlicePlusForResourceName(searchQuery.Resource, 0, 0)
+	} else {
+		result = models.NewSliceForResourceName(searchQuery.Resource, 0, 0)
+	}
+	if err := finder.find(pageQuery, related, result); err != nil {
+		return nil, err
+	}
+
+	resultVal := reflect.ValueOf(result).Elem()
+	morePages := false
+	if (usesCursor || !accurateTotal) && resultVal.Len() > options.Count {
+		// Drop the extra result, which is at the start of the page when paging backward
+		morePages = true
+		if options.Cursor != nil && (options.Cursor.Backward || options.Cursor.Last) {
+			resultVal = resultVal.Slice(1, resultVal.Len())
+		} else {
+			resultVal = resultVal.Slice(0, options.Count)
+		}
+	}
+
+	includesMap := make(map[string]interface{})
+	var entryList []models.BundleEntryComponent
+	for i := 0; i < resultVal.Len(); i++ {
+		var entry models.BundleEntryComponent
+		entry.Resource = resultVal.Index(i).Addr().Interface()
+		entry.Search = &models.BundleEntrySearchComponent{Mode: "match"}
+		entryList = append(entryList, entry)
+
+		if usesIncludes || usesRevIncludes {
+			rpi, ok := entry.Resource.(ResourcePlusRelatedResources)
+			if ok {
+				for k, v := range rpi.GetIncludedAndRevIncludedResources() {
+					includesMap[k] = v
+				}
+			}
+		}
+	}
+
+	for _, v := range includesMap {
+		var entry models.BundleEntryComponent
+		entry.Resource = v
+		entry.Search = &models.BundleEntrySearchComponent{Mode: "include"}
+		entryList = append(entryList, entry)
+	}
+
+	var bundle models.Bundle
+	bundle.Id = bson.NewObjectId().Hex()
+	bundle.Type = "searchset"
+	bundle.Entry = entryList
+
+	// Need to get the true total (not just how many were returned in this response), unless told otherwise
+	var total *uint32
+	exactTotal := true
+	lastPage := resultVal.Len() < options.Count || (!accurateTotal && !morePages)
+	switch {
+	case options.Total == search.TotalNone:
+		// Leave the total out
+	case !usesCursor && lastPage && (resultVal.Len() > 0 || options.Offset == 0):
+		// We can figure out the total by adding the offset and # results returned
+		total = new(uint32)
+		*total = uint32(options.Offset + resultVal.Len())
+	case options.Total == search.TotalEstimate:
+		estimate, exact, err := finder.estimateTotal(searchQuery)
+		if err != nil {
+			return nil, err
+		}
+		total = &estimate
+		// If the estimate only says there are at least that many, it can't locate the last page
+		exactTotal = exact
+	default:
+		// Need to get total count from the data store, since there may be more or the offset was too high
+		intTotal, err := finder.count(searchQuery)
+		if err != nil {
+			return nil, err
+		}
+		total = new(uint32)
+		*total = uint32(intTotal)
+	}
+	bundle.Total = total
+
+	// Add links for paging
+	if usesCursor {
+		var first, last interface{}
+		if resultVal.Len() > 0 {
+			first = resultVal.Index(0).Addr().Interface()
+			last = resultVal.Index(resultVal.Len() - 1).Addr().Interface()
+		}
+		var err error
+		bundle.Link, err = generateCursorPagingLinks(baseURL, searchQuery, first, last, morePages)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		linkTotal := total
+		if !exactTotal {
+			linkTotal = nil
+		}
+		bundle.Link = generatePagingLinks(baseURL, searchQuery, linkTotal, morePages)
+	}
+
+	return &bundle, nil
+}
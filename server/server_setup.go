@@ -16,18 +16,34 @@ type FHIRServer struct {
 	Engine           *gin.Engine
 	MiddlewareConfig map[string][]gin.HandlerFunc
 	AfterRoutes      []AfterRoutes
+	Interceptors     map[string][]Interceptor
 }
 
 func (f *FHIRServer) AddMiddleware(key string, middleware gin.HandlerFunc) {
 	f.MiddlewareConfig[key] = append(f.MiddlewareConfig[key], middleware)
 }
 
+// AddInterceptor adds an interceptor for the resource type (or AllResources), which is called around the data
+// access operations on resources of that type.
+func (f *FHIRServer) AddInterceptor(resourceType string, interceptor Interceptor) {
+	if f.Interceptors == nil {
+		f.Interceptors = make(map[string][]Interceptor)
+	}
+	f.Interceptors[resourceType] = append(f.Interceptors[resourceType], interceptor)
+}
+
 func NewServer(databaseHost string) *FHIRServer {
+	return NewServerWithCORSOrigins(databaseHost, "*")
+}
+
+// NewServerWithCORSOrigins creates a server that allows cross-origin requests from the passed in origins, which are
+// separated by commas, or "*" for any origin.  The databaseHost may be a host name or a mongodb:// URL.
+func NewServerWithCORSOrigins(databaseHost, origins string) *FHIRServer {
 	server := &FHIRServer{DatabaseHost: databaseHost, MiddlewareConfig: make(map[string][]gin.HandlerFunc)}
 	server.Engine = gin.Default()
 
 	server.Engine.Use(cors.Middleware(cors.Config{
-		Origins:         "*",
+		Origins:         origins,
 		Methods:         "GET, PUT, POST, DELETE",
 		RequestHeaders:  "Origin, Authorization, Content-Type, If-Match, If-None-Exist",
 		ExposedHeaders:  "Location, ETag, Last-Modified",
@@ -49,14 +65,42 @@ func (f *FHIRServer) Run(config Config) {
 	}
 	log.Println("Connected to mongodb")
 	defer session.Close()
+	if err = ConfigureMongoSession(session, config); err != nil {
+		panic(err)
+	}
 
-	Database = session.DB("fhir")
+	databaseName := config.DatabaseName
+	if databaseName == "" {
+		databaseName = "fhir"
+	}
+	Database = session.DB(databaseName)
+	if err = ensureConfiguredSearchIndexes(Database, config); err != nil {
+		panic(err)
+	}
+	log.Println("Verified search indexes")
+	if len(f.Interceptors) > 0 {
+		interceptors := make(map[string][]Interceptor)
+		for resourceType, list := range config.Interceptors {
+			interceptors[resourceType] = append(interceptors[resourceType], list...)
+		}
+		for resourceType, list := range f.Interceptors {
+			interceptors[resourceType] = append(interceptors[resourceType], list...)
+		}
+		config.Interceptors = interceptors
+	}
+	if config.MultiTenant && config.TenantResolver == nil {
+		config.TenantResolver = NewMongoTenantResolver(session, "fhir-", config)
+	}
 
-	RegisterRoutes(f.Engine, f.MiddlewareConfig, NewMongoDataAccessLayer(Database), config)
+	RegisterRoutes(f.Engine, f.MiddlewareConfig, NewMongoDataAccessLayerWithConfig(Database, config), config)
 
 	for _, ar := range f.AfterRoutes {
 		ar(f.Engine)
 	}
 
-	f.Engine.Run(":3001")
+	listenAddress := config.ListenAddress
+	if listenAddress == "" {
+		listenAddress = ":3001"
+	}
+	f.Engine.Run(listenAddress)
 }
@@ -286,6 +286,56 @@ func (s *ServerSuite) TestCreatePatientByPut(c *C) {
 	s.checkCreatedPatient(createdPatientID, c)
 }
 
+func (s *ServerSuite) TestCreatePatientByPutWithClientAssignedID(c *C) {
+	data, err := os.Open("../fixtures/patient-example-b.json")
+	util.CheckErr(err)
+	defer data.Close()
+
+	req, err := http.NewRequest("PUT", s.Server.URL+"/Patient/example-1.b", data)
+	util.CheckErr(err)
+
+	req.Header.Add("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+
+	c.Assert(res.StatusCode, Equals, 201)
+	c.Assert(res.Header.Get("Location"), Equals, s.Server.URL+"/Patient/example-1.b")
+	s.checkCreatedPatient("example-1.b", c)
+
+	res, err = http.Get(s.Server.URL + "/Patient/example-1.b")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+}
+
+func (s *ServerSuite) TestCreatePatientByPutWithInvalidID(c *C) {
+	data, err := os.Open("../fixtures/patient-example-b.json")
+	util.CheckErr(err)
+	defer data.Close()
+
+	req, err := http.NewRequest("PUT", s.Server.URL+"/Patient/"+strings.Repeat("a", 65), data)
+	util.CheckErr(err)
+
+	req.Header.Add("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+
+	c.Assert(res.StatusCode, Equals, 400)
+	oo := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(oo))
+	c.Assert(oo.Issue, HasLen, 1)
+	c.Assert(oo.Issue[0].Severity, Equals, "error")
+	c.Assert(oo.Issue[0].Code, Equals, "invalid")
+	count, err := s.Database.C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+}
+
+func (s *ServerSuite) TestGetPatientWithInvalidID(c *C) {
+	res, err := http.Get(s.Server.URL + "/Patient/not_valid")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
 func (s *ServerSuite) checkCreatedPatient(createdPatientID string, c *C) {
 	patientCollection := s.Database.C("patients")
 	patient := models.Patient{}
@@ -506,6 +556,116 @@ func (s *ServerSuite) TestConditionalDelete(c *C) {
 	c.Assert(count, Equals, 8)
 }
 
+func (s *ServerSuite) TestGetPatientsWithTotal(c *C) {
+	// Add 14 more patients
+	for i := 0; i < 14; i++ {
+		s.insertPatientFromFixture("../fixtures/patient-example-a.json")
+	}
+
+	// No total, so no last link
+	bundle := performSearch(c, s.Server.URL+"/Patient?_total=none&_count=10")
+	c.Assert(bundle.Entry, HasLen, 10)
+	c.Assert(bundle.Total, IsNil)
+	c.Assert(bundle.Link, HasLen, 3)
+	assertPagingLink(c, bundle.Link[0], "self", 10, 0)
+	assertPagingLink(c, bundle.Link[1], "first", 10, 0)
+	assertPagingLink(c, bundle.Link[2], "next", 10, 10)
+
+	bundle = performSearch(c, s.Server.URL+"/Patient?_total=none&_count=10&_offset=10")
+	c.Assert(bundle.Entry, HasLen, 5)
+	c.Assert(bundle.Total, IsNil)
+	c.Assert(bundle.Link, HasLen, 3)
+	assertPagingLink(c, bundle.Link[2], "previous", 10, 0)
+
+	// Estimates on a whole collection are exact
+	bundle = assertBundleCount(c, s.Server.URL+"/Patient?_total=estimate&_count=10", 10, 15)
+	c.Assert(bundle.Link, HasLen, 4)
+	assertPagingLink(c, bundle.Link[3], "last", 10, 10)
+	assertBundleCount(c, s.Server.URL+"/Patient?_total=estimate&gender=male&_count=10", 10, 15)
+
+	assertBundleCount(c, s.Server.URL+"/Patient?_total=accurate&_count=10", 10, 15)
+
+	res, err := http.Get(s.Server.URL + "/Patient?_total=sometimes")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *ServerSuite) TestGetPatientsCursorPaging(c *C) {
+	// Add 24 more patients, all with the same birth date
+	for i := 0; i < 24; i++ {
+		s.insertPatientFromFixture("../fixtures/patient-example-a.json")
+	}
+
+	e := gin.New()
+	RegisterRoutes(e, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayerWithConfig(s.Database, Config{CursorPaging: true}), Config{})
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	// Page forward, using the next links
+	var forward []string
+	bundle := performSearch(c, server.URL+"/Patient?_sort:desc=birthdate&_count=10")
+	c.Assert(*bundle.Total, Equals, uint32(25))
+	c.Assert(getLink(bundle, "previous"), Equals, "")
+	for pages := 1; ; pages++ {
+		for _, entry := range bundle.Entry {
+			id, _ := models.GetResourceID(entry.Resource)
+			forward = append(forward, id)
+		}
+		next := getLink(bundle, "next")
+		if next == "" {
+			c.Assert(pages, Equals, 3)
+			break
+		}
+		c.Assert(strings.Contains(next, search.OffsetParam), Equals, false)
+		bundle = performSearch(c, next)
+	}
+	c.Assert(forward, HasLen, 25)
+	for i := 1; i < len(forward); i++ {
+		// Ties on the birth date are broken by ID
+		c.Assert(forward[i-1] < forward[i], Equals, true)
+	}
+
+	// Page backward from the last page, using the previous links
+	var backward []string
+	bundle = performSearch(c, getLink(bundle, "last"))
+	for {
+		var page []string
+		for _, entry := range bundle.Entry {
+			id, _ := models.GetResourceID(entry.Resource)
+			page = append(page, id)
+		}
+		backward = append(page, backward...)
+		prev := getLink(bundle, "previous")
+		if prev == "" {
+			break
+		}
+		bundle = performSearch(c, prev)
+	}
+	c.Assert(backward, DeepEquals, forward)
+
+	// Adding a patient doesn't shift the next page
+	bundle = performSearch(c, server.URL+"/Patient?_sort:desc=birthdate&_count=10")
+	next := getLink(bundle, "next")
+	s.insertPatientFromFixture("../fixtures/patient-example-a.json")
+	bundle = performSearch(c, next)
+	id, _ := models.GetResourceID(bundle.Entry[0].Resource)
+	c.Assert(id, Equals, forward[10])
+
+	// A garbled cursor is rejected
+	res, err := http.Get(server.URL + "/Patient?_cursor=garbage")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func getLink(bundle *models.Bundle, relation string) string {
+	for _, link := range bundle.Link {
+		if link.Relation == relation {
+			return link.Url
+		}
+	}
+	return ""
+}
+
 func performSearch(c *C, url string) *models.Bundle {
 	res, err := http.Get(url)
 	util.CheckErr(err)
@@ -550,6 +710,23 @@ func assertPagingLinkWithParams(c *C, link models.BundleLinkComponent, relation
 	c.Assert(v.Get(search.OffsetParam), Equals, fmt.Sprint(offset))
 }
 
+func (s *ServerSuite) TestExposedResourceTypes(c *C) {
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.Database), Config{ResourceTypes: []string{"Patient"}})
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/Patient")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	res, err = http.Get(server.URL + "/Observation")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+	res, err = http.Get(server.URL + "/Group/123/$export")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+}
+
 func (s *ServerSuite) insertPatientFromFixture(filePath string) *models.Patient {
 	patientCollection := s.Database.C("patients")
 	patient := loadPatientFromFixture(filePath)
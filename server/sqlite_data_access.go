@@ -0,0 +1,405 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"sync"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NewSQLiteDataAccessLayer returns an implementation of DataAccessLayer that is backed by a SQLite database, creating
+// the tables it needs if they don't exist yet.  Resources are stored as JSON, with the values of their search
+// parameters extracted into index tables, and searches are translated into SQL.  The caller opens the database,
+// which requires importing a SQLite driver (such as github.com/mattn/go-sqlite3).  Since SQLite allows only one
+// writer at a time, the database is limited to a single connection.
+func NewSQLiteDataAccessLayer(db *sql.DB) (DataAccessLayer, error) {
+	return NewSQLiteDataAccessLayerWithConfig(db, Config{})
+}
+
+// NewSQLiteDataAccessLayerWithConfig returns an implementation of DataAccessLayer that is backed by a SQLite
+// database, using the paging and integrity options and interceptors in the passed in config
+func NewSQLiteDataAccessLayerWithConfig(db *sql.DB, config Config) (DataAccessLayer, error) {
+	db.SetMaxOpenConns(1)
+	for _, statement := range search.SQLSchema {
+		if _, err := db.Exec(statement); err != nil {
+			return nil, err
+		}
+	}
+	var dal DataAccessLayer = &sqliteDataAccessLayer{DB: db, CursorPaging: config.CursorPaging}
+	if config.EnforceReferentialIntegrity {
+		dal = NewIntegrityDataAccessLayer(dal)
+	}
+	if len(config.Interceptors) > 0 {
+		dal = NewInterceptorDataAccessLayer(dal, config.Interceptors)
+	}
+	return dal, nil
+}
+
+type sqliteDataAccessLayer struct {
+	DB *sql.DB
+	// CursorPaging indicates that search results are paged through with opaque cursors rather than offsets, when
+	// the sort allows it.
+	CursorPaging bool
+	// mutex ensures that searches see each write in full, since a search can take several statements
+	mutex sync.RWMutex
+}
+
+// sqlQueryer is implemented by both *sql.DB and *sql.Tx
+type sqlQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (dal *sqliteDataAccessLayer) Get(id, resourceType string) (result interface{}, err error) {
+	if err = validateID(id); err != nil {
+		return nil, err
+	}
+
+	dal.mutex.RLock()
+	defer dal.mutex.RUnlock()
+	var content string
+	err = dal.DB.QueryRow("SELECT content FROM resources WHERE collection = ? AND id = ?",
+		models.PluralizeLowerResourceName(resourceType), id).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	result = models.NewStructForResourceName(resourceType)
+	if err = json.Unmarshal([]byte(content), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (dal *sqliteDataAccessLayer) Post(resource interface{}) (id string, err error) {
+	id = bson.NewObjectId().Hex()
+	err = dal.PostWithID(id, resource)
+	return
+}
+
+func (dal *sqliteDataAccessLayer) PostWithID(id string, resource interface{}) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+
+	reflect.ValueOf(resource).Elem().FieldByName("Id").SetString(id)
+	updateLastUpdatedDate(resource)
+
+	dal.mutex.Lock()
+	defer dal.mutex.Unlock()
+	return dal.inTransaction(func(tx *sql.Tx) error {
+		if _, exists, err := dal.findSeq(tx, reflect.TypeOf(resource).Elem().Name(), id); err != nil {
+			return err
+		} else if exists {
+			// Report the duplicate ID the same way as Mongo, so mgo.IsDup recognizes it
+			return &mgo.LastError{Code: 11000, Err: "duplicate key error: " + id}
+		}
+		_, err := dal.store(tx, id, resource)
+		return err
+	})
+}
+
+func (dal *sqliteDataAccessLayer) Put(id string, resource interface{}) (createdNew bool, err error) {
+	if err = validateID(id); err != nil {
+		return false, err
+	}
+
+	reflect.ValueOf(resource).Elem().FieldByName("Id").SetString(id)
+	updateLastUpdatedDate(resource)
+
+	dal.mutex.Lock()
+	defer dal.mutex.Unlock()
+	err = dal.inTransaction(func(tx *sql.Tx) error {
+		createdNew, err = dal.store(tx, id, resource)
+		return err
+	})
+	return createdNew, err
+}
+
+func (dal *sqliteDataAccessLayer) PutBatch(resourceType string, resources []interface{}) error {
+	ids := make([]string, len(resources))
+	for i, resource := range resources {
+		id, _ := models.GetResourceID(resource)
+		if err := validateID(id); err != nil {
+			return err
+		}
+		ids[i] = id
+	}
+
+	dal.mutex.Lock()
+	defer dal.mutex.Unlock()
+	return dal.inTransaction(func(tx *sql.Tx) error {
+		for i, resource := range resources {
+			updateLastUpdatedDate(resource)
+			if _, err := dal.store(tx, ids[i], resource); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (dal *sqliteDataAccessLayer) ConditionalPut(query search.Query, resource interface{}) (id string, createdNew bool, err error) {
+	if IDs, err := dal.FindIDs(query); err == nil {
+		switch len(IDs) {
+		case 0:
+			id = bson.NewObjectId().Hex()
+		case 1:
+			id = IDs[0]
+		default:
+			return "", false, ErrMultipleMatches
+		}
+	} else {
+		return "", false, err
+	}
+
+	createdNew, err = dal.Put(id, resource)
+	return id, createdNew, err
+}
+
+func (dal *sqliteDataAccessLayer) Delete(id, resourceType string) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+
+	dal.mutex.Lock()
+	defer dal.mutex.Unlock()
+	return dal.inTransaction(func(tx *sql.Tx) error {
+		seq, exists, err := dal.findSeq(tx, resourceType, id)
+		if err != nil {
+			return err
+		} else if !exists {
+			return ErrNotFound
+		}
+		return dal.remove(tx, seq)
+	})
+}
+
+func (dal *sqliteDataAccessLayer) ConditionalDelete(query search.Query) (count int, err error) {
+	dal.mutex.Lock()
+	defer dal.mutex.Unlock()
+	err = dal.inTransaction(func(tx *sql.Tx) error {
+		seqs, err := querySeqs(tx, search.NewSQLSearcher().CreateQueryWithoutOptions(query))
+		if err != nil {
+			return err
+		}
+		for _, seq := range seqs {
+			if err := dal.remove(tx, seq); err != nil {
+				return err
+			}
+		}
+		count = len(seqs)
+		return nil
+	})
+	return count, err
+}
+
+func (dal *sqliteDataAccessLayer) Search(baseURL url.URL, searchQuery search.Query) (*models.Bundle, error) {
+	dal.mutex.RLock()
+	defer dal.mutex.RUnlock()
+	searcher := search.NewSQLSearcher()
+	searcher.SetCursorPaging(dal.CursorPaging)
+	return searchBundle(baseURL, searchQuery, dal.CursorPaging, &sqliteSearchFinder{db: dal.DB, searcher: searcher})
+}
+
+func (dal *sqliteDataAccessLayer) FindIDs(searchQuery search.Query) (IDs []string, err error) {
+	// First create a new query with the unsupported query options filtered out
+	oldParams := searchQuery.URLQueryParameters(true)
+	newParams := search.URLQueryParameters{}
+	for _, param := range oldParams.All() {
+		switch param.Key {
+		case search.ContainedParam, search.ContainedTypeParam, search.ElementsParam, search.IncludeParam,
+			search.RevIncludeParam, search.SummaryParam:
+			continue
+		default:
+			newParams.Add(param.Key, param.Value)
+		}
+	}
+	newQuery := search.Query{Resource: searchQuery.Resource, Query: newParams.Encode()}
+
+	dal.mutex.RLock()
+	defer dal.mutex.RUnlock()
+	docs, err := findDocuments(dal.DB, search.NewSQLSearcher().CreateQuery(newQuery))
+	if err != nil {
+		return nil, err
+	}
+	IDs = make([]string, len(docs))
+	for i := range docs {
+		IDs[i] = docs[i]["_id"].(string)
+	}
+	return IDs, nil
+}
+
+// inTransaction runs fn in a transaction, which is committed if fn succeeds and rolled back otherwise
+func (dal *sqliteDataAccessLayer) inTransaction(fn func(tx *sql.Tx) error) error {
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// findSeq finds the seq of the resource with the given type and ID, also returning whether it exists
+func (dal *sqliteDataAccessLayer) findSeq(q sqlQueryer, resourceType, id string) (seq int64, exists bool, err error) {
+	err = q.QueryRow("SELECT seq FROM resources WHERE collection = ? AND id = ?",
+		models.PluralizeLowerResourceName(resourceType), id).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return seq, err == nil, err
+}
+
+// store creates or updates the resource along with its index rows, returning true if it is new
+func (dal *sqliteDataAccessLayer) store(q sqlQueryer, id string, resource interface{}) (createdNew bool, err error) {
+	resourceType := reflect.TypeOf(resource).Elem().Name()
+	content, err := json.Marshal(resource)
+	if err != nil {
+		return false, err
+	}
+	doc := bson.M{}
+	if err = convertDocument(resource, &doc); err != nil {
+		return false, err
+	}
+
+	searcher := search.NewSQLSearcher()
+	seq, exists, err := dal.findSeq(q, resourceType, id)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		if _, err = q.Exec("UPDATE resources SET content = ? WHERE seq = ?", string(content), seq); err != nil {
+			return false, err
+		}
+		if err = execStatements(q, searcher.DeleteIndexStatements(seq)); err != nil {
+			return false, err
+		}
+	} else {
+		result, err := q.Exec("INSERT INTO resources (collection, id, content) VALUES (?, ?, ?)",
+			models.PluralizeLowerResourceName(resourceType), id, string(content))
+		if err != nil {
+			return false, err
+		}
+		if seq, err = result.LastInsertId(); err != nil {
+			return false, err
+		}
+	}
+	return !exists, execStatements(q, searcher.IndexStatements(seq, resourceType, doc))
+}
+
+// remove deletes the resource with the given seq along with its index rows
+func (dal *sqliteDataAccessLayer) remove(q sqlQueryer, seq int64) error {
+	if err := execStatements(q, search.NewSQLSearcher().DeleteIndexStatements(seq)); err != nil {
+		return err
+	}
+	_, err := q.Exec("DELETE FROM resources WHERE seq = ?", seq)
+	return err
+}
+
+func execStatements(q sqlQueryer, statements []search.SQLStatement) error {
+	for _, statement := range statements {
+		if _, err := q.Exec(statement.SQL, statement.Args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// querySeqs runs a statement selecting the seq and content of resources, returning only the seqs
+func querySeqs(q sqlQueryer, statement search.SQLStatement) ([]int64, error) {
+	rows, err := q.Query(statement.SQL, statement.Args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var seqs []int64
+	for rows.Next() {
+		var seq int64
+		var content string
+		if err = rows.Scan(&seq, &content); err != nil {
+			return nil, err
+		}
+		seqs = append(seqs, seq)
+	}
+	return seqs, rows.Err()
+}
+
+// findDocuments runs a statement selecting the seq and content of resources, returning the resources as documents,
+// just as they would be stored in Mongo
+func findDocuments(q sqlQueryer, statement search.SQLStatement) ([]bson.M, error) {
+	rows, err := q.Query(statement.SQL, statement.Args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs := []bson.M{}
+	for rows.Next() {
+		var seq int64
+		var content string
+		if err = rows.Scan(&seq, &content); err != nil {
+			return nil, err
+		}
+		var header struct {
+			ResourceType string `json:"resourceType"`
+		}
+		if err = json.Unmarshal([]byte(content), &header); err != nil {
+			return nil, err
+		}
+		resource := models.NewStructForResourceName(header.ResourceType)
+		if err = json.Unmarshal([]byte(content), resource); err != nil {
+			return nil, err
+		}
+		doc := bson.M{}
+		if err = convertDocument(resource, &doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+// sqliteSearchFinder finds search results in the SQLite database
+type sqliteSearchFinder struct {
+	db       *sql.DB
+	searcher *search.SQLSearcher
+}
+
+func (f *sqliteSearchFinder) find(query search.Query, related bool, result interface{}) error {
+	docs, err := findDocuments(f.db, f.searcher.CreateQuery(query))
+	if err != nil {
+		return err
+	}
+	if related {
+		find := func(statement search.SQLStatement) ([]bson.M, error) {
+			return findDocuments(f.db, statement)
+		}
+		if docs, err = f.searcher.AddRelated(query, docs, find); err != nil {
+			return err
+		}
+	}
+	return convertDocument(docs, result)
+}
+
+func (f *sqliteSearchFinder) count(query search.Query) (int, error) {
+	statement := f.searcher.CreateCountQuery(query)
+	var count int
+	err := f.db.QueryRow(statement.SQL, statement.Args...).Scan(&count)
+	return count, err
+}
+
+func (f *sqliteSearchFinder) estimateTotal(query search.Query) (total uint32, exact bool, err error) {
+	// The index tables make counting cheap enough that the estimate is always exact
+	count, err := f.count(query)
+	return uint32(count), true, err
+}
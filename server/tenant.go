@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+)
+
+// TenantResolver maps tenants to the DataAccessLayers holding their data.  Implementations may give each tenant its
+// own database, or share a database and discriminate between tenants within it.
+type TenantResolver interface {
+	// Resolve returns the DataAccessLayer for the tenant with the given ID, or ErrUnknownTenant if there is no such
+	// tenant.
+	Resolve(tenant string) (DataAccessLayer, error)
+}
+
+// TenantResolverFunc allows an ordinary function to be used as a TenantResolver.
+type TenantResolverFunc func(tenant string) (DataAccessLayer, error)
+
+// Resolve calls f(tenant)
+func (f TenantResolverFunc) Resolve(tenant string) (DataAccessLayer, error) {
+	return f(tenant)
+}
+
+// ErrUnknownTenant indicates that the tenant requested does not exist
+var ErrUnknownTenant = errors.New("Unknown Tenant")
+
+// tenantIDRegex restricts tenant IDs to characters that are safe to use in URLs, database names, and file paths
+var tenantIDRegex = regexp.MustCompile(`^[A-Za-z0-9_\-]{1,64}$`)
+
+// NewMongoTenantResolver returns a TenantResolver that stores each tenant's data in its own Mongo database, named by
+// appending the tenant ID to the passed in prefix.  Each tenant's DataAccessLayer is created using the passed in
+// config, and the configured search indexes are created in each tenant's database when it is first resolved.
+func NewMongoTenantResolver(session *mgo.Session, databasePrefix string, config Config) TenantResolver {
+	return &mongoTenantResolver{
+		Session:        session,
+		DatabasePrefix: databasePrefix,
+		Config:         config,
+		dals:           make(map[string]DataAccessLayer),
+	}
+}
+
+type mongoTenantResolver struct {
+	Session        *mgo.Session
+	DatabasePrefix string
+	Config         Config
+
+	lock sync.Mutex
+	dals map[string]DataAccessLayer
+}
+
+func (r *mongoTenantResolver) Resolve(tenant string) (DataAccessLayer, error) {
+	if !tenantIDRegex.MatchString(tenant) {
+		return nil, ErrUnknownTenant
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	dal, ok := r.dals[tenant]
+	if !ok {
+		db := r.Session.DB(r.DatabasePrefix + tenant)
+		if err := ensureConfiguredSearchIndexes(db, r.Config); err != nil {
+			return nil, err
+		}
+		dal = NewMongoDataAccessLayerWithConfig(db, r.Config)
+		r.dals[tenant] = dal
+	}
+	return dal, nil
+}
+
+type tenantContextKey int
+
+const (
+	tenantIDKey tenantContextKey = iota
+	tenantPathKey
+)
+
+// tenantDALKey is the key of the tenant's DataAccessLayer in the gin context
+const tenantDALKey = "TenantDAL"
+
+// TenantHandler returns middleware that identifies the tenant of each request, either from the :tenant URL parameter
+// or from the passed in header, and resolves the DataAccessLayer that the request's handlers should use.  Requests
+// that don't identify a tenant are left alone, unless requireTenant is true.
+func TenantHandler(resolver TenantResolver, header string, requireTenant bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant, fromPath := c.Param("tenant"), true
+		if tenant == "" && header != "" {
+			tenant, fromPath = c.Request.Header.Get(header), false
+		}
+		if tenant == "" {
+			if requireTenant {
+				c.JSON(http.StatusBadRequest, models.NewOperationOutcome("error", "required", "A tenant is required"))
+				c.Abort()
+			}
+			return
+		}
+
+		var dal DataAccessLayer
+		var err error
+		if tenantIDRegex.MatchString(tenant) {
+			dal, err = resolver.Resolve(tenant)
+		} else {
+			err = ErrUnknownTenant
+		}
+		if err == ErrUnknownTenant {
+			c.JSON(http.StatusNotFound, models.NewOperationOutcome("error", "not-found", "Unknown tenant: "+tenant))
+			c.Abort()
+			return
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		ctx := context.WithValue(c.Request.Context(), tenantIDKey, tenant)
+		if fromPath {
+			// URLs returned to the client need to keep the tenant prefix
+			ctx = context.WithValue(ctx, tenantPathKey, "t/"+tenant)
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Set("Tenant", tenant)
+		c.Set(tenantDALKey, dal)
+	}
+}
+
+// TenantFromRequest returns the ID of the request's tenant, or an empty string if the request doesn't have one.
+func TenantFromRequest(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantIDKey).(string)
+	return tenant
+}
+
+// tenantPath returns the path prefix identifying the request's tenant, or an empty string if the tenant isn't
+// identified by the path.
+func tenantPath(r *http.Request) string {
+	path, _ := r.Context().Value(tenantPathKey).(string)
+	return path
+}
+
+// requestDAL returns the DataAccessLayer of the request's tenant, or the passed in default DataAccessLayer if the
+// request doesn't have a tenant.
+func requestDAL(c *gin.Context, defaultDAL DataAccessLayer) DataAccessLayer {
+	if dal, ok := c.Get(tenantDALKey); ok {
+		return dal.(DataAccessLayer)
+	}
+	return defaultDAL
+}
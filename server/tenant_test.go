@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/pebbe/util"
+	. "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+)
+
+type TenantSuite struct {
+	Session *mgo.Session
+	Engine  *gin.Engine
+	Server  *httptest.Server
+}
+
+var _ = Suite(&TenantSuite{})
+
+func (s *TenantSuite) SetUpSuite(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+
+	// Set up the database
+	var err error
+	s.Session, err = mgo.Dial("localhost")
+	util.CheckErr(err)
+
+	// Build routes for testing, with each tenant in its own database and no default database
+	config := Config{TenantHeader: "X-Tenant"}
+	config.TenantResolver = NewMongoTenantResolver(s.Session, "fhir-test-", config)
+	s.Engine = gin.New()
+	RegisterRoutes(s.Engine, make(map[string][]gin.HandlerFunc), nil, config)
+
+	// Create httptest server
+	s.Server = httptest.NewServer(s.Engine)
+}
+
+func (s *TenantSuite) TearDownTest(c *C) {
+	s.Session.DB("fhir-test-a").DropDatabase()
+	s.Session.DB("fhir-test-b").DropDatabase()
+}
+
+func (s *TenantSuite) TearDownSuite(c *C) {
+	s.Session.Close()
+	s.Server.Close()
+}
+
+func (s *TenantSuite) TestCreateWithTenantPrefix(c *C) {
+	res := s.postPatient(c, "/t/a/Patient", "")
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+	c.Assert(strings.HasPrefix(res.Header.Get("Location"), s.Server.URL+"/t/a/Patient/"), Equals, true)
+
+	count, err := s.Session.DB("fhir-test-a").C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+	count, err = s.Session.DB("fhir-test-b").C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 0)
+}
+
+func (s *TenantSuite) TestCreateWithTenantHeader(c *C) {
+	res := s.postPatient(c, "/Patient", "b")
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+	c.Assert(strings.HasPrefix(res.Header.Get("Location"), s.Server.URL+"/Patient/"), Equals, true)
+
+	count, err := s.Session.DB("fhir-test-b").C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+}
+
+func (s *TenantSuite) TestTenantsAreIsolated(c *C) {
+	s.postPatient(c, "/t/a/Patient", "")
+	s.postPatient(c, "/t/a/Patient", "")
+	s.postPatient(c, "/t/b/Patient", "")
+
+	bundle := assertBundleCount(c, s.Server.URL+"/t/a/Patient", 2, 2)
+	c.Assert(strings.HasPrefix(bundle.Link[0].Url, s.Server.URL+"/t/a/Patient?"), Equals, true)
+	assertBundleCount(c, s.Server.URL+"/t/b/Patient", 1, 1)
+
+	// The tenant in the URL takes precedence over the header
+	req, err := http.NewRequest("GET", s.Server.URL+"/t/b/Patient", nil)
+	util.CheckErr(err)
+	req.Header.Set("X-Tenant", "a")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	bundle = &models.Bundle{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(bundle))
+	res.Body.Close()
+	c.Assert(*bundle.Total, Equals, uint32(1))
+}
+
+func (s *TenantSuite) TestTenantRequired(c *C) {
+	res, err := http.Get(s.Server.URL + "/Patient")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *TenantSuite) TestInvalidTenant(c *C) {
+	res := s.postPatient(c, "/Patient", "not a tenant!")
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *TenantSuite) TestTenantRequiredWithDefaultDataAccessLayer(c *C) {
+	resolver := TenantResolverFunc(func(tenant string) (DataAccessLayer, error) {
+		return NewMemoryDataAccessLayer(), nil
+	})
+	e := gin.New()
+	RegisterRoutes(e, make(map[string][]gin.HandlerFunc), NewMemoryDataAccessLayer(), Config{TenantResolver: resolver})
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	// Requests without a tenant don't silently fall back to the default DataAccessLayer
+	res, err := http.Get(server.URL + "/Patient")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+	res, err = http.Get(server.URL + "/t/a/Patient")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *TenantSuite) TestAllowDefaultTenant(c *C) {
+	resolver := TenantResolverFunc(func(tenant string) (DataAccessLayer, error) {
+		return NewMemoryDataAccessLayer(), nil
+	})
+	e := gin.New()
+	config := Config{TenantResolver: resolver, AllowDefaultTenant: true}
+	RegisterRoutes(e, make(map[string][]gin.HandlerFunc), NewMemoryDataAccessLayer(), config)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/Patient")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *TenantSuite) TestCustomResolver(c *C) {
+	db := s.Session.DB("fhir-test-a")
+	resolver := TenantResolverFunc(func(tenant string) (DataAccessLayer, error) {
+		if tenant != "a" {
+			return nil, ErrUnknownTenant
+		}
+		return NewMongoDataAccessLayer(db), nil
+	})
+	e := gin.New()
+	RegisterRoutes(e, make(map[string][]gin.HandlerFunc), nil, Config{TenantResolver: resolver})
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/t/a/Patient")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	res, err = http.Get(server.URL + "/t/b/Patient")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *TenantSuite) postPatient(c *C, path string, tenant string) *http.Response {
+	data, err := os.Open("../fixtures/patient-example-a.json")
+	util.CheckErr(err)
+	defer data.Close()
+
+	req, err := http.NewRequest("POST", s.Server.URL+path, data)
+	util.CheckErr(err)
+	req.Header.Set("Content-Type", "application/json+fhir")
+	if tenant != "" {
+		req.Header.Set("X-Tenant", tenant)
+	}
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	return res
+}
@@ -0,0 +1,163 @@
+package upload
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/intervention-engine/fhir/client"
+	"github.com/intervention-engine/fhir/models"
+)
+
+// BundleError reports that the server rejected a Bundle of resources, or some of the Bundle's entries
+type BundleError struct {
+	// StatusCode is the HTTP status of the server's response to the Bundle
+	StatusCode int
+	// Outcome is the OperationOutcome that the server responded with when it rejected the whole Bundle, if any
+	Outcome *models.OperationOutcome
+	// Entries describes the entries that the server rejected when it accepted the Bundle
+	Entries []EntryError
+}
+
+func (e *BundleError) Error() string {
+	if len(e.Entries) == 0 {
+		msg := fmt.Sprintf("The server rejected the Bundle with status %d", e.StatusCode)
+		if e.Outcome != nil {
+			for _, issue := range e.Outcome.Issue {
+				msg += ": " + issue.Diagnostics
+			}
+		}
+		return msg
+	}
+
+	entries := make([]string, len(e.Entries))
+	for i, entry := range e.Entries {
+		entries[i] = entry.Error()
+	}
+	return fmt.Sprintf("The server rejected %d of the Bundle's entries: %s", len(e.Entries), strings.Join(entries, ", "))
+}
+
+// EntryError describes a Bundle entry that the server rejected
+type EntryError struct {
+	// Index is the index of the entry in the Bundle
+	Index int
+	// ResourceType and ID identify the resource in the entry, by its ID before it was uploaded
+	ResourceType string
+	ID           string
+	// Status is the entry's response status
+	Status string
+}
+
+func (e EntryError) Error() string {
+	return fmt.Sprintf("entry %d (%s %s): %s", e.Index, e.ResourceType, e.ID, e.Status)
+}
+
+// uploadBundles uploads the resources, which are sorted by dependency, in Bundles of the uploader's BundleType.  Each
+// Bundle gives its entries urn:uuid fullUrls, and references to resources in the same Bundle are rewritten to them,
+// so the server resolves those references.  References to resources in earlier Bundles are rewritten to their
+// locations on the server.  References that form cycles have already been removed, since a server enforcing
+// referential integrity may not resolve them.  The function is called with each resource that the server accepts,
+// along with its old ID and new location.
+func (u *Uploader) uploadBundles(resources []interface{}, refMap map[string]string, record func(resource interface{}, oldID, loc string) error) error {
+	size := u.BundleSize
+	if size <= 0 {
+		size = len(resources)
+	}
+	for start := 0; start < len(resources); start += size {
+		end := start + size
+		if end > len(resources) {
+			end = len(resources)
+		}
+		if err := u.uploadBundle(resources[start:end], refMap, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *Uploader) uploadBundle(resources []interface{}, refMap map[string]string, record func(resource interface{}, oldID, loc string) error) error {
+	bundleRefs := make(map[string]string)
+	for oldID, loc := range refMap {
+		bundleRefs[oldID] = loc
+	}
+	fullURLs := make([]string, len(resources))
+	for i, resource := range resources {
+		fullURLs[i] = "urn:uuid:" + newUUID()
+		if oldID := getId(resource); oldID != "" {
+			bundleRefs[oldID] = fullURLs[i]
+		}
+	}
+	bundle := &models.Bundle{Type: u.BundleType, Entry: make([]models.BundleEntryComponent, len(resources))}
+	oldIDs := make([]string, len(resources))
+	// The Bundle can only be repeated without risking duplicates if all of its entries are conditional creates
+	retryable := isTransient
+	for i, resource := range resources {
+		if err := updateReferences(resource, bundleRefs); err != nil {
+			return err
+		}
+		resourceType := reflect.TypeOf(resource).Elem().Name()
+		oldIDs[i] = getId(resource)
+		bundle.Entry[i] = models.BundleEntryComponent{
+			FullUrl:  fullURLs[i],
+			Resource: resource,
+			Request:  &models.BundleEntryRequestComponent{Method: "POST", Url: resourceType, IfNoneExist: u.conditionalQuery(resource)},
+		}
+		if bundle.Entry[i].Request.IfNoneExist == "" {
+			retryable = wasNotProcessed
+		}
+	}
+
+	var responseBundle *models.Bundle
+	err := u.withRetries(retryable, func() (err error) {
+		responseBundle, err = u.client().Batch(bundle)
+		return err
+	})
+	if e, ok := err.(*client.Error); ok {
+		return &BundleError{StatusCode: e.StatusCode, Outcome: e.Outcome}
+	} else if err != nil {
+		return err
+	}
+	if len(responseBundle.Entry) != len(resources) {
+		return fmt.Errorf("The server responded to a Bundle of %d entries with %d entries", len(resources), len(responseBundle.Entry))
+	}
+
+	bundleErr := &BundleError{StatusCode: http.StatusOK}
+	for i, entry := range responseBundle.Entry {
+		resourceType := reflect.TypeOf(resources[i]).Elem().Name()
+		var id string
+		if entry.Response != nil && strings.HasPrefix(entry.Response.Status, "2") {
+			id = client.IDFromLocation(entry.Response.Location)
+		}
+		if id == "" {
+			status := "no response"
+			if entry.Response != nil {
+				status = entry.Response.Status
+				if strings.HasPrefix(status, "2") {
+					status += " without a location"
+				}
+			}
+			bundleErr.Entries = append(bundleErr.Entries, EntryError{Index: i, ResourceType: resourceType, ID: oldIDs[i], Status: status})
+			continue
+		}
+
+		setId(resources[i], id)
+		if err := record(resources[i], oldIDs[i], resourceType+"/"+id); err != nil {
+			return err
+		}
+	}
+	if len(bundleErr.Entries) > 0 {
+		return bundleErr
+	}
+	return nil
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
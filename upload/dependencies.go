@@ -0,0 +1,168 @@
+package upload
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// orderByDependency sorts the resources so that each one comes after the resources it references with cid:
+// references, using a depth-first topological sort that otherwise keeps the resources in their original order.  A
+// reference that would close a cycle (e.g., between linked Patients) is returned as deferred instead: its resource is
+// created without it, and updated with it once the resource it references exists.
+func orderByDependency(resources []interface{}) ([]interface{}, *deferredReferences) {
+	byID := make(map[string]interface{})
+	for _, resource := range resources {
+		if id := getId(resource); id != "" {
+			byID[id] = resource
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[interface{}]int)
+	sorted := make([]interface{}, 0, len(resources))
+	deferred := newDeferredReferences()
+
+	var visit func(resource interface{})
+	visit = func(resource interface{}) {
+		state[resource] = visiting
+		for _, ref := range getAllReferences(resource) {
+			target, ok := referencedResource(ref, byID)
+			if !ok {
+				continue
+			}
+			switch state[target] {
+			case unvisited:
+				visit(target)
+			case visiting:
+				// The target is still waiting on this resource, so this reference closes a cycle
+				deferred.add(resource, ref)
+			}
+		}
+		state[resource] = visited
+		sorted = append(sorted, resource)
+	}
+	for _, resource := range resources {
+		if state[resource] == unvisited {
+			visit(resource)
+		}
+	}
+	return sorted, deferred
+}
+
+// referencedResource returns the resource that the cid: reference refers to, if it is one of the passed in resources
+func referencedResource(ref *models.Reference, byID map[string]interface{}) (interface{}, bool) {
+	if !strings.HasPrefix(ref.Reference, "cid:") {
+		return nil, false
+	}
+	target, ok := byID[strings.TrimPrefix(ref.Reference, "cid:")]
+	return target, ok
+}
+
+// deferredReferences holds the references that are removed from resources to break dependency cycles, along with
+// the functions that put them back
+type deferredReferences struct {
+	byOwner   map[interface{}][]*models.Reference
+	ownerList []interface{}
+	restorers []func()
+}
+
+func newDeferredReferences() *deferredReferences {
+	return &deferredReferences{byOwner: make(map[interface{}][]*models.Reference)}
+}
+
+func (d *deferredReferences) add(owner interface{}, ref *models.Reference) {
+	if _, ok := d.byOwner[owner]; !ok {
+		d.ownerList = append(d.ownerList, owner)
+	}
+	d.byOwner[owner] = append(d.byOwner[owner], ref)
+}
+
+// remove takes the deferred references out of their resources, so the resources can be created without them.  The
+// pointers to the references are set to nil and the references are dropped from slices, rather than being emptied,
+// since an empty reference isn't valid.
+func (d *deferredReferences) remove() {
+	for _, owner := range d.ownerList {
+		refs := make(map[*models.Reference]bool)
+		for _, ref := range d.byOwner[owner] {
+			refs[ref] = true
+		}
+		d.restorers = append(d.restorers, detachReferences(reflect.ValueOf(owner), refs)...)
+	}
+}
+
+// restore puts the deferred references back into their resources
+func (d *deferredReferences) restore() {
+	for i := len(d.restorers) - 1; i >= 0; i-- {
+		d.restorers[i]()
+	}
+	d.restorers = nil
+}
+
+// owners returns the resources that have deferred references, in the order they were found
+func (d *deferredReferences) owners() []interface{} {
+	return d.ownerList
+}
+
+var (
+	referencePtrType   = reflect.TypeOf(&models.Reference{})
+	referenceSliceType = reflect.TypeOf([]models.Reference{})
+)
+
+// detachReferences removes the references from the value, wherever models.FindReferences would find them, and
+// returns the functions that put them back.  The references themselves are left untouched.
+func detachReferences(val reflect.Value, refs map[*models.Reference]bool) []func() {
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+	if !val.IsValid() {
+		return nil
+	}
+
+	var restorers []func()
+	switch val.Kind() {
+	case reflect.Struct:
+		for i := 0; i < val.NumField(); i++ {
+			field := val.Field(i)
+			switch {
+			case field.CanSet() && field.Type() == referencePtrType && refs[field.Interface().(*models.Reference)]:
+				original := reflect.ValueOf(field.Interface())
+				field.Set(reflect.Zero(field.Type()))
+				restorers = append(restorers, func() { field.Set(original) })
+			case field.CanSet() && field.Type() == referenceSliceType:
+				if restorer := dropReferences(field, refs); restorer != nil {
+					restorers = append(restorers, restorer)
+				}
+			default:
+				restorers = append(restorers, detachReferences(field, refs)...)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < val.Len(); i++ {
+			restorers = append(restorers, detachReferences(val.Index(i), refs)...)
+		}
+	}
+	return restorers
+}
+
+// dropReferences replaces the slice of references with a new slice without the passed in references, returning the
+// function that puts the original slice back, or nil if the slice has none of the references
+func dropReferences(field reflect.Value, refs map[*models.Reference]bool) func() {
+	original := reflect.ValueOf(field.Interface())
+	kept := reflect.Zero(field.Type())
+	for i := 0; i < original.Len(); i++ {
+		if !refs[original.Index(i).Addr().Interface().(*models.Reference)] {
+			kept = reflect.Append(kept, original.Index(i))
+		}
+	}
+	if kept.Len() == original.Len() {
+		return nil
+	}
+	field.Set(kept)
+	return func() { field.Set(original) }
+}
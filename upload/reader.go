@@ -0,0 +1,70 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// ReadResources reads the FHIR JSON resources from the reader, which may hold a single resource, a Bundle, or
+// newline-delimited JSON (NDJSON) with one resource per line.  The resources in the entries of Bundles are returned
+// in place of the Bundles themselves.
+func ReadResources(r io.Reader) ([]interface{}, error) {
+	var resources []interface{}
+	decoder := json.NewDecoder(r)
+	for {
+		var resourceMap map[string]interface{}
+		if err := decoder.Decode(&resourceMap); err == io.EOF {
+			return resources, nil
+		} else if err != nil {
+			return resources, fmt.Errorf("Invalid JSON: %s", err)
+		}
+
+		if resourceMap["resourceType"] != "Bundle" {
+			resource, err := mapToResource(resourceMap)
+			if err != nil {
+				return resources, err
+			}
+			resources = append(resources, resource)
+			continue
+		}
+
+		entries, _ := resourceMap["entry"].([]interface{})
+		for _, entry := range entries {
+			entryMap, _ := entry.(map[string]interface{})
+			if entryMap["resource"] == nil {
+				continue
+			}
+			resourceMap, ok := entryMap["resource"].(map[string]interface{})
+			if !ok {
+				return resources, fmt.Errorf("Invalid Bundle entry resource: %v", entryMap["resource"])
+			}
+			resource, err := mapToResource(resourceMap)
+			if err != nil {
+				return resources, err
+			}
+			resources = append(resources, resource)
+		}
+	}
+}
+
+func mapToResource(resourceMap map[string]interface{}) (interface{}, error) {
+	resourceType, _ := resourceMap["resourceType"].(string)
+	if resourceType == "" {
+		return nil, fmt.Errorf("Missing resourceType")
+	}
+	if models.StructForResourceName(resourceType) == nil {
+		return nil, fmt.Errorf("Unsupported resourceType: %s", resourceType)
+	}
+	data, err := json.Marshal(resourceMap)
+	if err != nil {
+		return nil, err
+	}
+	resource := models.NewStructForResourceName(resourceType)
+	if err := json.Unmarshal(data, resource); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", resourceType, err)
+	}
+	return resource, nil
+}
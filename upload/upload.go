@@ -1,25 +1,27 @@
 package upload
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
 	"reflect"
-	"regexp"
 	"strings"
 
+	"github.com/intervention-engine/fhir/client"
 	"github.com/intervention-engine/fhir/models"
 )
 
 /*
  * NOTE: This is a destructive operation.  Resources will be updated with new server-assigned ID and
  * its references will point to server locations of other resources.
+ *
+ * Resources whose references form a cycle are first created without the references that close the cycle, and are
+ * updated with them once every resource has been created.
  */
 func UploadResources(resources []interface{}, baseURL string) (map[string]string, error) {
 	refMap := make(map[string]string)
-	resources = sortResourcesByDependency(resources)
+	resources, deferred := orderByDependency(resources)
+	deferred.remove()
 	for _, t := range resources {
 		err := updateReferences(t, refMap)
 		if err != nil {
@@ -41,36 +43,61 @@ func UploadResources(resources []interface{}, baseURL string) (map[string]string
 		}
 	}
 
+	// Now that every resource exists, put the references that were removed to break cycles back
+	deferred.restore()
+	c := client.New(baseURL)
+	for _, t := range deferred.owners() {
+		if err := updateReferences(t, refMap); err != nil {
+			return refMap, err
+		}
+		if _, err := c.Update(getId(t), t); err != nil {
+			return refMap, err
+		}
+	}
+
 	return refMap, nil
 }
 
 /*
  * NOTE: This is a destructive operation.  The resources will be updated with new server-assigned ID.
+ *
+ * It returns the location that the server responded with (e.g., "http://example.org/fhir/Patient/123/_history/1").
+ * If the server rejects the resource, the error is a *client.Error.
  */
 func UploadResource(resource interface{}, baseURL string) (string, error) {
 	// FYI: We can post resource w/ bogus id because it doesn't get serialized
-	json, _ := json.Marshal(resource)
-	body := bytes.NewReader(json)
-	url := baseURL + "/" + reflect.TypeOf(resource).Elem().Name()
-	response, err := http.Post(url, "application/json+fhir", body)
+	resourceType := reflect.TypeOf(resource).Elem().Name()
+	copied, err := copyResource(resource)
 	if err != nil {
 		return "", err
 	}
-	defer response.Body.Close()
-	loc := response.Header.Get("Location")
-
-	regs := []string{".*/([^/]+)/_history/.*", ".*/([^/]+)"}
-	for _, reg := range regs {
-		creg := regexp.MustCompile(reg)
-		if matches := creg.FindStringSubmatch(loc); matches != nil {
-			setId(resource, matches[1])
-			break
-		}
+	loc, err := client.New(baseURL).CreateWithLocation(copied)
+	if err != nil {
+		return "", err
 	}
-
+	id := client.IDFromLocation(loc)
+	if id == "" {
+		return "", fmt.Errorf("The server didn't return the location of the uploaded %s", resourceType)
+	}
+	setId(resource, id)
 	return loc, nil
 }
 
+// copyResource returns a copy of the resource to create on the server.  Creating a resource updates what is passed
+// in with the server's representation of it, so a copy is passed in, leaving the references in the resource
+// (including those deferred to break cycles) in place.
+func copyResource(resource interface{}) (interface{}, error) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	copied := reflect.New(reflect.TypeOf(resource).Elem()).Interface()
+	if err = json.Unmarshal(data, copied); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
+
 func updateReferences(resource interface{}, refMap map[string]string) error {
 	refs := getAllReferences(resource)
 	for _, ref := range refs {
@@ -94,20 +121,10 @@ func updateReference(ref *models.Reference, refMap map[string]string) error {
 	return nil
 }
 
+// getAllReferences returns all of the references in the resource, including those in backbone elements, extensions,
+// and contained resources
 func getAllReferences(model interface{}) []*models.Reference {
-	refs := make([]*models.Reference, 0)
-	s := reflect.ValueOf(model).Elem()
-	for i := 0; i < s.NumField(); i++ {
-		f := s.Field(i)
-		if f.Type() == reflect.TypeOf(&models.Reference{}) && !f.IsNil() {
-			refs = append(refs, f.Interface().(*models.Reference))
-		} else if f.Type() == reflect.TypeOf([]models.Reference{}) {
-			for j := 0; j < f.Len(); j++ {
-				refs = append(refs, f.Index(j).Addr().Interface().(*models.Reference))
-			}
-		}
-	}
-	return refs
+	return models.FindReferences(model)
 }
 
 func getId(model interface{}) string {
@@ -120,28 +137,3 @@ func setId(model interface{}, id string) {
 		v.SetString(id)
 	}
 }
-
-// In order for upload to work correctly, resources must go after the resources they depend on.
-func sortResourcesByDependency(resources []interface{}) []interface{} {
-	var result []interface{}
-	for _, resource := range resources {
-		var i int
-		for i = 0; i < len(result); i++ {
-			if references(result[i], resource) {
-				break
-			}
-		}
-		result = append(result[:i], append([]interface{}{resource}, result[i:]...)...)
-	}
-	return result
-}
-
-func references(from interface{}, to interface{}) bool {
-	toID := getId(to)
-	for _, ref := range getAllReferences(from) {
-		if strings.TrimPrefix(ref.Reference, "cid:") == toID {
-			return true
-		}
-	}
-	return false
-}
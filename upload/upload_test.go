@@ -6,11 +6,17 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/gin-gonic/gin"
+	"github.com/intervention-engine/fhir/client"
 	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/server"
 	"github.com/pebbe/util"
 	. "gopkg.in/check.v1"
 )
@@ -128,6 +134,7 @@ func (s *UploadSuite) TestExternalReferences(c *C) {
 	newId, err := UploadResource(condition, ts.URL)
 	util.CheckErr(err)
 	c.Assert(newId, Equals, "http://localhost/Condition/abc")
+	c.Assert(condition.Id, Equals, "abc")
 
 	// Upload the resources and check the counts
 	refMap, err := UploadResources([]interface{}{condition}, ts.URL)
@@ -135,6 +142,20 @@ func (s *UploadSuite) TestExternalReferences(c *C) {
 	c.Assert(len(refMap), Equals, 1)
 }
 
+func (s *UploadSuite) TestUploadResourceErrors(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	condition := &models.Condition{}
+	condition.Id = "123"
+	_, err := UploadResource(condition, ts.URL)
+	c.Assert(err, FitsTypeOf, &client.Error{})
+	c.Assert(err.(*client.Error).StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(condition.Id, Equals, "123")
+}
+
 func (s *UploadSuite) TestUnorderedDependencies(c *C) {
 	// Setup the mock server
 	resourceCount := 0
@@ -196,3 +217,388 @@ func isValid(decoder *json.Decoder, model interface{}) bool {
 	}
 	return true
 }
+
+func (s *UploadSuite) TestReadResources(c *C) {
+	bundle, err := os.Open("../fixtures/clint_abbott_bundle.json")
+	util.CheckErr(err)
+	defer bundle.Close()
+	resources, err := ReadResources(bundle)
+	util.CheckErr(err)
+	c.Assert(resources, HasLen, 8)
+	c.Assert(resources[0], FitsTypeOf, &models.Patient{})
+
+	ndjson := `{"resourceType": "Patient", "id": "a1"}
+{"resourceType": "Condition", "id": "b2", "patient": {"reference": "cid:a1"}}
+`
+	resources, err = ReadResources(strings.NewReader(ndjson))
+	util.CheckErr(err)
+	c.Assert(resources, HasLen, 2)
+	c.Assert(resources[1].(*models.Condition).Patient.Reference, Equals, "cid:a1")
+
+	_, err = ReadResources(strings.NewReader(`{"resourceType": "Foo"}`))
+	c.Assert(err, ErrorMatches, "Unsupported resourceType: Foo")
+	_, err = ReadResources(strings.NewReader(`{"resourceType": "Patient", "birthDate": 1970}`))
+	c.Assert(err, ErrorMatches, "Invalid Patient: .*")
+}
+
+func (s *UploadSuite) TestUploaderRetriesAndResumes(c *C) {
+	var mutex sync.Mutex
+	posts := make(map[string]int)
+	failConditions := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		resourceType := strings.TrimPrefix(r.URL.Path, "/")
+		posts[resourceType]++
+		// Every other post fails, so each upload is retried once
+		if posts[resourceType]%2 == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if resourceType == "Condition" && failConditions {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Add("Location", fmt.Sprintf("http://localhost/%s/%d/_history/1", resourceType, posts[resourceType]))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "upload")
+	util.CheckErr(err)
+	defer os.RemoveAll(dir)
+	newResources := func() []interface{} {
+		patient := &models.Patient{}
+		patient.Id = "a1"
+		condition := &models.Condition{}
+		condition.Id = "b2"
+		condition.Patient = &models.Reference{Reference: "cid:a1"}
+		return []interface{}{condition, patient}
+	}
+	uploader := &Uploader{BaseURL: ts.URL, Concurrency: 2, Retries: 1, ProgressLog: filepath.Join(dir, "progress.log")}
+
+	// The Condition is rejected, but the Patient's upload is recorded
+	refMap, err := uploader.Upload(newResources())
+	c.Assert(err, ErrorMatches, "Couldn't upload Condition: 400.*")
+	c.Assert(refMap, DeepEquals, map[string]string{"a1": "Patient/2"})
+
+	// Resuming only uploads the Condition, referencing the Patient uploaded before
+	failConditions = false
+	resources := newResources()
+	refMap, err = uploader.Upload(resources)
+	util.CheckErr(err)
+	c.Assert(refMap, DeepEquals, map[string]string{"a1": "Patient/2", "b2": "Condition/4"})
+	c.Assert(posts["Patient"], Equals, 2)
+	c.Assert(resources[0].(*models.Condition).Patient.Reference, Equals, "Patient/2")
+	c.Assert(resources[1].(*models.Patient).Id, Equals, "2")
+}
+
+func (s *UploadSuite) TestUploaderOnlyRetriesSafeCreates(c *C) {
+	var mutex sync.Mutex
+	var ifNoneExist []string
+	status := http.StatusInternalServerError
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		// Every other post fails after the server may have processed it
+		ifNoneExist = append(ifNoneExist, r.Header.Get("If-None-Exist"))
+		if len(ifNoneExist)%2 == 1 {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Add("Location", fmt.Sprintf("http://localhost/Patient/%d/_history/1", len(ifNoneExist)))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+	uploader := &Uploader{BaseURL: ts.URL, Retries: 1, MatchIdentifiers: true}
+
+	// A create without an identifier might have created the patient, so it isn't retried
+	_, err := uploader.Upload([]interface{}{&models.Patient{}})
+	c.Assert(err, ErrorMatches, "Couldn't upload Patient: 500.*")
+	c.Assert(ifNoneExist, DeepEquals, []string{""})
+
+	// A create with an identifier is conditional, so it is
+	ifNoneExist = nil
+	patient := &models.Patient{Identifier: []models.Identifier{{System: "http://example.org/mrn", Value: "123"}}}
+	_, err = uploader.Upload([]interface{}{patient})
+	util.CheckErr(err)
+	c.Assert(patient.Id, Equals, "2")
+	query := "identifier=http%3A%2F%2Fexample.org%2Fmrn%7C123"
+	c.Assert(ifNoneExist, DeepEquals, []string{query, query})
+
+	// Without matching identifiers, the create isn't conditional
+	ifNoneExist = nil
+	uploader.MatchIdentifiers = false
+	_, err = uploader.Upload([]interface{}{patient})
+	c.Assert(err, ErrorMatches, "Couldn't upload Patient: 500.*")
+	c.Assert(ifNoneExist, DeepEquals, []string{""})
+
+	// The server responds with 503 when a request times out, which may be after it was processed
+	ifNoneExist = nil
+	status = http.StatusServiceUnavailable
+	_, err = uploader.Upload([]interface{}{&models.Patient{}})
+	c.Assert(err, ErrorMatches, "Couldn't upload Patient: 503.*")
+	c.Assert(ifNoneExist, DeepEquals, []string{""})
+}
+
+func (s *UploadSuite) TestDependencyWaves(c *C) {
+	patient := &models.Patient{}
+	patient.Id = "a1"
+	encounter := &models.Encounter{}
+	encounter.Id = "b2"
+	encounter.Patient = &models.Reference{Reference: "cid:a1"}
+	condition := &models.Condition{}
+	condition.Id = "c3"
+	condition.Patient = &models.Reference{Reference: "cid:a1"}
+	condition.Encounter = &models.Reference{Reference: "cid:b2"}
+	medication := &models.Medication{}
+
+	waves := dependencyWaves([]interface{}{patient, medication, encounter, condition})
+	c.Assert(waves, DeepEquals, [][]interface{}{{patient, medication}, {encounter}, {condition}})
+}
+
+func (s *UploadSuite) TestUploadTransactionBundles(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+	dal := server.NewMemoryDataAccessLayer()
+	engine := gin.New()
+	server.RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), dal, server.Config{})
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+
+	patient := &models.Patient{}
+	patient.Id = "a1"
+	encounter := &models.Encounter{}
+	encounter.Id = "b2"
+	encounter.Patient = &models.Reference{Reference: "cid:a1"}
+	condition := &models.Condition{}
+	condition.Id = "c3"
+	condition.Patient = &models.Reference{Reference: "cid:a1"}
+	condition.Encounter = &models.Reference{Reference: "cid:b2"}
+
+	// With two resources per Bundle, the Condition's reference to the Patient is resolved by the uploader, and its
+	// reference to the Encounter by the server
+	uploader := &Uploader{BaseURL: ts.URL, BundleType: "transaction", BundleSize: 2}
+	refMap, err := uploader.Upload([]interface{}{condition, encounter, patient})
+	util.CheckErr(err)
+	c.Assert(refMap, HasLen, 3)
+	c.Assert(refMap["a1"], Equals, "Patient/"+patient.Id)
+
+	stored, err := dal.Get(condition.Id, "Condition")
+	util.CheckErr(err)
+	c.Assert(stored.(*models.Condition).Patient.Reference, Equals, refMap["a1"])
+	c.Assert(stored.(*models.Condition).Encounter.Reference, Equals, refMap["b2"])
+	stored, err = dal.Get(encounter.Id, "Encounter")
+	util.CheckErr(err)
+	c.Assert(stored.(*models.Encounter).Patient.Reference, Equals, refMap["a1"])
+}
+
+func (s *UploadSuite) TestUploadBundleErrors(c *C) {
+	rejectBundle := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json+fhir")
+		if rejectBundle {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(models.NewOperationOutcome("error", "invalid", "Bad Bundle"))
+			return
+		}
+		json.NewEncoder(w).Encode(&models.Bundle{Type: "batch-response", Entry: []models.BundleEntryComponent{
+			{Response: &models.BundleEntryResponseComponent{Status: "201", Location: "Patient/1/_history/1"}},
+			{Response: &models.BundleEntryResponseComponent{Status: "422"}},
+		}})
+	}))
+	defer ts.Close()
+
+	newResources := func() []interface{} {
+		patient := &models.Patient{}
+		patient.Id = "a1"
+		condition := &models.Condition{}
+		condition.Id = "b2"
+		condition.Patient = &models.Reference{Reference: "cid:a1"}
+		return []interface{}{patient, condition}
+	}
+	uploader := &Uploader{BaseURL: ts.URL, BundleType: "batch"}
+
+	refMap, err := uploader.Upload(newResources())
+	c.Assert(err, FitsTypeOf, &BundleError{})
+	c.Assert(err.(*BundleError).StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(err.(*BundleError).Outcome.Issue[0].Diagnostics, Equals, "Bad Bundle")
+	c.Assert(refMap, HasLen, 0)
+
+	rejectBundle = false
+	refMap, err = uploader.Upload(newResources())
+	c.Assert(err, FitsTypeOf, &BundleError{})
+	c.Assert(err.(*BundleError).Entries, DeepEquals, []EntryError{{Index: 1, ResourceType: "Condition", ID: "b2", Status: "422"}})
+	c.Assert(err, ErrorMatches, "The server rejected 1 of the Bundle's entries: entry 1 \\(Condition b2\\): 422")
+	c.Assert(refMap, DeepEquals, map[string]string{"a1": "Patient/1"})
+}
+
+func (s *UploadSuite) TestNestedReferences(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+	dal := server.NewMemoryDataAccessLayer()
+	engine := gin.New()
+	server.RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), dal, server.Config{})
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+
+	practitioner := &models.Practitioner{}
+	practitioner.Id = "p1"
+	patient := &models.Patient{}
+	patient.Id = "a1"
+	contained := &models.Condition{Patient: &models.Reference{Reference: "cid:a1"}}
+	contained.Id = "c1"
+	encounter := &models.Encounter{
+		Participant: []models.EncounterParticipantComponent{{Individual: &models.Reference{Reference: "cid:p1"}}},
+		Indication:  []models.Reference{{Reference: "#c1"}},
+	}
+	encounter.Id = "e1"
+	encounter.Contained = []interface{}{contained}
+	encounter.Extension = []models.Extension{{Url: "http://example.org/fhir/extensions/referrer", ValueReference: &models.Reference{Reference: "cid:p1"}}}
+
+	// The Encounter depends on the Patient and Practitioner only through nested references
+	refMap, err := (&Uploader{BaseURL: ts.URL}).Upload([]interface{}{encounter, patient, practitioner})
+	util.CheckErr(err)
+
+	stored, err := dal.Get(encounter.Id, "Encounter")
+	util.CheckErr(err)
+	storedEncounter := stored.(*models.Encounter)
+	c.Assert(storedEncounter.Participant[0].Individual.Reference, Equals, refMap["p1"])
+	c.Assert(storedEncounter.Extension[0].ValueReference.Reference, Equals, refMap["p1"])
+	c.Assert(storedEncounter.Indication[0].Reference, Equals, "#c1")
+	c.Assert(contained.Patient.Reference, Equals, refMap["a1"])
+}
+
+func (s *UploadSuite) TestOrderByDependency(c *C) {
+	// A chain of Encounters, each part of the one before it, given in reverse order
+	var encounters []interface{}
+	for i := 4; i >= 0; i-- {
+		encounter := &models.Encounter{}
+		encounter.Id = fmt.Sprintf("e%d", i)
+		if i > 0 {
+			encounter.PartOf = &models.Reference{Reference: fmt.Sprintf("cid:e%d", i-1)}
+		}
+		encounters = append(encounters, encounter)
+	}
+	sorted, deferred := orderByDependency(encounters)
+	var ids []string
+	for _, resource := range sorted {
+		ids = append(ids, getId(resource))
+	}
+	c.Assert(ids, DeepEquals, []string{"e0", "e1", "e2", "e3", "e4"})
+	c.Assert(deferred.owners(), HasLen, 0)
+
+	// Patients linked to each other form a cycle, which is broken by deferring one of the links
+	a, b := newLinkedPatients()
+	sorted, deferred = orderByDependency([]interface{}{a, b})
+	c.Assert(sorted, DeepEquals, []interface{}{b, a})
+	c.Assert(deferred.owners(), DeepEquals, []interface{}{b})
+
+	// The deferred link's reference is taken out, rather than left empty
+	deferred.remove()
+	c.Assert(b.Link[0].Other, IsNil)
+	c.Assert(a.Link[0].Other.Reference, Equals, "cid:b")
+	data, err := json.Marshal(b)
+	util.CheckErr(err)
+	c.Assert(strings.Contains(string(data), `"reference"`), Equals, false)
+	deferred.restore()
+	c.Assert(b.Link[0].Other.Reference, Equals, "cid:a")
+
+	// A deferred reference in a slice of references is dropped from it
+	condition := &models.Condition{Encounter: &models.Reference{Reference: "cid:e"}}
+	condition.Id = "c"
+	encounter := &models.Encounter{Indication: []models.Reference{{Reference: "#local"}, {Reference: "cid:c"}}}
+	encounter.Id = "e"
+	_, deferred = orderByDependency([]interface{}{condition, encounter})
+	c.Assert(deferred.owners(), DeepEquals, []interface{}{encounter})
+	deferred.remove()
+	c.Assert(encounter.Indication, DeepEquals, []models.Reference{{Reference: "#local"}})
+	deferred.restore()
+	c.Assert(encounter.Indication, DeepEquals, []models.Reference{{Reference: "#local"}, {Reference: "cid:c"}})
+}
+
+func (s *UploadSuite) TestUploadCycles(c *C) {
+	gin.SetMode(gin.ReleaseMode)
+	dal := server.NewMemoryDataAccessLayer()
+	engine := gin.New()
+	server.RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), dal, server.Config{EnforceReferentialIntegrity: true})
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+
+	uploaders := []func([]interface{}) (map[string]string, error){
+		func(resources []interface{}) (map[string]string, error) {
+			return UploadResources(resources, ts.URL)
+		},
+		(&Uploader{BaseURL: ts.URL, Concurrency: 2}).Upload,
+		// The cycle is split across Bundles, so it is broken the same way
+		(&Uploader{BaseURL: ts.URL, BundleType: "transaction", BundleSize: 1}).Upload,
+		// The cycle is within a single Bundle, but it is still broken the same way
+		(&Uploader{BaseURL: ts.URL, BundleType: "transaction"}).Upload,
+	}
+	for _, upload := range uploaders {
+		a, b := newLinkedPatients()
+		refMap, err := upload([]interface{}{a, b})
+		util.CheckErr(err)
+
+		stored, err := dal.Get(a.Id, "Patient")
+		util.CheckErr(err)
+		c.Assert(stored.(*models.Patient).Link[0].Other.Reference, Equals, refMap["b"])
+		stored, err = dal.Get(b.Id, "Patient")
+		util.CheckErr(err)
+		c.Assert(stored.(*models.Patient).Link[0].Other.Reference, Equals, refMap["a"])
+	}
+}
+
+func (s *UploadSuite) TestResumeCycles(c *C) {
+	var mutex sync.Mutex
+	var posts, puts int
+	failPuts := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Method == "PUT" {
+			puts++
+			if failPuts {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		posts++
+		w.Header().Add("Location", fmt.Sprintf("http://localhost%s/%d", r.URL.Path, posts))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "upload")
+	util.CheckErr(err)
+	defer os.RemoveAll(dir)
+	uploader := &Uploader{BaseURL: ts.URL, ProgressLog: filepath.Join(dir, "progress.log")}
+
+	// Both Patients are created, but the update that closes the cycle fails
+	a, b := newLinkedPatients()
+	_, err = uploader.Upload([]interface{}{a, b})
+	c.Assert(err, ErrorMatches, "Couldn't update Patient: 400.*")
+
+	// Resuming only retries the update, with the link resolved to the Patient created before
+	failPuts = false
+	a, b = newLinkedPatients()
+	refMap, err := uploader.Upload([]interface{}{a, b})
+	util.CheckErr(err)
+	c.Assert(posts, Equals, 2)
+	c.Assert(puts, Equals, 2)
+	c.Assert(b.Link[0].Other.Reference, Equals, refMap["a"])
+
+	// Once the update has been recorded, there is nothing left to do
+	a, b = newLinkedPatients()
+	_, err = uploader.Upload([]interface{}{a, b})
+	util.CheckErr(err)
+	c.Assert(puts, Equals, 2)
+}
+
+func newLinkedPatients() (*models.Patient, *models.Patient) {
+	a := &models.Patient{Link: []models.PatientLinkComponent{{Other: &models.Reference{Reference: "cid:b"}, Type: "seealso"}}}
+	a.Id = "a"
+	b := &models.Patient{Link: []models.PatientLinkComponent{{Other: &models.Reference{Reference: "cid:a"}, Type: "seealso"}}}
+	b.Id = "b"
+	return a, b
+}
@@ -0,0 +1,383 @@
+package upload
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/fhir/client"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+)
+
+// Uploader uploads resources to a FHIR server the same way as UploadResources, sorting them by dependency and
+// rewriting their cid: references, but uploads independent resources concurrently, retries failed uploads, and
+// can record its progress so that an interrupted upload can be resumed.  If BundleType is set, the resources are
+// uploaded in Bundles instead of one at a time.
+type Uploader struct {
+	// BaseURL is the URL of the root of the FHIR server.  It isn't used if Client is set.
+	BaseURL string
+	// Concurrency is the most resources that are uploaded at once.  If it is less than one, one is used.  Bundles
+	// are always uploaded one at a time.
+	Concurrency int
+	// BundleType is "batch" or "transaction" to upload the resources in Bundles of that type, letting the server
+	// resolve the references between the resources in each Bundle.  If it is empty, each resource is posted on its
+	// own.
+	BundleType string
+	// BundleSize is the most resources in each Bundle.  If it is zero, all of the resources are uploaded in a single
+	// Bundle.
+	BundleSize int
+	// Retries is the number of times an upload is retried after an error showing that the server didn't process
+	// it: a connection that couldn't be made, or a 429 response.  Since conditional creates and updates are
+	// safe to repeat, they are also retried after other connection errors and 5xx responses.  A Bundle is retried as
+	// a whole, and is only safe to repeat if all of its entries are conditional creates.
+	Retries int
+	// RetryDelay is the wait before the first retry, which doubles with each retry after that
+	RetryDelay time.Duration
+	// ProgressLog is the path of the file that uploaded resources are recorded in.  Resources that are recorded in
+	// the file when the upload starts are skipped.  If it is empty, progress isn't recorded.
+	ProgressLog string
+	// MatchIdentifiers creates the resources that have an identifier conditionally (with If-None-Exist), so that a
+	// resource whose identifier is already on the server isn't created again, and references to it are rewritten to
+	// the resource on the server.  The server has to support conditional creates.
+	MatchIdentifiers bool
+	// Client makes the requests to the server.  If it is nil, a client for BaseURL is used.
+	Client *client.Client
+}
+
+// Upload uploads the resources, returning a map from the resources' old IDs to their new locations relative to the
+// server's root (e.g., "Patient/123").  Resources are uploaded in waves, each holding the resources whose
+// dependencies were uploaded in earlier waves, or if BundleType is set, in Bundles of up to BundleSize resources.  If
+// the server rejects a Bundle or some of its entries, the error is a *BundleError.  Resources whose references form
+// a cycle are first created without the references that close the cycle, and are updated with them once every
+// resource has been created, even when the resources are uploaded in the same Bundle.
+//
+// NOTE: This is a destructive operation.  Resources will be updated with new server-assigned ID and
+// its references will point to server locations of other resources.
+func (u *Uploader) Upload(resources []interface{}) (map[string]string, error) {
+	refMap := make(map[string]string)
+	keys := make(map[interface{}]string)
+	for _, resource := range resources {
+		keys[resource] = progressKey(resource)
+	}
+
+	done := make(map[string]string)
+	var progress *os.File
+	if u.ProgressLog != "" {
+		var err error
+		if done, err = readProgressLog(u.ProgressLog); err != nil {
+			return refMap, err
+		}
+		if progress, err = os.OpenFile(u.ProgressLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			return refMap, err
+		}
+		defer progress.Close()
+	}
+
+	ordered, deferred := orderByDependency(resources)
+	deferred.remove()
+	var remaining []interface{}
+	for _, resource := range ordered {
+		if loc, ok := done[keys[resource]]; ok {
+			if oldID := getId(resource); oldID != "" {
+				refMap[oldID] = loc
+			}
+			setId(resource, client.IDFromLocation(loc))
+		} else {
+			remaining = append(remaining, resource)
+		}
+	}
+
+	var mutex sync.Mutex
+	logProgress := func(key, loc string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if progress != nil {
+			if _, err := fmt.Fprintf(progress, "%s\t%s\n", key, loc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	record := func(resource interface{}, oldID, loc string) error {
+		if err := logProgress(keys[resource], loc); err != nil {
+			return err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if oldID != "" {
+			refMap[oldID] = loc
+		}
+		return nil
+	}
+
+	if u.BundleType != "" {
+		if err := u.uploadBundles(remaining, refMap, record); err != nil {
+			return refMap, err
+		}
+	} else {
+		for _, wave := range dependencyWaves(remaining) {
+			for _, resource := range wave {
+				if err := updateReferences(resource, refMap); err != nil {
+					return refMap, err
+				}
+			}
+
+			err := u.eachUntilError(wave, func(resource interface{}) error {
+				oldID := getId(resource)
+				loc, err := u.uploadWithRetries(resource)
+				if err != nil {
+					return err
+				}
+				return record(resource, oldID, loc)
+			})
+			if err != nil {
+				return refMap, err
+			}
+		}
+	}
+
+	// Now that every resource exists, update the resources whose references were removed to break cycles
+	deferred.restore()
+	err := u.eachUntilError(deferred.owners(), func(resource interface{}) error {
+		key := "updated:" + keys[resource]
+		if _, ok := done[key]; ok {
+			return nil
+		}
+		if err := updateReferences(resource, refMap); err != nil {
+			return err
+		}
+		resourceType := reflect.TypeOf(resource).Elem().Name()
+		err := u.withRetries(isTransient, func() error {
+			_, err := u.client().Update(getId(resource), resource)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Couldn't update %s: %s", resourceType, err)
+		}
+		return logProgress(key, resourceType+"/"+getId(resource))
+	})
+	return refMap, err
+}
+
+// eachUntilError calls the function with each of the resources, like each, returning the first error that it
+// returns
+func (u *Uploader) eachUntilError(resources []interface{}, f func(interface{}) error) error {
+	var mutex sync.Mutex
+	var firstErr error
+	u.each(resources, func(resource interface{}) {
+		if err := f(resource); err != nil {
+			mutex.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			mutex.Unlock()
+		}
+	})
+	return firstErr
+}
+
+// each calls the function with each of the resources, calling it concurrently up to the uploader's concurrency
+func (u *Uploader) each(resources []interface{}, f func(interface{})) {
+	workers := u.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan interface{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for resource := range queue {
+				f(resource)
+			}
+		}()
+	}
+	for _, resource := range resources {
+		queue <- resource
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// uploadWithRetries creates the resource on the server, setting its ID to the one the server assigns, and returns
+// its location relative to the server's root
+func (u *Uploader) uploadWithRetries(resource interface{}) (string, error) {
+	resourceType := reflect.TypeOf(resource).Elem().Name()
+
+	copied, err := copyResource(resource)
+	if err != nil {
+		return "", err
+	}
+
+	// Creates that aren't conditional can't be repeated without risking a duplicate, unless the server didn't
+	// process them
+	query := u.conditionalQuery(copied)
+	retryable := wasNotProcessed
+	if query != "" {
+		retryable = isTransient
+	}
+	var id string
+	err = u.withRetries(retryable, func() (err error) {
+		if query != "" {
+			id, err = u.client().ConditionalCreate(query, copied)
+		} else {
+			id, err = u.client().Create(copied)
+		}
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("Couldn't upload %s: %s", resourceType, err)
+	}
+	if id == "" {
+		return "", fmt.Errorf("The server didn't return the location of the uploaded %s", resourceType)
+	}
+	setId(resource, id)
+	return resourceType + "/" + id, nil
+}
+
+// withRetries calls the function, calling it again after the errors that retryable accepts
+func (u *Uploader) withRetries(retryable func(error) bool, f func() error) error {
+	delay := u.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || !retryable(err) || attempt >= u.Retries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// isTransient reports whether the error is a connection error or a 5xx or 429 response, after which requests that
+// are safe to repeat are retried
+func isTransient(err error) bool {
+	if e, ok := err.(*client.Error); ok {
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	}
+	return err != nil
+}
+
+// wasNotProcessed reports whether the error shows that the server didn't process the request, because the
+// connection couldn't be made or the server responded with 429.  Requests that aren't safe to repeat are only retried
+// after these errors.  A 503 doesn't show this, since the server responds with it when a request times out, which
+// may be after it has written some of a Bundle's resources.
+func wasNotProcessed(err error) bool {
+	switch e := err.(type) {
+	case *client.Error:
+		return e.StatusCode == http.StatusTooManyRequests
+	case *url.Error:
+		op, ok := e.Err.(*net.OpError)
+		return ok && op.Op == "dial"
+	}
+	return false
+}
+
+// conditionalQuery returns the query for a conditional create of the resource, matching its first identifier with a
+// system and a value, or an empty string if it has no such identifier or the uploader doesn't match identifiers
+func (u *Uploader) conditionalQuery(resource interface{}) string {
+	if !u.MatchIdentifiers {
+		return ""
+	}
+	resourceType := reflect.TypeOf(resource).Elem().Name()
+	if _, ok := search.SearchParameterDictionary[resourceType]["identifier"]; !ok {
+		return ""
+	}
+	field := reflect.ValueOf(resource).Elem().FieldByName("Identifier")
+	if !field.IsValid() {
+		return ""
+	}
+	var identifiers []models.Identifier
+	switch value := field.Interface().(type) {
+	case []models.Identifier:
+		identifiers = value
+	case *models.Identifier:
+		if value != nil {
+			identifiers = append(identifiers, *value)
+		}
+	}
+	for _, identifier := range identifiers {
+		if identifier.System != "" && identifier.Value != "" {
+			return "identifier=" + url.QueryEscape(identifier.System+"|"+identifier.Value)
+		}
+	}
+	return ""
+}
+
+func (u *Uploader) client() *client.Client {
+	if u.Client != nil {
+		return u.Client
+	}
+	return client.New(u.BaseURL)
+}
+
+// dependencyWaves splits the resources, which are sorted by dependency, into waves that can each be uploaded
+// concurrently, because the resources in each wave only reference resources in earlier waves
+func dependencyWaves(resources []interface{}) [][]interface{} {
+	byID := make(map[string]interface{})
+	for _, resource := range resources {
+		if id := getId(resource); id != "" {
+			byID[id] = resource
+		}
+	}
+
+	levels := make(map[interface{}]int)
+	var waves [][]interface{}
+	for _, resource := range resources {
+		level := 0
+		for _, ref := range getAllReferences(resource) {
+			if target, ok := referencedResource(ref, byID); ok && levels[target]+1 > level {
+				level = levels[target] + 1
+			}
+		}
+		levels[resource] = level
+		for len(waves) <= level {
+			waves = append(waves, nil)
+		}
+		waves[level] = append(waves[level], resource)
+	}
+	return waves
+}
+
+// progressKey identifies the resource in the progress log: by its ID, or if it has none, by a hash of its content
+func progressKey(resource interface{}) string {
+	if id := getId(resource); id != "" {
+		return reflect.TypeOf(resource).Elem().Name() + "/" + id
+	}
+	data, _ := json.Marshal(resource)
+	hash := sha1.Sum(data)
+	return "sha1:" + hex.EncodeToString(hash[:])
+}
+
+// readProgressLog reads the progress log at the path, if it exists, returning a map from the keys of the uploaded
+// resources to their new locations
+func readProgressLog(path string) (map[string]string, error) {
+	done := make(map[string]string)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(parts) == 2 {
+			done[parts[0]] = parts[1]
+		}
+	}
+	return done, scanner.Err()
+}